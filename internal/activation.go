@@ -0,0 +1,109 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	ActivationOnDemand = "on-demand"
+	ActivationAlways   = "always"
+
+	// defaultIdleTimeout is how long the connection to a host used only by
+	// on-demand tunnels is kept once its last channel closes
+	defaultIdleTimeout = 10 * time.Minute
+)
+
+func (t *Tunnel) validateActivation() bool {
+	valid := true
+	t.Activation = strings.ToLower(strings.TrimSpace(t.Activation))
+	switch t.Activation {
+	case "", ActivationOnDemand, ActivationAlways:
+	default:
+		Errorf("tunnel (%s) activation (%s) is invalid.  Must be %s or %s", t.Name, t.Activation, ActivationOnDemand, ActivationAlways)
+		valid = false
+	}
+	t.IdleTimeout = strings.TrimSpace(t.IdleTimeout)
+	t.idleTimeout = defaultIdleTimeout
+	if t.IdleTimeout != "" {
+		if t.Activation == ActivationAlways {
+			Warnf("tunnel (%s) idle_timeout is ignored with activation %s", t.Name, ActivationAlways)
+		}
+		d, err := time.ParseDuration(t.IdleTimeout)
+		if err != nil || (d != 0 && d < time.Second) {
+			Errorf("tunnel (%s) idle_timeout (%s) is invalid.  Must be a duration of at least 1s, or 0 to never close", t.Name, t.IdleTimeout)
+			valid = false
+		}
+		t.idleTimeout = d
+	}
+	return valid
+}
+
+// activate records how the tunnel's host connection is to be kept: warm for
+// tunnels always active, else closed once idle for the longest idle timeout
+// of the on-demand tunnels using it
+func (t *Tunnel) activate(h *Host) {
+	switch {
+	case t.Activation == ActivationAlways:
+		h.keepWarm = true
+		h.keepOpen = true
+	case t.idleTimeout == 0:
+		h.keepOpen = true
+	case t.idleTimeout > h.idleTimeout:
+		h.idleTimeout = t.idleTimeout
+	}
+}
+
+// ActivateHosts connects to the hosts of tunnels that are always active, then
+// closes the connections of the other hosts as they fall idle
+func ActivateHosts(ctx context.Context) {
+	warm := make([]*Host, 0, len(Hosts))
+	for _, h := range Hosts {
+		if h.valid && h.keepWarm && !h.KeyboardInteractive && !h.Connected() {
+			warm = append(warm, h)
+		}
+	}
+	openHosts(warm, "activated")
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		for _, h := range Hosts {
+			if h.valid && !h.keepOpen && h.idleTimeout > 0 {
+				h.closeIdle()
+			}
+		}
+	}
+}
+
+// closeIdle closes the connection to the host once it has carried no channel
+// for its idle timeout, to be opened again by the next connection
+func (h *Host) closeIdle() {
+	idle, ok := h.stats.idle()
+	if !ok || idle < h.idleTimeout {
+		return
+	}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.client == nil || h.retrying {
+		return
+	}
+	if idle, ok = h.stats.idle(); !ok || idle < h.idleTimeout {
+		return
+	}
+	client := h.client
+	h.client = nil
+	h.stats.disconnected()
+	emit(&Event{Type: EventHostDisconnect, Host: h.Name, Message: fmt.Sprintf("idle for %s", idle.Round(time.Second))})
+	if verboseFlag {
+		Infof("host (%s) idle for %s, connection closed", h.Name, idle.Round(time.Second))
+	}
+	_ = client.Close()
+}
@@ -1,6 +1,7 @@
 package internal
 
 import (
+	"encoding/json"
 	"fmt"
 	"net"
 	"strconv"
@@ -10,7 +11,12 @@ import (
 type Address struct {
 	valid   bool
 	address string
+	host    string
 	port    int
+	unix    bool
+	pipe    bool
+	// anyPort allows a port of 0, for the system to pick
+	anyPort bool
 }
 
 func NewAddress(address string) *Address {
@@ -20,6 +26,12 @@ func NewAddress(address string) *Address {
 }
 
 func (a *Address) Validate(group string, name string, attr string, remote bool, defaultPort bool) bool {
+	if strings.HasPrefix(a.address, unixScheme) {
+		return a.validateUnix(group, name, attr)
+	}
+	if strings.HasPrefix(a.address, pipeScheme) {
+		return a.validatePipe(group, name, attr)
+	}
 	a.valid = true
 	parts := strings.Split(a.address, ":")
 	if len(parts) == 1 {
@@ -29,32 +41,35 @@ func (a *Address) Validate(group string, name string, attr string, remote bool,
 			parts = []string{"0.0.0.0", parts[0]}
 		}
 	} else if len(parts) > 2 {
-		fmt.Printf(
-			"  Error - %s(%s) %s(%s) is invalid.  Required syntax is <ip address>:<port>\n",
+		Errorf(
+			"%s(%s) %s(%s) is invalid.  Required syntax is <ip address>:<port>",
 			group, name, attr, a.address,
 		)
 		a.valid = false
 		return false
 	}
 
+	a.host = parts[0]
 	ips, err := net.LookupIP(parts[0])
 	if err != nil {
 		if !remote {
-			fmt.Printf("  Error - %s(%s) %s(%s) cannot be resolved\n", group, name, attr, parts[0])
+			Errorf("%s(%s) %s(%s) cannot be resolved", group, name, attr, parts[0])
 			a.valid = false
 		} else {
-			fmt.Printf("  Warn  - %s(%s) %s(%s) cannot be resolved local\n", group, name, attr, parts[0])
+			// Left for the remote side to resolve
+			Warnf("%s(%s) %s(%s) cannot be resolved local", group, name, attr, parts[0])
+			a.address = parts[0]
 		}
 	} else if len(ips) == 0 {
-		fmt.Printf(
-			"  Error - %s(%s) %s(%s) has no valid IP addresses associated with it\n",
+		Errorf(
+			"%s(%s) %s(%s) has no valid IP addresses associated with it",
 			group, name, attr, parts[0],
 		)
 		a.valid = false
 	} else {
 		if ipv4 := ips[0].To4(); ipv4 == nil {
-			fmt.Printf(
-				"  Error - %s(%s) %s(%s) cannot be converted to a valid IP4 address\n",
+			Errorf(
+				"%s(%s) %s(%s) cannot be converted to a valid IP4 address",
 				group, name, attr, parts[0],
 			)
 		} else if !remote {
@@ -65,10 +80,10 @@ func (a *Address) Validate(group string, name string, attr string, remote bool,
 	}
 
 	if i, err := strconv.Atoi(parts[1]); err != nil {
-		fmt.Printf("  Error - %s(%s) %s port(%s) %v\n", group, name, attr, parts[1], err.Error())
+		Errorf("%s(%s) %s port(%s) %v", group, name, attr, parts[1], err.Error())
 		a.valid = false
-	} else if i < 1 || i > 65536 {
-		fmt.Printf("  Error - %s(%s) %s port(%s) range is invalid.  Must be between 1 and 65536\n", group, name, attr, parts[1])
+	} else if i < 0 || i > 65536 || (i == 0 && !a.anyPort) {
+		Errorf("%s(%s) %s port(%s) range is invalid.  Must be between 1 and 65536", group, name, attr, parts[1])
 		a.valid = false
 	} else {
 		a.address = fmt.Sprintf("%s:%d", a.address, i)
@@ -78,7 +93,10 @@ func (a *Address) Validate(group string, name string, attr string, remote bool,
 }
 
 func (a *Address) UnmarshalJSON(data []byte) error {
-	a.address = strings.TrimSpace(string(data))
+	if err := json.Unmarshal(data, &a.address); err != nil {
+		// A bare port number
+		a.address = strings.TrimSpace(string(data))
+	}
 	return nil
 }
 
@@ -86,6 +104,27 @@ func (a *Address) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	return unmarshal(&a.address)
 }
 
+func (a *Address) MarshalJSON() ([]byte, error) {
+	return json.Marshal(a.String())
+}
+
+func (a *Address) MarshalYAML() (interface{}, error) {
+	return a.String(), nil
+}
+
+// String is the address in the form it is configured with: host:port, once
+// validated with any default port added, unix://<path> for unix sockets, or
+// npipe:////./pipe/<name> for named pipes
+func (a *Address) String() string {
+	if a.unix {
+		return unixScheme + a.address
+	}
+	if a.pipe {
+		return pipeScheme + strings.ReplaceAll(a.address, `\`, "/")
+	}
+	return a.address
+}
+
 func (a *Address) IsBlank() bool {
 	return a.address == ""
 }
@@ -94,6 +133,11 @@ func (a *Address) IsValid() bool {
 	return a.valid
 }
 
+// Host returns the host name as configured, prior to any resolution
+func (a *Address) Host() string {
+	return a.host
+}
+
 func (a *Address) Port() interface{} {
 	return a.port
 }
@@ -0,0 +1,136 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	// defaultAddressCache is how long the address printed by an address_command
+	// is connected to before the command is run again
+	defaultAddressCache = 5 * time.Minute
+	// addressCommandTimeout bounds an address_command, which may well call out to
+	// a cloud API
+	addressCommandTimeout = 30 * time.Second
+)
+
+// validateAddressCommand reads address_command, a command run on connecting to
+// the host whose output is its address, for hosts such as bastions whose
+// address changes as they are replaced.  The address is reused for
+// address_cache, and looked up again at once should connecting to it fail.
+func (h *Host) validateAddressCommand() bool {
+	h.AddressCommand = strings.TrimSpace(h.AddressCommand)
+	h.AddressCache = strings.TrimSpace(h.AddressCache)
+	if h.AddressCommand == "" && h.cloud == nil {
+		if h.AddressCache != "" {
+			Warnf("host (%s) address_cache is ignored without address_command or a cloud address", h.Name)
+		}
+		return true
+	}
+	valid := true
+	lookup := "address_command"
+	if h.cloud != nil {
+		lookup = h.cloud.provider + " address"
+	}
+	if h.AddressCommand != "" && h.Address != nil && !h.Address.IsBlank() {
+		Errorf("host (%s) cannot have both an address and an address_command", h.Name)
+		valid = false
+	}
+	if h.Websocket != "" || h.Relay != nil {
+		Errorf("host (%s) %s cannot be combined with a websocket or relay", h.Name, lookup)
+		valid = false
+	}
+	if h.PasswordSource != "" {
+		Errorf("host (%s) password_source cannot be used with an %s, as the address is only known on connecting", h.Name, lookup)
+		valid = false
+	}
+	h.addressCache = defaultAddressCache
+	if h.AddressCache != "" {
+		d, err := time.ParseDuration(h.AddressCache)
+		if err != nil || d < 0 {
+			Errorf("host (%s) address_cache (%s) is invalid.  Must be a duration, 0 to look up the address on every connection", h.Name, h.AddressCache)
+			valid = false
+		}
+		h.addressCache = d
+	}
+	return valid
+}
+
+// sshAddress is the address the SSH connection of the host is made to, which
+// for an address_command is that last printed, and for a cloud instance that
+// last looked up, until the cache expires.  The host lock must be held.
+func (h *Host) sshAddress() (string, error) {
+	if h.AddressCommand == "" && h.cloud == nil {
+		return h.Address.address, nil
+	}
+	if h.resolvedAddress != "" && time.Since(h.resolvedAt) < h.addressCache {
+		return h.resolvedAddress, nil
+	}
+	var address, lookup string
+	var err error
+	if h.cloud != nil {
+		lookup = h.cloud.provider + " lookup"
+		address, err = h.cloud.lookup()
+	} else {
+		lookup = "address_command"
+		address, err = h.runAddressCommand()
+	}
+	if err != nil {
+		return "", fmt.Errorf("%s failed: %v", lookup, err)
+	}
+	if verboseFlag || address != h.resolvedAddress {
+		Infof("host (%s) %s gave %s", h.Name, lookup, address)
+	}
+	h.resolvedAddress, h.resolvedAt = address, time.Now()
+	return address, nil
+}
+
+// forgetAddress has the address looked up again on the next connection, as
+// that last found may have gone.  The host lock must be held.
+func (h *Host) forgetAddress() {
+	h.resolvedAddress = ""
+}
+
+// runAddressCommand runs the address_command, given the name of the host as
+// FERRET_HOST, returning the first line it prints, with port 22 unless it has one
+func (h *Host) runAddressCommand() (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), addressCommandTimeout)
+	defer cancel()
+	cmd := shellCommand(ctx, h.AddressCommand)
+	cmd.Env = append(os.Environ(), "FERRET_HOST="+h.Name)
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+	// Children of a killed shell may hold its output open
+	cmd.WaitDelay = 100 * time.Millisecond
+	out, err := cmd.Output()
+	if ctx.Err() != nil {
+		return "", fmt.Errorf("timed out after %s", addressCommandTimeout)
+	}
+	if err != nil {
+		if message := strings.TrimSpace(stderr.String()); message != "" {
+			return "", errors.New(message)
+		}
+		return "", err
+	}
+	line, _, _ := strings.Cut(strings.TrimSpace(string(out)), "\n")
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return "", errors.New("no address printed")
+	}
+	address := line
+	if _, _, err = net.SplitHostPort(address); err != nil {
+		address = net.JoinHostPort(strings.Trim(address, "[]"), "22")
+	}
+	if host, port, err := net.SplitHostPort(address); err != nil || host == "" || strings.ContainsAny(host, " \t") {
+		return "", fmt.Errorf("printed (%s), which is not an address", line)
+	} else if _, err = net.LookupPort("tcp", port); err != nil {
+		return "", fmt.Errorf("printed (%s), which is not an address", line)
+	}
+	return address, nil
+}
@@ -0,0 +1,119 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+const (
+	AdmissionAllow = "allow"
+	AdmissionDeny  = "deny"
+
+	defaultAdmissionTimeout = 2 * time.Second
+)
+
+// Admission runs a command for every connection a tunnel accepts, deciding
+// whether it is forwarded.  The command is given the connection through the
+// FERRET_TUNNEL, FERRET_HOST, FERRET_FORWARD, FERRET_LABELS, FERRET_CLIENT,
+// FERRET_CLIENT_IP and FERRET_TIME environment variables.  Exiting 0 admits
+// the connection and any other status denies it, the first line of output
+// being logged as the reason.  A command that cannot be run, or does not
+// finish within the timeout, admits or denies according to on_error.
+type Admission struct {
+	Command string `yaml:"command" json:"command"`
+	Timeout string `yaml:"timeout,omitempty" json:"timeout,omitempty"`
+	OnError string `yaml:"on_error,omitempty" json:"on_error,omitempty"`
+	timeout time.Duration
+}
+
+// Validate checks the admission hook of the owner, a tunnel or the policy
+func (a *Admission) Validate(owner string) bool {
+	valid := true
+	a.Command = strings.TrimSpace(a.Command)
+	if a.Command == "" {
+		Errorf("%s admission requires a command", owner)
+		valid = false
+	}
+	a.timeout = defaultAdmissionTimeout
+	if strings.TrimSpace(a.Timeout) != "" {
+		d, err := time.ParseDuration(strings.TrimSpace(a.Timeout))
+		if err != nil || d <= 0 {
+			Errorf("%s admission timeout (%s) is invalid.  Must be a duration above 0", owner, a.Timeout)
+			valid = false
+		}
+		a.timeout = d
+	}
+	a.OnError = strings.ToLower(strings.TrimSpace(a.OnError))
+	switch a.OnError {
+	case "":
+		a.OnError = AdmissionDeny
+	case AdmissionAllow, AdmissionDeny:
+	default:
+		Errorf("%s admission on_error (%s) is invalid.  Must be %s or %s", owner, a.OnError, AdmissionAllow, AdmissionDeny)
+		valid = false
+	}
+	return valid
+}
+
+// admit runs the command for a connection to the tunnel, returning whether the
+// connection is allowed and, when it is not, why
+func (a *Admission) admit(t *Tunnel, client string) (bool, string) {
+	ctx, cancel := context.WithTimeout(context.Background(), a.timeout)
+	defer cancel()
+	cmd := shellCommand(ctx, a.Command)
+	clientIP := client
+	if host, _, err := net.SplitHostPort(client); err == nil {
+		clientIP = host
+	}
+	forward := t.forwardAddresses()
+	cmd.Env = append(os.Environ(),
+		"FERRET_TUNNEL="+t.Name,
+		"FERRET_HOST="+t.Host,
+		"FERRET_FORWARD="+forward,
+		"FERRET_LABELS="+strings.Join(t.Labels, ","),
+		"FERRET_CLIENT="+client,
+		"FERRET_CLIENT_IP="+clientIP,
+		"FERRET_TIME="+time.Now().Format(time.RFC3339),
+	)
+	cmd.Stderr = os.Stderr
+	// Children of a killed shell may hold its output open
+	cmd.WaitDelay = 100 * time.Millisecond
+	out, err := cmd.Output()
+	if err == nil {
+		return true, ""
+	}
+	var exitErr *exec.ExitError
+	if ctx.Err() == nil && errors.As(err, &exitErr) {
+		reason, _, _ := strings.Cut(string(bytes.TrimSpace(out)), "\n")
+		if reason == "" {
+			reason = fmt.Sprintf("exit status %d", exitErr.ExitCode())
+		}
+		return false, reason
+	}
+	if ctx.Err() != nil {
+		err = fmt.Errorf("timed out after %s", a.timeout)
+	}
+	Warnf("tunnel (%s) admission command failed: %v", t.Name, err)
+	return a.OnError == AdmissionAllow, "admission command failed"
+}
+
+// admit consults the policy's admission hook and then the tunnel's own, either
+// of which may deny the connection
+func (t *Tunnel) admit(client string) (bool, string) {
+	if policy != nil && policy.Admission != nil {
+		if ok, reason := policy.Admission.admit(t, client); !ok {
+			return false, reason
+		}
+	}
+	if t.Admission != nil {
+		return t.Admission.admit(t, client)
+	}
+	return true, ""
+}
@@ -0,0 +1,92 @@
+package internal
+
+import (
+	"errors"
+	"net"
+	"os"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+var (
+	agentLock   sync.Mutex
+	agentClient agent.ExtendedAgent
+)
+
+// agentSigners returns the keys held by the running ssh-agent (SSH_AUTH_SOCK).
+// The agent connection is shared by every host, and re-established on the next
+// use after a failure, should the agent be restarted.
+func agentSigners() ([]ssh.Signer, error) {
+	agentLock.Lock()
+	defer agentLock.Unlock()
+	if agentClient == nil {
+		socket := os.Getenv("SSH_AUTH_SOCK")
+		if socket == "" {
+			return nil, errors.New("SSH_AUTH_SOCK is not set")
+		}
+		conn, err := net.Dial("unix", socket)
+		if err != nil {
+			return nil, err
+		}
+		agentClient = agent.NewClient(conn)
+	}
+	signers, err := agentClient.Signers()
+	if err != nil {
+		agentClient = nil
+	}
+	return signers, err
+}
+
+// signers offers the keys of the host's PKCS#11 token, then the agent's keys,
+// when the host uses the agent, followed by the host's identity files, which
+// are relied upon alone when the agent is unavailable.  Any certificate is offered
+// first.
+func (h *Host) signers() ([]ssh.Signer, error) {
+	var signers []ssh.Signer
+	var err error
+	if h.PKCS11 != nil {
+		if signers, err = h.PKCS11.signers(); err != nil {
+			Warnf("host (%s) pkcs11 keys unavailable: %v", h.Name, err)
+		}
+	}
+	if h.Agent {
+		var agentKeys []ssh.Signer
+		if agentKeys, err = agentSigners(); err != nil && verboseFlag {
+			Warnf("host (%s) ssh-agent unavailable: %v", h.Name, err)
+		}
+		signers = append(signers, agentKeys...)
+	}
+	signers = append(signers, h.identitySigners()...)
+	if len(signers) == 0 && err != nil {
+		return nil, err
+	}
+	if h.Certificate != "" {
+		signers = h.certify(signers)
+	}
+	return signers, nil
+}
+
+// forwardAgent lets sessions on the host use the local agent, as ssh -A does,
+// so commands run there, such as ssh to a further hop, authenticate with keys
+// that never leave this machine
+func (h *Host) forwardAgent(client hostClient) {
+	sshClient, ok := client.(*ssh.Client)
+	if !h.ForwardAgent || !ok {
+		return
+	}
+	if err := agent.ForwardToRemote(sshClient, os.Getenv("SSH_AUTH_SOCK")); err != nil {
+		Warnf("host (%s) agent cannot be forwarded: %v", h.Name, err)
+	}
+}
+
+// requestAgent asks for the agent to be forwarded to a session on the host
+func (h *Host) requestAgent(session *ssh.Session) {
+	if !h.ForwardAgent {
+		return
+	}
+	if err := agent.RequestAgentForwarding(session); err != nil {
+		Warnf("host (%s) agent forwarding refused: %v", h.Name, err)
+	}
+}
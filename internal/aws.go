@@ -0,0 +1,86 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+)
+
+const awsTimeout = 15 * time.Second
+
+// awsSecretsProvider reads secrets from AWS Secrets Manager.  A secret string
+// holding a JSON object has the field read from it, any other is used whole, as
+// is a binary secret.
+type awsSecretsProvider struct{}
+
+// awsParameterProvider reads SecureString, or plain, parameters from the AWS
+// Systems Manager Parameter Store.
+type awsParameterProvider struct{}
+
+func (p *awsSecretsProvider) Secret(reference string, field string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), awsTimeout)
+	defer cancel()
+	cfg, err := awsConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+	output, err := secretsmanager.NewFromConfig(cfg).GetSecretValue(ctx, &secretsmanager.GetSecretValueInput{
+		SecretId: aws.String(reference),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if output.SecretString == nil {
+		if len(output.SecretBinary) == 0 {
+			return nil, fmt.Errorf("secret has no value")
+		}
+		return output.SecretBinary, nil
+	}
+	value := []byte(*output.SecretString)
+	var fields map[string]interface{}
+	if json.Unmarshal(value, &fields) != nil {
+		return value, nil
+	}
+	secret, ok := fields[field].(string)
+	if !ok {
+		return nil, fmt.Errorf("field (%s) not found", field)
+	}
+	return []byte(secret), nil
+}
+
+func (p *awsParameterProvider) Secret(reference string, _ string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), awsTimeout)
+	defer cancel()
+	cfg, err := awsConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+	output, err := ssm.NewFromConfig(cfg).GetParameter(ctx, &ssm.GetParameterInput{
+		Name:           aws.String(reference),
+		WithDecryption: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if output.Parameter == nil || aws.ToString(output.Parameter.Value) == "" {
+		return nil, fmt.Errorf("parameter has no value")
+	}
+	return []byte(*output.Parameter.Value), nil
+}
+
+// awsConfig loads the AWS configuration from the environment, shared config and
+// credentials files, as the aws CLI does, so profiles, SSO and the region are
+// resolved just as they are for the user's other AWS tooling
+func awsConfig(ctx context.Context, options ...func(*config.LoadOptions) error) (aws.Config, error) {
+	cfg, err := config.LoadDefaultConfig(ctx, options...)
+	if err != nil {
+		return cfg, fmt.Errorf("aws config cannot be loaded: %w", err)
+	}
+	return cfg, nil
+}
@@ -0,0 +1,115 @@
+package internal
+
+import (
+	"strings"
+	"sync"
+)
+
+const (
+	BalanceRoundRobin       = "round-robin"
+	BalanceLeastConnections = "least-connections"
+)
+
+// balancer spreads the connections of a tunnel with several forward addresses
+// across them, in turn or to whichever has the fewest open
+type balancer struct {
+	lock   sync.Mutex
+	next   int
+	active []int
+}
+
+func (t *Tunnel) validateForwards() bool {
+	t.Balance = strings.ToLower(strings.TrimSpace(t.Balance))
+	if len(t.Forwards) == 0 {
+		if t.Balance != "" {
+			Warnf("tunnel (%s) balance is ignored without forwards", t.Name)
+		}
+		return true
+	}
+	valid := true
+	if t.Forward != nil && !t.Forward.IsBlank() {
+		Errorf("tunnel (%s) cannot have both a forward address and forwards", t.Name)
+		valid = false
+	}
+	for _, forward := range t.Forwards {
+		if forward == nil || forward.IsBlank() {
+			Errorf("tunnel (%s) forwards cannot contain a blank address", t.Name)
+			valid = false
+		} else if !forward.Validate("tunnel", t.Name, "forwards address", true, false) {
+			valid = false
+		} else if forward.IsUnix() && t.Protocol != "" {
+			Errorf("tunnel (%s) protocol (%s) cannot be used with a unix socket forward address", t.Name, t.Protocol)
+			valid = false
+		}
+	}
+	switch t.Balance {
+	case "":
+		t.Balance = BalanceRoundRobin
+	case BalanceRoundRobin, BalanceLeastConnections:
+	default:
+		Errorf("tunnel (%s) balance (%s) is invalid.  Must be %s or %s", t.Name, t.Balance, BalanceRoundRobin, BalanceLeastConnections)
+		valid = false
+	}
+	t.balancer = &balancer{active: make([]int, len(t.Forwards))}
+	return valid
+}
+
+// targets are the forward addresses of the tunnel, none when clients name
+// their own destination
+func (t *Tunnel) targets() []*Address {
+	if len(t.Forwards) > 0 {
+		return t.Forwards
+	}
+	if t.Forward != nil && !t.Forward.IsBlank() {
+		return []*Address{t.Forward}
+	}
+	return nil
+}
+
+// unixTarget reports whether any forward address of the tunnel is a unix socket
+func (t *Tunnel) unixTarget() bool {
+	for _, target := range t.targets() {
+		if target.IsUnix() {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardAddresses lists the forward addresses of the tunnel, separated by
+// commas
+func (t *Tunnel) forwardAddresses() string {
+	addresses := make([]string, 0, len(t.targets()))
+	for _, target := range t.targets() {
+		addresses = append(addresses, target.address)
+	}
+	return strings.Join(addresses, ",")
+}
+
+// nextForward picks the forward address of a connection, returning with it the
+// function to call once the connection closes
+func (t *Tunnel) nextForward() (*Address, func()) {
+	if t.balancer == nil {
+		return t.Forward, func() {}
+	}
+	b := t.balancer
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	index := b.next % len(t.Forwards)
+	if t.Balance == BalanceLeastConnections {
+		// Ties go in turn, starting after the last pick
+		for i := 0; i < len(t.Forwards); i++ {
+			candidate := (b.next + i) % len(t.Forwards)
+			if b.active[candidate] < b.active[index] {
+				index = candidate
+			}
+		}
+	}
+	b.next = index + 1
+	b.active[index]++
+	return t.Forwards[index], func() {
+		b.lock.Lock()
+		b.active[index]--
+		b.lock.Unlock()
+	}
+}
@@ -0,0 +1,63 @@
+package internal
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// receiveBanner is the banner callback of the SSH connection of the host.  The
+// banner is logged, and emitted as an event, when it first arrives or changes,
+// rather than on every reconnection, and kept for the banner command, as
+// bastions announce maintenance windows in them.
+func (h *Host) receiveBanner(message string) error {
+	message = strings.TrimRight(strings.ReplaceAll(message, "\r\n", "\n"), "\n \t")
+	if strings.TrimSpace(message) == "" {
+		return nil
+	}
+	h.bannerLock.Lock()
+	changed := message != h.banner
+	h.banner, h.bannerAt = message, time.Now()
+	h.bannerLock.Unlock()
+	if !changed {
+		return nil
+	}
+	for _, line := range strings.Split(message, "\n") {
+		Infof("host (%s) banner: %s", h.Name, line)
+	}
+	emit(&Event{Type: EventHostBanner, Host: h.Name, Message: message})
+	return nil
+}
+
+// showBanners answers the banner control command with the last banner of each
+// host given, or of every host that has shown one
+func showBanners(tenant *Tenant, args []string) (string, error) {
+	hosts, err := controlHosts(tenant, args)
+	if err != nil {
+		return "", err
+	}
+	sort.Slice(hosts, func(i, j int) bool {
+		return hosts[i].Name < hosts[j].Name
+	})
+	sb := strings.Builder{}
+	for _, host := range hosts {
+		host.bannerLock.Lock()
+		banner, at := host.banner, host.bannerAt
+		host.bannerLock.Unlock()
+		if banner == "" {
+			if len(args) > 0 {
+				sb.WriteString(fmt.Sprintf("host (%s) has shown no banner\n", host.Name))
+			}
+			continue
+		}
+		sb.WriteString(fmt.Sprintf("host (%s) banner, last shown %s:\n", host.Name, at.Format(time.DateTime)))
+		for _, line := range strings.Split(banner, "\n") {
+			sb.WriteString("  " + line + "\n")
+		}
+	}
+	if sb.Len() == 0 {
+		sb.WriteString("no host has shown a banner\n")
+	}
+	return sb.String(), nil
+}
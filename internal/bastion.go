@@ -0,0 +1,141 @@
+package internal
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"net"
+	"os"
+
+	"golang.org/x/crypto/ssh"
+)
+
+type directTCPIP struct {
+	Host       string
+	Port       uint32
+	OriginHost string
+	OriginPort uint32
+}
+
+// FakeBastion runs a minimal SSH server on the loopback interface that accepts
+// any user and key, and supports direct-tcpip channels only.  It exists purely
+// to exercise tunnels locally without real infrastructure and must never be
+// exposed.  Without a host key file an ephemeral host key is generated.
+func FakeBastion(ctx context.Context, port int, keyFile string) bool {
+	signer, ok := bastionHostKey(keyFile)
+	if !ok {
+		return false
+	}
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(ssh.ConnMetadata, ssh.PublicKey) (*ssh.Permissions, error) {
+			return nil, nil
+		},
+		PasswordCallback: func(ssh.ConnMetadata, []byte) (*ssh.Permissions, error) {
+			return nil, nil
+		},
+	}
+	config.AddHostKey(signer)
+
+	address := fmt.Sprintf("127.0.0.1:%d", port)
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		Errorf("fake bastion (%s) cannot listen: %v", address, err)
+		return false
+	}
+	Infof("fake bastion listening on %s (host key %s)", address, ssh.FingerprintSHA256(signer.PublicKey()))
+
+	go func() {
+		<-ctx.Done()
+		_ = listener.Close()
+	}()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return ctx.Err() != nil
+		}
+		go serveBastion(conn, config)
+	}
+}
+
+func bastionHostKey(keyFile string) (ssh.Signer, bool) {
+	if keyFile == "" {
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			Errorf("fake bastion host key cannot be generated: %v", err)
+			return nil, false
+		}
+		signer, err := ssh.NewSignerFromKey(key)
+		if err != nil {
+			Errorf("fake bastion host key cannot be used: %v", err)
+			return nil, false
+		}
+		return signer, true
+	}
+	bs, err := os.ReadFile(keyFile)
+	if err != nil {
+		Errorf("fake bastion host key (%s) cannot be read: %v", keyFile, err)
+		return nil, false
+	}
+	signer, err := ssh.ParsePrivateKey(bs)
+	if err != nil {
+		Errorf("fake bastion host key (%s) cannot be parsed: %v", keyFile, err)
+		return nil, false
+	}
+	return signer, true
+}
+
+func serveBastion(conn net.Conn, config *ssh.ServerConfig) {
+	serverConn, channels, requests, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		if verboseFlag {
+			Warnf("fake bastion handshake with %s failed: %v", conn.RemoteAddr(), err)
+		}
+		_ = conn.Close()
+		return
+	}
+	if verboseFlag {
+		Infof("fake bastion login (%s) from %s", serverConn.User(), serverConn.RemoteAddr())
+	}
+	go ssh.DiscardRequests(requests)
+	for newChannel := range channels {
+		if newChannel.ChannelType() != "direct-tcpip" {
+			_ = newChannel.Reject(ssh.UnknownChannelType, "only direct-tcpip is supported")
+			continue
+		}
+		go bastionForward(newChannel)
+	}
+}
+
+func bastionForward(newChannel ssh.NewChannel) {
+	target := &directTCPIP{}
+	if err := ssh.Unmarshal(newChannel.ExtraData(), target); err != nil {
+		_ = newChannel.Reject(ssh.ConnectionFailed, "invalid direct-tcpip request")
+		return
+	}
+	address := net.JoinHostPort(target.Host, fmt.Sprint(target.Port))
+	remoteConn, err := net.Dial("tcp", address)
+	if err != nil {
+		_ = newChannel.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	channel, requests, err := newChannel.Accept()
+	if err != nil {
+		_ = remoteConn.Close()
+		return
+	}
+	go ssh.DiscardRequests(requests)
+	if verboseFlag {
+		Infof("fake bastion forwarding %s:%d to %s", target.OriginHost, target.OriginPort, address)
+	}
+	go func() {
+		_, _ = io.Copy(channel, remoteConn)
+		_ = channel.CloseWrite()
+		_ = channel.Close()
+	}()
+	go func() {
+		_, _ = io.Copy(remoteConn, channel)
+		_ = remoteConn.Close()
+	}()
+}
@@ -0,0 +1,92 @@
+package internal
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// canaryTimeout bounds how long a canary waits for a host to connect
+const canaryTimeout = 10 * time.Second
+
+// canary tries the tunnels a push would start against the live environment,
+// before any running tunnel is touched.  The local addresses are bound together
+// and released, save those of the tunnels they replace, which are only free
+// once those stop, and the hosts are connected to and the forward addresses
+// reached through them.
+func (d *pushDiff) canary() error {
+	var failures []string
+	held := make(map[string]bool)
+	for _, running := range d.stopping {
+		held[running.Local.address] = true
+	}
+	var bound []net.Listener
+	for _, t := range d.starting {
+		if held[t.Local.address] || t.Local.IsPipe() || (t.Local.port == 0 && !t.Local.IsUnix()) {
+			continue
+		}
+		var listener net.Listener
+		var err error
+		switch {
+		case t.Protocol == ProtocolUDP:
+			listener, err = listenUDP(t.Local.address)
+		case t.Local.IsUnix():
+			listener, err = listenUnix(t.Local.address, t.localMode)
+		default:
+			listener, err = net.Listen("tcp", t.Local.address)
+		}
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("tunnel (%s) entrance (%s) cannot be opened: %v", t.Name, t.Local.address, err))
+			continue
+		}
+		bound = append(bound, listener)
+	}
+	for _, listener := range bound {
+		_ = listener.Close()
+	}
+
+	reached := make(map[string]bool)
+	for _, t := range d.starting {
+		host := Hosts[t.Host]
+		if !t.direct() && !reached[host.Name] {
+			reached[host.Name] = true
+			if !host.WaitOpen(canaryTimeout) {
+				failures = append(failures, fmt.Sprintf("host (%s) cannot be connected to", host.Name))
+			}
+		}
+		if (!t.direct() && !host.Connected()) || t.Protocol == ProtocolUDP {
+			continue
+		}
+		for _, target := range append(t.targets(), t.routeTargets()...) {
+			var conn net.Conn
+			var ok bool
+			switch {
+			case t.direct() && target.IsUnix():
+				conn, ok = t.dialDirect("unix", target.address)
+			case t.direct():
+				conn, ok = t.dialDirect("tcp", target.address)
+			case target.IsUnix():
+				conn, ok = host.DialUnix(target.address)
+			default:
+				conn, ok = host.Dial(target.address)
+			}
+			if !ok {
+				failure := fmt.Sprintf("tunnel (%s) forward address (%s) cannot be reached", t.Name, target)
+				if !t.direct() {
+					failure += fmt.Sprintf(" through host (%s)", host.Name)
+				}
+				failures = append(failures, failure)
+				continue
+			}
+			_ = conn.Close()
+		}
+	}
+	if len(failures) > 0 {
+		return fmt.Errorf("canary failed, so nothing was changed: %s", strings.Join(failures, "; "))
+	}
+	if verboseFlag {
+		Infof("canary of %d tunnels passed", len(d.starting))
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package internal
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// loadCertificate reads an OpenSSH certificate (e.g. id_ed25519-cert.pub) and
+// checks it is currently valid.
+func loadCertificate(path string) (*ssh.Certificate, error) {
+	bs, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key, _, _, _, err := ssh.ParseAuthorizedKey(bs)
+	if err != nil {
+		return nil, err
+	}
+	cert, ok := key.(*ssh.Certificate)
+	if !ok {
+		return nil, fmt.Errorf("not a certificate")
+	}
+	if cert.CertType != ssh.UserCert {
+		return nil, fmt.Errorf("not a user certificate")
+	}
+	now := uint64(time.Now().Unix())
+	if cert.ValidAfter > now {
+		return nil, fmt.Errorf("not valid until %s", certificateTime(cert.ValidAfter))
+	}
+	if cert.ValidBefore != ssh.CertTimeInfinity && cert.ValidBefore <= now {
+		return nil, fmt.Errorf("expired at %s", certificateTime(cert.ValidBefore))
+	}
+	return cert, nil
+}
+
+func certificateTime(t uint64) string {
+	return time.Unix(int64(t), 0).Format(time.RFC3339)
+}
+
+func (h *Host) validateCertificate() bool {
+	cert, err := loadCertificate(h.Certificate)
+	if err != nil {
+		Errorf("host (%s) certificate (%s) cannot be used: %v", h.Name, h.Certificate, err)
+		return false
+	}
+	if signers := h.identitySigners(); len(signers) > 0 {
+		matched := false
+		for _, signer := range signers {
+			matched = matched || certifies(cert, signer)
+		}
+		if !matched {
+			Errorf("host (%s) certificate (%s) does not match identity file (%s)", h.Name, h.Certificate, strings.Join(h.Identity, ", "))
+			return false
+		}
+	}
+	if len(h.Identity) == 0 && !h.Agent {
+		Errorf("host (%s) certificate requires an identity file or agent holding its key", h.Name)
+		return false
+	}
+	if verboseFlag && cert.ValidBefore != ssh.CertTimeInfinity {
+		Infof("host (%s) certificate valid until %s", h.Name, certificateTime(cert.ValidBefore))
+	}
+	return true
+}
+
+// certify offers the host's certificate ahead of the plain keys.  Being short
+// lived, the certificate is read again for every connection, so one renewed on
+// disk is picked up when the host reconnects.
+func (h *Host) certify(signers []ssh.Signer) []ssh.Signer {
+	cert, err := loadCertificate(h.Certificate)
+	if err != nil {
+		Errorf("host (%s) certificate (%s) cannot be used: %v", h.Name, h.Certificate, err)
+		return signers
+	}
+	for _, signer := range signers {
+		if certifies(cert, signer) {
+			if certSigner, err := ssh.NewCertSigner(cert, signer); err == nil {
+				return append([]ssh.Signer{certSigner}, signers...)
+			}
+		}
+	}
+	return signers
+}
+
+func certifies(cert *ssh.Certificate, signer ssh.Signer) bool {
+	return bytes.Equal(cert.Key.Marshal(), signer.PublicKey().Marshal())
+}
@@ -0,0 +1,135 @@
+package internal
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"strings"
+	"time"
+)
+
+// defaultChaosResetAfter bounds when a connection chosen to be reset is reset
+const defaultChaosResetAfter = 10 * time.Second
+
+// ChaosConfig degrades the connections of a tunnel, for testing how clients
+// cope with a poor network.  Each read in either direction is held back by the
+// latency, give or take the jitter, and by the time the bandwidth takes to
+// carry it.  The reset fraction of connections are reset at a random time
+// within reset_after.
+type ChaosConfig struct {
+	Latency    string  `yaml:"latency,omitempty" json:"latency,omitempty"`
+	Jitter     string  `yaml:"jitter,omitempty" json:"jitter,omitempty"`
+	Bandwidth  string  `yaml:"bandwidth,omitempty" json:"bandwidth,omitempty"`
+	Reset      float64 `yaml:"reset,omitempty" json:"reset,omitempty"`
+	ResetAfter string  `yaml:"reset_after,omitempty" json:"reset_after,omitempty"`
+	latency    time.Duration
+	jitter     time.Duration
+	bandwidth  int64
+	resetAfter time.Duration
+}
+
+func (c *ChaosConfig) Validate(tunnel string) bool {
+	valid := true
+	duration := func(attr string, value string) time.Duration {
+		if strings.TrimSpace(value) == "" {
+			return 0
+		}
+		d, err := time.ParseDuration(strings.TrimSpace(value))
+		if err != nil || d < 0 {
+			Errorf("tunnel (%s) chaos %s (%s) is invalid.  Must be a duration, e.g. 100ms", tunnel, attr, value)
+			valid = false
+		}
+		return d
+	}
+	c.latency = duration("latency", c.Latency)
+	c.jitter = duration("jitter", c.Jitter)
+	c.resetAfter = duration("reset_after", c.ResetAfter)
+	if c.resetAfter == 0 {
+		c.resetAfter = defaultChaosResetAfter
+	}
+	if strings.TrimSpace(c.Bandwidth) != "" {
+		bandwidth, err := ParseByteCount(c.Bandwidth)
+		if err != nil || bandwidth <= 0 {
+			Errorf("tunnel (%s) chaos bandwidth (%s) is invalid.  Must be bytes per second, e.g. 64K", tunnel, c.Bandwidth)
+			valid = false
+		}
+		c.bandwidth = bandwidth
+	}
+	if c.Reset < 0 || c.Reset > 1 {
+		Errorf("tunnel (%s) chaos reset (%v) is invalid.  Must be a fraction of connections between 0 and 1", tunnel, c.Reset)
+		valid = false
+	}
+	if valid {
+		var effects []string
+		if c.latency > 0 || c.jitter > 0 {
+			effects = append(effects, fmt.Sprintf("latency %s±%s", c.latency, c.jitter))
+		}
+		if c.bandwidth > 0 {
+			effects = append(effects, fmt.Sprintf("bandwidth %s/s", strings.TrimSpace(c.Bandwidth)))
+		}
+		if c.Reset > 0 {
+			effects = append(effects, fmt.Sprintf("%.0f%% reset within %s", c.Reset*100, c.resetAfter))
+		}
+		Warnf("tunnel (%s) chaos enabled: %s", tunnel, strings.Join(effects, ", "))
+	}
+	return valid
+}
+
+// reader degrades one direction of a connection
+func (c *ChaosConfig) reader(r io.Reader) io.Reader {
+	if c.latency == 0 && c.jitter == 0 && c.bandwidth == 0 {
+		return r
+	}
+	return &chaosReader{Reader: r, chaos: c}
+}
+
+// disrupt resets the connection, if chosen to be, at a random time before it
+// would otherwise end, returning the function that stops it doing so
+func (c *ChaosConfig) disrupt(localConn net.Conn, sshConn net.Conn) func() {
+	if c.Reset == 0 || rand.Float64() >= c.Reset {
+		return func() {}
+	}
+	timer := time.AfterFunc(time.Duration(rand.Int63n(int64(c.resetAfter))), func() {
+		conn := localConn
+		if tlsConn, ok := conn.(*tls.Conn); ok {
+			conn = tlsConn.NetConn()
+		}
+		if tcpConn, ok := conn.(*net.TCPConn); ok {
+			// Closed without lingering, the client is sent a reset
+			_ = tcpConn.SetLinger(0)
+		}
+		_ = localConn.Close()
+		_ = sshConn.Close()
+	})
+	return func() {
+		timer.Stop()
+	}
+}
+
+type chaosReader struct {
+	io.Reader
+	chaos *ChaosConfig
+}
+
+func (r *chaosReader) Read(b []byte) (int, error) {
+	if limit := int(r.chaos.bandwidth / 10); r.chaos.bandwidth > 0 && len(b) > limit {
+		// Reads of a tenth of a second each keep the flow smooth
+		b = b[:max(limit, 1)]
+	}
+	n, err := r.Reader.Read(b)
+	if n > 0 {
+		delay := r.chaos.latency
+		if r.chaos.jitter > 0 {
+			delay += time.Duration(rand.Int63n(int64(2*r.chaos.jitter))) - r.chaos.jitter
+		}
+		if r.chaos.bandwidth > 0 {
+			delay += time.Duration(int64(n) * int64(time.Second) / r.chaos.bandwidth)
+		}
+		if delay > 0 {
+			time.Sleep(delay)
+		}
+	}
+	return n, err
+}
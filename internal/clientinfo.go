@@ -0,0 +1,220 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Ways of conveying the original client to the forward address
+const (
+	ClientInfoProxy        = "proxy"
+	ClientInfoForwardedFor = "x-forwarded-for"
+)
+
+const (
+	headerXForwardedFor   = "X-Forwarded-For"
+	headerXForwardedProto = "X-Forwarded-Proto"
+)
+
+// proxyHeader builds a PROXY protocol (v1) header describing the connection as
+// accepted at the tunnel entrance, for services such as HAProxy or nginx that
+// read the original client from it.
+func proxyHeader(conn net.Conn) string {
+	src, ok1 := conn.RemoteAddr().(*net.TCPAddr)
+	dst, ok2 := conn.LocalAddr().(*net.TCPAddr)
+	if !ok1 || !ok2 {
+		return "PROXY UNKNOWN\r\n"
+	}
+	family := "TCP4"
+	if src.IP.To4() == nil || dst.IP.To4() == nil {
+		family = "TCP6"
+	}
+	return fmt.Sprintf("PROXY %s %s %s %d %d\r\n", family, src.IP, dst.IP, src.Port, dst.Port)
+}
+
+// forwardedFor reads HTTP/1.x requests from the client connection and adds the
+// client address to each request's X-Forwarded-For header, appending to any
+// the client supplied.  Requests are otherwise passed on as they were read,
+// their headers and bodies untouched.  Once a request upgrades the connection,
+// such as to a websocket, the remainder is passed through untouched too.
+func forwardedFor(conn net.Conn) io.Reader {
+	client := conn.RemoteAddr().String()
+	if host, _, err := net.SplitHostPort(client); err == nil {
+		client = host
+	}
+	reader, writer := io.Pipe()
+	go func() {
+		buffered := bufio.NewReader(conn)
+		for {
+			switched, err := forwardRequest(buffered, writer, client)
+			if err != nil {
+				if err == io.EOF {
+					err = nil
+				}
+				_ = writer.CloseWithError(err)
+				return
+			}
+			if switched {
+				_, err = io.Copy(writer, buffered)
+				_ = writer.CloseWithError(err)
+				return
+			}
+		}
+	}()
+	return reader
+}
+
+// forwardRequest passes a request on, adding the client to its X-Forwarded-For
+// header, and X-Forwarded-Proto when missing, reporting whether the request
+// switches the connection to another protocol.  The body is passed on as
+// framed, by its Content-Length or chunked.
+func forwardRequest(reader *bufio.Reader, writer io.Writer, client string) (bool, error) {
+	limit := http.DefaultMaxHeaderBytes
+	var requestLine []byte
+	var err error
+	for len(bytes.TrimSpace(requestLine)) == 0 {
+		// Empty lines ahead of a request are ignored, as servers do
+		if requestLine, err = readLine(reader, &limit); err != nil {
+			return false, err
+		}
+	}
+	method, _, _ := strings.Cut(string(requestLine), " ")
+	head := bytes.NewBuffer(requestLine)
+	forwardedFor := -1
+	proto, upgrade, chunked := false, false, false
+	var length int64
+	var lines [][]byte
+	for {
+		line, err := readLine(reader, &limit)
+		if err == io.EOF {
+			return false, io.ErrUnexpectedEOF
+		} else if err != nil {
+			return false, err
+		}
+		if len(bytes.TrimSpace(line)) == 0 {
+			lines = append(lines, line)
+			break
+		}
+		name, value, _ := strings.Cut(string(line), ":")
+		value = strings.TrimSpace(value)
+		switch http.CanonicalHeaderKey(strings.TrimSpace(name)) {
+		case headerXForwardedFor:
+			forwardedFor = len(lines)
+		case headerXForwardedProto:
+			proto = true
+		case "Upgrade":
+			upgrade = upgrade || value != ""
+		case "Transfer-Encoding":
+			chunked = strings.HasSuffix(strings.ToLower(value), "chunked")
+		case "Content-Length":
+			if length, err = strconv.ParseInt(value, 10, 64); err != nil || length < 0 {
+				return false, fmt.Errorf("content length (%s) is invalid", value)
+			}
+		}
+		lines = append(lines, line)
+	}
+	// The header lines as read, but for the client appended to the last
+	// X-Forwarded-For, as its values run on across lines, or one added
+	added, end := "", string(lines[len(lines)-1])
+	if forwardedFor >= 0 {
+		line := lines[forwardedFor]
+		trimmed := bytes.TrimRight(line, "\r\n")
+		lines[forwardedFor] = append(append(append([]byte{}, trimmed...), ", "+client...), line[len(trimmed):]...)
+	} else {
+		added += headerXForwardedFor + ": " + client + end
+	}
+	if !proto {
+		added += headerXForwardedProto + ": http" + end
+	}
+	for _, line := range lines[:len(lines)-1] {
+		head.Write(line)
+	}
+	head.WriteString(added)
+	head.Write(lines[len(lines)-1])
+	if _, err = writer.Write(head.Bytes()); err != nil {
+		return false, err
+	}
+
+	if chunked {
+		err = copyChunked(reader, writer)
+	} else if length > 0 {
+		_, err = io.CopyN(writer, reader, length)
+	}
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return method == http.MethodConnect || upgrade, err
+}
+
+// copyChunked passes on a chunked body as it was read, up to and including its
+// trailers
+func copyChunked(reader *bufio.Reader, writer io.Writer) error {
+	for {
+		limit := http.DefaultMaxHeaderBytes
+		line, err := readLine(reader, &limit)
+		if err != nil {
+			return err
+		}
+		if _, err = writer.Write(line); err != nil {
+			return err
+		}
+		sizeText, _, _ := strings.Cut(string(line), ";")
+		size, err := strconv.ParseInt(strings.TrimSpace(sizeText), 16, 64)
+		if err != nil || size < 0 {
+			return fmt.Errorf("chunk size (%s) is invalid", strings.TrimSpace(sizeText))
+		}
+		if size == 0 {
+			break
+		}
+		if _, err = io.CopyN(writer, reader, size); err != nil {
+			return err
+		}
+		// The line ending of the chunk
+		if line, err = readLine(reader, &limit); err != nil {
+			return err
+		}
+		if _, err = writer.Write(line); err != nil {
+			return err
+		}
+	}
+	limit := http.DefaultMaxHeaderBytes
+	for {
+		line, err := readLine(reader, &limit)
+		if err != nil {
+			return err
+		}
+		if _, err = writer.Write(line); err != nil {
+			return err
+		}
+		if len(bytes.TrimSpace(line)) == 0 {
+			return nil
+		}
+	}
+}
+
+// readLine reads a line, line ending included, taking its length from the limit
+// on how much may be read
+func readLine(reader *bufio.Reader, limit *int) ([]byte, error) {
+	var line []byte
+	for {
+		slice, err := reader.ReadSlice('\n')
+		if *limit -= len(slice); *limit < 0 {
+			return nil, errors.New("request header is too large")
+		}
+		line = append(line, slice...)
+		switch {
+		case err == bufio.ErrBufferFull:
+			continue
+		case err == io.EOF && len(line) > 0:
+			return nil, io.ErrUnexpectedEOF
+		}
+		return line, err
+	}
+}
@@ -0,0 +1,87 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+)
+
+// CopyToClipboard places text on the system clipboard by way of the platform's
+// clipboard command: pbcopy, clip, or on other systems wl-copy, xclip or xsel,
+// whichever is installed.
+func CopyToClipboard(text string) error {
+	var candidates [][]string
+	switch runtime.GOOS {
+	case "darwin":
+		candidates = [][]string{{"pbcopy"}}
+	case "windows":
+		candidates = [][]string{{"clip"}}
+	default:
+		if os.Getenv("WAYLAND_DISPLAY") != "" {
+			candidates = append(candidates, []string{"wl-copy"})
+		}
+		candidates = append(candidates,
+			[]string{"xclip", "-selection", "clipboard"},
+			[]string{"xsel", "--clipboard", "--input"},
+		)
+	}
+	for _, candidate := range candidates {
+		if _, err := exec.LookPath(candidate[0]); err != nil {
+			continue
+		}
+		cmd := exec.Command(candidate[0], candidate[1:]...)
+		cmd.Stdin = strings.NewReader(text)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("%s failed: %v %s", candidate[0], err, strings.TrimSpace(string(out)))
+		}
+		return nil
+	}
+	return errors.New("no clipboard command found")
+}
+
+// endpoint is how clients reach the tunnel: its url when it has a url template,
+// otherwise the address of its entrance.  It is empty while not listening.
+func (t *Tunnel) endpoint() string {
+	address := t.Entrance()
+	if address == "" || t.URL == "" {
+		return address
+	}
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return address
+	}
+	return strings.NewReplacer("{addr}", address, "{host}", host, "{port}", port).Replace(t.URL)
+}
+
+// copyEndpoint copies the endpoint of a tunnel with copy enabled once it opens
+func (t *Tunnel) copyEndpoint() {
+	if !t.Copy {
+		return
+	}
+	endpoint := t.endpoint()
+	if err := CopyToClipboard(endpoint); err != nil {
+		Warnf("tunnel (%s) endpoint cannot be copied to the clipboard: %v", t.Name, err)
+	} else if verboseFlag {
+		Infof("tunnel (%s) endpoint %s copied to the clipboard", t.Name, endpoint)
+	}
+}
+
+// tunnelEndpoint answers the url control command with the endpoint of a tunnel
+func tunnelEndpoint(tenant *Tenant, args []string) (string, error) {
+	if len(args) != 1 {
+		return "", errors.New("a tunnel name is required")
+	}
+	t, err := ownTunnel(tenant, args[0])
+	if err != nil {
+		return "", err
+	}
+	endpoint := t.endpoint()
+	if endpoint == "" {
+		return "", fmt.Errorf("tunnel (%s) is not listening", args[0])
+	}
+	return endpoint + "\n", nil
+}
@@ -0,0 +1,204 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// dropTimeout is how long the connections of a dropped clone may drain
+const dropTimeout = 30 * time.Second
+
+var (
+	// controlContext is the context the tunnels of the config are served with,
+	// and with them the clones made through the control socket
+	controlContext context.Context
+	clonesLock     sync.Mutex
+	clones         = make(map[string]context.CancelFunc)
+)
+
+// clone copies the configuration of the tunnel, but none of its state
+func (t *Tunnel) clone() (*Tunnel, error) {
+	bs, err := yaml.Marshal(t)
+	if err != nil {
+		return nil, err
+	}
+	clone := &Tunnel{}
+	if err = yaml.Unmarshal(bs, clone); err != nil {
+		return nil, err
+	}
+	return clone, nil
+}
+
+// ownTunnel finds a tunnel of the tenant, or a shared tunnel, by name
+func ownTunnel(tenant *Tenant, name string) (*Tunnel, error) {
+	tunnelsLock.RLock()
+	t, ok := Tunnels[name]
+	if own, found := Tunnels[tenant.qualify(name)]; found {
+		t, ok = own, true
+	}
+	tunnelsLock.RUnlock()
+	if !ok || !tenant.owns(t.tenant) {
+		return nil, fmt.Errorf("tunnel (%s) is not defined", name)
+	}
+	return t, nil
+}
+
+// cloneTunnel answers the clone control command, opening a copy of a tunnel
+// under a new name with its addresses overridden by local=<address> and
+// forward=<address>.  Without a local address the clone listens on a port the
+// system picks.  A tenant may only override the forward address of a tunnel
+// through a host of its own.  Clones are ephemeral: they last until dropped or ferret stops,
+// and are left out of config exports unless asked for.
+func cloneTunnel(tenant *Tenant, args []string) (string, error) {
+	if len(args) < 2 {
+		return "", errors.New("the tunnel to clone and a name for the clone are required")
+	}
+	if controlContext == nil || controlStats == nil {
+		return "", errors.New("tunnels cannot be cloned until ferret is running")
+	}
+	source, err := ownTunnel(tenant, args[0])
+	if err != nil {
+		return "", err
+	}
+	clone, err := source.clone()
+	if err != nil {
+		return "", fmt.Errorf("tunnel (%s) cannot be cloned: %v", source.Name, err)
+	}
+	clone.ID = ""
+	clone.Name = tenant.qualify(strings.TrimSpace(args[1]))
+	clone.Local = nil
+	if !source.Local.IsUnix() && !source.Local.IsPipe() {
+		clone.Local = NewAddress(net.JoinHostPort(source.Local.Host(), "0"))
+	}
+	for _, arg := range args[2:] {
+		key, value, _ := strings.Cut(arg, "=")
+		switch key {
+		case "local":
+			clone.Local = NewAddress(value)
+		case "forward":
+			if reason := tenant.forwardRefusal(source); reason != "" {
+				return "", fmt.Errorf("tunnel (%s) forward address refused: %s", args[1], reason)
+			}
+			clone.Forward, clone.Forwards = NewAddress(value), nil
+		default:
+			return "", fmt.Errorf("override (%s) is invalid.  Must be local=<address> or forward=<address>", arg)
+		}
+	}
+	if clone.Local == nil {
+		return "", fmt.Errorf("tunnel (%s) listens on a unix socket or named pipe, so its clone requires local=<address>", source.Name)
+	}
+	clone.tenant = source.tenant
+	clone.ephemeral = true
+
+	tunnelsLock.Lock()
+	if _, ok := Tunnels[clone.Name]; ok {
+		tunnelsLock.Unlock()
+		return "", fmt.Errorf("tunnel (%s) is already defined", args[1])
+	}
+	if !clone.Validate() {
+		err = fmt.Errorf("tunnel (%s) is invalid, as the log of ferret explains", args[1])
+	} else if reason := tenant.bindRefusal(clone); reason != "" {
+		err = fmt.Errorf("tunnel (%s) local address refused: %s", args[1], reason)
+	}
+	if err != nil && Tunnels[clone.Name] == clone {
+		delete(Tunnels, clone.Name)
+	}
+	tunnelsLock.Unlock()
+	if err != nil {
+		return "", err
+	}
+
+	clone.Init(controlStats.UpdateChannel())
+	if err = clone.Listen(); err != nil {
+		unregisterTunnel(clone)
+		return "", err
+	}
+	controlStats.AddTunnelStats(clone.stats)
+	ctx, cancel := context.WithCancel(controlContext)
+	clonesLock.Lock()
+	clones[clone.Name] = cancel
+	clonesLock.Unlock()
+	go clone.Serve(ctx)
+	Infof("tunnel (%s) cloned from tunnel (%s)", clone.Name, source.Name)
+	return clone.endpoint() + "\n", nil
+}
+
+// dropTunnel answers the drop control command, closing a clone
+func dropTunnel(tenant *Tenant, args []string) (string, error) {
+	if len(args) != 1 {
+		return "", errors.New("the name of a clone is required")
+	}
+	t, err := ownTunnel(tenant, args[0])
+	if err != nil {
+		return "", err
+	}
+	clonesLock.Lock()
+	cancel, ok := clones[t.Name]
+	delete(clones, t.Name)
+	clonesLock.Unlock()
+	if !ok {
+		return "", fmt.Errorf("tunnel (%s) is not a clone, only clones can be dropped", args[0])
+	}
+	cancel()
+	// Free the entrance and the name now, so they may be cloned again at once
+	t.closeListener()
+	unregisterTunnel(t)
+	Infof("tunnel (%s) dropped", t.Name)
+	go func() {
+		t.shutdown(time.Now().Add(dropTimeout))
+		controlStats.RemoveTunnelStats(t.stats)
+	}()
+	return "", nil
+}
+
+func unregisterTunnel(t *Tunnel) {
+	tunnelsLock.Lock()
+	defer tunnelsLock.Unlock()
+	if Tunnels[t.Name] == t {
+		delete(Tunnels, t.Name)
+	}
+}
+
+// exportConfig answers the export control command with the tunnels of the
+// tenant in the form of a config file, including clones when the argument
+// ephemeral is given
+func exportConfig(tenant *Tenant, args []string) (string, error) {
+	ephemeral := len(args) == 1 && args[0] == "ephemeral"
+	owner, prefix := "", ""
+	if tenant != nil {
+		owner, prefix = tenant.User, tenant.User+"/"
+	}
+	var tunnels []*Tunnel
+	for _, t := range tunnelList() {
+		// Tunnels of tenants belong to the tenants section of the config
+		if t.tenant != owner {
+			continue
+		}
+		if t.ephemeral && !ephemeral {
+			continue
+		}
+		exported, err := t.clone()
+		if err != nil {
+			return "", fmt.Errorf("tunnel (%s) cannot be exported: %v", t.Name, err)
+		}
+		// A tenant's own names are exported as the tenant configured them
+		exported.Name = strings.TrimPrefix(exported.Name, prefix)
+		exported.Host = strings.TrimPrefix(exported.Host, prefix)
+		tunnels = append(tunnels, exported)
+	}
+	sort.Slice(tunnels, func(i, j int) bool {
+		return tunnels[i].Name < tunnels[j].Name
+	})
+	bs, err := yaml.Marshal(&struct {
+		Tunnels []*Tunnel `yaml:"tunnels"`
+	}{tunnels})
+	return string(bs), err
+}
@@ -0,0 +1,197 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+)
+
+// cloudInstance is a host address naming a cloud instance, as
+// aws://<instance id>?profile=&region=, gcp://<instance>?project=&zone= or
+// azure://<vm>?resource_group=&subscription=, whose IP is looked up on
+// connecting so that a configuration survives the instance being replaced.  ip
+// chooses the public or private IP, by default the public, else the private,
+// and port the SSH port, by default 22.
+type cloudInstance struct {
+	provider string
+	instance string
+	params   url.Values
+	ip       string
+	port     string
+}
+
+var cloudParams = map[string][]string{
+	"aws":   {"profile", "region"},
+	"gcp":   {"project", "zone"},
+	"azure": {"resource_group", "subscription"},
+}
+
+// validateCloudAddress reads an address naming a cloud instance, if it does
+func (h *Host) validateCloudAddress() bool {
+	if h.Address == nil {
+		return true
+	}
+	provider, _, ok := strings.Cut(h.Address.address, "://")
+	if _, cloud := cloudParams[provider]; !ok || !cloud {
+		return true
+	}
+	u, err := url.Parse(h.Address.address)
+	if err != nil {
+		Errorf("host (%s) address (%s) is invalid: %v", h.Name, h.Address.address, err)
+		return false
+	}
+	c := &cloudInstance{provider: provider, instance: u.Host, params: u.Query(), port: "22"}
+	valid := true
+	if c.instance == "" || (u.Path != "" && u.Path != "/") {
+		Errorf("host (%s) address (%s) is invalid.  Must be %s://<instance>", h.Name, h.Address.address, provider)
+		valid = false
+	}
+	for key := range c.params {
+		switch {
+		case key == "ip":
+			c.ip = c.params.Get(key)
+			if c.ip != "public" && c.ip != "private" {
+				Errorf("host (%s) address ip (%s) is invalid.  Must be public or private", h.Name, c.ip)
+				valid = false
+			}
+		case key == "port":
+			c.port = c.params.Get(key)
+			if port, err := strconv.Atoi(c.port); err != nil || port < 1 || port > 65535 {
+				Errorf("host (%s) address port (%s) is invalid.  Must be between 1 and 65535", h.Name, c.port)
+				valid = false
+			}
+		case !slices.Contains(cloudParams[provider], key):
+			Errorf("host (%s) address parameter (%s) is unknown.  %s takes %s, ip and port", h.Name, key, provider, strings.Join(cloudParams[provider], ", "))
+			valid = false
+		}
+	}
+	if provider == "azure" && c.params.Get("resource_group") == "" {
+		Errorf("host (%s) address (%s) requires a resource_group", h.Name, h.Address.address)
+		valid = false
+	}
+	h.cloud = c
+	return valid
+}
+
+// lookup finds the IP of the instance with the AWS SDK, or the provider's CLI,
+// so credentials, profiles and SSO are resolved just as they are for the user's
+// other tooling
+func (c *cloudInstance) lookup() (string, error) {
+	var public, private string
+	var err error
+	switch c.provider {
+	case "aws":
+		public, private, err = awsInstanceIPs(c.instance, c.params.Get("profile"), c.params.Get("region"))
+	case "gcp":
+		args := []string{"compute", "instances", "describe", c.instance,
+			"--format", "value(networkInterfaces[0].accessConfigs[0].natIP,networkInterfaces[0].networkIP)"}
+		public, private, err = cloudIPs(runCLI("gcloud", c.flags(args, "project", "zone")...))
+	case "azure":
+		args := []string{"vm", "list-ip-addresses", "--name", c.instance, "--output", "tsv",
+			"--query", "[0].virtualMachine.network.[publicIpAddresses[0].ipAddress,privateIpAddresses[0]]"}
+		public, private, err = cloudIPs(runCLI("az", c.flags(args, "resource_group", "subscription")...))
+	}
+	if err != nil {
+		return "", err
+	}
+	public, private = cloudIP(public), cloudIP(private)
+	ip := public
+	if c.ip == "private" || (c.ip == "" && public == "") {
+		ip = private
+	}
+	if ip == "" {
+		return "", fmt.Errorf("%s instance (%s) has no %s IP", c.provider, c.instance, c.describeIP())
+	}
+	return net.JoinHostPort(ip, c.port), nil
+}
+
+// awsInstanceIPs looks up the public and private IPs of an EC2 instance
+func awsInstanceIPs(instance string, profile string, region string) (string, string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), awsTimeout)
+	defer cancel()
+	var options []func(*config.LoadOptions) error
+	if profile != "" {
+		options = append(options, config.WithSharedConfigProfile(profile))
+	}
+	if region != "" {
+		options = append(options, config.WithRegion(region))
+	}
+	cfg, err := awsConfig(ctx, options...)
+	if err != nil {
+		return "", "", err
+	}
+	output, err := ec2.NewFromConfig(cfg).DescribeInstances(ctx, &ec2.DescribeInstancesInput{
+		InstanceIds: []string{instance},
+	})
+	if err != nil {
+		return "", "", err
+	}
+	for _, reservation := range output.Reservations {
+		for _, i := range reservation.Instances {
+			return aws.ToString(i.PublicIpAddress), aws.ToString(i.PrivateIpAddress), nil
+		}
+	}
+	return "", "", fmt.Errorf("aws instance (%s) not found", instance)
+}
+
+// cloudIPs reads the public IP, then the private, tab separated, as the CLIs
+// are asked to print them
+func cloudIPs(out []byte, err error) (string, string, error) {
+	if err != nil {
+		return "", "", err
+	}
+	public, private, _ := strings.Cut(strings.TrimRight(string(out), "\r\n"), "\t")
+	return public, private, nil
+}
+
+func cloudIP(field string) string {
+	field = strings.TrimSpace(field)
+	if net.ParseIP(field) == nil {
+		// None, or empty, when the instance has no such IP
+		return ""
+	}
+	return field
+}
+
+func (c *cloudInstance) describeIP() string {
+	if c.ip == "" {
+		return "public or private"
+	}
+	return c.ip
+}
+
+// flags passes the parameters given as the CLI's flags of the same name
+func (c *cloudInstance) flags(args []string, params ...string) []string {
+	for _, param := range params {
+		if value := c.params.Get(param); value != "" {
+			args = append(args, "--"+strings.ReplaceAll(param, "_", "-"), value)
+		}
+	}
+	return args
+}
+
+// runCLI runs a provider's CLI, giving what it prints, or else what it printed
+// to stderr as the error
+func runCLI(name string, args ...string) ([]byte, error) {
+	cmd := exec.Command(name, args...)
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if message := strings.TrimSpace(stderr.String()); message != "" {
+			return nil, fmt.Errorf("%s %s failed: %s", name, args[0], message)
+		}
+		return nil, fmt.Errorf("%s %s failed: %w", name, args[0], err)
+	}
+	return out, nil
+}
@@ -0,0 +1,182 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+)
+
+// Protocols a tunnel understands well enough to follow a cluster through it
+const (
+	ProtocolKafka   = "kafka"
+	ProtocolMongoDB = "mongodb"
+)
+
+// maxRewriteFrame bounds the frames read whole to be rewritten.  Cluster
+// metadata is small, anything larger is passed through untouched.
+const maxRewriteFrame = 16 << 20
+
+// clusterMembers follows a clustered service through a tunnel.  The addresses
+// the service advertises for its members, Kafka brokers or MongoDB replica set
+// members, are rewritten to the entrances of tunnels opened for each member as
+// it is discovered, so clients bootstrapped through one tunnel reach them all.
+type clusterMembers struct {
+	tunnel  *Tunnel
+	lock    sync.Mutex
+	ctx     context.Context
+	members map[string]*Tunnel
+}
+
+func newClusterMembers(t *Tunnel) *clusterMembers {
+	return &clusterMembers{tunnel: t, members: make(map[string]*Tunnel)}
+}
+
+// serve records the context the member tunnels are served with, that of the
+// tunnel the cluster was bootstrapped through
+func (c *clusterMembers) serve(ctx context.Context) {
+	c.lock.Lock()
+	c.ctx = ctx
+	c.lock.Unlock()
+}
+
+// advertise returns the entrance clients are to use for a member of the
+// cluster, opening a tunnel to the member the first time it is seen.  A member
+// that cannot be tunneled is left as advertised.
+func (c *clusterMembers) advertise(host string, port int) (string, int) {
+	address := net.JoinHostPort(host, strconv.Itoa(port))
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if address == c.tunnel.Forward.address {
+		return c.entranceHost(), c.tunnel.entrancePort()
+	}
+	if member, ok := c.members[address]; ok {
+		return c.entranceHost(), member.entrancePort()
+	}
+	member := c.open(address)
+	if member == nil {
+		return host, port
+	}
+	c.members[address] = member
+	return c.entranceHost(), member.entrancePort()
+}
+
+// entranceHost is the host of the bootstrap entrance, or the loopback address
+// when it listens on every interface
+func (c *clusterMembers) entranceHost() string {
+	host := c.tunnel.Local.Host()
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		return "127.0.0.1"
+	}
+	return host
+}
+
+func (c *clusterMembers) open(address string) *Tunnel {
+	if c.ctx == nil || c.ctx.Err() != nil {
+		return nil
+	}
+	listener, port, ok := freePort(c.tunnel.Local.Host())
+	if !ok {
+		Warnf("tunnel (%s) has no free port for cluster member %s", c.tunnel.Name, address)
+		return nil
+	}
+	t := &Tunnel{
+		Name:       fmt.Sprintf("%s-%d", c.tunnel.Name, len(c.members)+1),
+		Local:      NewAddress(net.JoinHostPort(c.tunnel.Local.Host(), strconv.Itoa(int(port)))),
+		Host:       c.tunnel.Host,
+		Forward:    NewAddress(address),
+		OnError:    OnErrorContinue,
+		ClientInfo: c.tunnel.ClientInfo,
+		Labels:     c.tunnel.Labels,
+		Protocol:   c.tunnel.Protocol,
+		Rewrite:    c.tunnel.Rewrite,
+		Admission:  c.tunnel.Admission,
+		cluster:    c,
+		tenant:     c.tunnel.tenant,
+		reserved:   listener,
+	}
+	tunnelsLock.Lock()
+	valid := t.Validate()
+	if !valid && Tunnels[t.Name] == t {
+		delete(Tunnels, t.Name)
+	}
+	tunnelsLock.Unlock()
+	if !valid {
+		_ = listener.Close()
+		Warnf("tunnel (%s) cluster member %s SKIPPED: failed validation", c.tunnel.Name, address)
+		return nil
+	}
+	t.Init(c.tunnel.updateChan)
+	if t.Listen() != nil {
+		tunnelsLock.Lock()
+		delete(Tunnels, t.Name)
+		tunnelsLock.Unlock()
+		return nil
+	}
+	if controlStats != nil {
+		controlStats.AddTunnelStats(t.stats)
+	}
+	Infof("tunnel (%s) added tunnel (%s) for cluster member %s", c.tunnel.Name, t.Name, address)
+	go t.Serve(c.ctx)
+	return t
+}
+
+// frameReader passes a stream of length prefixed messages through a message
+// at a time.  The first head bytes of each message are handed to inspect, which
+// returns how the message is to be rewritten, or nil to pass it through as is.
+type frameReader struct {
+	src       io.Reader
+	head      int
+	size      func(head []byte) int
+	inspect   func(head []byte, size int) func(frame []byte) []byte
+	pending   []byte
+	remaining int
+}
+
+func (f *frameReader) Read(p []byte) (int, error) {
+	if len(f.pending) == 0 && f.remaining == 0 {
+		if err := f.next(); err != nil {
+			return 0, err
+		}
+	}
+	if len(f.pending) > 0 {
+		n := copy(p, f.pending)
+		f.pending = f.pending[n:]
+		return n, nil
+	}
+	if len(p) > f.remaining {
+		p = p[:f.remaining]
+	}
+	n, err := f.src.Read(p)
+	f.remaining -= n
+	if err == io.EOF && f.remaining > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func (f *frameReader) next() error {
+	head := make([]byte, f.head)
+	if _, err := io.ReadFull(f.src, head); err != nil {
+		return err
+	}
+	size := f.size(head)
+	if size < f.head {
+		return fmt.Errorf("message length (%d) is invalid", size)
+	}
+	rewrite := f.inspect(head, size)
+	if rewrite == nil || size > maxRewriteFrame {
+		f.pending = head
+		f.remaining = size - f.head
+		return nil
+	}
+	frame := make([]byte, size)
+	copy(frame, head)
+	if _, err := io.ReadFull(f.src, frame[f.head:]); err != nil {
+		return io.ErrUnexpectedEOF
+	}
+	f.pending = rewrite(frame)
+	return nil
+}
@@ -1,80 +1,216 @@
 package internal
 
 import (
-	"encoding/json"
-	"fmt"
+	"errors"
 	"os"
 	"strings"
-
-	"gopkg.in/yaml.v3"
 )
 
 var verboseFlag bool
 
 type Configuration struct {
-	Hosts   []*Host   `yaml:"hosts"`
-	Tunnels []*Tunnel `yaml:"tunnels"`
+	Hardened    bool               `yaml:"hardened"`
+	RunAs       string             `yaml:"run_as"`
+	Stats       *StatsConfig       `yaml:"stats"`
+	Journal     *JournalConfig     `yaml:"journal"`
+	Diagnostics *DiagnosticsConfig `yaml:"diagnostics"`
+	Log         *LogConfig         `yaml:"log"`
+	Watchdog    *WatchdogConfig    `yaml:"watchdog"`
+	Ports       *PortsConfig       `yaml:"ports"`
+	Discovery   []*DiscoveryConfig `yaml:"discovery"`
+	Routes      []*RouteConfig     `yaml:"routes"`
+	Hosts       []*Host            `yaml:"hosts"`
+	Tunnels     []*Tunnel          `yaml:"tunnels"`
+	Tenants     []*Tenant          `yaml:"tenants"`
+	file        string
+	workspace   string
+	source      []byte
+	uid         int
+	gid         int
+	routes      *packetStack
 }
 
 func (c *Configuration) Load(configFile string, verbose bool) *Configuration {
 	verboseFlag = verbose
 	if fi, err := os.Stat(configFile); os.IsNotExist(err) {
-		fmt.Printf("  Error - config file (%s) cannot be read: file not found\n", configFile)
+		Errorf("config file (%s) cannot be read: file not found", configFile)
 		return nil
 	} else if fi.IsDir() {
-		fmt.Printf("  Error - config file (%s) cannot be read: file is a directory\n", configFile)
+		Errorf("config file (%s) cannot be read: file is a directory", configFile)
 		return nil
 	}
 	bs, err := os.ReadFile(configFile)
 	if err != nil {
 		if os.IsPermission(err) {
-			fmt.Printf("  Error - config file (%s) cannot be read: permission denied\n", configFile)
+			Errorf("config file (%s) cannot be read: permission denied", configFile)
 		} else {
-			fmt.Printf("  Error - config file (%s) cannot be read: %v\n", configFile, err)
+			Errorf("config file (%s) cannot be read: %v", configFile, err)
 		}
 		return nil
 	}
+	return c.load(configFile, bs)
+}
+
+// load parses a configuration already read from the file
+func (c *Configuration) load(configFile string, bs []byte) *Configuration {
+	if !checkPermissions("config file", configFile, true) {
+		return nil
+	}
+
+	config, err := parseConfig(configFile, bs)
+	if errors.Is(err, errUnknownExtension) {
+		Errorf("config file (%s) has unknown extension", configFile)
+		return nil
+	} else if err != nil {
+		Errorf("config file (%s) cannot be parsed: %v", configFile, err)
+		return nil
+	}
+	if config.Journal == nil {
+		config.Journal = &JournalConfig{}
+	}
+	config.file = configFile
+	config.source = bs
+	return config
+}
 
-	config := Configuration{}
+var errUnknownExtension = errors.New("unknown extension")
+
+// parseConfig decodes a configuration in the format the extension of the file
+// names, without validating it
+func parseConfig(configFile string, bs []byte) (*Configuration, error) {
+	config := &Configuration{}
+	var err error
 	if strings.HasSuffix(configFile, "yaml") || strings.HasSuffix(configFile, "yml") {
-		err = yaml.Unmarshal(bs, &config)
+		err = unmarshalExpandedYAML(bs, config)
 	} else if strings.HasSuffix(configFile, "json") {
-		err = json.Unmarshal(bs, &config)
+		err = unmarshalExpandedJSON(bs, config)
 	} else {
-		fmt.Printf("  Error - config file (%s) has unknown extension\n", configFile)
-		return nil
+		err = errUnknownExtension
 	}
 	if err != nil {
-		fmt.Printf("  Error - config file (%s) cannot be parsed: %v\n", configFile, err)
-		return nil
+		return nil, err
 	}
-	return &config
+	return config, nil
 }
 
-func (c *Configuration) Validate(defaultUsername string) bool {
+func (c *Configuration) Validate(defaultUsername string, partialStart bool) bool {
+	partial = partialStart
 	valid := true
-	for _, host := range c.Hosts {
-		if !host.Validate(defaultUsername) {
+	if c.Stats != nil && !c.Stats.Validate() {
+		valid = false
+	}
+	if !c.Journal.Validate(c.file) {
+		valid = false
+	}
+	if c.Diagnostics != nil && !c.Diagnostics.Validate() {
+		valid = false
+	}
+	if c.Log != nil && !c.Log.Validate(c.file) {
+		valid = false
+	}
+	if c.Watchdog != nil && !c.Watchdog.Validate() {
+		valid = false
+	}
+	if c.Ports != nil && !c.Ports.Validate() {
+		valid = false
+	}
+	if !c.validateRunAs() {
+		valid = false
+	}
+	for _, tenant := range c.Tenants {
+		if !tenant.Validate() {
 			valid = false
 		}
+		c.Hosts = append(c.Hosts, tenant.Hosts...)
+		c.Tunnels = append(c.Tunnels, tenant.Tunnels...)
+	}
+	hops, ok := jumpHops(c.Hosts)
+	if !ok {
+		valid = false
+	}
+	c.Hosts = append(c.Hosts, hops...)
+	for _, host := range c.Hosts {
+		host.Validate(defaultUsername)
 	}
 	for _, tunnel := range c.Tunnels {
-		if !tunnel.Validate() {
+		if !tunnel.Validate() && !skipTunnel(tunnel) {
+			valid = false
+		}
+	}
+	for _, tenant := range c.Tenants {
+		if !tenant.checkBinds() {
 			valid = false
 		}
 	}
-	if !validateJumpHosts() {
+	if !validateJumpHosts() && !partial {
 		valid = false
 	}
+	discoveries := make(map[string]bool)
+	for _, discovery := range c.Discovery {
+		if !discovery.Validate() {
+			valid = false
+		} else if discoveries[discovery.Name] {
+			Errorf("discovery name (%s) redefined", discovery.Name)
+			valid = false
+		} else if !Hosts[discovery.Host].valid {
+			Errorf("discovery (%s) host (%s) is invalid", discovery.Name, discovery.Host)
+			valid = false
+		}
+		discoveries[discovery.Name] = true
+	}
+	routes := make(map[string]bool)
+	for _, r := range c.Routes {
+		if !r.Validate() {
+			valid = false
+		} else if routes[r.Name] {
+			Errorf("route name (%s) redefined", r.Name)
+			valid = false
+		} else if !Hosts[r.Host].valid {
+			Errorf("route (%s) host (%s) is invalid", r.Name, r.Host)
+			valid = false
+		}
+		routes[r.Name] = true
+	}
+	for _, tunnel := range c.Tunnels {
+		if host, ok := Hosts[tunnel.Host]; ok && !host.valid && Tunnels[tunnel.Name] == tunnel {
+			Errorf("tunnel (%s) remote host (%s) is invalid", tunnel.Name, tunnel.Host)
+			if !skipTunnel(tunnel) {
+				valid = false
+			}
+		}
+	}
 	var unused []string
 	for name, host := range Hosts {
 		if !host.isHost && !host.isJumpHost {
-			fmt.Printf("  Info  - host (%s) is unused\n", name)
+			if !host.valid && !partial {
+				valid = false
+			} else if !host.valid {
+				Warnf("host (%s) SKIPPED: failed validation", name)
+			} else {
+				Infof("host (%s) is unused", name)
+			}
 			unused = append(unused, name)
 		}
 	}
 	for _, name := range unused {
 		delete(Hosts, name)
 	}
+	if valid && len(Tunnels) == 0 && len(c.Discovery) == 0 && len(c.Routes) == 0 {
+		Errorf("no tunnels remain to be started")
+		valid = false
+	}
 	return valid
 }
+
+// skipTunnel removes a tunnel that failed validation if it may be skipped,
+// reporting whether it was.
+func skipTunnel(t *Tunnel) bool {
+	if !t.ContinueOnError() {
+		return false
+	}
+	Warnf("tunnel (%s) SKIPPED: failed validation", t.Name)
+	if Tunnels[t.Name] == t {
+		delete(Tunnels, t.Name)
+	}
+	return true
+}
@@ -0,0 +1,82 @@
+package internal
+
+import (
+	"context"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	// defaultConnectionAgeQuiet is how long a connection past its max age must
+	// pass no bytes before it is closed
+	defaultConnectionAgeQuiet = 5 * time.Second
+	// connectionAgeGrace is how long a connection past its max age may go on
+	// passing bytes before it is closed regardless
+	connectionAgeGrace = time.Minute
+)
+
+// validateConnectionAge reads max_connection_age, after which each connection
+// of the tunnel is closed, forcing its client to reconnect.  So as not to cut
+// a transfer short, the connection is first given max_connection_age_quiet to
+// fall quiet, and closed when it does, or after a minute at the latest.
+func (t *Tunnel) validateConnectionAge() bool {
+	valid := true
+	t.MaxConnectionAge = strings.TrimSpace(t.MaxConnectionAge)
+	t.MaxConnectionAgeQuiet = strings.TrimSpace(t.MaxConnectionAgeQuiet)
+	t.maxConnectionAge, t.connectionAgeQuiet = 0, defaultConnectionAgeQuiet
+	if t.MaxConnectionAge != "" {
+		d, err := time.ParseDuration(t.MaxConnectionAge)
+		if err != nil || d < time.Second {
+			Errorf("tunnel (%s) max_connection_age (%s) is invalid.  Must be a duration of at least 1s", t.Name, t.MaxConnectionAge)
+			valid = false
+		}
+		t.maxConnectionAge = d
+	}
+	if t.MaxConnectionAgeQuiet != "" {
+		d, err := time.ParseDuration(t.MaxConnectionAgeQuiet)
+		if err != nil || d < 0 || d > connectionAgeGrace {
+			Errorf("tunnel (%s) max_connection_age_quiet (%s) is invalid.  Must be a duration of at most %s", t.Name, t.MaxConnectionAgeQuiet, connectionAgeGrace)
+			valid = false
+		}
+		if t.MaxConnectionAge == "" {
+			Warnf("tunnel (%s) max_connection_age_quiet is ignored without max_connection_age", t.Name)
+		}
+		t.connectionAgeQuiet = d
+	}
+	return valid
+}
+
+// ageOut closes a connection once it reaches the max age of the tunnel and has
+// fallen quiet, unless it ends first
+func (t *Tunnel) ageOut(ctx context.Context, id int32, client string, connStats *ConnectionStats, conns ...net.Conn) {
+	if t.maxConnectionAge == 0 {
+		return
+	}
+	timer := time.NewTimer(t.maxConnectionAge)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return
+	case <-timer.C:
+	}
+	Warnf("tunnel (%s) id:%d connection from %s reached its max_connection_age of %s, closing once quiet for %s", t.Name, id, client, t.maxConnectionAge, t.connectionAgeQuiet)
+	deadline := time.Now().Add(connectionAgeGrace)
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		last := max(connStats.activity.lastReceived.Load(), connStats.activity.lastTransmitted.Load(), connStats.Started.UnixNano())
+		if time.Since(time.Unix(0, last)) >= t.connectionAgeQuiet || time.Now().After(deadline) {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+	Infof("tunnel (%s) id:%d connection from %s closed, older than its max_connection_age", t.Name, id, client)
+	for _, conn := range conns {
+		_ = conn.Close()
+	}
+}
@@ -0,0 +1,67 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// ShowConnections prints the connections currently being forwarded by a running
+// ferret.  When following, the table is reprinted with every stats update.
+func (s *StatsManager) ShowConnections(ctx context.Context, follow bool) bool {
+	address := fmt.Sprintf("127.0.0.1:%d", s.statsPort)
+	conn, err := dialStats(address)
+	if err != nil {
+		Errorf("ferret stats (%s) cannot be reached: %v", address, err)
+		return false
+	}
+	go func() {
+		<-ctx.Done()
+		_ = conn.Close()
+	}()
+
+	previous := make(map[string]*ConnectionStats)
+	previousTime := time.Time{}
+	err = readFrames(conn, func(frame *StatsFrame) bool {
+		ts := frame.Tunnels
+		now := time.Now()
+		current := make(map[string]*ConnectionStats)
+		if ts := Timestamp(); ts != "" {
+			fmt.Println(ts)
+		}
+		fmt.Printf("%-25s %-21s %-25s %-9s %-13s %-13s %-11s\n", "Tunnel", "Client", "Target", "Age", "Rcvd", "Sent", "Rate")
+		for _, t := range ts {
+			if !s.filter.matchesTunnel(t.Name) {
+				continue
+			}
+			sort.Slice(t.Active, func(i, j int) bool {
+				return t.Active[i].Started.Before(t.Active[j].Started)
+			})
+			for _, c := range t.Active {
+				key := fmt.Sprintf("%s/%d", t.Name, c.ID)
+				current[key] = c
+				age := now.Sub(c.Started)
+				var rate int64
+				if prev, ok := previous[key]; ok && now.After(previousTime) {
+					delta := (c.Received - prev.Received) + (c.Transmitted - prev.Transmitted)
+					rate = int64(float64(delta) / now.Sub(previousTime).Seconds())
+				} else if age > time.Second {
+					rate = int64(float64(c.Received+c.Transmitted) / age.Seconds())
+				}
+				_, _ = p.Printf(
+					"%-25s %-21s %-25s %-9s %-13d %-13d %-11d\n",
+					t.Name, c.Client, c.Target, age.Truncate(time.Second), c.Received, c.Transmitted, rate,
+				)
+			}
+		}
+		previous = current
+		previousTime = now
+		return follow
+	})
+	if err != nil && follow && ctx.Err() == nil {
+		Infof("ferret terminated or cannot be reached")
+	}
+	_ = conn.Close()
+	return true
+}
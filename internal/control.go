@@ -0,0 +1,187 @@
+package internal
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+type ControlRequest struct {
+	Command string   `json:"command"`
+	Args    []string `json:"args,omitempty"`
+}
+
+type ControlResponse struct {
+	OK     bool   `json:"ok"`
+	Output string `json:"output,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// controlHandler carries out a command for a tenant, or for the owner of ferret
+// when the tenant is nil
+type controlHandler func(tenant *Tenant, args []string) (string, error)
+
+var controlHandlers = map[string]controlHandler{
+	"reconnect": reconnectHosts,
+	"dump":      dumpState,
+	"env":       environment,
+	"stats":     statsSnapshot,
+	"url":       tunnelEndpoint,
+	"clone":     cloneTunnel,
+	"drop":      dropTunnel,
+	"export":    exportConfig,
+	"push":      pushConfig,
+	"handoff":   handOff,
+	"upgrade":   upgrade,
+	"banner":    showBanners,
+}
+
+// StartControl listens on a unix socket for commands from other ferret invocations,
+// such as `ferret reconnect`.  Each connection carries a single JSON request line
+// answered by a single JSON response line.
+func StartControl(ctx context.Context, path string) bool {
+	if _, err := os.Stat(path); err == nil {
+		if conn, err := net.DialTimeout("unix", path, time.Second); err == nil {
+			_ = conn.Close()
+			Warnf("control socket (%s) is in use by another ferret", path)
+			return false
+		}
+		// Left behind by a ferret that did not shut down cleanly
+		_ = os.Remove(path)
+	}
+	listener, err := listenControl(path)
+	if err != nil {
+		Warnf("control socket (%s) cannot be created, control commands unavailable: %v", path, err)
+		return false
+	}
+	if len(tenants) > 0 {
+		// Tenants connect as themselves, and are told apart by their credentials
+		_ = os.Chmod(path, 0666)
+	} else {
+		_ = os.Chmod(path, 0600)
+	}
+	controlSocket = path
+	controlContext = ctx
+	if verboseFlag {
+		Infof("control socket listening on %s", path)
+	}
+
+	go func() {
+		<-ctx.Done()
+		_ = listener.Close()
+	}()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveControl(conn)
+		}
+	}()
+	return true
+}
+
+func serveControl(conn net.Conn) {
+	defer func() {
+		_ = conn.Close()
+	}()
+	response := &ControlResponse{}
+	request := &ControlRequest{}
+	tenant, err := controlTenant(conn)
+	if err != nil {
+		response.Error = fmt.Sprintf("not permitted: %v", err)
+		bs, _ := json.Marshal(response)
+		_, _ = conn.Write(append(bs, '\n'))
+		return
+	}
+	line, err := bufio.NewReader(conn).ReadBytes('\n')
+	if err == nil {
+		err = json.Unmarshal(line, request)
+	}
+	if err != nil {
+		response.Error = fmt.Sprintf("invalid request: %v", err)
+	} else if handler, ok := controlHandlers[request.Command]; !ok {
+		response.Error = fmt.Sprintf("unknown command (%s)", request.Command)
+	} else if response.Output, err = handler(tenant, request.Args); err != nil {
+		response.Error = err.Error()
+	} else {
+		response.OK = true
+	}
+	bs, _ := json.Marshal(response)
+	_, _ = conn.Write(append(bs, '\n'))
+}
+
+// Control sends a command to the ferret listening on the control socket and returns its output
+func Control(path string, command string, args ...string) (string, error) {
+	conn, err := net.DialTimeout("unix", path, 5*time.Second)
+	if err != nil {
+		return "", fmt.Errorf("ferret is not running or cannot be reached: %w", err)
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+	bs, _ := json.Marshal(&ControlRequest{Command: command, Args: args})
+	if _, err = conn.Write(append(bs, '\n')); err != nil {
+		return "", err
+	}
+	line, err := bufio.NewReader(conn).ReadBytes('\n')
+	if err != nil {
+		return "", err
+	}
+	response := &ControlResponse{}
+	if err = json.Unmarshal(line, response); err != nil {
+		return "", err
+	}
+	if !response.OK {
+		return response.Output, errors.New(response.Error)
+	}
+	return response.Output, nil
+}
+
+func reconnectHosts(tenant *Tenant, args []string) (string, error) {
+	hosts, err := controlHosts(tenant, args)
+	if err != nil {
+		return "", err
+	}
+
+	sb := strings.Builder{}
+	for _, host := range hosts {
+		if host.Reconnect() {
+			sb.WriteString(fmt.Sprintf("host (%s) reconnected\n", host.Name))
+		} else {
+			sb.WriteString(fmt.Sprintf("host (%s) unreachable, retrying in the background\n", host.Name))
+		}
+	}
+	return sb.String(), nil
+}
+
+// controlHosts are the hosts named by a control command, or every host of the
+// tenant when none are
+func controlHosts(tenant *Tenant, args []string) ([]*Host, error) {
+	var hosts []*Host
+	if len(args) == 0 {
+		for _, host := range Hosts {
+			if tenant.owns(host.tenant) {
+				hosts = append(hosts, host)
+			}
+		}
+	}
+	for _, name := range args {
+		host, ok := Hosts[name]
+		if own, found := Hosts[tenant.qualify(name)]; found {
+			host, ok = own, true
+		}
+		if !ok || !tenant.owns(host.tenant) {
+			return nil, fmt.Errorf("host (%s) is not defined", name)
+		}
+		hosts = append(hosts, host)
+	}
+	return hosts, nil
+}
@@ -0,0 +1,9 @@
+//go:build !linux && !darwin
+
+package internal
+
+import "net"
+
+func listenControl(path string) (net.Listener, error) {
+	return net.Listen("unix", path)
+}
@@ -0,0 +1,16 @@
+//go:build linux || darwin
+
+package internal
+
+import (
+	"net"
+	"syscall"
+)
+
+// listenControl creates the control socket with no access for others from the
+// start, rather than under the umask until chmod narrows it
+func listenControl(path string) (net.Listener, error) {
+	mask := syscall.Umask(0177)
+	defer syscall.Umask(mask)
+	return net.Listen("unix", path)
+}
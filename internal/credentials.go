@@ -0,0 +1,202 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+const (
+	PasswordSourceNetrc   = "netrc"
+	PasswordSourceHelper  = "helper"
+	PasswordSourceWincred = "wincred"
+)
+
+const (
+	PassphraseSourceKeychain = "keychain"
+	PassphraseSourceWincred  = "wincred"
+)
+
+// KeychainItem names the generic password item of the macOS Keychain holding a
+// secret.  The service defaults to ferret and the account to the host name.
+type KeychainItem struct {
+	Service string `yaml:"service,omitempty" json:"service,omitempty"`
+	Account string `yaml:"account,omitempty" json:"account,omitempty"`
+}
+
+type netrcEntry struct {
+	machine  string
+	login    string
+	password string
+}
+
+// netrcPassword looks up the password for a machine in the user's netrc file
+// ($NETRC, ~/.netrc or ~/_netrc on windows).  An entry matching both machine
+// and login is preferred over one matching the machine alone, with the
+// default entry used as a last resort.
+func netrcPassword(machine string, login string) (string, string, error) {
+	file, err := netrcFile()
+	if err != nil {
+		return "", "", err
+	}
+	bs, err := os.ReadFile(file)
+	if err != nil {
+		return "", "", fmt.Errorf("netrc file (%s) cannot be read: %w", file, err)
+	}
+
+	var candidate *netrcEntry
+	var fallback *netrcEntry
+	for _, entry := range parseNetrc(bs) {
+		switch {
+		case entry.machine == machine && (login == "" || entry.login == login):
+			return entry.login, entry.password, nil
+		case entry.machine == machine && candidate == nil:
+			candidate = entry
+		case entry.machine == "" && fallback == nil:
+			fallback = entry
+		}
+	}
+	if candidate == nil {
+		candidate = fallback
+	}
+	if candidate == nil {
+		return "", "", fmt.Errorf("netrc file (%s) has no entry for machine %s", file, machine)
+	}
+	return candidate.login, candidate.password, nil
+}
+
+func netrcFile() (string, error) {
+	if file := os.Getenv("NETRC"); file != "" {
+		return file, nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("home directory cannot be determined: %w", err)
+	}
+	if runtime.GOOS == "windows" {
+		return filepath.Join(home, "_netrc"), nil
+	}
+	return filepath.Join(home, ".netrc"), nil
+}
+
+func parseNetrc(bs []byte) []*netrcEntry {
+	var entries []*netrcEntry
+	var entry *netrcEntry
+	scanner := bufio.NewScanner(bytes.NewReader(bs))
+	inMacro := false
+	for scanner.Scan() {
+		line := scanner.Text()
+		if inMacro {
+			// Macro definitions run until the next blank line
+			inMacro = strings.TrimSpace(line) != ""
+			continue
+		}
+		if strings.HasPrefix(strings.TrimSpace(line), "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		for i := 0; i < len(fields); i++ {
+			value := ""
+			if i+1 < len(fields) {
+				value = fields[i+1]
+			}
+			switch fields[i] {
+			case "machine":
+				entry = &netrcEntry{machine: value}
+				entries = append(entries, entry)
+				i++
+			case "default":
+				entry = &netrcEntry{}
+				entries = append(entries, entry)
+			case "login":
+				if entry != nil {
+					entry.login = value
+				}
+				i++
+			case "password":
+				if entry != nil {
+					entry.password = value
+				}
+				i++
+			case "account":
+				i++
+			case "macdef":
+				inMacro = true
+				i = len(fields)
+			}
+		}
+	}
+	return entries
+}
+
+// helperPassword asks a git-credential style helper for the password of a
+// host.  Helpers are named as in git: a bare name runs git-credential-<name>,
+// a path runs the program directly and a leading ! runs a shell command.
+func helperPassword(helper string, host string, username string) (string, string, error) {
+	var cmd *exec.Cmd
+	switch {
+	case strings.HasPrefix(helper, "!"):
+		cmd = shellCommand(context.Background(), helper[1:]+" get")
+	case filepath.IsAbs(helper):
+		cmd = exec.Command(helper, "get")
+	default:
+		cmd = exec.Command("git-credential-"+helper, "get")
+	}
+
+	request := fmt.Sprintf("protocol=ssh\nhost=%s\n", host)
+	if username != "" {
+		request += fmt.Sprintf("username=%s\n", username)
+	}
+	cmd.Stdin = strings.NewReader(request + "\n")
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", "", fmt.Errorf("credential helper (%s) failed: %w", helper, err)
+	}
+
+	password := ""
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		key, value, found := strings.Cut(scanner.Text(), "=")
+		if !found {
+			continue
+		}
+		switch key {
+		case "username":
+			username = value
+		case "password":
+			password = value
+		}
+	}
+	if password == "" {
+		return "", "", fmt.Errorf("credential helper (%s) returned no password for %s", helper, host)
+	}
+	return username, password, nil
+}
+
+// password reads a generic password from the macOS Keychain using the security
+// tool, which may ask the user to allow ferret access the first time.
+func (k *KeychainItem) password(host string) (string, error) {
+	if runtime.GOOS != "darwin" {
+		return "", fmt.Errorf("the keychain is only available on macOS")
+	}
+	service, account := "ferret", host
+	if k != nil && strings.TrimSpace(k.Service) != "" {
+		service = strings.TrimSpace(k.Service)
+	}
+	if k != nil && strings.TrimSpace(k.Account) != "" {
+		account = strings.TrimSpace(k.Account)
+	}
+	cmd := exec.Command("security", "find-generic-password", "-s", service, "-a", account, "-w")
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("keychain item (service %s, account %s) cannot be read: %w", service, account, err)
+	}
+	return strings.TrimRight(string(out), "\r\n"), nil
+}
@@ -0,0 +1,37 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/pprof"
+	"time"
+)
+
+// StartDebug serves the Go profiling endpoints (/debug/pprof/) on the loopback
+// interface only, so the forwarding path can be profiled in place, e.g.
+// go tool pprof http://127.0.0.1:<port>/debug/pprof/profile
+func StartDebug(ctx context.Context, port int) bool {
+	address := fmt.Sprintf("127.0.0.1:%d", port)
+	listener, err := listenTCP(address)
+	if err != nil {
+		Errorf("debug port %d cannot be opened: %v", port, err)
+		return false
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		<-ctx.Done()
+		_ = server.Close()
+	}()
+	go func() {
+		_ = server.Serve(listener)
+	}()
+	Warnf("profiling endpoints listening on http://%s/debug/pprof/", address)
+	return true
+}
@@ -0,0 +1,146 @@
+package internal
+
+import (
+	"context"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultDiagnosticsInterval = 10 * time.Second
+	defaultStallAfter          = 30 * time.Second
+)
+
+// DiagnosticsConfig enables periodic measurement of each host's round trip time,
+// through its SSH connection, and detection of stalled connections, i.e. ones
+// where the client has sent data that has gone unanswered for stall_after.
+type DiagnosticsConfig struct {
+	Interval   string `yaml:"interval" json:"interval"`
+	StallAfter string `yaml:"stall_after" json:"stall_after"`
+	interval   time.Duration
+	stallAfter time.Duration
+}
+
+// activity records when a connection last moved data in each direction, as
+// unix nanoseconds
+type activity struct {
+	lastReceived    atomic.Int64
+	lastTransmitted atomic.Int64
+}
+
+func (c *DiagnosticsConfig) Validate() bool {
+	valid := true
+	c.interval = defaultDiagnosticsInterval
+	if strings.TrimSpace(c.Interval) != "" {
+		d, err := time.ParseDuration(strings.TrimSpace(c.Interval))
+		if err != nil || d < time.Second {
+			Errorf("diagnostics interval (%s) is invalid.  Must be a duration of at least 1s", c.Interval)
+			valid = false
+		}
+		c.interval = d
+	}
+	c.stallAfter = defaultStallAfter
+	if strings.TrimSpace(c.StallAfter) != "" {
+		d, err := time.ParseDuration(strings.TrimSpace(c.StallAfter))
+		if err != nil || d < time.Second {
+			Errorf("diagnostics stall_after (%s) is invalid.  Must be a duration of at least 1s", c.StallAfter)
+			valid = false
+		}
+		c.stallAfter = d
+	}
+	return valid
+}
+
+// StartDiagnostics samples every host and tunnel each interval, publishing the
+// results in the tunnel stats, until the context is cancelled.
+func (c *DiagnosticsConfig) StartDiagnostics(ctx context.Context) {
+	if c == nil {
+		return
+	}
+	if verboseFlag {
+		Infof("diagnostics sampling every %v, stalls after %v", c.interval, c.stallAfter)
+	}
+	go func() {
+		ticker := time.NewTicker(c.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				c.sample()
+			}
+		}
+	}()
+}
+
+func (c *DiagnosticsConfig) sample() {
+	rtts := make(map[string]time.Duration)
+	replied := make(map[string]bool)
+	for name, host := range Hosts {
+		if !(host.isHost || host.isJumpHost) || !host.Connected() {
+			continue
+		}
+		rtt, err := host.roundTrip(c.interval)
+		rtts[name], replied[name] = rtt, err == nil
+	}
+
+	now := time.Now()
+	for _, t := range tunnelList() {
+		if t.stats == nil {
+			continue
+		}
+		_, sampled := rtts[t.Host]
+		stalled := t.stats.stalled(now, c.stallAfter)
+		t.stats.lock.Lock()
+		changed := t.stats.Stalled != stalled
+		t.stats.Stalled = stalled
+		t.stats.RTT = 0
+		if replied[t.Host] {
+			t.stats.RTT = max(rtts[t.Host].Milliseconds(), 1)
+		}
+		unanswered := sampled && !replied[t.Host]
+		suspect := stalled > 0 || unanswered
+		if suspect && !t.stats.Suspect {
+			if unanswered {
+				Warnf("tunnel (%s) is suspect: host (%s) did not reply within %v", t.Name, t.Host, c.interval)
+			} else {
+				Warnf("tunnel (%s) is suspect: %d connections stalled", t.Name, stalled)
+			}
+		}
+		changed = changed || t.stats.Suspect != suspect || sampled
+		recovered := t.stats.Suspect && !suspect
+		t.stats.Suspect = suspect
+		t.stats.lock.Unlock()
+		if suspect {
+			t.transition(StateDegraded)
+		} else if recovered {
+			t.transition(StateListening)
+		}
+		if changed && t.updateChan != nil {
+			t.updateChan <- struct{}{}
+		}
+	}
+}
+
+func (t *TunnelStats) suspect() bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.Suspect
+}
+
+// stalled counts the open connections whose client sent data that has gone
+// unanswered for longer than stallAfter
+func (t *TunnelStats) stalled(now time.Time, stallAfter time.Duration) int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	count := 0
+	for _, conn := range t.Active {
+		received := conn.activity.lastReceived.Load()
+		if received > conn.activity.lastTransmitted.Load() && now.Sub(time.Unix(0, received)) > stallAfter {
+			count++
+		}
+	}
+	return count
+}
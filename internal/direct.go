@@ -0,0 +1,42 @@
+package internal
+
+import (
+	"net"
+	"time"
+)
+
+// directDialTimeout bounds how long a direct tunnel waits to connect to its
+// forward address
+const directDialTimeout = 10 * time.Second
+
+// direct reports whether the tunnel connects to its forward addresses itself,
+// over plain TCP rather than through a host, as a tunnel without a host does
+func (t *Tunnel) direct() bool {
+	return t.Host == ""
+}
+
+func (t *Tunnel) validateDirect() bool {
+	valid := true
+	if t.tenant != "" {
+		Errorf("tunnel (%s) missing remote host, which the tunnels of tenants require", t.Name)
+		valid = false
+	}
+	if t.Protocol == ProtocolUDP {
+		Errorf("tunnel (%s) protocol (%s) requires a remote host", t.Name, t.Protocol)
+		valid = false
+	}
+	if valid && verboseFlag {
+		Infof("tunnel (%s) has no remote host, so connects to its forward address directly", t.Name)
+	}
+	return valid
+}
+
+// dialDirect connects to a forward address of a direct tunnel
+func (t *Tunnel) dialDirect(network string, address string) (net.Conn, bool) {
+	conn, err := net.DialTimeout(network, address, directDialTimeout)
+	if err != nil {
+		Errorf("tunnel (%s) failed to call forward address: %v", t.Name, err)
+		return nil, false
+	}
+	return conn, true
+}
@@ -0,0 +1,366 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DiscoverySourceConsul     = "consul"
+	DiscoverySourceKubernetes = "kubernetes"
+	DiscoverySourceCommand    = "command"
+
+	defaultDiscoveryInterval = time.Minute
+	defaultDiscoveryLocal    = "127.0.0.1:{port}"
+	defaultKubernetesCommand = "kubectl get services --all-namespaces -o json"
+	discoveryTimeout         = 30 * time.Second
+)
+
+// DiscoveryConfig creates tunnels for the services a remote source reports,
+// queried through a host and refreshed every interval.  The sources are the
+// Consul catalog at address, Kubernetes services listed by kubectl on the host,
+// or a command run on the host that prints a "name address:port" line for each
+// service.  Tunnels are named <name>-<service> and listen on the local template,
+// in which {port} is replaced by the service's port.
+type DiscoveryConfig struct {
+	Name     string `yaml:"name" json:"name"`
+	Host     string `yaml:"host" json:"host"`
+	Source   string `yaml:"source" json:"source"`
+	Address  string `yaml:"address,omitempty" json:"address,omitempty"`
+	Command  string `yaml:"command,omitempty" json:"command,omitempty"`
+	Match    string `yaml:"match,omitempty" json:"match,omitempty"`
+	Local    string `yaml:"local,omitempty" json:"local,omitempty"`
+	Interval string `yaml:"interval,omitempty" json:"interval,omitempty"`
+	interval time.Duration
+	lock     sync.Mutex
+	running  map[string]*discoveredTunnel
+}
+
+type discoveredTunnel struct {
+	tunnel  *Tunnel
+	forward string
+	cancel  context.CancelFunc
+}
+
+func (c *DiscoveryConfig) Validate() bool {
+	valid := true
+	c.Name = strings.TrimSpace(c.Name)
+	if c.Name == "" {
+		Errorf("discovery name cannot be blank")
+		valid = false
+	}
+	c.Host = strings.TrimSpace(c.Host)
+	if host, ok := Hosts[c.Host]; !ok {
+		Errorf("discovery (%s) host (%s) undefined", c.Name, c.Host)
+		valid = false
+	} else {
+		// Discovery runs its commands over the connection
+		host.isHost = true
+		host.keepOpen = true
+	}
+	c.Source = strings.ToLower(strings.TrimSpace(c.Source))
+	switch c.Source {
+	case DiscoverySourceConsul:
+		if _, _, err := net.SplitHostPort(strings.TrimSpace(c.Address)); err != nil {
+			Errorf("discovery (%s) consul requires an address (host:port): %v", c.Name, err)
+			valid = false
+		}
+	case DiscoverySourceKubernetes:
+		if strings.TrimSpace(c.Command) == "" {
+			c.Command = defaultKubernetesCommand
+		}
+	case DiscoverySourceCommand:
+		if strings.TrimSpace(c.Command) == "" {
+			Errorf("discovery (%s) source %s requires a command", c.Name, DiscoverySourceCommand)
+			valid = false
+		}
+	default:
+		Errorf(
+			"discovery (%s) source (%s) is invalid.  Must be %s, %s or %s",
+			c.Name, c.Source, DiscoverySourceConsul, DiscoverySourceKubernetes, DiscoverySourceCommand,
+		)
+		valid = false
+	}
+	c.Match = strings.TrimSpace(c.Match)
+	if c.Match == "" {
+		c.Match = "*"
+	}
+	if _, err := path.Match(c.Match, ""); err != nil {
+		Errorf("discovery (%s) match (%s) is invalid: %v", c.Name, c.Match, err)
+		valid = false
+	}
+	c.Local = strings.TrimSpace(c.Local)
+	if c.Local == "" {
+		c.Local = defaultDiscoveryLocal
+	}
+	if _, _, err := net.SplitHostPort(strings.ReplaceAll(c.Local, "{port}", "1")); err != nil {
+		Errorf("discovery (%s) local (%s) is invalid: %v", c.Name, c.Local, err)
+		valid = false
+	}
+	c.interval = defaultDiscoveryInterval
+	if strings.TrimSpace(c.Interval) != "" {
+		d, err := time.ParseDuration(strings.TrimSpace(c.Interval))
+		if err != nil || d < 5*time.Second {
+			Errorf("discovery (%s) interval (%s) is invalid.  Must be a duration of at least 5s", c.Name, c.Interval)
+			valid = false
+		}
+		c.interval = d
+	}
+	return valid
+}
+
+// StartDiscovery refreshes the discovered tunnels every interval until the
+// context is cancelled.
+func (c *DiscoveryConfig) StartDiscovery(ctx context.Context, stats *StatsManager) {
+	c.running = make(map[string]*discoveredTunnel)
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+	for {
+		c.refresh(ctx, stats)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (c *DiscoveryConfig) refresh(ctx context.Context, stats *StatsManager) {
+	host := Hosts[c.Host]
+	if !host.WaitOpen(hostWaitTimeout) {
+		Warnf("discovery (%s) host (%s) unreachable, keeping current tunnels", c.Name, c.Host)
+		return
+	}
+	var services map[string]string
+	var err error
+	switch c.Source {
+	case DiscoverySourceConsul:
+		services, err = c.consulServices(host)
+	case DiscoverySourceKubernetes:
+		services, err = c.kubernetesServices(host)
+	default:
+		services, err = c.commandServices(host)
+	}
+	if err != nil {
+		Warnf("discovery (%s) failed, keeping current tunnels: %v", c.Name, err)
+		return
+	}
+	for service := range services {
+		if matched, _ := path.Match(c.Match, service); !matched {
+			delete(services, service)
+		}
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for service, running := range c.running {
+		if forward, ok := services[service]; !ok || forward != running.forward {
+			c.stop(service, running, stats)
+		}
+	}
+	names := make([]string, 0, len(services))
+	for service := range services {
+		names = append(names, service)
+	}
+	sort.Strings(names)
+	for _, service := range names {
+		if _, ok := c.running[service]; !ok && ctx.Err() == nil {
+			c.start(ctx, service, services[service], stats)
+		}
+	}
+}
+
+func (c *DiscoveryConfig) start(ctx context.Context, service string, forward string, stats *StatsManager) {
+	_, port, _ := net.SplitHostPort(forward)
+	t := &Tunnel{
+		Name:    fmt.Sprintf("%s-%s", c.Name, service),
+		Local:   NewAddress(strings.ReplaceAll(c.Local, "{port}", port)),
+		Host:    c.Host,
+		Forward: NewAddress(forward),
+		OnError: OnErrorContinue,
+	}
+	tunnelsLock.Lock()
+	valid := t.Validate()
+	if !valid && Tunnels[t.Name] == t {
+		delete(Tunnels, t.Name)
+	}
+	tunnelsLock.Unlock()
+	if !valid {
+		Warnf("discovery (%s) service (%s) at %s SKIPPED: failed validation", c.Name, service, forward)
+		return
+	}
+	t.Init(stats.UpdateChannel())
+	if t.Listen() != nil {
+		c.remove(t, stats)
+		return
+	}
+	stats.AddTunnelStats(t.stats)
+	tunnelCtx, cancel := context.WithCancel(ctx)
+	c.running[service] = &discoveredTunnel{tunnel: t, forward: forward, cancel: cancel}
+	Infof("discovery (%s) added tunnel (%s) to %s", c.Name, t.Name, forward)
+	go t.Serve(tunnelCtx)
+}
+
+func (c *DiscoveryConfig) stop(service string, running *discoveredTunnel, stats *StatsManager) {
+	delete(c.running, service)
+	running.cancel()
+	// Free the entrance now, as a replacement may be about to take it
+	running.tunnel.closeListener()
+	Infof("discovery (%s) removed tunnel (%s)", c.Name, running.tunnel.Name)
+	go func() {
+		running.tunnel.shutdown(time.Now().Add(discoveryTimeout))
+		c.remove(running.tunnel, stats)
+	}()
+}
+
+func (c *DiscoveryConfig) remove(t *Tunnel, stats *StatsManager) {
+	tunnelsLock.Lock()
+	if Tunnels[t.Name] == t {
+		delete(Tunnels, t.Name)
+	}
+	tunnelsLock.Unlock()
+	stats.RemoveTunnelStats(t.stats)
+}
+
+// consulServices reads the Consul catalog, through the host, taking the first
+// instance of each service.
+func (c *DiscoveryConfig) consulServices(host *Host) (map[string]string, error) {
+	client := &http.Client{
+		Timeout: discoveryTimeout,
+		Transport: &http.Transport{
+			DialContext: func(context.Context, string, string) (net.Conn, error) {
+				if conn, ok := host.Dial(c.Address); ok {
+					return conn, nil
+				}
+				return nil, fmt.Errorf("consul (%s) cannot be reached", c.Address)
+			},
+		},
+	}
+	defer client.CloseIdleConnections()
+
+	var catalog map[string][]string
+	if err := consulGet(client, "/v1/catalog/services", &catalog); err != nil {
+		return nil, err
+	}
+	services := make(map[string]string)
+	for service := range catalog {
+		if matched, _ := path.Match(c.Match, service); !matched {
+			continue
+		}
+		var instances []struct {
+			Address        string
+			ServiceAddress string
+			ServicePort    int
+		}
+		if err := consulGet(client, "/v1/catalog/service/"+url.PathEscape(service), &instances); err != nil {
+			return nil, err
+		}
+		if len(instances) == 0 {
+			continue
+		}
+		address := instances[0].ServiceAddress
+		if address == "" {
+			address = instances[0].Address
+		}
+		services[service] = net.JoinHostPort(address, strconv.Itoa(instances[0].ServicePort))
+	}
+	return services, nil
+}
+
+func consulGet(client *http.Client, path string, v interface{}) error {
+	// The host name is never resolved, as the connection is made through the host
+	resp, err := client.Get("http://consul" + path)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("consul %s answered %s", path, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// kubernetesServices lists the services with a cluster IP, named
+// <service>.<namespace>, or <service>.<namespace>-<port name> when a service
+// has several ports.
+func (c *DiscoveryConfig) kubernetesServices(host *Host) (map[string]string, error) {
+	out, err := host.Run(c.Command)
+	if err != nil {
+		return nil, fmt.Errorf("%s failed: %w", c.Command, err)
+	}
+	var list struct {
+		Items []struct {
+			Metadata struct {
+				Name      string `json:"name"`
+				Namespace string `json:"namespace"`
+			} `json:"metadata"`
+			Spec struct {
+				ClusterIP string `json:"clusterIP"`
+				Ports     []struct {
+					Name string `json:"name"`
+					Port int    `json:"port"`
+				} `json:"ports"`
+			} `json:"spec"`
+		} `json:"items"`
+	}
+	if err = json.Unmarshal(out, &list); err != nil {
+		return nil, fmt.Errorf("%s output cannot be parsed: %w", c.Command, err)
+	}
+	services := make(map[string]string)
+	for _, item := range list.Items {
+		if item.Spec.ClusterIP == "" || item.Spec.ClusterIP == "None" {
+			continue
+		}
+		name := fmt.Sprintf("%s.%s", item.Metadata.Name, item.Metadata.Namespace)
+		for _, port := range item.Spec.Ports {
+			service := name
+			if len(item.Spec.Ports) > 1 {
+				suffix := port.Name
+				if suffix == "" {
+					suffix = strconv.Itoa(port.Port)
+				}
+				service = fmt.Sprintf("%s-%s", name, suffix)
+			}
+			services[service] = net.JoinHostPort(item.Spec.ClusterIP, strconv.Itoa(port.Port))
+		}
+	}
+	return services, nil
+}
+
+func (c *DiscoveryConfig) commandServices(host *Host) (map[string]string, error) {
+	out, err := host.Run(c.Command)
+	if err != nil {
+		return nil, fmt.Errorf("%s failed: %w", c.Command, err)
+	}
+	services := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s output line (%s) is not \"name address:port\"", c.Command, line)
+		}
+		if _, _, err = net.SplitHostPort(fields[1]); err != nil {
+			return nil, fmt.Errorf("%s output line (%s) is invalid: %w", c.Command, line, err)
+		}
+		services[fields[0]] = fields[1]
+	}
+	return services, nil
+}
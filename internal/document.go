@@ -0,0 +1,146 @@
+package internal
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ConfigDocument is a YAML configuration file held as a node tree rather than
+// decoded into a Configuration, so that tooling can change it and write it back
+// with the user's comments, key order and quoting intact.  Only blank lines are
+// not preserved.
+type ConfigDocument struct {
+	path string
+	mode os.FileMode
+	root yaml.Node
+}
+
+func LoadConfigDocument(path string) (*ConfigDocument, error) {
+	if !strings.HasSuffix(path, "yaml") && !strings.HasSuffix(path, "yml") {
+		return nil, fmt.Errorf("config file (%s) is not yaml", path)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	bs, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	d := &ConfigDocument{path: path, mode: fi.Mode().Perm()}
+	if err = yaml.Unmarshal(bs, &d.root); err != nil {
+		return nil, fmt.Errorf("config file (%s) cannot be parsed: %w", path, err)
+	}
+	if d.root.Kind == 0 {
+		d.root = yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{{Kind: yaml.MappingNode}}}
+	}
+	if d.root.Kind != yaml.DocumentNode || len(d.root.Content) != 1 || d.root.Content[0].Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("config file (%s) is not a yaml mapping", path)
+	}
+	return d, nil
+}
+
+// Set changes the value at a dotted path, e.g. tunnels.db.local, creating any
+// missing mapping keys along the way.  Sequence elements are addressed by their
+// name, or by their index.  The value is written as given, so is typed as any
+// YAML scalar would be, and a replaced value keeps its comments.
+func (d *ConfigDocument) Set(path string, value string) error {
+	keys := strings.Split(path, ".")
+	node := d.root.Content[0]
+	for i, key := range keys {
+		last := i == len(keys)-1
+		next, err := child(node, key, last)
+		if err != nil {
+			return fmt.Errorf("%s: %w", strings.Join(keys[:i+1], "."), err)
+		}
+		if last {
+			if next.Kind != yaml.ScalarNode && next.Kind != 0 {
+				return fmt.Errorf("%s is not a single value", path)
+			}
+			next.Kind, next.Tag, next.Value = yaml.ScalarNode, "", value
+			if next.Style != yaml.DoubleQuotedStyle && next.Style != yaml.SingleQuotedStyle {
+				next.Style = 0
+			}
+		}
+		node = next
+	}
+	return nil
+}
+
+// child finds key within a mapping, adding it when missing, or the named or
+// numbered element of a sequence.
+func child(node *yaml.Node, key string, last bool) (*yaml.Node, error) {
+	switch node.Kind {
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			if node.Content[i].Value == key {
+				return node.Content[i+1], nil
+			}
+		}
+		value := &yaml.Node{Kind: yaml.MappingNode}
+		if last {
+			value = &yaml.Node{Kind: yaml.ScalarNode}
+		}
+		node.Content = append(node.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: key}, value)
+		return value, nil
+	case yaml.SequenceNode:
+		for _, element := range node.Content {
+			if element.Kind != yaml.MappingNode {
+				continue
+			}
+			for i := 0; i+1 < len(element.Content); i += 2 {
+				if element.Content[i].Value == "name" && element.Content[i+1].Value == key {
+					return element, nil
+				}
+			}
+		}
+		if index, err := strconv.Atoi(key); err == nil && index >= 0 && index < len(node.Content) {
+			return node.Content[index], nil
+		}
+		return nil, fmt.Errorf("no element named %s", key)
+	}
+	return nil, fmt.Errorf("not a mapping or list")
+}
+
+// Save writes the document back in place, through a temporary file so that a
+// failure never leaves the configuration half written.
+func (d *ConfigDocument) Save() error {
+	buf := &bytes.Buffer{}
+	encoder := yaml.NewEncoder(buf)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(&d.root); err != nil {
+		return err
+	}
+	if err := encoder.Close(); err != nil {
+		return err
+	}
+	return writeConfigFile(d.path, d.mode, buf.Bytes())
+}
+
+// writeConfigFile replaces a configuration file through a temporary file, so
+// that a failure never leaves it half written
+func writeConfigFile(path string, mode os.FileMode, bs []byte) error {
+	temp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = os.Remove(temp.Name())
+	}()
+	if _, err = temp.Write(bs); err == nil {
+		err = temp.Chmod(mode)
+	}
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(temp.Name(), path)
+}
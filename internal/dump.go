@@ -0,0 +1,116 @@
+package internal
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime/pprof"
+	"sort"
+	"strings"
+	"time"
+)
+
+var dumpDirectory = os.TempDir()
+
+// SetDumpDirectory sets where WriteDump places its files
+func SetDumpDirectory(dir string) {
+	dumpDirectory = dir
+}
+
+// WriteDump records the state of every host, tunnel and active connection, as
+// well as the stack of every goroutine, to a new file without interrupting
+// ferret, and returns the path of that file.  Host locks are only ever tried,
+// so a host stuck holding its lock is reported rather than hanging the dump.
+func WriteDump() (string, error) {
+	now := time.Now()
+	path := filepath.Join(dumpDirectory, fmt.Sprintf("ferret-dump-%s.txt", now.Format("20060102-150405.000")))
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+
+	sb := &strings.Builder{}
+	fmt.Fprintf(sb, "ferret dump at %s, pid %d\n\nHosts:\n", now.Format(time.RFC3339), os.Getpid())
+	names := make([]string, 0, len(Hosts))
+	for name := range Hosts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(sb, "  %-25s %s\n", name, Hosts[name].dumpState())
+	}
+
+	sb.WriteString("\nTunnels:\n")
+	tunnels := tunnelList()
+	sort.Slice(tunnels, func(i, j int) bool {
+		return tunnels[i].Name < tunnels[j].Name
+	})
+	for _, t := range tunnels {
+		forward := t.Type
+		if addresses := t.forwardAddresses(); addresses != "" {
+			forward = addresses
+		}
+		via := "via " + t.Host
+		if t.direct() {
+			via = "direct"
+		}
+		fmt.Fprintf(sb, "  %-25s %-10s %s -> %s %s [%s]", t.Name, t.State(), t.Local.address, forward, via, t.id)
+		if t.stats == nil {
+			sb.WriteString("\n")
+			continue
+		}
+		t.stats.lock.Lock()
+		fmt.Fprintf(sb, ", %d active, %d total\n", t.stats.Connected, t.stats.Connections)
+		for _, c := range t.stats.Active {
+			fmt.Fprintf(
+				sb, "    id:%d client:%s age:%s rcvd:%d sent:%d\n",
+				c.ID, c.Client, now.Sub(c.Started).Truncate(time.Second), c.Received, c.Transmitted,
+			)
+		}
+		t.stats.lock.Unlock()
+	}
+
+	sb.WriteString("\nGoroutines:\n")
+	if _, err = file.WriteString(sb.String()); err != nil {
+		return "", err
+	}
+	if err = pprof.Lookup("goroutine").WriteTo(file, 2); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+func (h *Host) dumpState() string {
+	if !h.lock.TryLock() {
+		return "lock held (possibly stuck connecting or dialing)"
+	}
+	defer h.lock.Unlock()
+	state := "disconnected"
+	if h.client != nil {
+		state = "connected"
+	}
+	if h.retrying {
+		state += ", retrying"
+	}
+	if h.Address != nil {
+		state = fmt.Sprintf("%s %s", h.Address.address, state)
+	}
+	return state
+}
+
+func dumpState(tenant *Tenant, _ []string) (string, error) {
+	if tenant != nil {
+		return "", fmt.Errorf("dump is restricted to the owner of ferret")
+	}
+	path, err := WriteDump()
+	if err != nil {
+		return "", fmt.Errorf("dump cannot be written: %w", err)
+	}
+	return fmt.Sprintf("dump written to %s\n", path), nil
+}
@@ -0,0 +1,149 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var envLock sync.Mutex
+
+// envPrefix turns a tunnel name into an environment variable prefix, e.g. the
+// tunnel "db-primary" becomes FERRET_DB_PRIMARY.
+func envPrefix(name string) string {
+	prefix := strings.Map(func(r rune) rune {
+		if (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		if r >= 'a' && r <= 'z' {
+			return r - 'a' + 'A'
+		}
+		return '_'
+	}, name)
+	return "FERRET_" + prefix
+}
+
+// TunnelEnvironment lists the environment variables describing the entrance of
+// every listening tunnel: its address, host and port, and its url when the
+// tunnel has a url template.
+func TunnelEnvironment() []string {
+	return tenantEnvironment(nil)
+}
+
+// tunnelEntrance is the entrance of a listening tunnel, as written to env files
+// in JSON
+type tunnelEntrance struct {
+	Address string `json:"address"`
+	Host    string `json:"host,omitempty"`
+	Port    string `json:"port,omitempty"`
+	Path    string `json:"path,omitempty"`
+	URL     string `json:"url,omitempty"`
+}
+
+// tenantEntrances returns the entrances of the listening tunnels of a tenant by
+// tunnel name
+func tenantEntrances(tenant *Tenant) map[string]*tunnelEntrance {
+	entrances := make(map[string]*tunnelEntrance)
+	for _, t := range tunnelList() {
+		if !tenant.owns(t.tenant) {
+			continue
+		}
+		address := t.Entrance()
+		if address == "" {
+			continue
+		}
+		if t.Local.IsUnix() || t.Local.IsPipe() {
+			entrances[t.Name] = &tunnelEntrance{Address: address, Path: address}
+			continue
+		}
+		host, port, err := net.SplitHostPort(address)
+		if err != nil {
+			continue
+		}
+		entrance := &tunnelEntrance{Address: address, Host: host, Port: port}
+		if t.URL != "" {
+			entrance.URL = t.endpoint()
+		}
+		entrances[t.Name] = entrance
+	}
+	return entrances
+}
+
+// tenantEnvironment lists the environment variables of the tunnels of a tenant
+func tenantEnvironment(tenant *Tenant) []string {
+	var env []string
+	for name, entrance := range tenantEntrances(tenant) {
+		prefix := envPrefix(name)
+		env = append(env, fmt.Sprintf("%s_ADDR=%s", prefix, entrance.Address))
+		if entrance.Path != "" {
+			env = append(env, fmt.Sprintf("%s_PATH=%s", prefix, entrance.Path))
+			continue
+		}
+		env = append(env,
+			fmt.Sprintf("%s_HOST=%s", prefix, entrance.Host),
+			fmt.Sprintf("%s_PORT=%s", prefix, entrance.Port),
+		)
+		if entrance.URL != "" {
+			env = append(env, fmt.Sprintf("%s_URL=%s", prefix, entrance.URL))
+		}
+	}
+	sort.Strings(env)
+	return env
+}
+
+// formatEnvironment renders variables for a shell (export NAME='value') or, for
+// env files, as plain NAME=value lines.
+func formatEnvironment(env []string, shell bool) string {
+	sb := strings.Builder{}
+	for _, variable := range env {
+		if shell {
+			name, value, _ := strings.Cut(variable, "=")
+			sb.WriteString(fmt.Sprintf("export %s='%s'\n", name, strings.ReplaceAll(value, "'", `'\''`)))
+		} else {
+			sb.WriteString(variable + "\n")
+		}
+	}
+	return sb.String()
+}
+
+// EmitEnv keeps the file at path up to date with the environment of the
+// listening tunnels, rewriting it as each tunnel opens or closes.  Files named
+// .envrc or *.sh are written as shell exports, *.json as an object of the
+// entrances by tunnel name, any other as an env file.
+func EmitEnv(path string) {
+	base := filepath.Base(path)
+	shell := base == ".envrc" || strings.HasSuffix(base, ".sh")
+	write := func() {
+		envLock.Lock()
+		defer envLock.Unlock()
+		var content []byte
+		if strings.HasSuffix(base, ".json") {
+			content, _ = json.MarshalIndent(tenantEntrances(nil), "", "  ")
+		} else {
+			content = []byte(formatEnvironment(TunnelEnvironment(), shell))
+		}
+		// Written whole then renamed, readers never see it half written
+		temp := path + ".tmp"
+		err := os.WriteFile(temp, content, 0600)
+		if err == nil {
+			err = os.Rename(temp, path)
+		}
+		if err != nil {
+			Warnf("environment file (%s) cannot be written: %v", path, err)
+		}
+	}
+	addEventSink(func(event *Event) {
+		if event.Type == EventTunnelOpen || event.Type == EventTunnelClose {
+			write()
+		}
+	})
+}
+
+func environment(tenant *Tenant, _ []string) (string, error) {
+	return formatEnvironment(tenantEnvironment(tenant), true), nil
+}
@@ -0,0 +1,71 @@
+package internal
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+)
+
+// Event types
+const (
+	EventConnect        = "connect"
+	EventDisconnect     = "disconnect"
+	EventError          = "error"
+	EventDenied         = "denied"
+	EventTunnelOpen     = "tunnel_open"
+	EventTunnelClose    = "tunnel_close"
+	EventTunnelState    = "tunnel_state"
+	EventHostConnect    = "host_connect"
+	EventHostDisconnect = "host_disconnect"
+	EventHostBanner     = "host_banner"
+)
+
+// Event records something that happened to a tunnel, connection or host
+type Event struct {
+	Time        time.Time `json:"time"`
+	Type        string    `json:"type"`
+	Tunnel      string    `json:"tunnel,omitempty"`
+	TunnelID    string    `json:"tunnel_id,omitempty"`
+	Host        string    `json:"host,omitempty"`
+	ID          int32     `json:"id,omitempty"`
+	Client      string    `json:"client,omitempty"`
+	Received    int64     `json:"received,omitempty"`
+	Transmitted int64     `json:"transmitted,omitempty"`
+	Message     string    `json:"message,omitempty"`
+}
+
+var (
+	eventLock  sync.Mutex
+	eventSinks []func(event *Event)
+)
+
+func addEventSink(sink func(event *Event)) {
+	eventLock.Lock()
+	defer eventLock.Unlock()
+	eventSinks = append(eventSinks, sink)
+}
+
+func emit(event *Event) {
+	event.Time = time.Now()
+	eventLock.Lock()
+	defer eventLock.Unlock()
+	for _, sink := range eventSinks {
+		sink(event)
+	}
+}
+
+// EventsToStdout writes every event to stdout as a line of JSON, for wrapper
+// scripts to follow.  Stdout then carries only events, so all messages go to
+// stderr.
+func EventsToStdout() {
+	events := os.Stdout
+	os.Stdout = os.Stderr
+	addEventSink(func(event *Event) {
+		bs, err := json.Marshal(event)
+		if err != nil {
+			return
+		}
+		_, _ = events.Write(append(bs, '\n'))
+	})
+}
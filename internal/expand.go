@@ -0,0 +1,122 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+
+	"gopkg.in/yaml.v3"
+)
+
+// environmentReference matches ${VAR} and ${VAR:-default}, and $${ which escapes
+// a literal ${
+var environmentReference = regexp.MustCompile(`\$\$\{|\$\{([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?\}`)
+
+// expandEnvironment replaces the environment variable references in a config
+// value.  A variable that is not set, and has no default, is an error rather
+// than silently becoming blank.
+func expandEnvironment(value string) (string, error) {
+	var err error
+	expanded := environmentReference.ReplaceAllStringFunc(value, func(reference string) string {
+		if reference == "$${" {
+			return "${"
+		}
+		match := environmentReference.FindStringSubmatch(reference)
+		if variable, ok := os.LookupEnv(match[1]); ok {
+			return variable
+		}
+		if match[2] != "" {
+			return match[3]
+		}
+		if err == nil {
+			err = fmt.Errorf("environment variable (%s) is not set", match[1])
+		}
+		return ""
+	})
+	return expanded, err
+}
+
+// unmarshalExpandedYAML decodes a YAML config with the environment variable
+// references of its values expanded.  Keys and comments are left alone, and a
+// plain value is typed by what it expands to, so port: ${PORT} is a number.
+func unmarshalExpandedYAML(bs []byte, v interface{}) error {
+	root := &yaml.Node{}
+	if err := yaml.Unmarshal(bs, root); err != nil {
+		return err
+	}
+	if err := expandNode(root); err != nil {
+		return err
+	}
+	if root.Kind == 0 {
+		return nil
+	}
+	return root.Decode(v)
+}
+
+func expandNode(node *yaml.Node) error {
+	switch node.Kind {
+	case yaml.ScalarNode:
+		expanded, err := expandEnvironment(node.Value)
+		if err != nil {
+			return fmt.Errorf("line %d: %w", node.Line, err)
+		}
+		if expanded != node.Value {
+			node.Value = expanded
+			if node.Style == 0 {
+				node.Tag = ""
+			}
+		}
+	case yaml.MappingNode:
+		for i := 1; i < len(node.Content); i += 2 {
+			if err := expandNode(node.Content[i]); err != nil {
+				return err
+			}
+		}
+	default:
+		for _, child := range node.Content {
+			if err := expandNode(child); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// unmarshalExpandedJSON decodes a JSON config with the environment variable
+// references of its string values expanded
+func unmarshalExpandedJSON(bs []byte, v interface{}) error {
+	var document interface{}
+	if err := json.Unmarshal(bs, &document); err != nil {
+		return err
+	}
+	document, err := expandValue(document)
+	if err != nil {
+		return err
+	}
+	if bs, err = json.Marshal(document); err != nil {
+		return err
+	}
+	return json.Unmarshal(bs, v)
+}
+
+func expandValue(value interface{}) (interface{}, error) {
+	var err error
+	switch value := value.(type) {
+	case string:
+		return expandEnvironment(value)
+	case map[string]interface{}:
+		for key, child := range value {
+			if value[key], err = expandValue(child); err != nil {
+				return nil, err
+			}
+		}
+	case []interface{}:
+		for i, child := range value {
+			if value[i], err = expandValue(child); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return value, nil
+}
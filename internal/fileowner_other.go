@@ -0,0 +1,16 @@
+//go:build !windows
+
+package internal
+
+import (
+	"os"
+	"syscall"
+)
+
+// fileOwner returns the user id of the owner of a file
+func fileOwner(fi os.FileInfo) (int, bool) {
+	if stat, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return int(stat.Uid), true
+	}
+	return 0, false
+}
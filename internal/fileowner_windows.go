@@ -0,0 +1,10 @@
+package internal
+
+import (
+	"os"
+)
+
+// fileOwner is not available on windows, where files are owned by a SID
+func fileOwner(os.FileInfo) (int, bool) {
+	return 0, false
+}
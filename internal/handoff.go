@@ -0,0 +1,143 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// handoffTimeout is how long a ferret taking over waits for the ferret it takes
+// over from to stop
+const handoffTimeout = time.Minute
+
+var (
+	// takingOver has the entrances of this ferret opened alongside those of the
+	// ferret it is taking over from
+	takingOver  bool
+	handedOff   = make(chan struct{})
+	handoffOnce sync.Once
+)
+
+// listenTCP opens a TCP listener with SO_REUSEPORT, where supported, so that a
+// ferret taking over may open it too.  Unless taking over, the address is first
+// bound without, which fails should another ferret hold it, as sharing is only
+// meant for a handoff.  The SO_REUSEADDR Go always sets lets an address be
+// bound again at once despite the connections it leaves in TIME_WAIT.
+func listenTCP(address string) (net.Listener, error) {
+	if l, ok, err := inheritedListener("tcp", address); ok {
+		return l, err
+	}
+	if !handoffSupported {
+		return net.Listen("tcp", address)
+	}
+	if _, port, _ := net.SplitHostPort(address); !takingOver && port != "0" {
+		probe, err := net.Listen("tcp", address)
+		if err != nil {
+			return nil, err
+		}
+		_ = probe.Close()
+	}
+	lc := &net.ListenConfig{Control: reusePort}
+	return lc.Listen(context.Background(), "tcp", address)
+}
+
+// BeginHandoff prepares to take over from the ferret listening on the control
+// socket, opening the entrances and stats port alongside its own.  Only TCP
+// entrances can be shared, unless handed down open by an upgrade.
+func BeginHandoff(controlPath string) bool {
+	if !handoffSupported {
+		Errorf("handoff is not supported on %s", runtime.GOOS)
+		return false
+	}
+	conn, err := net.DialTimeout("unix", controlPath, time.Second)
+	if err != nil {
+		Errorf("handoff requires a running ferret on the control socket (%s): %v", controlPath, err)
+		return false
+	}
+	_ = conn.Close()
+	inheritListeners()
+	valid := true
+	for _, t := range tunnelList() {
+		switch {
+		case t.Local.IsPipe():
+		case t.Protocol == ProtocolUDP && isInherited("udp", t.Local.address):
+			continue
+		case t.Local.IsUnix() && isInherited("unix", t.Local.address):
+			continue
+		case t.Local.IsUnix() || t.Protocol == ProtocolUDP:
+		default:
+			continue
+		}
+		Errorf("tunnel (%s) entrance (%s) cannot be shared for a handoff, only TCP entrances can, save those handed down by an upgrade", t.Name, t.Local)
+		valid = false
+	}
+	takingOver = valid
+	return valid
+}
+
+// CompleteHandoff asks the ferret being taken over from to stop accepting
+// connections, now that this ferret's entrances are open, and waits for it to
+// finish draining those it has open
+func CompleteHandoff(controlPath string) bool {
+	if _, err := Control(controlPath, "handoff"); err != nil {
+		Errorf("handoff refused: %v", err)
+		return false
+	}
+	closeInherited()
+	Infof("handoff accepted, waiting for the previous ferret to stop")
+	deadline := time.Now().Add(handoffTimeout)
+	for time.Now().Before(deadline) {
+		conn, err := net.DialTimeout("unix", controlPath, time.Second)
+		if err != nil {
+			return true
+		}
+		_ = conn.Close()
+		time.Sleep(100 * time.Millisecond)
+	}
+	Warnf("previous ferret has not stopped within %s", handoffTimeout)
+	return true
+}
+
+// HandedOff is closed once another ferret has taken over, when this ferret
+// should stop once its open connections drain
+func HandedOff() <-chan struct{} {
+	return handedOff
+}
+
+// handOff answers the handoff control command of a ferret taking over, closing
+// the entrances and stats port it has opened alongside, so that every new
+// connection goes to it
+func handOff(tenant *Tenant, _ []string) (string, error) {
+	if tenant != nil {
+		return "", errors.New("only the owner of ferret can hand off")
+	}
+	if !handoffSupported {
+		return "", fmt.Errorf("handoff is not supported on %s", runtime.GOOS)
+	}
+	accepted := false
+	handoffOnce.Do(func() {
+		accepted = true
+		for _, t := range tunnelList() {
+			t.connLock.Lock()
+			if l, ok := t.listener.(*net.UnixListener); ok {
+				// The socket lives on in the ferret it was handed down to
+				l.SetUnlinkOnClose(false)
+			}
+			t.connLock.Unlock()
+			t.closeListener()
+		}
+		if controlStats != nil && controlStats.statsListener != nil {
+			_ = controlStats.statsListener.Close()
+		}
+		Infof("handed off to a new ferret, stopping once open connections drain")
+		close(handedOff)
+	})
+	if !accepted {
+		return "", errors.New("already handed off")
+	}
+	return "", nil
+}
@@ -0,0 +1,59 @@
+package internal
+
+import "strings"
+
+var sparks = []rune("▁▂▃▄▅▆▇█")
+
+// RateHistory is a fixed size ring buffer of the most recent rate samples of a tunnel
+type RateHistory struct {
+	samples []int64
+	next    int
+	count   int
+}
+
+func NewRateHistory(size int) *RateHistory {
+	return &RateHistory{
+		samples: make([]int64, size),
+	}
+}
+
+func (h *RateHistory) Add(rate int64) {
+	if len(h.samples) == 0 {
+		return
+	}
+	h.samples[h.next] = rate
+	h.next = (h.next + 1) % len(h.samples)
+	if h.count < len(h.samples) {
+		h.count++
+	}
+}
+
+// Samples returns the recorded samples, oldest first
+func (h *RateHistory) Samples() []int64 {
+	samples := make([]int64, 0, h.count)
+	start := (h.next - h.count + len(h.samples)) % max(len(h.samples), 1)
+	for i := 0; i < h.count; i++ {
+		samples = append(samples, h.samples[(start+i)%len(h.samples)])
+	}
+	return samples
+}
+
+// Sparkline renders the samples scaled to the largest value in the buffer,
+// padded on the left so that all tunnels line up.
+func (h *RateHistory) Sparkline() string {
+	samples := h.Samples()
+	var peak int64
+	for _, sample := range samples {
+		peak = max(peak, sample)
+	}
+	sb := strings.Builder{}
+	sb.WriteString(strings.Repeat(" ", len(h.samples)-len(samples)))
+	for _, sample := range samples {
+		if peak == 0 {
+			sb.WriteRune(sparks[0])
+		} else {
+			sb.WriteRune(sparks[int(sample*int64(len(sparks)-1)/peak)])
+		}
+	}
+	return sb.String()
+}
@@ -1,16 +1,25 @@
 package internal
 
 import (
+	"errors"
 	"fmt"
 	"net"
+	"net/url"
 	"os"
 	"strings"
 	"sync"
+	"time"
 
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/crypto/ssh/knownhosts"
 )
 
+const (
+	reconnectMinDelay = time.Second
+	reconnectMaxDelay = time.Minute
+	hostWaitTimeout   = 30 * time.Second
+)
+
 var (
 	Hosts       = make(map[string]*Host)
 	identityMap = make(map[string]ssh.Signer)
@@ -22,45 +31,341 @@ var (
 )
 
 type Host struct {
-	Name       string   `yaml:"name" json:"name"`
-	Address    *Address `yaml:"address" json:"address"`
-	Username   string   `yaml:"username" json:"username"`
-	Identity   string   `yaml:"identity" json:"identity"`
-	Passphrase string   `yaml:"passphrase,omitempty" json:"passphrase,omitempty"`
-	KnownHosts string   `yaml:"known_hosts,omitempty" json:"known_hosts,omitempty"`
-	JumpHost   string   `yaml:"jump_host,omitempty" json:"jump_host,omitempty"`
-	isHost     bool
-	isJumpHost bool
-	lock       sync.Mutex
-	client     *ssh.Client
-	config     *ssh.ClientConfig
+	Name                string          `yaml:"name" json:"name"`
+	Address             *Address        `yaml:"address" json:"address"`
+	AddressCommand      string          `yaml:"address_command,omitempty" json:"address_command,omitempty"`
+	AddressCache        string          `yaml:"address_cache,omitempty" json:"address_cache,omitempty"`
+	Username            string          `yaml:"username" json:"username"`
+	Identity            Identities      `yaml:"identity" json:"identity"`
+	Passphrase          Secret          `yaml:"passphrase,omitempty" json:"passphrase,omitempty"`
+	PassphraseSource    string          `yaml:"passphrase_source,omitempty" json:"passphrase_source,omitempty"`
+	Keychain            *KeychainItem   `yaml:"keychain,omitempty" json:"keychain,omitempty"`
+	Credential          string          `yaml:"credential,omitempty" json:"credential,omitempty"`
+	Certificate         string          `yaml:"certificate,omitempty" json:"certificate,omitempty"`
+	Agent               bool            `yaml:"agent,omitempty" json:"agent,omitempty"`
+	KeyboardInteractive bool            `yaml:"keyboard_interactive,omitempty" json:"keyboard_interactive,omitempty"`
+	Answers             []*PromptAnswer `yaml:"answers,omitempty" json:"answers,omitempty"`
+	KnownHosts          string          `yaml:"known_hosts,omitempty" json:"known_hosts,omitempty"`
+	JumpHost            string          `yaml:"jump_host,omitempty" json:"jump_host,omitempty"`
+	ProxyCommand        string          `yaml:"proxy_command,omitempty" json:"proxy_command,omitempty"`
+	Proxy               SecretURL       `yaml:"proxy,omitempty" json:"proxy,omitempty"`
+	Websocket           string          `yaml:"websocket,omitempty" json:"websocket,omitempty"`
+	Relay               *RelayConfig    `yaml:"relay,omitempty" json:"relay,omitempty"`
+	Password            Secret          `yaml:"password,omitempty" json:"password,omitempty"`
+	PasswordSource      string          `yaml:"password_source,omitempty" json:"password_source,omitempty"`
+	CredentialHelper    string          `yaml:"credential_helper,omitempty" json:"credential_helper,omitempty"`
+	SourceAddress       string          `yaml:"source_address,omitempty" json:"source_address,omitempty"`
+	SourceCommand       string          `yaml:"source_command,omitempty" json:"source_command,omitempty"`
+	UDPCommand          string          `yaml:"udp_command,omitempty" json:"udp_command,omitempty"`
+	PKCS11              *PKCS11Config   `yaml:"pkcs11,omitempty" json:"pkcs11,omitempty"`
+	ForwardAgent        bool            `yaml:"forward_agent,omitempty" json:"forward_agent,omitempty"`
+	Prewarm             bool            `yaml:"prewarm,omitempty" json:"prewarm,omitempty"`
+	KeepaliveInterval   string          `yaml:"keepalive_interval,omitempty" json:"keepalive_interval,omitempty"`
+	KeepaliveMax        int             `yaml:"keepalive_max,omitempty" json:"keepalive_max,omitempty"`
+	valid               bool
+	isHost              bool
+	isJumpHost          bool
+	lock                sync.Mutex
+	client              hostClient
+	config              *ssh.ClientConfig
+	password            string
+	retrying            bool
+	ready               chan struct{}
+	wake                chan struct{}
+	stats               *HostStats
+	tenant              string
+	websocket           *url.URL
+	proxy               *url.URL
+	keepWarm            bool
+	keepOpen            bool
+	idleTimeout         time.Duration
+	keepaliveInterval   time.Duration
+	cloud               *cloudInstance
+	addressCache        time.Duration
+	resolvedAddress     string
+	resolvedAt          time.Time
+	bannerLock          sync.Mutex
+	banner              string
+	bannerAt            time.Time
+}
+
+// hostClient is the connection to a host, normally an SSH client though a relay
+// client for hosts reached through a ferret relay
+type hostClient interface {
+	Dial(network string, address string) (net.Conn, error)
+	SendRequest(name string, wantReply bool, payload []byte) (bool, []byte, error)
+	Wait() error
+	Close() error
 }
 
+// Open connects to the host, unless it is already connected or is reconnecting
+// in the background, which is left to finish in its own time.
 func (h *Host) Open() bool {
 	h.lock.Lock()
 	defer h.lock.Unlock()
 
 	if h.client == nil {
-		var err error
-		h.client, err = ssh.Dial("tcp", h.Address.address, h.config)
+		if h.retrying {
+			return false
+		}
+		client, err := h.dial()
 		if err != nil {
-			fmt.Printf("  Error - failed to connect to remote address: %v\n", err)
+			Errorf("host (%s) failed to connect to remote address: %v", h.Name, err)
+			emit(&Event{Type: EventError, Host: h.Name, Message: err.Error()})
+			h.retry()
 			return false
 		}
+		h.setClient(client)
 	}
 	return true
 }
 
+// WaitOpen connects to the host and, if it is unreachable, waits up to timeout
+// for the background reconnection to succeed.
+func (h *Host) WaitOpen(timeout time.Duration) bool {
+	if h.Open() {
+		return true
+	}
+	h.lock.Lock()
+	if h.client != nil {
+		// The background reconnection succeeded in the meantime
+		h.lock.Unlock()
+		return true
+	}
+	if h.ready == nil {
+		h.ready = make(chan struct{})
+	}
+	ready := h.ready
+	h.lock.Unlock()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-ready:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+// setClient installs a newly connected client, releasing anyone waiting on the
+// host, and forgets it again once the connection drops so that the next use
+// reconnects.  The host lock must be held.
+func (h *Host) setClient(client hostClient) {
+	emit(&Event{Type: EventHostConnect, Host: h.Name})
+	h.stats.connected()
+	h.client = client
+	h.forwardAgent(client)
+	if h.ready != nil {
+		close(h.ready)
+		h.ready = nil
+	}
+	if h.keepaliveInterval > 0 {
+		go h.keepAlive(client)
+	}
+	go func() {
+		_ = client.Wait()
+		h.lock.Lock()
+		defer h.lock.Unlock()
+		if h.client == client {
+			h.client = nil
+			h.stats.disconnected()
+			emit(&Event{Type: EventHostDisconnect, Host: h.Name})
+			if verboseFlag {
+				Infof("host (%s) connection closed", h.Name)
+			}
+			if h.keepWarm {
+				// Tunnels always active don't wait for their next connection
+				h.retry()
+			}
+		}
+	}()
+}
+
+// retry keeps reconnecting to the host in the background, backing off
+// exponentially, until it succeeds.  While the handshake is being intercepted
+// (captive portal, proxy) retries slow to the longest delay, rather than
+// hammering the portal, until the network changes.  The host lock must be held.
+func (h *Host) retry() {
+	if h.retrying {
+		return
+	}
+	h.retrying = true
+	h.wake = make(chan struct{}, 1)
+	go func() {
+		delay := reconnectMinDelay
+		intercepted := false
+		for {
+			timer := time.NewTimer(delay)
+			select {
+			case <-timer.C:
+			case <-h.wake:
+				timer.Stop()
+				delay = reconnectMinDelay
+			}
+			h.lock.Lock()
+			if h.client == nil {
+				client, err := h.dial()
+				if err == nil {
+					h.setClient(client)
+				} else if errors.Is(err, errInterceptedHandshake) {
+					if !intercepted {
+						Warnf("host (%s) handshake intercepted, retrying every %s until the network changes", h.Name, reconnectMaxDelay)
+					}
+					intercepted = true
+					delay = reconnectMaxDelay
+				} else {
+					intercepted = false
+					delay = min(delay*2, reconnectMaxDelay)
+					if verboseFlag {
+						Infof("host (%s) still unreachable, retrying in %s: %v", h.Name, delay, err)
+					}
+				}
+			}
+			connected := h.client != nil
+			if connected {
+				h.retrying = false
+			}
+			h.lock.Unlock()
+			if connected {
+				Infof("host (%s) connected", h.Name)
+				return
+			}
+		}
+	}()
+}
+
+// wakeRetry cuts short the wait of a host that is retrying in the background
+func (h *Host) wakeRetry() {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.retrying {
+		select {
+		case h.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (h *Host) Connected() bool {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.client != nil
+}
+
+// Check verifies the host connection is still alive with a keepalive request,
+// closing it when no reply arrives within the timeout.
+func (h *Host) Check(timeout time.Duration) bool {
+	h.lock.Lock()
+	client := h.client
+	h.lock.Unlock()
+	if client == nil {
+		return false
+	}
+
+	if _, err := h.roundTrip(timeout); err == nil {
+		return true
+	}
+	_ = client.Close()
+	return false
+}
+
+// roundTrip measures the time taken for the host to answer a keepalive
+// request over its SSH connection.
+func (h *Host) roundTrip(timeout time.Duration) (time.Duration, error) {
+	h.lock.Lock()
+	client := h.client
+	h.lock.Unlock()
+	if client == nil {
+		return 0, errors.New("not connected")
+	}
+	return sendKeepalive(client, timeout)
+}
+
+// sendKeepalive measures the time taken for the client to answer a keepalive
+// request, failing should no reply arrive within the timeout
+func sendKeepalive(client hostClient, timeout time.Duration) (time.Duration, error) {
+	start := time.Now()
+	result := make(chan error, 1)
+	go func() {
+		_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+		result <- err
+	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case err := <-result:
+		return time.Since(start), err
+	case <-timer.C:
+		return 0, fmt.Errorf("no reply within %v", timeout)
+	}
+}
+
+// Reconnect closes any existing connection to the host and opens a new one
+func (h *Host) Reconnect() bool {
+	h.lock.Lock()
+	if h.client != nil {
+		_ = h.client.Close()
+		h.client = nil
+		h.stats.disconnected()
+		emit(&Event{Type: EventHostDisconnect, Host: h.Name, Message: "reconnecting"})
+	}
+	h.lock.Unlock()
+	return h.Open()
+}
+
 func (h *Host) Dial(address string) (net.Conn, bool) {
+	return h.dialNetwork("tcp", address)
+}
+
+// DialUnix connects to a unix socket on the host, by way of OpenSSH's
+// direct-streamlocal channel
+func (h *Host) DialUnix(path string) (net.Conn, bool) {
+	return h.dialNetwork("unix", path)
+}
+
+func (h *Host) dialNetwork(network string, address string) (net.Conn, bool) {
 	h.lock.Lock()
 	defer h.lock.Unlock()
-	conn, err := h.client.Dial("tcp", address)
-	// TODO Redial (Open) as necessary
+	if h.client == nil {
+		Errorf("Host (%s) failed to call remote address: not connected", h.Name)
+		return nil, false
+	}
+	var conn net.Conn
+	var err error
+	if client, ok := h.client.(*ssh.Client); ok && h.SourceAddress != "" && network == "tcp" {
+		conn, err = h.dialFrom(client, address)
+	} else {
+		conn, err = h.client.Dial(network, address)
+	}
 	if err != nil {
-		fmt.Printf("  Error - Host (%s) failed to call remote address: %v\n", h.Name, err)
+		Errorf("Host (%s) failed to call remote address: %v", h.Name, err)
 		return nil, false
 	}
-	return conn, true
+	return h.stats.channel(conn, address), true
+}
+
+// Run runs a command on the host and returns its output
+func (h *Host) Run(command string) ([]byte, error) {
+	h.lock.Lock()
+	client := h.client
+	h.lock.Unlock()
+	if client == nil {
+		return nil, errors.New("not connected")
+	}
+	sshClient, ok := client.(*ssh.Client)
+	if !ok {
+		return nil, errors.New("commands cannot be run through a relay")
+	}
+	session, err := sshClient.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = session.Close()
+	}()
+	h.requestAgent(session)
+	return session.Output(command)
 }
 
 func (h *Host) Validate(defaultUsername string) bool {
@@ -68,35 +373,35 @@ func (h *Host) Validate(defaultUsername string) bool {
 
 	h.Name = strings.TrimSpace(h.Name)
 	if h.Name == "" {
-		fmt.Printf("  Error - host name cannot be blank\n")
+		Errorf("host name cannot be blank")
 		valid = false
 	}
 	if _, ok := Hosts[h.Name]; ok {
-		fmt.Printf("  Error - host name (%s) redfined\n", h.Name)
+		Errorf("host name (%s) redfined", h.Name)
 		valid = false
 	}
 
 	h.Username = strings.TrimSpace(h.Username)
 	if strings.TrimSpace(h.Username) == "" && verboseFlag {
-		fmt.Printf("  Info  - host (%s) will use default username: %s\n", h.Name, defaultUsername)
+		Infof("host (%s) will use default username: %s", h.Name, defaultUsername)
 		h.Username = defaultUsername
 	}
 
 	h.KnownHosts = strings.TrimSpace(h.KnownHosts)
 	if _, ok := hostKeysMap[h.KnownHosts]; !ok {
 		if fi, err := os.Stat(h.KnownHosts); os.IsNotExist(err) {
-			fmt.Printf("  Error - host (%s) known_hosts file (%s) cannot be read: file not found\n", h.Name, h.KnownHosts)
+			Errorf("host (%s) known_hosts file (%s) cannot be read: file not found", h.Name, h.KnownHosts)
 			valid = false
 		} else if fi.IsDir() {
-			fmt.Printf("  Error - host (%s) known_hosts file (%s) cannot be read: file is a directory\n", h.Name, h.KnownHosts)
+			Errorf("host (%s) known_hosts file (%s) cannot be read: file is a directory", h.Name, h.KnownHosts)
 			valid = false
 		} else {
 			var hostKeyCallback ssh.HostKeyCallback
 			if hostKeyCallback, err = knownhosts.New(h.KnownHosts); os.IsPermission(err) {
-				fmt.Printf("  Error - host (%s) known_hosts file (%s) cannot be read: permission denied\n", h.Name, h.KnownHosts)
+				Errorf("host (%s) known_hosts file (%s) cannot be read: permission denied", h.Name, h.KnownHosts)
 				valid = false
 			} else if err != nil {
-				fmt.Printf("  Error - host (%s) known_hosts file (%s) cannot be read: %v\n", h.Name, h.KnownHosts, err)
+				Errorf("host (%s) known_hosts file (%s) cannot be read: %v", h.Name, h.KnownHosts, err)
 				valid = false
 			} else {
 				hostKeysMap[h.KnownHosts] = hostKeyCallback
@@ -104,127 +409,341 @@ func (h *Host) Validate(defaultUsername string) bool {
 		}
 	}
 
-	h.Identity = strings.TrimSpace(h.Identity)
-	if h.Identity == "" {
-		fmt.Printf("  Error - host (%s) missing identity file\n", h.Name)
-		valid = false
-	}
-	if _, ok := identityMap[h.Identity]; !ok {
-		if fi, err := os.Stat(h.Identity); os.IsNotExist(err) {
-			fmt.Printf("  Error - host (%s) identity file (%s) cannot be read: file not found\n", h.Name, h.Identity)
+	h.PasswordSource = strings.TrimSpace(h.PasswordSource)
+	h.CredentialHelper = strings.TrimSpace(h.CredentialHelper)
+	h.Identity = h.Identity.trimmed()
+	if len(h.Identity) == 0 {
+		if h.PasswordSource == "" && h.Password == "" && !h.Agent && !h.KeyboardInteractive && h.Relay == nil && h.PKCS11 == nil {
+			Errorf("host (%s) missing identity file", h.Name)
 			valid = false
-		} else if fi.IsDir() {
-			fmt.Printf("  Error - host (%s) identity file (%s) cannot be read: file is a directory\n", h.Name, h.Identity)
-			valid = false
-		} else {
-			var key []byte
-			key, err = os.ReadFile(h.Identity)
-			if os.IsPermission(err) {
-				fmt.Printf("  Error - host (%s) identity file (%s) cannot be read: permission denied\n", h.Name, h.Identity)
-				valid = false
-			} else if err != nil {
-				fmt.Printf("  Error - host (%s) identity file (%s) cannot be read: %v\n", h.Name, h.Identity, err)
+		}
+	} else {
+		for _, identity := range h.Identity {
+			if !h.validateIdentity(identity) {
 				valid = false
-			} else {
-				var signer ssh.Signer
-				h.Passphrase = strings.TrimSpace(h.Passphrase)
-				if h.Passphrase != "" {
-					signer, err = ssh.ParsePrivateKeyWithPassphrase(key, []byte(h.Passphrase))
-				} else {
-					signer, err = ssh.ParsePrivateKey(key)
-				}
-				if err != nil {
-					fmt.Printf("  Error - host (%s) identity file (%s) cannot be decode: %v\n", h.Name, h.Identity, err)
-					valid = false
-				} else {
-					identityMap[h.Identity] = signer
-				}
 			}
 		}
 	}
-
-	if h.Address == nil || h.Address.IsBlank() {
-		fmt.Printf("  Error - host (%s) requires an address\n", h.Name)
+	// The identities are parsed, and cached, so the passphrase is not kept for
+	// exports and the control API to give away.  Go strings cannot be zeroed, so
+	// the configured passphrase is only dropped, for the collector to reclaim.
+	h.Passphrase = ""
+	h.Certificate = strings.TrimSpace(h.Certificate)
+	if h.Certificate != "" && !h.validateCertificate() {
+		valid = false
+	}
+	if h.Agent && len(h.Identity) == 0 {
+		if _, err := agentSigners(); err != nil {
+			Warnf("host (%s) ssh-agent cannot be reached yet: %v", h.Name, err)
+		}
+	}
+	if h.PKCS11 != nil && !h.PKCS11.Validate(h.Name) {
 		valid = false
-	} else if !h.Address.Validate("host", h.Name, "address", h.JumpHost != "", true) {
+	}
+	if h.ForwardAgent && h.Relay != nil {
+		Errorf("host (%s) forward_agent cannot be used with a relay", h.Name)
 		valid = false
+	} else if h.ForwardAgent && os.Getenv("SSH_AUTH_SOCK") == "" {
+		Warnf("host (%s) forward_agent has no agent to forward: SSH_AUTH_SOCK is not set", h.Name)
 	}
 
-	if h.JumpHost != "" {
-		if h.JumpHost == h.Name {
-			fmt.Printf("  Error - host (%s) jump_host cannot reference itself\n", h.Name)
+	h.Websocket = strings.TrimSpace(h.Websocket)
+	if !h.validateCloudAddress() {
+		valid = false
+	}
+	if !h.validateAddressCommand() {
+		valid = false
+	}
+	if !h.validateProxyCommand() {
+		valid = false
+	}
+	h.Proxy = SecretURL(strings.TrimSpace(string(h.Proxy)))
+	if !h.validateProxy() {
+		valid = false
+	}
+	if h.Websocket != "" && !h.validateWebsocket() {
+		valid = false
+	}
+	if h.Relay != nil {
+		if !h.Relay.Validate(h.Name) {
 			valid = false
-		} else {
-			h.KnownHosts = ""
+		} else if h.Websocket != "" || h.JumpHost != "" {
+			Errorf("host (%s) relay cannot be combined with a websocket or jump_host", h.Name)
+			valid = false
+		} else if h.Address == nil || h.Address.IsBlank() {
+			h.Address = NewAddress(h.Relay.Address)
 		}
 	}
+	switch {
+	case h.AddressCommand != "" || h.cloud != nil:
+		// The address is only known on connecting
+	case h.Address == nil || h.Address.IsBlank():
+		Errorf("host (%s) requires an address", h.Name)
+		valid = false
+	case !h.Address.Validate("host", h.Name, "address", h.JumpHost != "" || h.ProxyCommand != "" || h.Proxy != "", true):
+		valid = false
+	}
+
+	if !h.validatePassword() {
+		valid = false
+	}
+	if !h.validateSource() {
+		valid = false
+	}
+	if !h.validateUDP() {
+		valid = false
+	}
+	if !h.validateAnswers() {
+		valid = false
+	}
+	if !h.validateKeepalive() {
+		valid = false
+	}
+	if !policy.checkHost(h) {
+		valid = false
+	}
+
+	if h.JumpHost != "" && h.JumpHost == h.Name {
+		Errorf("host (%s) jump_host cannot reference itself", h.Name)
+		valid = false
+	}
+	var auth []ssh.AuthMethod
+	if len(h.Identity) > 0 || h.Agent || h.PKCS11 != nil {
+		auth = append(auth, ssh.PublicKeysCallback(h.signers))
+	}
+	if h.password != "" {
+		auth = append(auth, ssh.Password(h.password))
+	}
+	if h.KeyboardInteractive {
+		auth = append(auth, ssh.KeyboardInteractive(h.challenge))
+	}
 	h.config = &ssh.ClientConfig{
-		User: h.Username,
-		Auth: []ssh.AuthMethod{
-			ssh.PublicKeys(identityMap[h.Identity]),
-		},
+		User:            h.Username,
+		Auth:            auth,
 		HostKeyCallback: hostKeysMap[h.KnownHosts],
+		BannerCallback:  h.receiveBanner,
 	}
 
 	if verboseFlag && valid {
-		fmt.Printf("  Info - host (%s) validated\n", h.Name)
+		Infof("host (%s) validated", h.Name)
 	}
+	h.valid = valid
+	h.stats = newHostStats(h)
 	Hosts[h.Name] = h
 	return valid
 }
 
-func (h *Host) IsJumpHost() bool {
-	return h.isJumpHost
+func (h *Host) validateIdentity(identity string) bool {
+	if _, ok := identityMap[identity]; ok {
+		return true
+	}
+	if keyHolder != nil {
+		return h.keyHolderIdentity(identity)
+	}
+
+	var key []byte
+	var err error
+	if secretReference(identity) {
+		if key, err = resolveSecret(identity, "private_key"); err != nil {
+			Errorf("host (%s) identity cannot be read: %v", h.Name, err)
+			return false
+		}
+	} else if key = h.readIdentity(identity); key == nil {
+		return false
+	}
+
+	// Neither the key nor its passphrase is needed once parsed, so the bytes
+	// read are zeroed.  A passphrase configured as a string is only copied
+	// here, so the copy is zeroed and the string dropped once every identity
+	// is parsed.
+	defer clear(key)
+	signer, err := ssh.ParsePrivateKey(key)
+	var missing *ssh.PassphraseMissingError
+	if errors.As(err, &missing) {
+		passphrase, ok := h.passphrase()
+		if !ok {
+			return false
+		}
+		signer, err = ssh.ParsePrivateKeyWithPassphrase(key, passphrase)
+		clear(passphrase)
+	}
+	if err != nil {
+		Errorf("host (%s) identity file (%s) cannot be decode: %v", h.Name, identity, err)
+		return false
+	}
+	identityMap[identity] = signer
+	return true
 }
 
-func (h *Host) IsHost() bool {
-	return h.isHost
+func (h *Host) readIdentity(identity string) []byte {
+	if fi, err := os.Stat(identity); os.IsNotExist(err) {
+		Errorf("host (%s) identity file (%s) cannot be read: file not found", h.Name, identity)
+		return nil
+	} else if err == nil && fi.IsDir() {
+		Errorf("host (%s) identity file (%s) cannot be read: file is a directory", h.Name, identity)
+		return nil
+	}
+	key, err := os.ReadFile(identity)
+	if os.IsPermission(err) {
+		Errorf("host (%s) identity file (%s) cannot be read: permission denied", h.Name, identity)
+		return nil
+	} else if err != nil {
+		Errorf("host (%s) identity file (%s) cannot be read: %v", h.Name, identity, err)
+		return nil
+	}
+	if !checkPermissions(fmt.Sprintf("host (%s) identity file", h.Name), identity, h.tenant == "") {
+		return nil
+	}
+	return key
 }
 
-func freePort() (net.Listener, int32, bool) {
-	if address, err := net.ResolveTCPAddr("tcp", "localhost:0"); err == nil {
-		var listener net.Listener
-		listener, err = net.ListenTCP("tcp", address)
-		if err == nil {
-			return listener, int32(listener.Addr().(*net.TCPAddr).Port), true
+// passphrase returns the passphrase of the identity, either as configured, from
+// a secret provider or from the passphrase_source, to be cleared once used.
+// One configured is a copy of the string, which is left as it is.
+func (h *Host) passphrase() ([]byte, bool) {
+	h.Passphrase = Secret(strings.TrimSpace(string(h.Passphrase)))
+	h.PassphraseSource = strings.TrimSpace(h.PassphraseSource)
+	if h.PassphraseSource == "" && secretReference(string(h.Passphrase)) {
+		passphrase, err := resolveSecret(string(h.Passphrase), "passphrase")
+		if err != nil {
+			Errorf("host (%s) passphrase cannot be read: %v", h.Name, err)
+			return nil, false
+		}
+		return passphrase, true
+	}
+	if h.PassphraseSource == "" {
+		return []byte(h.Passphrase), true
+	}
+	if h.Passphrase != "" {
+		Warnf("host (%s) passphrase is ignored with passphrase_source: %s", h.Name, h.PassphraseSource)
+	}
+
+	var passphrase string
+	var err error
+	switch h.PassphraseSource {
+	case PassphraseSourceKeychain:
+		passphrase, err = h.Keychain.password(h.Name)
+	case PassphraseSourceWincred:
+		_, passphrase, err = wincredSecret(h.credential())
+	default:
+		Errorf(
+			"host (%s) passphrase_source (%s) is invalid.  Must be %s or %s",
+			h.Name, h.PassphraseSource, PassphraseSourceKeychain, PassphraseSourceWincred,
+		)
+		return nil, false
+	}
+	if err != nil {
+		Errorf("host (%s) passphrase cannot be read: %v", h.Name, err)
+		return nil, false
+	}
+	return []byte(passphrase), true
+}
+
+// credential names the Windows Credential Manager entry holding the secrets of
+// the host, by default ferret:<host name>
+func (h *Host) credential() string {
+	if credential := strings.TrimSpace(h.Credential); credential != "" {
+		return credential
+	}
+	return "ferret:" + h.Name
+}
+
+func (h *Host) validatePassword() bool {
+	h.Password = Secret(strings.TrimSpace(string(h.Password)))
+	if h.Password != "" {
+		if h.PasswordSource != "" {
+			Errorf("host (%s) cannot have both a password and a password_source", h.Name)
+			return false
+		}
+		if !secretReference(string(h.Password)) {
+			h.password = string(h.Password)
+			return true
+		}
+		password, err := resolveSecret(string(h.Password), "password")
+		if err != nil {
+			Errorf("host (%s) password cannot be read: %v", h.Name, err)
+			return false
+		}
+		h.password = string(password)
+		return true
+	}
+	if h.PasswordSource == "" {
+		if h.CredentialHelper != "" {
+			Warnf("host (%s) credential_helper is ignored without password_source: %s", h.Name, PasswordSourceHelper)
+		}
+		return true
+	}
+	if h.Address == nil || !h.Address.IsValid() {
+		// Already reported by the address validation
+		return false
+	}
+
+	var err error
+	var username string
+	switch h.PasswordSource {
+	case PasswordSourceNetrc:
+		username, h.password, err = netrcPassword(h.Address.Host(), h.Username)
+	case PasswordSourceHelper:
+		if h.CredentialHelper == "" {
+			Errorf("host (%s) password_source %s requires a credential_helper", h.Name, PasswordSourceHelper)
+			return false
 		}
-		_ = listener.Close()
+		username, h.password, err = helperPassword(h.CredentialHelper, h.Address.Host(), h.Username)
+	case PasswordSourceWincred:
+		username, h.password, err = wincredSecret(h.credential())
+	default:
+		Errorf(
+			"host (%s) password_source (%s) is invalid.  Must be %s, %s or %s",
+			h.Name, h.PasswordSource, PasswordSourceNetrc, PasswordSourceHelper, PasswordSourceWincred,
+		)
+		return false
+	}
+	if err != nil {
+		Errorf("host (%s) password cannot be read: %v", h.Name, err)
+		return false
 	}
-	return nil, -1, false
+	if h.Username == "" && username != "" {
+		h.Username = username
+	}
+	return true
+}
+
+func (h *Host) IsJumpHost() bool {
+	return h.isJumpHost
 }
 
+func (h *Host) IsHost() bool {
+	return h.isHost
+}
+
+// validateJumpHosts checks the jump host of each host with a jump_host, which may
+// itself have a jump_host, so a host may be any number of jumps away.  A jump
+// host is taken into use once a host in use jumps through it.
 func validateJumpHosts() bool {
 	valid := true
-	var freePortListeners []net.Listener
-	defer func() {
-		for _, listener := range freePortListeners {
-			_ = listener.Close()
-		}
-	}()
-	for _, h := range Hosts {
-		if h.JumpHost != "" && h.isHost {
+	linked := make(map[*Host]bool)
+	for pending := true; pending; {
+		pending = false
+		for _, h := range Hosts {
+			if h.JumpHost == "" || !(h.isHost || h.isJumpHost) || linked[h] {
+				continue
+			}
+			linked[h] = true
+			pending = true
 			if jumpHost, ok := Hosts[h.JumpHost]; !ok {
-				fmt.Printf("  Error - host (%s) jump_host (%s) is not defined\n", h.Name, h.JumpHost)
+				Errorf("host (%s) jump_host (%s) is not defined", h.Name, h.JumpHost)
+				h.valid = false
+				valid = false
+			} else if !jumpHost.valid {
+				Errorf("host (%s) jump_host (%s) is invalid", h.Name, h.JumpHost)
+				h.valid = false
 				valid = false
-			} else if jumpHost.JumpHost != "" {
-				fmt.Printf("  Error - host (%s) requires multi-host jumps and is not supported", h.Name)
+			} else if h.jumpLoop() {
+				Errorf("host (%s) jump_host (%s) leads back to a host already jumped through", h.Name, h.JumpHost)
+				h.valid = false
 				valid = false
 			} else {
-				listener, port, found := freePort()
-				if !found {
-					valid = false
-					break
-				} else {
-					jumpTunnel := &Tunnel{
-						Name:    fmt.Sprintf("%s jumphost", jumpHost.Name),
-						Local:   NewAddress(fmt.Sprintf("127.0.0.1:%d", port)),
-						Host:    h.JumpHost,
-						Forward: h.Address,
-					}
-					jumpTunnel.Validate()
-					h.Address = jumpTunnel.Local
-					freePortListeners = append(freePortListeners, listener)
-				}
+				jumpHost.isJumpHost = true
 			}
 		}
 	}
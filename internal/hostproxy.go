@@ -0,0 +1,227 @@
+package internal
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// validateProxy reads the proxy the SSH connection of the host is dialled
+// through, such as a corporate egress proxy or Tor: socks5://, resolving the
+// address of the host here, socks5h://, having the proxy resolve it, or an HTTP
+// proxy, http:// or https://, asked to CONNECT.  A user and password in the url
+// authenticate to the proxy.
+func (h *Host) validateProxy() bool {
+	if h.Proxy == "" {
+		return true
+	}
+	u, err := url.Parse(string(h.Proxy))
+	if err != nil {
+		Errorf("host (%s) proxy (%s) is invalid: %v", h.Name, h.Proxy, err)
+		return false
+	}
+	valid := true
+	switch u.Scheme {
+	case "socks5", "socks5h":
+		if u.Port() == "" {
+			u.Host = net.JoinHostPort(u.Hostname(), strconv.Itoa(defaultSOCKSPort))
+		}
+	case "http":
+		if u.Port() == "" {
+			u.Host = net.JoinHostPort(u.Hostname(), strconv.Itoa(defaultHTTPProxyPort))
+		}
+	case "https":
+		if u.Port() == "" {
+			u.Host = net.JoinHostPort(u.Hostname(), "443")
+		}
+	default:
+		Errorf("host (%s) proxy (%s) is invalid.  Must be a socks5://, socks5h://, http:// or https:// url", h.Name, h.Proxy)
+		return false
+	}
+	if u.Hostname() == "" {
+		Errorf("host (%s) proxy (%s) has no host", h.Name, h.Proxy)
+		valid = false
+	}
+	if h.JumpHost != "" || h.ProxyCommand != "" || h.Websocket != "" || h.Relay != nil {
+		Errorf("host (%s) proxy cannot be combined with a jump_host, proxy_command, websocket or relay", h.Name)
+		valid = false
+	}
+	h.proxy = u
+	return valid
+}
+
+// dialHostProxy connects to the address through the proxy
+func dialHostProxy(proxy *url.URL, address string, timeout time.Duration) (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", proxy.Host, timeout)
+	if err != nil {
+		return nil, fmt.Errorf("proxy (%s) cannot be reached: %v", proxy.Host, err)
+	}
+	_ = conn.SetDeadline(time.Now().Add(timeout))
+	if proxy.Scheme == "https" {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: proxy.Hostname()})
+		if err = tlsConn.Handshake(); err != nil {
+			_ = conn.Close()
+			return nil, fmt.Errorf("proxy (%s) TLS handshake failed: %v", proxy.Host, err)
+		}
+		conn = tlsConn
+	}
+	if proxy.Scheme == "http" || proxy.Scheme == "https" {
+		conn, err = httpConnect(conn, proxy, address)
+	} else {
+		err = socksDial(conn, proxy, address)
+	}
+	if err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("proxy (%s) refused %s: %v", proxy.Host, address, err)
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// httpConnect asks an HTTP proxy to CONNECT to the address, authenticating with
+// the user and password of its url as basic authentication, if it has them
+func httpConnect(conn net.Conn, proxy *url.URL, address string) (net.Conn, error) {
+	request := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		Header: make(http.Header),
+	}
+	if proxy.User != nil {
+		password, _ := proxy.User.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(proxy.User.Username() + ":" + password))
+		request.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+	if err := request.Write(conn); err != nil {
+		return conn, err
+	}
+	reader := bufio.NewReader(conn)
+	response, err := http.ReadResponse(reader, request)
+	if err != nil {
+		return conn, err
+	}
+	_ = response.Body.Close()
+	switch {
+	case response.StatusCode == http.StatusProxyAuthRequired && proxy.User == nil:
+		return conn, fmt.Errorf("%s, give a user and password in the proxy url", response.Status)
+	case response.StatusCode != http.StatusOK:
+		return conn, errors.New(response.Status)
+	case reader.Buffered() > 0:
+		// The server may well have sent its banner already
+		return &bufferedConn{Conn: conn, reader: reader}, nil
+	}
+	return conn, nil
+}
+
+// socksDial asks a SOCKS5 proxy to connect to the address, authenticating
+// with the user and password of its url (RFC 1929), if it has them
+func socksDial(conn net.Conn, proxy *url.URL, address string) error {
+	host, portText, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.Atoi(portText)
+	if err != nil {
+		return err
+	}
+	methods := []byte{socksNoAuthentication}
+	if proxy.User != nil {
+		methods = []byte{socksUsernamePassword}
+	}
+	if _, err = conn.Write(append([]byte{socksVersion, byte(len(methods))}, methods...)); err != nil {
+		return err
+	}
+	reply := make([]byte, 2)
+	if _, err = io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	switch {
+	case reply[0] != socksVersion:
+		return fmt.Errorf("unsupported SOCKS version %d", reply[0])
+	case reply[1] == socksUsernamePassword && proxy.User != nil:
+		if err = socksAuthenticate(conn, proxy.User); err != nil {
+			return err
+		}
+	case reply[1] != socksNoAuthentication:
+		return errors.New("no acceptable authentication method")
+	}
+
+	request := []byte{socksVersion, socksConnect, 0}
+	ip := net.ParseIP(host)
+	if ip == nil && proxy.Scheme == "socks5" {
+		ips, err := net.LookupIP(host)
+		if err != nil || len(ips) == 0 {
+			return fmt.Errorf("%s cannot be resolved", host)
+		}
+		ip = ips[0]
+	}
+	switch {
+	case ip.To4() != nil:
+		request = append(append(request, socksIPv4), ip.To4()...)
+	case ip != nil:
+		request = append(append(request, socksIPv6), ip.To16()...)
+	case len(host) > 255:
+		return fmt.Errorf("%s is too long a name", host)
+	default:
+		request = append(append(request, socksDomain, byte(len(host))), host...)
+	}
+	request = binary.BigEndian.AppendUint16(request, uint16(port))
+	if _, err = conn.Write(request); err != nil {
+		return err
+	}
+
+	header := make([]byte, 4)
+	if _, err = io.ReadFull(conn, header); err != nil {
+		return err
+	}
+	if header[1] != socksSucceeded {
+		return fmt.Errorf("SOCKS reply %d", header[1])
+	}
+	// The address bound by the proxy, which is of no use here
+	var skip int
+	switch header[3] {
+	case socksIPv4:
+		skip = net.IPv4len
+	case socksIPv6:
+		skip = net.IPv6len
+	case socksDomain:
+		length := make([]byte, 1)
+		if _, err = io.ReadFull(conn, length); err != nil {
+			return err
+		}
+		skip = int(length[0])
+	default:
+		return fmt.Errorf("unsupported SOCKS address type %d", header[3])
+	}
+	_, err = io.ReadFull(conn, make([]byte, skip+2))
+	return err
+}
+
+func socksAuthenticate(conn net.Conn, user *url.Userinfo) error {
+	password, _ := user.Password()
+	if len(user.Username()) > 255 || len(password) > 255 {
+		return errors.New("user or password is too long")
+	}
+	request := append([]byte{socksAuthVersion, byte(len(user.Username()))}, user.Username()...)
+	request = append(append(request, byte(len(password))), password...)
+	if _, err := conn.Write(request); err != nil {
+		return err
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[1] != socksSucceeded {
+		return errors.New("authentication failed")
+	}
+	return nil
+}
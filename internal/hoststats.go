@@ -0,0 +1,345 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// HostStats describes the SSH connection to a host, including jump hosts,
+// independently of the tunnels carried over it.  Byte counts are those of the
+// SSH connection itself, so include encryption and protocol overhead.  The
+// bytes of each channel over it are counted too, by the tunnel it was opened
+// for and, while open, by the connection it carries.
+type HostStats struct {
+	lock           sync.Mutex
+	Name           string                    `json:"name"`
+	Address        string                    `json:"address,omitempty"`
+	Via            string                    `json:"via,omitempty"`
+	Connected      bool                      `json:"connected"`
+	ConnectedSince *time.Time                `json:"connected_since,omitempty"`
+	Reconnects     int                       `json:"reconnects"`
+	Channels       int                       `json:"channels"`
+	Received       int64                     `json:"received"`
+	Transmitted    int64                     `json:"transmitted"`
+	Tunnels        map[string]*ChannelTotals `json:"tunnels,omitempty"`
+	Open           []*ChannelStats           `json:"open,omitempty"`
+	connects       int
+	tenant         string
+	lastActive     time.Time
+}
+
+// ChannelTotals are the bytes carried by the channels of a tunnel over a host
+// connection, and how many of them are open
+type ChannelTotals struct {
+	Channels    int   `json:"channels"`
+	Received    int64 `json:"received"`
+	Transmitted int64 `json:"transmitted"`
+}
+
+// ChannelStats describes a channel open over a host connection.  Tunnel and
+// Connection are those of the tunnel connection it carries, if any.
+type ChannelStats struct {
+	Tunnel      string    `json:"tunnel,omitempty"`
+	Connection  int32     `json:"connection,omitempty"`
+	Target      string    `json:"target,omitempty"`
+	Opened      time.Time `json:"opened"`
+	Received    int64     `json:"received"`
+	Transmitted int64     `json:"transmitted"`
+	totals      *ChannelTotals
+}
+
+// StatsFrame is a stats update, stamped with when and by which ferret it was
+// taken.  A delta update holds only the tunnels and hosts that changed, and
+// the ids of the tunnels removed, since the previous update.
+type StatsFrame struct {
+	Time     time.Time      `json:"time"`
+	Instance *StatsInstance `json:"instance,omitempty"`
+	Delta    bool           `json:"delta,omitempty"`
+	Tunnels  []*TunnelStats `json:"tunnels"`
+	Hosts    []*HostStats   `json:"hosts,omitempty"`
+	Removed  []string       `json:"removed,omitempty"`
+}
+
+// StatsInstance identifies the ferret a stats update came from
+type StatsInstance struct {
+	Name    string    `json:"name"`
+	Host    string    `json:"host"`
+	PID     int       `json:"pid"`
+	Started time.Time `json:"started"`
+}
+
+func newHostStats(h *Host) *HostStats {
+	stats := &HostStats{Name: statsConfig.label(h.Name), tenant: h.tenant}
+	if !statsConfig.redacted(StatsFieldHost) {
+		if h.Address != nil {
+			stats.Address = statsConfig.label(h.Address.address)
+		}
+		if h.JumpHost != "" {
+			stats.Via = statsConfig.label(h.JumpHost)
+		}
+	}
+	return stats
+}
+
+func (s *HostStats) MarshalJSON() ([]byte, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	type hostStats HostStats
+	return json.Marshal((*hostStats)(s))
+}
+
+func (s *HostStats) connected() {
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	now := time.Now()
+	if s.connects > 0 {
+		s.Reconnects++
+	}
+	s.connects++
+	s.Connected = true
+	s.ConnectedSince = &now
+	s.Channels = 0
+	s.lastActive = now
+}
+
+func (s *HostStats) disconnected() {
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.Connected = false
+	s.ConnectedSince = nil
+	s.Channels = 0
+}
+
+// channel wraps a channel opened over the host connection to the target so it
+// is counted while open, along with the bytes it carries
+func (s *HostStats) channel(conn net.Conn, target string) net.Conn {
+	if s == nil {
+		return conn
+	}
+	info := &ChannelStats{Opened: time.Now()}
+	if !statsConfig.redacted(StatsFieldForward) {
+		info.Target = statsConfig.label(target)
+	}
+	s.lock.Lock()
+	s.Channels++
+	s.Open = append(s.Open, info)
+	s.lastActive = time.Now()
+	s.lock.Unlock()
+	return &hostChannel{Conn: conn, stats: s, info: info}
+}
+
+// labelChannel attributes a channel opened over a host connection to the tunnel
+// connection it carries
+func labelChannel(conn net.Conn, tunnel string, connection int32) {
+	c, ok := conn.(*hostChannel)
+	if !ok {
+		return
+	}
+	c.stats.lock.Lock()
+	defer c.stats.lock.Unlock()
+	if c.stats.Tunnels == nil {
+		c.stats.Tunnels = make(map[string]*ChannelTotals)
+	}
+	totals, ok := c.stats.Tunnels[tunnel]
+	if !ok {
+		totals = &ChannelTotals{}
+		c.stats.Tunnels[tunnel] = totals
+	}
+	totals.Channels++
+	totals.Received += c.info.Received
+	totals.Transmitted += c.info.Transmitted
+	c.info.Tunnel, c.info.Connection, c.info.totals = tunnel, connection, totals
+}
+
+// idle reports how long the connection has carried no channel, if it is
+// connected and carrying none
+func (s *HostStats) idle() (time.Duration, bool) {
+	if s == nil {
+		return 0, false
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if !s.Connected || s.Channels > 0 {
+		return 0, false
+	}
+	return time.Since(s.lastActive), true
+}
+
+// count wraps the network connection beneath an SSH connection to total the
+// bytes it carries
+func (s *HostStats) count(conn net.Conn) net.Conn {
+	if s == nil {
+		return conn
+	}
+	return &countingConn{Conn: conn, stats: s}
+}
+
+type hostChannel struct {
+	net.Conn
+	stats *HostStats
+	info  *ChannelStats
+	once  sync.Once
+}
+
+func (c *hostChannel) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.stats.lock.Lock()
+		c.info.Received += int64(n)
+		if c.info.totals != nil {
+			c.info.totals.Received += int64(n)
+		}
+		c.stats.lock.Unlock()
+	}
+	return n, err
+}
+
+func (c *hostChannel) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		c.stats.lock.Lock()
+		c.info.Transmitted += int64(n)
+		if c.info.totals != nil {
+			c.info.totals.Transmitted += int64(n)
+		}
+		c.stats.lock.Unlock()
+	}
+	return n, err
+}
+
+// CloseWrite half closes the channel, so the far end sees the end of the input
+func (c *hostChannel) CloseWrite() error {
+	if closer, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return closer.CloseWrite()
+	}
+	return errors.New("half close is not supported")
+}
+
+func (c *hostChannel) Close() error {
+	c.once.Do(func() {
+		c.stats.lock.Lock()
+		if c.stats.Channels > 0 {
+			c.stats.Channels--
+		}
+		if c.info.totals != nil {
+			c.info.totals.Channels--
+		}
+		for i, info := range c.stats.Open {
+			if info == c.info {
+				c.stats.Open = append(c.stats.Open[:i], c.stats.Open[i+1:]...)
+				break
+			}
+		}
+		c.stats.lastActive = time.Now()
+		c.stats.lock.Unlock()
+	})
+	return c.Conn.Close()
+}
+
+type countingConn struct {
+	net.Conn
+	stats *HostStats
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.stats.lock.Lock()
+		c.stats.Received += int64(n)
+		c.stats.lock.Unlock()
+	}
+	return n, err
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		c.stats.lock.Lock()
+		c.stats.Transmitted += int64(n)
+		c.stats.lock.Unlock()
+	}
+	return n, err
+}
+
+func (h *Host) Stats() *HostStats {
+	return h.stats
+}
+
+func displayHosts(hs []*HostStats) {
+	if len(hs) == 0 {
+		return
+	}
+	sort.Slice(hs, func(i, j int) bool {
+		return hs[i].Name < hs[j].Name
+	})
+	fmt.Println()
+	fmt.Printf("%-35s %-13s %-13s %-13s %-10s %-8s\n", "Host", "Rcvd", "Sent", "Up", "Reconnect", "Chans")
+	now := time.Now()
+	for _, h := range hs {
+		up := "down"
+		if h.Connected && h.ConnectedSince != nil {
+			up = now.Sub(*h.ConnectedSince).Truncate(time.Second).String()
+		}
+		name := h.Name
+		if h.Via != "" {
+			name = fmt.Sprintf("%s (via %s)", h.Name, h.Via)
+		}
+		line := p.Sprintf("%-35s %-13d %-13d %-13s %-10d %-8d", name, h.Received, h.Transmitted, up, h.Reconnects, h.Channels)
+		if !h.Connected {
+			line = "\033[7m" + line + "\033[0m"
+		}
+		fmt.Println(line)
+		displayChannels(h)
+	}
+}
+
+// hostChannelsShown bounds the open channels listed under each tunnel of a host
+const hostChannelsShown = 3
+
+// displayChannels breaks the traffic of a host down by tunnel, busiest first,
+// each followed by its busiest open connections
+func displayChannels(h *HostStats) {
+	names := make([]string, 0, len(h.Tunnels))
+	for name := range h.Tunnels {
+		names = append(names, name)
+	}
+	total := func(name string) int64 {
+		return h.Tunnels[name].Received + h.Tunnels[name].Transmitted
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if total(names[i]) != total(names[j]) {
+			return total(names[i]) > total(names[j])
+		}
+		return names[i] < names[j]
+	})
+	sort.Slice(h.Open, func(i, j int) bool {
+		return h.Open[i].Received+h.Open[i].Transmitted > h.Open[j].Received+h.Open[j].Transmitted
+	})
+	for _, name := range names {
+		totals := h.Tunnels[name]
+		fmt.Println(p.Sprintf("  %-33s %-13d %-13d %-13s %-10s %-8d", name, totals.Received, totals.Transmitted, "", "", totals.Channels))
+		shown := 0
+		for _, c := range h.Open {
+			if c.Tunnel != name {
+				continue
+			}
+			if shown == hostChannelsShown {
+				fmt.Printf("      ... %d more\n", totals.Channels-shown)
+				break
+			}
+			fmt.Println(p.Sprintf("    %-31s %-13d %-13d %-13s", fmt.Sprintf("id:%d %s", c.Connection, c.Target), c.Received, c.Transmitted, time.Since(c.Opened).Truncate(time.Second)))
+			shown++
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package internal
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	TunnelTypeHTTPProxy = "http-proxy"
+
+	// defaultHTTPProxyPort is the customary port of an HTTP proxy
+	defaultHTTPProxyPort = 3128
+)
+
+// proxyOutcome is the result of dialling the destination a proxy client asked
+// for, which it is told of in the terms of its protocol
+type proxyOutcome int
+
+const (
+	proxySucceeded proxyOutcome = iota
+	proxyHostDown
+	proxyUnreachable
+	proxyNotAllowed
+)
+
+// proxied reports whether the clients of the tunnel name their own destination
+func (t *Tunnel) proxied() bool {
+	return t.Type == TunnelTypeSOCKS5 || t.Type == TunnelTypeHTTPProxy
+}
+
+// proxyTarget reads the destination a client of a SOCKS5 or HTTP proxy tunnel
+// asks for, returning the connection to carry on with in place of conn
+func (t *Tunnel) proxyTarget(conn net.Conn) (net.Conn, string, error) {
+	if t.Type == TunnelTypeHTTPProxy {
+		return t.httpProxyTarget(conn)
+	}
+	target, err := t.socksTarget(conn)
+	return conn, target, err
+}
+
+// proxyReply answers a proxy client once its destination has been dialled
+func (t *Tunnel) proxyReply(conn net.Conn, outcome proxyOutcome) {
+	if t.Type == TunnelTypeHTTPProxy {
+		switch outcome {
+		case proxySucceeded:
+			_, _ = io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+		case proxyHostDown:
+			httpProxyReply(conn, http.StatusServiceUnavailable)
+		case proxyNotAllowed:
+			httpProxyReply(conn, http.StatusForbidden)
+		default:
+			httpProxyReply(conn, http.StatusBadGateway)
+		}
+		return
+	}
+	switch outcome {
+	case proxySucceeded:
+		socksReply(conn, socksSucceeded)
+	case proxyHostDown:
+		socksReply(conn, socksGeneralFailure)
+	case proxyNotAllowed:
+		socksReply(conn, socksNotAllowed)
+	default:
+		socksReply(conn, socksHostUnreachable)
+	}
+}
+
+// httpProxyTarget reads the CONNECT request of an HTTP proxy client, refusing
+// any other method and destinations the policy does not allow
+func (t *Tunnel) httpProxyTarget(conn net.Conn) (net.Conn, string, error) {
+	_ = conn.SetReadDeadline(time.Now().Add(socksHandshakeTimeout))
+	defer func() {
+		_ = conn.SetReadDeadline(time.Time{})
+	}()
+
+	reader := bufio.NewReader(conn)
+	request, err := http.ReadRequest(reader)
+	if err != nil {
+		return nil, "", err
+	}
+	if request.Method != http.MethodConnect {
+		httpProxyReply(conn, http.StatusMethodNotAllowed)
+		return nil, "", fmt.Errorf("unsupported method %s, only CONNECT is proxied", request.Method)
+	}
+	target := request.Host
+	if _, _, err = net.SplitHostPort(target); err != nil {
+		httpProxyReply(conn, http.StatusBadRequest)
+		return nil, "", fmt.Errorf("destination (%s) is invalid: %v", target, err)
+	}
+	if policy != nil && len(policy.networks) > 0 {
+		host, _, _ := net.SplitHostPort(target)
+		if !policy.allowedDestination(host) {
+			httpProxyReply(conn, http.StatusForbidden)
+			return nil, "", fmt.Errorf("%s is not an allowed destination by policy", target)
+		}
+	}
+	if reader.Buffered() > 0 {
+		// The client began talking to the destination without waiting
+		conn = &bufferedConn{Conn: conn, reader: reader}
+	}
+	return conn, target, nil
+}
+
+func httpProxyReply(conn net.Conn, status int) {
+	text := http.StatusText(status)
+	reply := fmt.Sprintf("HTTP/1.1 %d %s\r\nContent-Length: %d\r\nConnection: close\r\n", status, text, len(text)+1)
+	if status == http.StatusMethodNotAllowed {
+		reply += "Allow: CONNECT\r\n"
+	}
+	_, _ = io.WriteString(conn, reply+"\r\n"+strings.ToLower(text)+"\n")
+}
+
+// bufferedConn reads what was buffered while reading a request before reading
+// any more of the connection
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
@@ -0,0 +1,276 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	TunnelTypeHTTP = "http"
+
+	// defaultHTTPPort is the local port of an http tunnel without one
+	defaultHTTPPort = 8080
+)
+
+// errHostDown fails the requests of an http tunnel whose host is not connected
+var errHostDown = errors.New("host unreachable")
+
+// HTTPRoute sends the requests of an http tunnel for a host, a path, or both, to
+// a forward address.  Of the routes a request matches, those naming its host
+// come first, then those with the longest path.  A route with neither is the
+// default.  strip_path removes the path of the route from the forwarded request.
+// The routes of an sni tunnel have no path, and match the server name a client
+// asks for in its TLS handshake.
+type HTTPRoute struct {
+	Host      string   `yaml:"host,omitempty" json:"host,omitempty"`
+	Path      string   `yaml:"path,omitempty" json:"path,omitempty"`
+	Forward   *Address `yaml:"forward" json:"forward"`
+	StripPath bool     `yaml:"strip_path,omitempty" json:"strip_path,omitempty"`
+}
+
+func (t *Tunnel) validateRoutes() bool {
+	valid := true
+	if len(t.Routes) == 0 {
+		Errorf("tunnel (%s) of type %s requires routes", t.Name, t.Type)
+		return false
+	}
+	for i, route := range t.Routes {
+		if route == nil {
+			Errorf("tunnel (%s) routes cannot contain a blank route", t.Name)
+			valid = false
+			continue
+		}
+		route.Host = strings.ToLower(strings.TrimSpace(route.Host))
+		route.Path = strings.TrimSpace(route.Path)
+		if route.Path != "" && !strings.HasPrefix(route.Path, "/") {
+			Errorf("tunnel (%s) route %d path (%s) is invalid.  Must begin with /", t.Name, i+1, route.Path)
+			valid = false
+		}
+		if route.Forward == nil || route.Forward.IsBlank() {
+			Errorf("tunnel (%s) route %d requires a forward address", t.Name, i+1)
+			valid = false
+		} else if !route.Forward.Validate("tunnel", t.Name, "route forward address", true, false) {
+			valid = false
+		} else if route.Forward.IsUnix() {
+			Errorf("tunnel (%s) route %d forward address (%s) cannot be a unix socket", t.Name, i+1, route.Forward)
+			valid = false
+		}
+	}
+	if valid && t.Type == TunnelTypeHTTP {
+		t.httpProxy = t.newHTTPProxy()
+	}
+	return valid
+}
+
+// routeTargets lists the forward addresses of the routes of the tunnel
+func (t *Tunnel) routeTargets() []*Address {
+	var targets []*Address
+	for _, route := range t.Routes {
+		if route != nil && route.Forward != nil {
+			targets = append(targets, route.Forward)
+		}
+	}
+	return targets
+}
+
+// route finds the route of a request, or nil when none matches
+func (t *Tunnel) route(r *http.Request) *HTTPRoute {
+	host := strings.ToLower(r.Host)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	var found *HTTPRoute
+	for _, route := range t.Routes {
+		if route.Host != "" && route.Host != host {
+			continue
+		}
+		if route.Path != "" && !pathHasPrefix(r.URL.Path, route.Path) {
+			continue
+		}
+		switch {
+		case found == nil:
+			found = route
+		case route.Host != "" && found.Host == "":
+			found = route
+		case (route.Host == "") == (found.Host == "") && len(route.Path) > len(found.Path):
+			found = route
+		}
+	}
+	return found
+}
+
+// pathHasPrefix reports whether the path is the prefix or lies beneath it
+func pathHasPrefix(path string, prefix string) bool {
+	if !strings.HasPrefix(path, prefix) {
+		return false
+	}
+	return len(path) == len(prefix) || strings.HasSuffix(prefix, "/") || path[len(prefix)] == '/'
+}
+
+// newHTTPProxy creates the reverse proxy of an http tunnel, forwarding each
+// request over the host of the tunnel to the forward address of its route
+func (t *Tunnel) newHTTPProxy() *httputil.ReverseProxy {
+	transport := &http.Transport{
+		DialContext: func(_ context.Context, _ string, address string) (net.Conn, error) {
+			rewritten, err := t.rewrite(address)
+			if err != nil {
+				return nil, err
+			}
+			var conn net.Conn
+			var ok bool
+			if t.direct() {
+				conn, ok = t.dialDirect("tcp", rewritten)
+			} else {
+				host := Hosts[t.Host]
+				if !host.WaitOpen(hostWaitTimeout) {
+					t.transition(StateDegraded)
+					return nil, errHostDown
+				}
+				conn, ok = host.Dial(rewritten)
+			}
+			if !ok {
+				return nil, fmt.Errorf("forward address (%s) cannot be reached", address)
+			}
+			labelChannel(conn, t.stats.Name, 0)
+			if t.State() == StateDegraded && !t.stats.suspect() {
+				t.transition(StateListening)
+			}
+			return conn, nil
+		},
+		MaxIdleConnsPerHost: 8,
+		IdleConnTimeout:     90 * time.Second,
+	}
+	return &httputil.ReverseProxy{
+		Rewrite: func(r *httputil.ProxyRequest) {
+			route := t.route(r.In)
+			r.SetURL(&url.URL{Scheme: "http", Host: route.Forward.address})
+			if route.StripPath && route.Path != "" {
+				r.Out.URL.Path = "/" + strings.TrimPrefix(strings.TrimPrefix(r.In.URL.Path, route.Path), "/")
+				r.Out.URL.RawPath = ""
+			}
+			r.SetXForwarded()
+			if verboseFlag {
+				Infof("tunnel (%s) %s %s%s routed to %s", t.Name, r.In.Method, r.In.Host, r.In.URL.Path, route.Forward.address)
+			}
+		},
+		Transport: transport,
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			Errorf("tunnel (%s) %s %s%s failed: %v", t.Name, r.Method, r.Host, r.URL.Path, err)
+			if errors.Is(err, errHostDown) {
+				w.WriteHeader(http.StatusServiceUnavailable)
+			} else {
+				w.WriteHeader(http.StatusBadGateway)
+			}
+		},
+	}
+}
+
+// serveRoute answers requests that match no route, and proxies the others
+func (t *Tunnel) serveRoute(w http.ResponseWriter, r *http.Request) {
+	if t.route(r) == nil {
+		http.Error(w, "no route", http.StatusNotFound)
+		return
+	}
+	t.httpProxy.ServeHTTP(w, r)
+}
+
+// forwardHTTP serves the requests of a client of an http tunnel until it
+// disconnects, counting the bytes of the connection as forward does
+func (t *Tunnel) forwardHTTP(localConn net.Conn, id int32, client string) {
+	emit(&Event{Type: EventConnect, Tunnel: t.Name, TunnelID: t.id, Host: t.Host, ID: id, Client: client})
+	connStats := t.stats.addConnection(id, client, t.stats.Forward)
+	conn := &httpClientConn{Conn: localConn, tunnel: t, stats: connStats, done: make(chan struct{})}
+	t.track(id, conn)
+	t.stats.connected(1)
+	defer func() {
+		t.stats.connected(-1)
+		t.untrack(id)
+		t.stats.removeConnection(connStats)
+		// Handlers of the connection may yet be writing to it
+		t.stats.lock.Lock()
+		received, transmitted := connStats.Received, connStats.Transmitted
+		t.stats.lock.Unlock()
+		emit(&Event{
+			Type:        EventDisconnect,
+			Tunnel:      t.Name,
+			TunnelID:    t.id,
+			Host:        t.Host,
+			ID:          id,
+			Client:      client,
+			Received:    received,
+			Transmitted: transmitted,
+		})
+	}()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go t.ageOut(ctx, id, client, connStats, conn)
+	server := &http.Server{Handler: http.HandlerFunc(t.serveRoute), ReadHeaderTimeout: socksHandshakeTimeout}
+	_ = server.Serve(&httpClientListener{conn: conn})
+}
+
+// httpClientConn counts the bytes of a client of an http tunnel, and tells its
+// listener when it closes
+type httpClientConn struct {
+	net.Conn
+	tunnel *Tunnel
+	stats  *ConnectionStats
+	done   chan struct{}
+	once   sync.Once
+}
+
+func (c *httpClientConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.tunnel.stats.received(c.stats, n)
+		c.tunnel.updateChan <- struct{}{}
+	}
+	return n, err
+}
+
+func (c *httpClientConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		c.tunnel.stats.transmitted(c.stats, n)
+		c.tunnel.updateChan <- struct{}{}
+	}
+	return n, err
+}
+
+func (c *httpClientConn) Close() error {
+	c.once.Do(func() {
+		close(c.done)
+	})
+	return c.Conn.Close()
+}
+
+// httpClientListener hands a single connection to an http server, then holds it
+// serving until the connection closes
+type httpClientListener struct {
+	conn     *httpClientConn
+	accepted bool
+}
+
+func (l *httpClientListener) Accept() (net.Conn, error) {
+	if !l.accepted {
+		l.accepted = true
+		return l.conn, nil
+	}
+	<-l.conn.done
+	return nil, net.ErrClosed
+}
+
+func (l *httpClientListener) Close() error {
+	return nil
+}
+
+func (l *httpClientListener) Addr() net.Addr {
+	return l.conn.LocalAddr()
+}
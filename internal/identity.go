@@ -0,0 +1,101 @@
+package internal
+
+import (
+	"encoding/json"
+	"io"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Identities are the identity files of a host, offered in order as OpenSSH
+// stacks IdentityFile.  A single identity may be given as a plain value.
+type Identities []string
+
+func (i *Identities) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var identity string
+	if err := unmarshal(&identity); err == nil {
+		*i = Identities{identity}
+		return nil
+	}
+	var identities []string
+	if err := unmarshal(&identities); err != nil {
+		return err
+	}
+	*i = identities
+	return nil
+}
+
+func (i *Identities) UnmarshalJSON(data []byte) error {
+	var identity string
+	if err := json.Unmarshal(data, &identity); err == nil {
+		*i = Identities{identity}
+		return nil
+	}
+	var identities []string
+	if err := json.Unmarshal(data, &identities); err != nil {
+		return err
+	}
+	*i = identities
+	return nil
+}
+
+func (i Identities) MarshalYAML() (interface{}, error) {
+	if len(i) == 1 {
+		return i[0], nil
+	}
+	return []string(i), nil
+}
+
+func (i Identities) MarshalJSON() ([]byte, error) {
+	if len(i) == 1 {
+		return json.Marshal(i[0])
+	}
+	return json.Marshal([]string(i))
+}
+
+// trimmed returns the identities without surrounding space or blank entries
+func (i Identities) trimmed() Identities {
+	var identities Identities
+	for _, identity := range i {
+		if identity = strings.TrimSpace(identity); identity != "" {
+			identities = append(identities, identity)
+		}
+	}
+	return identities
+}
+
+// identitySigners returns the signers of the host's identities, in order.  When
+// there are several, the one the host accepts is logged.
+func (h *Host) identitySigners() []ssh.Signer {
+	var signers []ssh.Signer
+	for _, identity := range h.Identity {
+		signer, ok := identityMap[identity]
+		if !ok {
+			continue
+		}
+		if algorithmSigner, ok := signer.(ssh.AlgorithmSigner); ok && len(h.Identity) > 1 {
+			signer = &identitySigner{AlgorithmSigner: algorithmSigner, host: h.Name, identity: identity}
+		}
+		signers = append(signers, signer)
+	}
+	return signers
+}
+
+// identitySigner logs the identity it signs for, as keys are only asked to sign
+// once the host has accepted them
+type identitySigner struct {
+	ssh.AlgorithmSigner
+	host     string
+	identity string
+}
+
+func (s *identitySigner) Sign(rand io.Reader, data []byte) (*ssh.Signature, error) {
+	Infof("host (%s) authenticating with identity (%s)", s.host, s.identity)
+	return s.AlgorithmSigner.Sign(rand, data)
+}
+
+func (s *identitySigner) SignWithAlgorithm(rand io.Reader, data []byte, algorithm string) (*ssh.Signature, error) {
+	Infof("host (%s) authenticating with identity (%s)", s.host, s.identity)
+	return s.AlgorithmSigner.SignWithAlgorithm(rand, data, algorithm)
+}
@@ -0,0 +1,152 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"golang.org/x/term"
+)
+
+var promptLock sync.Mutex
+
+// PromptAnswer scripts the answer to a keyboard-interactive prompt.  It answers
+// any question containing prompt, ignoring case, either with answer or with the
+// output of command, e.g. a TOTP generator.
+type PromptAnswer struct {
+	Prompt  string `yaml:"prompt" json:"prompt"`
+	Answer  Secret `yaml:"answer,omitempty" json:"answer,omitempty"`
+	Command string `yaml:"command,omitempty" json:"command,omitempty"`
+}
+
+func (a *PromptAnswer) Validate(hostName string) bool {
+	a.Prompt = strings.TrimSpace(a.Prompt)
+	a.Command = strings.TrimSpace(a.Command)
+	if a.Prompt == "" {
+		Errorf("host (%s) answers require a prompt", hostName)
+		return false
+	}
+	if (a.Answer == "") == (a.Command == "") {
+		Errorf("host (%s) answer to prompt (%s) requires either an answer or a command", hostName, a.Prompt)
+		return false
+	}
+	return true
+}
+
+func (a *PromptAnswer) value() (string, error) {
+	if a.Command == "" {
+		return string(a.Answer), nil
+	}
+	cmd := shellCommand(context.Background(), a.Command)
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("answer command for prompt (%s) failed: %w", a.Prompt, err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+func (h *Host) validateAnswers() bool {
+	valid := true
+	for _, answer := range h.Answers {
+		if !answer.Validate(h.Name) {
+			valid = false
+		}
+	}
+	if len(h.Answers) > 0 && !h.KeyboardInteractive {
+		Warnf("host (%s) answers are ignored without keyboard_interactive", h.Name)
+	}
+	return valid
+}
+
+// challenge answers a keyboard-interactive challenge, using the scripted answers
+// where they match and asking on the terminal otherwise.
+func (h *Host) challenge(name string, instruction string, questions []string, echos []bool) ([]string, error) {
+	answers := make([]string, len(questions))
+	instructed := false
+	for i, question := range questions {
+		if scripted := h.scriptedAnswer(question); scripted != nil {
+			answer, err := scripted.value()
+			if err != nil {
+				return nil, err
+			}
+			answers[i] = answer
+			continue
+		}
+		if !instructed {
+			instructed = true
+			if name != "" || instruction != "" {
+				fmt.Printf("host (%s) %s\n", h.Name, strings.TrimSpace(name+" "+instruction))
+			}
+		}
+		answer, err := promptTerminal(h.Name, question, echos[i])
+		if err != nil {
+			return nil, err
+		}
+		answers[i] = answer
+	}
+	return answers, nil
+}
+
+func (h *Host) scriptedAnswer(question string) *PromptAnswer {
+	for _, answer := range h.Answers {
+		if strings.Contains(strings.ToLower(question), strings.ToLower(answer.Prompt)) {
+			return answer
+		}
+	}
+	return nil
+}
+
+// promptTerminal asks a question on the terminal, hiding the answer unless the
+// server asked for it to be echoed.  Hosts connecting at the same time take
+// turns.
+func promptTerminal(hostName string, question string, echo bool) (string, error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return "", fmt.Errorf("no answer is scripted for prompt (%s) and there is no terminal to ask", strings.TrimSpace(question))
+	}
+	promptLock.Lock()
+	defer promptLock.Unlock()
+	fmt.Printf("host (%s) %s", hostName, question)
+	if !echo {
+		answer, err := term.ReadPassword(fd)
+		fmt.Println()
+		return string(answer), err
+	}
+	var answer []byte
+	b := make([]byte, 1)
+	for {
+		n, err := os.Stdin.Read(b)
+		if err != nil {
+			return "", err
+		}
+		if n == 0 || b[0] == '\r' {
+			continue
+		}
+		if b[0] == '\n' {
+			return string(answer), nil
+		}
+		answer = append(answer, b[0])
+	}
+}
+
+// OpenInteractiveHosts connects the hosts using keyboard-interactive
+// authentication straight away, so any questions are asked at startup rather
+// than when a tunnel is first used.
+func OpenInteractiveHosts() {
+	names := make([]string, 0, len(Hosts))
+	for name, h := range Hosts {
+		if h.KeyboardInteractive && h.valid {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if !Hosts[name].Open() {
+			Warnf("host (%s) not yet connected, will retry", name)
+		}
+	}
+}
@@ -0,0 +1,196 @@
+package internal
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultJournalSize = 5 * 1024 * 1024
+
+var journalTimeLayouts = []string{
+	time.RFC3339,
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+	"2006-01-02",
+}
+
+// JournalConfig controls the on-disk journal of connection events.  The journal
+// is a ring of two files, each holding up to half of max_size, so it never
+// grows beyond max_size while always holding the most recent events.
+type JournalConfig struct {
+	Path     string `yaml:"path" json:"path"`
+	MaxSize  string `yaml:"max_size" json:"max_size"`
+	Disabled bool   `yaml:"disabled" json:"disabled"`
+	maxSize  int64
+}
+
+type journal struct {
+	lock    sync.Mutex
+	path    string
+	maxSize int64
+	file    *os.File
+	size    int64
+}
+
+func (c *JournalConfig) Validate(configFile string) bool {
+	c.Path = strings.TrimSpace(c.Path)
+	if c.Path == "" {
+		c.Path = filepath.Join(filepath.Dir(configFile), "journal.jsonl")
+	}
+	c.maxSize = defaultJournalSize
+	if strings.TrimSpace(c.MaxSize) != "" {
+		size, err := ParseByteCount(c.MaxSize)
+		if err != nil || size < 1024 {
+			Errorf("journal max_size (%s) is invalid.  Must be at least 1K", c.MaxSize)
+			return false
+		}
+		c.maxSize = size
+	}
+	return true
+}
+
+// StartJournal begins recording events to the journal
+func (c *JournalConfig) StartJournal() bool {
+	if c.Disabled {
+		return true
+	}
+	j := &journal{
+		path:    c.Path,
+		maxSize: c.maxSize,
+	}
+	if !j.open() {
+		return false
+	}
+	if verboseFlag {
+		Infof("journal recording to %s", c.Path)
+	}
+	addEventSink(j.write)
+	return true
+}
+
+func (j *journal) open() bool {
+	file, err := os.OpenFile(j.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		Errorf("journal (%s) cannot be opened: %v", j.path, err)
+		return false
+	}
+	j.file = file
+	j.size = 0
+	if fi, err := file.Stat(); err == nil {
+		j.size = fi.Size()
+	}
+	return true
+}
+
+func (j *journal) write(event *Event) {
+	bs, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+	bs = append(bs, '\n')
+
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	if j.file == nil {
+		return
+	}
+	if j.size+int64(len(bs)) > j.maxSize/2 {
+		_ = j.file.Close()
+		_ = os.Rename(j.path, rotatedJournal(j.path))
+		if !j.open() {
+			j.file = nil
+			return
+		}
+	}
+	n, _ := j.file.Write(bs)
+	j.size += int64(n)
+}
+
+func rotatedJournal(path string) string {
+	ext := filepath.Ext(path)
+	return strings.TrimSuffix(path, ext) + ".1" + ext
+}
+
+// ParseJournalTime accepts an absolute time in one of the journal layouts, a
+// time of day (15:04) meaning today, or a duration (90m) meaning that long ago.
+func ParseJournalTime(value string) (time.Time, error) {
+	now := time.Now()
+	if d, err := time.ParseDuration(value); err == nil {
+		return now.Add(-d), nil
+	}
+	for _, layout := range journalTimeLayouts {
+		if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	if t, err := time.ParseInLocation("15:04", value, time.Local); err == nil {
+		return time.Date(now.Year(), now.Month(), now.Day(), t.Hour(), t.Minute(), 0, 0, time.Local), nil
+	}
+	return time.Time{}, fmt.Errorf("invalid time (%s).  Expected e.g. 2006-01-02 15:04, 15:04 or 2h", value)
+}
+
+// ShowJournal prints the journaled events between since and until (either may be
+// zero) for the tunnels or hosts matching the filter, or the tunnels with the ids.
+func (c *JournalConfig) ShowJournal(since time.Time, until time.Time, filter *StatsFilter, ids map[string]bool) bool {
+	found := false
+	for _, path := range []string{rotatedJournal(c.Path), c.Path} {
+		file, err := os.Open(path)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			Errorf("journal (%s) cannot be read: %v", path, err)
+			return false
+		}
+		found = true
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			event := &Event{}
+			if json.Unmarshal(scanner.Bytes(), event) != nil {
+				continue
+			}
+			if (!since.IsZero() && event.Time.Before(since)) || (!until.IsZero() && event.Time.After(until)) {
+				continue
+			}
+			if filter.Tunnel != "" && !filter.matchesTunnel(event.Tunnel) && !filter.matchesTunnel(event.Host) && !ids[event.TunnelID] {
+				continue
+			}
+			printEvent(event)
+		}
+		_ = file.Close()
+	}
+	if !found {
+		Infof("journal (%s) is empty", c.Path)
+	}
+	return true
+}
+
+func printEvent(event *Event) {
+	subject := event.Tunnel
+	if subject == "" {
+		subject = event.Host
+	}
+	timestamp := formatTimestamp(event.Time)
+	if timestamp == "" {
+		timestamp = event.Time.Local().Format("2006-01-02 15:04:05")
+	}
+	line := fmt.Sprintf("%s  %-15s %-25s", timestamp, event.Type, subject)
+	if event.ID != 0 {
+		line += fmt.Sprintf(" id:%d", event.ID)
+	}
+	if event.Client != "" {
+		line += fmt.Sprintf(" client:%s", event.Client)
+	}
+	if event.Received != 0 || event.Transmitted != 0 {
+		line += p.Sprintf(" rcvd:%d sent:%d", event.Received, event.Transmitted)
+	}
+	if event.Message != "" {
+		line += " " + event.Message
+	}
+	fmt.Println(strings.TrimRight(line, " "))
+}
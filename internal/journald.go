@@ -0,0 +1,102 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const journaldSocket = "/run/systemd/journal/socket"
+
+// JournaldConfig sends log messages, and optionally connection events, to the
+// systemd journal using its native protocol, so every field can be queried,
+// e.g. journalctl FERRET_TUNNEL=db.
+type JournaldConfig struct {
+	Level  string `yaml:"level" json:"level"`
+	Events bool   `yaml:"events" json:"events"`
+}
+
+func (c *JournaldConfig) Validate() bool {
+	return validateSinkLevel("journald", &c.Level)
+}
+
+func (c *JournaldConfig) start() bool {
+	if c.Level == LevelNone && !c.Events {
+		return true
+	}
+	sink := &datagramSink{name: "journald", dial: func() (net.Conn, error) {
+		return net.Dial("unixgram", journaldSocket)
+	}}
+	if !sink.start() {
+		return false
+	}
+	identifier := filepath.Base(os.Args[0])
+	if c.Level != LevelNone {
+		addLogSink(c.Level, func(entry *logEntry) {
+			sink.send(journaldMessage(map[string]string{
+				"MESSAGE":           entry.Message,
+				"PRIORITY":          fmt.Sprint(syslogSeverities[entry.Level]),
+				"SYSLOG_IDENTIFIER": identifier,
+				"FERRET_LEVEL":      strings.ToLower(entry.Level),
+			}))
+		})
+	}
+	if c.Events {
+		addEventSink(func(event *Event) {
+			priority := syslogSeverities[LevelInfo]
+			if event.Type == EventError {
+				priority = syslogSeverities[LevelError]
+			}
+			subject := event.Tunnel
+			if subject == "" {
+				subject = event.Host
+			}
+			fields := map[string]string{
+				"MESSAGE":           strings.TrimSpace(fmt.Sprintf("%s %s %s", event.Type, subject, event.Message)),
+				"PRIORITY":          fmt.Sprint(priority),
+				"SYSLOG_IDENTIFIER": identifier,
+				"FERRET_EVENT":      event.Type,
+				"FERRET_TUNNEL":     event.Tunnel,
+				"FERRET_HOST":       event.Host,
+				"FERRET_CLIENT":     event.Client,
+			}
+			if event.ID != 0 {
+				fields["FERRET_ID"] = fmt.Sprint(event.ID)
+			}
+			if event.Type == EventDisconnect {
+				fields["FERRET_RECEIVED"] = fmt.Sprint(event.Received)
+				fields["FERRET_TRANSMITTED"] = fmt.Sprint(event.Transmitted)
+			}
+			sink.send(journaldMessage(fields))
+		})
+	}
+	if verboseFlag {
+		Infof("logging %s and above to journald", strings.ToLower(c.Level))
+	}
+	return true
+}
+
+// journaldMessage encodes fields in the journal's native protocol.  Values that
+// span lines are length prefixed rather than newline terminated.
+func journaldMessage(fields map[string]string) []byte {
+	buf := &bytes.Buffer{}
+	for key, value := range fields {
+		if value == "" {
+			continue
+		}
+		if !strings.Contains(value, "\n") {
+			fmt.Fprintf(buf, "%s=%s\n", key, value)
+			continue
+		}
+		buf.WriteString(key)
+		buf.WriteByte('\n')
+		_ = binary.Write(buf, binary.LittleEndian, uint64(len(value)))
+		buf.WriteString(value)
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes()
+}
@@ -0,0 +1,94 @@
+package internal
+
+import (
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// jumpHops adds a host for each hop of a jump_host list, which, as the ProxyJump
+// of OpenSSH, reaches the host through each host of the list in turn, so that
+// a jump_host of a,b reaches b through a, and the host through b.  Each hop is a
+// copy of its host named after the list up to it, making a,b a copy of b with a
+// jump_host of a, which leaves b free to be used directly.
+func jumpHops(hosts []*Host) ([]*Host, bool) {
+	defined := make(map[string]*Host)
+	for _, h := range hosts {
+		defined[strings.TrimSpace(h.Name)] = h
+	}
+	valid := true
+	var hops []*Host
+	for _, h := range hosts {
+		if !strings.Contains(h.JumpHost, ",") {
+			continue
+		}
+		names, ok := splitJumpHost(h.JumpHost)
+		if !ok {
+			Errorf("host (%s) jump_host (%s) is invalid.  Must be a comma separated list of hosts", strings.TrimSpace(h.Name), h.JumpHost)
+			valid = false
+			continue
+		}
+		h.JumpHost = strings.Join(names, ",")
+		for i := 1; i < len(names); i++ {
+			name := strings.Join(names[:i+1], ",")
+			if _, ok = defined[name]; ok {
+				continue
+			}
+			last, found := defined[names[i]]
+			if !found {
+				Errorf("host (%s) jump_host (%s) is not defined", strings.TrimSpace(h.Name), names[i])
+				valid = false
+				break
+			}
+			hop, err := last.hop(name, strings.Join(names[:i], ","))
+			if err != nil {
+				Errorf("host (%s) jump_host (%s) cannot be copied: %v", strings.TrimSpace(h.Name), names[i], err)
+				valid = false
+				break
+			}
+			defined[name] = hop
+			hops = append(hops, hop)
+		}
+	}
+	return hops, valid
+}
+
+// splitJumpHost splits a jump_host list into the names of its hosts
+func splitJumpHost(jumpHost string) ([]string, bool) {
+	names := strings.Split(jumpHost, ",")
+	for i, name := range names {
+		names[i] = strings.TrimSpace(name)
+		if names[i] == "" {
+			return nil, false
+		}
+	}
+	return names, true
+}
+
+// hop copies the configuration of the host, but none of its state, as the hop
+// of a jump_host list reached through the hops before it
+func (h *Host) hop(name string, via string) (*Host, error) {
+	bs, err := yaml.Marshal(h)
+	if err != nil {
+		return nil, err
+	}
+	hop := &Host{}
+	if err = yaml.Unmarshal(bs, hop); err != nil {
+		return nil, err
+	}
+	hop.Name = name
+	hop.JumpHost = via
+	return hop, nil
+}
+
+// jumpLoop reports whether following the jump hosts of the host leads back to it
+func (h *Host) jumpLoop() bool {
+	seen := map[*Host]bool{h: true}
+	for next := Hosts[h.JumpHost]; next != nil; next = Hosts[next.JumpHost] {
+		if seen[next] {
+			return true
+		}
+		seen[next] = true
+	}
+	return false
+}
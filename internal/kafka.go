@@ -0,0 +1,255 @@
+package internal
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+)
+
+// The Kafka APIs whose responses name brokers
+const (
+	kafkaMetadata        = 3
+	kafkaFindCoordinator = 10
+	kafkaDescribeCluster = 60
+)
+
+var errKafkaShort = errors.New("kafka response is truncated")
+
+// kafkaStream follows the requests of a Kafka client, as the responses naming
+// brokers only carry the correlation id of the request they answer
+type kafkaStream struct {
+	cluster *clusterMembers
+	lock    sync.Mutex
+	pending map[int32]kafkaRequest
+}
+
+type kafkaRequest struct {
+	api     int16
+	version int16
+}
+
+// flexible reports whether the response uses the compact encodings of KIP-482
+func (r kafkaRequest) flexible() bool {
+	switch r.api {
+	case kafkaMetadata:
+		return r.version >= 9
+	case kafkaFindCoordinator:
+		return r.version >= 3
+	}
+	return true
+}
+
+// kafka wraps the requests and responses of a connection to a broker, so the
+// brokers named in responses are reached through tunnels of their own
+func (c *clusterMembers) kafka(requests io.Reader, responses io.Reader) (io.Reader, io.Reader) {
+	k := &kafkaStream{cluster: c, pending: make(map[int32]kafkaRequest)}
+	size := func(head []byte) int {
+		return 4 + int(int32(binary.BigEndian.Uint32(head)))
+	}
+	return &frameReader{src: requests, head: 12, size: size, inspect: k.request},
+		&frameReader{src: responses, head: 8, size: size, inspect: k.response}
+}
+
+func (k *kafkaStream) request(head []byte, _ int) func([]byte) []byte {
+	request := kafkaRequest{
+		api:     int16(binary.BigEndian.Uint16(head[4:])),
+		version: int16(binary.BigEndian.Uint16(head[6:])),
+	}
+	switch request.api {
+	case kafkaMetadata, kafkaFindCoordinator, kafkaDescribeCluster:
+		k.lock.Lock()
+		k.pending[int32(binary.BigEndian.Uint32(head[8:]))] = request
+		k.lock.Unlock()
+	}
+	return nil
+}
+
+func (k *kafkaStream) response(head []byte, _ int) func([]byte) []byte {
+	correlation := int32(binary.BigEndian.Uint32(head[4:]))
+	k.lock.Lock()
+	request, ok := k.pending[correlation]
+	delete(k.pending, correlation)
+	k.lock.Unlock()
+	if !ok {
+		return nil
+	}
+	return func(frame []byte) []byte {
+		rewritten, err := k.rewrite(frame, request)
+		if err != nil {
+			Warnf("tunnel (%s) kafka response (api %d v%d) left as is: %v", k.cluster.tunnel.Name, request.api, request.version, err)
+			return frame
+		}
+		return rewritten
+	}
+}
+
+// rewrite replaces the host and port of each broker in a response, copying
+// everything else as it is
+func (k *kafkaStream) rewrite(frame []byte, request kafkaRequest) ([]byte, error) {
+	d := &kafkaDecoder{bs: frame, pos: 8, flexible: request.flexible()}
+	d.taggedFields()
+	out := make([]byte, 0, len(frame)+64)
+	mark := 0
+	broker := func() {
+		start := d.pos
+		host, _ := d.string()
+		port := d.int32()
+		if d.err != nil || host == "" || port <= 0 {
+			return
+		}
+		host, advertised := k.cluster.advertise(host, int(port))
+		out = append(out, frame[mark:start]...)
+		out = d.appendString(out, host)
+		out = binary.BigEndian.AppendUint32(out, uint32(advertised))
+		mark = d.pos
+	}
+
+	version := request.version
+	switch request.api {
+	case kafkaMetadata:
+		if version >= 3 {
+			d.skip(4) // throttle_time_ms
+		}
+		for n := d.array(); n > 0 && d.err == nil; n-- {
+			d.skip(4) // node_id
+			broker()
+			if version >= 1 {
+				d.string() // rack
+			}
+			d.taggedFields()
+		}
+	case kafkaFindCoordinator:
+		if version >= 1 {
+			d.skip(4) // throttle_time_ms
+		}
+		if version < 4 {
+			d.skip(2) // error_code
+			if version >= 1 {
+				d.string() // error_message
+			}
+			d.skip(4) // node_id
+			broker()
+			break
+		}
+		for n := d.array(); n > 0 && d.err == nil; n-- {
+			d.string() // key
+			d.skip(4)  // node_id
+			broker()
+			d.skip(2)  // error_code
+			d.string() // error_message
+			d.taggedFields()
+		}
+	case kafkaDescribeCluster:
+		d.skip(4 + 2) // throttle_time_ms, error_code
+		d.string()    // error_message
+		if version >= 1 {
+			d.skip(1) // endpoint_type
+		}
+		d.string() // cluster_id
+		d.skip(4)  // controller_id
+		for n := d.array(); n > 0 && d.err == nil; n-- {
+			d.skip(4) // broker_id
+			broker()
+			d.string() // rack
+			if version >= 2 {
+				d.skip(1) // is_fenced
+			}
+			d.taggedFields()
+		}
+	}
+	if d.err != nil {
+		return nil, d.err
+	}
+	out = append(out, frame[mark:]...)
+	binary.BigEndian.PutUint32(out, uint32(len(out)-4))
+	return out, nil
+}
+
+// kafkaDecoder reads the fields of a Kafka message, in the classic or compact
+// encoding, the first error stopping all further reads
+type kafkaDecoder struct {
+	bs       []byte
+	pos      int
+	flexible bool
+	err      error
+}
+
+func (d *kafkaDecoder) skip(n int) {
+	if d.err == nil && (n < 0 || d.pos+n > len(d.bs)) {
+		d.err = errKafkaShort
+	}
+	if d.err == nil {
+		d.pos += n
+	}
+}
+
+func (d *kafkaDecoder) int16() int16 {
+	if d.skip(2); d.err != nil {
+		return 0
+	}
+	return int16(binary.BigEndian.Uint16(d.bs[d.pos-2:]))
+}
+
+func (d *kafkaDecoder) int32() int32 {
+	if d.skip(4); d.err != nil {
+		return 0
+	}
+	return int32(binary.BigEndian.Uint32(d.bs[d.pos-4:]))
+}
+
+func (d *kafkaDecoder) uvarint() int {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(d.bs[d.pos:])
+	if n <= 0 {
+		d.err = errKafkaShort
+		return 0
+	}
+	d.pos += n
+	return int(v)
+}
+
+// length reads the length of a string or array, -1 being null
+func (d *kafkaDecoder) length(classic func() int) int {
+	if d.flexible {
+		return d.uvarint() - 1
+	}
+	return classic()
+}
+
+func (d *kafkaDecoder) array() int {
+	return d.length(func() int { return int(d.int32()) })
+}
+
+func (d *kafkaDecoder) string() (string, bool) {
+	n := d.length(func() int { return int(d.int16()) })
+	if n < 0 {
+		return "", false
+	}
+	start := d.pos
+	if d.skip(n); d.err != nil {
+		return "", false
+	}
+	return string(d.bs[start:d.pos]), true
+}
+
+func (d *kafkaDecoder) taggedFields() {
+	if !d.flexible {
+		return
+	}
+	for n := d.uvarint(); n > 0 && d.err == nil; n-- {
+		d.uvarint()
+		d.skip(d.uvarint())
+	}
+}
+
+func (d *kafkaDecoder) appendString(out []byte, s string) []byte {
+	if d.flexible {
+		out = binary.AppendUvarint(out, uint64(len(s)+1))
+	} else {
+		out = binary.BigEndian.AppendUint16(out, uint16(len(s)))
+	}
+	return append(out, s...)
+}
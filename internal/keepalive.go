@@ -0,0 +1,80 @@
+package internal
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// defaultKeepaliveMax is how many keepalives in a row may go unanswered before
+// the connection is given up on, as the ServerAliveCountMax of OpenSSH
+const defaultKeepaliveMax = 3
+
+// validateKeepalive reads keepalive_interval, how often a keepalive is sent
+// over the SSH connection of the host, as the ServerAliveInterval of OpenSSH,
+// so that NAT and firewalls do not drop it while idle, and one they have
+// dropped is noticed.  Once keepalive_max go unanswered in a row, the
+// connection is closed, to be reconnected as one that dropped.
+func (h *Host) validateKeepalive() bool {
+	h.KeepaliveInterval = strings.TrimSpace(h.KeepaliveInterval)
+	if h.KeepaliveInterval == "" {
+		if h.KeepaliveMax != 0 {
+			Warnf("host (%s) keepalive_max is ignored without keepalive_interval", h.Name)
+		}
+		return true
+	}
+	valid := true
+	d, err := time.ParseDuration(h.KeepaliveInterval)
+	if err != nil || (d != 0 && d < time.Second) {
+		Errorf("host (%s) keepalive_interval (%s) is invalid.  Must be a duration of at least 1s, or 0 to send none", h.Name, h.KeepaliveInterval)
+		valid = false
+	}
+	h.keepaliveInterval = d
+	if h.KeepaliveMax < 0 {
+		Errorf("host (%s) keepalive_max (%d) is invalid.  Must be at least 1", h.Name, h.KeepaliveMax)
+		valid = false
+	} else if h.KeepaliveMax == 0 {
+		h.KeepaliveMax = defaultKeepaliveMax
+	}
+	return valid
+}
+
+// keepAlive sends keepalives over the client for as long as it is the client of
+// the host, closing it once too many go unanswered
+func (h *Host) keepAlive(client hostClient) {
+	ticker := time.NewTicker(h.keepaliveInterval)
+	defer ticker.Stop()
+	missed := 0
+	for range ticker.C {
+		h.lock.Lock()
+		current := h.client == client
+		h.lock.Unlock()
+		if !current {
+			return
+		}
+		if _, err := sendKeepalive(client, h.keepaliveInterval); err == nil {
+			missed = 0
+			continue
+		} else if missed++; verboseFlag {
+			Infof("host (%s) keepalive %d of %d unanswered: %v", h.Name, missed, h.KeepaliveMax, err)
+		}
+		if missed < h.KeepaliveMax {
+			continue
+		}
+		h.lock.Lock()
+		if h.client == client {
+			Warnf("host (%s) answered none of %d keepalives, closing the connection", h.Name, missed)
+			h.client = nil
+			h.stats.disconnected()
+			emit(&Event{Type: EventHostDisconnect, Host: h.Name, Message: fmt.Sprintf("%d keepalives unanswered", missed)})
+			if h.keepWarm {
+				// As when the connection drops, only tunnels always active
+				// reconnect now, the rest on their next connection
+				h.retry()
+			}
+		}
+		h.lock.Unlock()
+		_ = client.Close()
+		return
+	}
+}
@@ -0,0 +1,184 @@
+package internal
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// KeyHolderFlag is the hidden command line flag that starts ferret as the key holder process
+const KeyHolderFlag = "--key-holder"
+
+var (
+	keyHolder            agent.ExtendedAgent
+	keyHolderSigners     = make(map[string]ssh.Signer)
+	errReadOnlyKeyHolder = errors.New("key holder is read only")
+)
+
+type stdioPipe struct {
+	io.Reader
+	io.Writer
+}
+
+// StartKeyHolder re-executes ferret as a separate process that loads the
+// identity files and only ever hands out signatures over the ssh-agent
+// protocol on its stdin/stdout.  The process forwarding traffic never reads
+// private keys or passphrases, so a compromise of the forwarding path cannot
+// exfiltrate them, and the key holder itself makes no network connections,
+// so each can be confined by its own SELinux/AppArmor profile.
+func StartKeyHolder(configFile string, workspaceFile string) bool {
+	executable, err := os.Executable()
+	if err != nil {
+		Errorf("key holder cannot be started: %v", err)
+		return false
+	}
+	args := []string{KeyHolderFlag, "--config", configFile}
+	if workspaceFile != "" {
+		args = append(args, "--workspace", workspaceFile)
+	}
+	cmd := exec.Command(executable, args...)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		Errorf("key holder cannot be started: %v", err)
+		return false
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		Errorf("key holder cannot be started: %v", err)
+		return false
+	}
+	if err = cmd.Start(); err != nil {
+		Errorf("key holder cannot be started: %v", err)
+		return false
+	}
+
+	client := agent.NewClient(&stdioPipe{Reader: stdout, Writer: stdin})
+	keys, err := client.List()
+	if err != nil {
+		Errorf("key holder cannot be reached: %v", err)
+		return false
+	}
+	signers, err := client.Signers()
+	if err != nil || len(signers) != len(keys) {
+		Errorf("key holder identities cannot be read: %v", err)
+		return false
+	}
+	for i, key := range keys {
+		keyHolderSigners[key.Comment] = signers[i]
+	}
+	keyHolder = client
+	if verboseFlag {
+		Infof("key holder (pid %d) holding %d identities", cmd.Process.Pid, len(keys))
+	}
+	return true
+}
+
+// ServeKeyHolder runs the key holder side of the hardened mode.  It loads the
+// identities of every host, including those of the workspace, and serves them
+// until ferret closes its stdin.
+func ServeKeyHolder(configFile string, workspaceFile string) {
+	// Stdout carries the agent protocol, so all messages go to stderr
+	protocol := os.Stdout
+	os.Stdout = os.Stderr
+
+	config := LoadWorkspace(configFile, workspaceFile, false)
+	if config == nil {
+		return
+	}
+	for _, host := range config.Hosts {
+		host.Name = strings.TrimSpace(host.Name)
+		for _, identity := range host.Identity.trimmed() {
+			host.validateIdentity(identity)
+		}
+		host.Passphrase = ""
+	}
+	_ = agent.ServeAgent(&signerAgent{signers: identityMap}, &stdioPipe{Reader: os.Stdin, Writer: protocol})
+}
+
+func (h *Host) keyHolderIdentity(identity string) bool {
+	signer, ok := keyHolderSigners[identity]
+	if !ok {
+		Errorf("host (%s) identity file (%s) is not available from the key holder", h.Name, identity)
+		return false
+	}
+	identityMap[identity] = signer
+	h.Passphrase = ""
+	return true
+}
+
+// signerAgent is a sign-only agent over the loaded identities.  Keys can be
+// neither added, removed nor exported through it.
+type signerAgent struct {
+	signers map[string]ssh.Signer
+}
+
+func (a *signerAgent) List() ([]*agent.Key, error) {
+	var keys []*agent.Key
+	for identity, signer := range a.signers {
+		pub := signer.PublicKey()
+		keys = append(keys, &agent.Key{
+			Format:  pub.Type(),
+			Blob:    pub.Marshal(),
+			Comment: identity,
+		})
+	}
+	return keys, nil
+}
+
+func (a *signerAgent) Sign(key ssh.PublicKey, data []byte) (*ssh.Signature, error) {
+	return a.SignWithFlags(key, data, 0)
+}
+
+func (a *signerAgent) SignWithFlags(key ssh.PublicKey, data []byte, flags agent.SignatureFlags) (*ssh.Signature, error) {
+	for _, signer := range a.signers {
+		if !bytes.Equal(signer.PublicKey().Marshal(), key.Marshal()) {
+			continue
+		}
+		if algorithmSigner, ok := signer.(ssh.AlgorithmSigner); ok {
+			switch {
+			case flags&agent.SignatureFlagRsaSha256 != 0:
+				return algorithmSigner.SignWithAlgorithm(rand.Reader, data, ssh.KeyAlgoRSASHA256)
+			case flags&agent.SignatureFlagRsaSha512 != 0:
+				return algorithmSigner.SignWithAlgorithm(rand.Reader, data, ssh.KeyAlgoRSASHA512)
+			}
+		}
+		return signer.Sign(rand.Reader, data)
+	}
+	return nil, errors.New("key not held")
+}
+
+func (a *signerAgent) Signers() ([]ssh.Signer, error) {
+	return nil, errReadOnlyKeyHolder
+}
+
+func (a *signerAgent) Add(agent.AddedKey) error {
+	return errReadOnlyKeyHolder
+}
+
+func (a *signerAgent) Remove(ssh.PublicKey) error {
+	return errReadOnlyKeyHolder
+}
+
+func (a *signerAgent) RemoveAll() error {
+	return errReadOnlyKeyHolder
+}
+
+func (a *signerAgent) Lock([]byte) error {
+	return errReadOnlyKeyHolder
+}
+
+func (a *signerAgent) Unlock([]byte) error {
+	return errReadOnlyKeyHolder
+}
+
+func (a *signerAgent) Extension(string, []byte) ([]byte, error) {
+	return nil, agent.ErrExtensionUnsupported
+}
@@ -0,0 +1,80 @@
+package internal
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"strings"
+	"time"
+)
+
+// tlsHandshakeTimeout bounds how long a client may take to complete the TLS
+// handshake with the entrance of a tunnel
+const tlsHandshakeTimeout = 10 * time.Second
+
+// TLSConfig has the entrance of a tunnel speak TLS, for clients that refuse to
+// connect to plaintext endpoints, though what is forwarded over ssh is still
+// the plaintext.  The certificate and key are read from PEM files, the key from
+// the cert file when not given, or with self_signed a certificate for the local
+// address is generated on every start.
+type TLSConfig struct {
+	Cert       string `yaml:"cert,omitempty" json:"cert,omitempty"`
+	Key        string `yaml:"key,omitempty" json:"key,omitempty"`
+	SelfSigned bool   `yaml:"self_signed,omitempty" json:"self_signed,omitempty"`
+	config     *tls.Config
+}
+
+func (c *TLSConfig) Validate(t *Tunnel) bool {
+	c.Cert = strings.TrimSpace(c.Cert)
+	c.Key = strings.TrimSpace(c.Key)
+	if c.Key == "" {
+		c.Key = c.Cert
+	}
+	if t.Protocol != "" {
+		Errorf("tunnel (%s) tls cannot be used with protocol (%s)", t.Name, t.Protocol)
+		return false
+	}
+	var certificate tls.Certificate
+	var err error
+	switch {
+	case c.SelfSigned && c.Cert != "":
+		Errorf("tunnel (%s) tls cannot have both a cert and self_signed", t.Name)
+		return false
+	case c.SelfSigned:
+		hosts := []string{"localhost", "127.0.0.1", "::1"}
+		if t.Local != nil && t.Local.Host() != "" && !t.Local.IsUnix() && !t.Local.IsPipe() {
+			hosts = append(hosts, t.Local.Host())
+		}
+		var bs []byte
+		if bs, err = selfSignedCertificate("ferret "+t.Name, hosts); err != nil {
+			Errorf("tunnel (%s) tls certificate cannot be generated: %v", t.Name, err)
+			return false
+		}
+		certificate, _ = tls.X509KeyPair(bs, bs)
+		Infof("tunnel (%s) tls certificate self-signed, fingerprint %s", t.Name, certificateFingerprint(certificate.Certificate[0]))
+	case c.Cert != "":
+		if certificate, err = tls.LoadX509KeyPair(c.Cert, c.Key); err != nil {
+			Errorf("tunnel (%s) tls cert (%s) and key (%s) cannot be loaded: %v", t.Name, c.Cert, c.Key, err)
+			return false
+		}
+	default:
+		Errorf("tunnel (%s) tls requires a cert, or self_signed", t.Name)
+		return false
+	}
+	c.config = &tls.Config{
+		Certificates: []tls.Certificate{certificate},
+		MinVersion:   tls.VersionTLS12,
+	}
+	return true
+}
+
+// handshake opens a TLS session with the client of the connection
+func (c *TLSConfig) handshake(conn net.Conn) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), tlsHandshakeTimeout)
+	defer cancel()
+	tlsConn := tls.Server(conn, c.config)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		return nil, err
+	}
+	return tlsConn, nil
+}
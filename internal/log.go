@@ -0,0 +1,149 @@
+package internal
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Log levels
+const (
+	LevelError = "Error"
+	LevelWarn  = "Warn"
+	LevelInfo  = "Info"
+	LevelNone  = "None"
+)
+
+var levelRanks = map[string]int{
+	LevelNone:  0,
+	LevelError: 1,
+	LevelWarn:  2,
+	LevelInfo:  3,
+}
+
+// logEntry is a single message, as handed to every log sink
+type logEntry struct {
+	Time    time.Time
+	Level   string
+	Message string
+}
+
+type logSink struct {
+	level string
+	write func(entry *logEntry)
+}
+
+var (
+	logLock      sync.Mutex
+	consoleLevel = LevelInfo
+	logSinks     []*logSink
+)
+
+// DefaultTimestampFormat is the layout used to timestamp output unless overridden
+const DefaultTimestampFormat = "2006-01-02 15:04:05.000"
+
+var (
+	timestampFormat = DefaultTimestampFormat
+	timestampUTC    bool
+	namedFormats    = map[string]string{
+		"rfc3339":  time.RFC3339,
+		"rfc3339n": time.RFC3339Nano,
+		"iso":      "2006-01-02T15:04:05.000Z07:00",
+		"time":     "15:04:05.000",
+		"none":     "",
+	}
+)
+
+// SetTimestamps sets the layout (a Go time layout or one of rfc3339, rfc3339n,
+// iso, time or none) used to timestamp output, and whether times are in UTC
+func SetTimestamps(format string, utc bool) {
+	if named, ok := namedFormats[strings.ToLower(format)]; ok {
+		format = named
+	}
+	timestampFormat = format
+	timestampUTC = utc
+}
+
+// Timestamp returns the current time formatted for output, or an empty string
+// when timestamps are disabled.
+func Timestamp() string {
+	return formatTimestamp(time.Now())
+}
+
+func formatTimestamp(t time.Time) string {
+	if timestampFormat == "" {
+		return ""
+	}
+	if timestampUTC {
+		t = t.UTC()
+	} else {
+		t = t.Local()
+	}
+	return t.Format(timestampFormat)
+}
+
+func Errorf(format string, args ...interface{}) {
+	logf(LevelError, format, args...)
+}
+
+func Warnf(format string, args ...interface{}) {
+	logf(LevelWarn, format, args...)
+}
+
+func Infof(format string, args ...interface{}) {
+	logf(LevelInfo, format, args...)
+}
+
+// parseLevel accepts a level name in any case, returning the canonical name
+func parseLevel(level string) (string, bool) {
+	for name := range levelRanks {
+		if strings.EqualFold(name, strings.TrimSpace(level)) {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+func enabled(sinkLevel string, level string) bool {
+	return levelRanks[level] <= levelRanks[sinkLevel]
+}
+
+// SetConsoleLevel sets the lowest level of message printed to the console
+func SetConsoleLevel(level string) {
+	logLock.Lock()
+	defer logLock.Unlock()
+	consoleLevel = level
+}
+
+func addLogSink(level string, write func(entry *logEntry)) {
+	logLock.Lock()
+	defer logLock.Unlock()
+	logSinks = append(logSinks, &logSink{level: level, write: write})
+}
+
+func logf(level string, format string, args ...interface{}) {
+	entry := &logEntry{Time: time.Now(), Level: level, Message: fmt.Sprintf(format, args...)}
+	logLock.Lock()
+	defer logLock.Unlock()
+	if enabled(consoleLevel, level) {
+		fmt.Print(formatEntry(entry, timestampFormat != ""))
+	}
+	for _, sink := range logSinks {
+		if enabled(sink.level, level) {
+			sink.write(entry)
+		}
+	}
+}
+
+// formatEntry renders an entry as a console style line
+func formatEntry(entry *logEntry, timestamped bool) string {
+	if !timestamped {
+		return fmt.Sprintf("  %-5s - %s\n", entry.Level, entry.Message)
+	}
+	ts := formatTimestamp(entry.Time)
+	if ts == "" {
+		ts = entry.Time.Format(DefaultTimestampFormat)
+	}
+	return fmt.Sprintf("%s  %-5s - %s\n", ts, entry.Level, entry.Message)
+}
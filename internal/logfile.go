@@ -0,0 +1,234 @@
+package internal
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultLogFileSize   = 10 * 1024 * 1024
+	rotatedLogTimeLayout = "20060102-150405.000"
+)
+
+// LogConfig sets the level of console output and adds any number of log files,
+// as well as syslog and journald, each with its own level.  Log files are rotated
+// once they reach max_size, and rotated files are removed once there are more
+// than max_backups of them or they are older than max_age.
+type LogConfig struct {
+	Console  string           `yaml:"console" json:"console"`
+	Files    []*LogFileConfig `yaml:"files" json:"files"`
+	Syslog   *SyslogConfig    `yaml:"syslog" json:"syslog"`
+	Journald *JournaldConfig  `yaml:"journald" json:"journald"`
+}
+
+type LogFileConfig struct {
+	Path       string `yaml:"path" json:"path"`
+	Level      string `yaml:"level" json:"level"`
+	MaxSize    string `yaml:"max_size" json:"max_size"`
+	MaxAge     string `yaml:"max_age" json:"max_age"`
+	MaxBackups int    `yaml:"max_backups" json:"max_backups"`
+	maxSize    int64
+	maxAge     time.Duration
+}
+
+type logFile struct {
+	lock   sync.Mutex
+	config *LogFileConfig
+	file   *os.File
+	size   int64
+}
+
+func (c *LogConfig) Validate(configFile string) bool {
+	valid := true
+	if strings.TrimSpace(c.Console) != "" {
+		level, ok := parseLevel(c.Console)
+		if !ok {
+			Errorf("log console level (%s) is invalid.  Must be error, warn, info or none", c.Console)
+			valid = false
+		}
+		c.Console = level
+	}
+	for _, file := range c.Files {
+		if !file.Validate(configFile) {
+			valid = false
+		}
+	}
+	if c.Syslog != nil && !c.Syslog.Validate() {
+		valid = false
+	}
+	if c.Journald != nil && !c.Journald.Validate() {
+		valid = false
+	}
+	return valid
+}
+
+func (c *LogFileConfig) Validate(configFile string) bool {
+	valid := true
+	c.Path = strings.TrimSpace(c.Path)
+	if c.Path == "" {
+		Errorf("log file requires a path")
+		valid = false
+	} else if !filepath.IsAbs(c.Path) {
+		c.Path = filepath.Join(filepath.Dir(configFile), c.Path)
+	}
+	c.Level = strings.TrimSpace(c.Level)
+	if c.Level == "" {
+		c.Level = LevelInfo
+	} else if level, ok := parseLevel(c.Level); !ok {
+		Errorf("log file (%s) level (%s) is invalid.  Must be error, warn, info or none", c.Path, c.Level)
+		valid = false
+	} else {
+		c.Level = level
+	}
+	c.maxSize = defaultLogFileSize
+	if strings.TrimSpace(c.MaxSize) != "" {
+		size, err := ParseByteCount(c.MaxSize)
+		if err != nil || size < 1024 {
+			Errorf("log file (%s) max_size (%s) is invalid.  Must be at least 1K", c.Path, c.MaxSize)
+			valid = false
+		}
+		c.maxSize = size
+	}
+	if strings.TrimSpace(c.MaxAge) != "" {
+		age, err := time.ParseDuration(strings.TrimSpace(c.MaxAge))
+		if err != nil || age <= 0 {
+			Errorf("log file (%s) max_age (%s) is invalid.  Must be a positive duration (e.g. 168h)", c.Path, c.MaxAge)
+			valid = false
+		}
+		c.maxAge = age
+	}
+	if c.MaxBackups < 0 {
+		Errorf("log file (%s) max_backups (%d) cannot be negative", c.Path, c.MaxBackups)
+		valid = false
+	}
+	return valid
+}
+
+// StartLogging applies the console level and opens every log file
+func (c *LogConfig) StartLogging() bool {
+	if c == nil {
+		return true
+	}
+	for _, config := range c.Files {
+		if config.Level == LevelNone {
+			continue
+		}
+		file := &logFile{config: config}
+		if err := file.open(); err != nil {
+			Errorf("log file (%s) cannot be opened: %v", config.Path, err)
+			return false
+		}
+		file.prune()
+		addLogSink(config.Level, file.write)
+		if verboseFlag {
+			Infof("logging %s and above to %s", strings.ToLower(config.Level), config.Path)
+		}
+	}
+	if c.Syslog != nil && !c.Syslog.start() {
+		return false
+	}
+	if c.Journald != nil && !c.Journald.start() {
+		return false
+	}
+	if c.Console != "" {
+		logLock.Lock()
+		consoleLevel = c.Console
+		logLock.Unlock()
+	}
+	return true
+}
+
+func (f *logFile) open() error {
+	if err := os.MkdirAll(filepath.Dir(f.config.Path), 0700); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(f.config.Path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	f.file = file
+	f.size = 0
+	if fi, err := file.Stat(); err == nil {
+		f.size = fi.Size()
+	}
+	return nil
+}
+
+func (f *logFile) write(entry *logEntry) {
+	line := formatEntry(entry, true)
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.file == nil {
+		return
+	}
+	if f.size > 0 && f.size+int64(len(line)) > f.config.maxSize {
+		f.rotate()
+		if f.file == nil {
+			return
+		}
+	}
+	n, _ := f.file.WriteString(line)
+	f.size += int64(n)
+}
+
+// rotate renames the current file aside, with the time of rotation added to
+// its name, and starts a new one.
+func (f *logFile) rotate() {
+	_ = f.file.Close()
+	f.file = nil
+	ext := filepath.Ext(f.config.Path)
+	rotated := fmt.Sprintf("%s-%s%s", strings.TrimSuffix(f.config.Path, ext), time.Now().Format(rotatedLogTimeLayout), ext)
+	_ = os.Rename(f.config.Path, rotated)
+	if err := f.open(); err != nil {
+		// Logging here would recurse back into this sink
+		_, _ = fmt.Fprintf(os.Stderr, "log file (%s) cannot be reopened: %v\n", f.config.Path, err)
+		return
+	}
+	go f.prune()
+}
+
+// prune removes rotated files beyond max_backups or older than max_age
+func (f *logFile) prune() {
+	if f.config.MaxBackups == 0 && f.config.maxAge == 0 {
+		return
+	}
+	ext := filepath.Ext(f.config.Path)
+	dir := filepath.Dir(f.config.Path)
+	prefix := strings.TrimSuffix(filepath.Base(f.config.Path), ext) + "-"
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	// Only names rotate gave, so that siblings such as ferret-errors.log are
+	// left alone
+	var rotated []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, ext) || len(name) < len(prefix)+len(ext) {
+			continue
+		}
+		if _, err := time.Parse(rotatedLogTimeLayout, name[len(prefix):len(name)-len(ext)]); err == nil {
+			rotated = append(rotated, filepath.Join(dir, name))
+		}
+	}
+	// The rotation time in each name sorts chronologically, newest last
+	sort.Strings(rotated)
+	for i, path := range rotated {
+		expired := false
+		if f.config.MaxBackups > 0 && i < len(rotated)-f.config.MaxBackups {
+			expired = true
+		} else if f.config.maxAge > 0 {
+			if fi, err := os.Stat(path); err == nil && time.Since(fi.ModTime()) > f.config.maxAge {
+				expired = true
+			}
+		}
+		if expired {
+			_ = os.Remove(path)
+		}
+	}
+}
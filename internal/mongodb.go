@@ -0,0 +1,259 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+)
+
+// MongoDB wire protocol op codes carrying command replies
+const (
+	mongoOpReply = 1
+	mongoOpMsg   = 2013
+
+	mongoChecksumPresent = 1
+	// maxMongoHello bounds the replies inspected for replica set members, a
+	// hello reply being a few hundred bytes
+	maxMongoHello = 64 << 10
+)
+
+var errBSONInvalid = errors.New("bson document is invalid")
+
+// mongoMemberFields are the fields of a hello reply naming replica set members
+var mongoMemberFields = map[string]bool{
+	"hosts":    true,
+	"passives": true,
+	"arbiters": true,
+	"primary":  true,
+	"me":       true,
+}
+
+// mongodb wraps the replies of a connection to a replica set member, so the
+// members named in hello replies are reached through tunnels of their own
+func (c *clusterMembers) mongodb(replies io.Reader) io.Reader {
+	return &frameReader{
+		src:  replies,
+		head: 16,
+		size: func(head []byte) int {
+			return int(int32(binary.LittleEndian.Uint32(head)))
+		},
+		inspect: func(head []byte, size int) func([]byte) []byte {
+			opCode := binary.LittleEndian.Uint32(head[12:])
+			if (opCode != mongoOpMsg && opCode != mongoOpReply) || size > maxMongoHello {
+				return nil
+			}
+			return func(frame []byte) []byte {
+				rewritten, err := c.rewriteMongoReply(frame, opCode)
+				if err != nil {
+					Warnf("tunnel (%s) mongodb reply left as is: %v", c.tunnel.Name, err)
+					return frame
+				}
+				return rewritten
+			}
+		},
+	}
+}
+
+// rewriteMongoReply rewrites the members named by the reply's document, when it
+// is a hello reply from a replica set.  A checksum, which would no longer
+// match, is dropped.
+func (c *clusterMembers) rewriteMongoReply(frame []byte, opCode uint32) ([]byte, error) {
+	start, end := 36, len(frame) // responseFlags, cursorID, startingFrom, numberReturned
+	var flags uint32
+	if opCode == mongoOpMsg {
+		if len(frame) < 21 || frame[20] != 0 {
+			// Only a body section, kind 0, holds the reply
+			return frame, nil
+		}
+		flags = binary.LittleEndian.Uint32(frame[16:])
+		if flags&mongoChecksumPresent != 0 {
+			end -= 4
+		}
+		start = 21
+	}
+	if start+4 > end {
+		return frame, nil
+	}
+	size := int(int32(binary.LittleEndian.Uint32(frame[start:])))
+	if size < 5 || start+size > end {
+		return nil, errBSONInvalid
+	}
+	doc, changed, err := c.rewriteHello(frame[start : start+size])
+	if err != nil || !changed {
+		return frame, err
+	}
+
+	out := make([]byte, 0, len(frame)+len(doc)-size)
+	out = append(out, frame[:start]...)
+	out = append(out, doc...)
+	out = append(out, frame[start+size:end]...)
+	if opCode == mongoOpMsg {
+		binary.LittleEndian.PutUint32(out[16:], flags&^mongoChecksumPresent)
+	}
+	binary.LittleEndian.PutUint32(out, uint32(len(out)))
+	return out, nil
+}
+
+// rewriteHello replaces the member addresses of a hello, or isMaster, reply
+// from a replica set, reporting whether the document is one
+func (c *clusterMembers) rewriteHello(doc []byte) ([]byte, bool, error) {
+	elements, err := bsonElements(doc)
+	if err != nil {
+		return nil, false, err
+	}
+	replicaSet := false
+	for _, e := range elements {
+		if e.name == "setName" {
+			replicaSet = true
+		}
+	}
+	if !replicaSet {
+		return doc, false, nil
+	}
+
+	out := []byte{0, 0, 0, 0}
+	for _, e := range elements {
+		switch {
+		case !mongoMemberFields[e.name]:
+			out = append(out, e.raw...)
+		case e.kind == 0x02:
+			out = bsonAppendString(out, e.name, c.advertiseMember(bsonString(e.value)))
+		case e.kind == 0x04:
+			members, err := bsonElements(e.value)
+			if err != nil {
+				return nil, false, err
+			}
+			array := []byte{0, 0, 0, 0}
+			for i, member := range members {
+				if member.kind != 0x02 {
+					return nil, false, errBSONInvalid
+				}
+				array = bsonAppendString(array, strconv.Itoa(i), c.advertiseMember(bsonString(member.value)))
+			}
+			array = append(array, 0)
+			binary.LittleEndian.PutUint32(array, uint32(len(array)))
+			out = append(out, 0x04)
+			out = append(out, e.name...)
+			out = append(out, 0)
+			out = append(out, array...)
+		default:
+			out = append(out, e.raw...)
+		}
+	}
+	out = append(out, 0)
+	binary.LittleEndian.PutUint32(out, uint32(len(out)))
+	return out, true, nil
+}
+
+func (c *clusterMembers) advertiseMember(address string) string {
+	host, portText, err := net.SplitHostPort(address)
+	if err != nil {
+		// A member without a port uses the default
+		host, portText = address, "27017"
+	}
+	port, err := strconv.Atoi(portText)
+	if err != nil {
+		return address
+	}
+	host, port = c.advertise(host, port)
+	return net.JoinHostPort(host, strconv.Itoa(port))
+}
+
+type bsonElement struct {
+	kind  byte
+	name  string
+	value []byte
+	raw   []byte
+}
+
+// bsonElements splits a document into its elements
+func bsonElements(doc []byte) ([]bsonElement, error) {
+	if len(doc) < 5 || int(binary.LittleEndian.Uint32(doc)) != len(doc) || doc[len(doc)-1] != 0 {
+		return nil, errBSONInvalid
+	}
+	var elements []bsonElement
+	for p := 4; p < len(doc)-1; {
+		start := p
+		kind := doc[p]
+		end := bytes.IndexByte(doc[p+1:], 0)
+		if end < 0 {
+			return nil, errBSONInvalid
+		}
+		name := string(doc[p+1 : p+1+end])
+		p += end + 2
+		size, err := bsonValueSize(kind, doc[p:len(doc)-1])
+		if err != nil {
+			return nil, err
+		}
+		elements = append(elements, bsonElement{kind: kind, name: name, value: doc[p : p+size], raw: doc[start : p+size]})
+		p += size
+	}
+	return elements, nil
+}
+
+func bsonValueSize(kind byte, bs []byte) (int, error) {
+	length := func(extra int) (int, error) {
+		if len(bs) < 4 {
+			return 0, errBSONInvalid
+		}
+		return int(int32(binary.LittleEndian.Uint32(bs))) + extra, nil
+	}
+	var size int
+	var err error
+	switch kind {
+	case 0x06, 0x0A, 0x7F, 0xFF: // undefined, null, max and min key
+	case 0x08: // boolean
+		size = 1
+	case 0x10: // int32
+		size = 4
+	case 0x01, 0x09, 0x11, 0x12: // double, datetime, timestamp, int64
+		size = 8
+	case 0x07: // object id
+		size = 12
+	case 0x13: // decimal128
+		size = 16
+	case 0x02, 0x0D, 0x0E: // string, javascript, symbol
+		size, err = length(4)
+	case 0x03, 0x04, 0x0F: // document, array, javascript with scope
+		size, err = length(0)
+	case 0x05: // binary
+		size, err = length(5)
+	case 0x0C: // db pointer
+		size, err = length(16)
+	case 0x0B: // regular expression, two cstrings
+		pattern := bytes.IndexByte(bs, 0)
+		if pattern < 0 {
+			return 0, errBSONInvalid
+		}
+		options := bytes.IndexByte(bs[pattern+1:], 0)
+		if options < 0 {
+			return 0, errBSONInvalid
+		}
+		size = pattern + options + 2
+	default:
+		return 0, errBSONInvalid
+	}
+	if err != nil || size < 0 || size > len(bs) {
+		return 0, errBSONInvalid
+	}
+	return size, nil
+}
+
+func bsonString(value []byte) string {
+	if len(value) < 5 {
+		return ""
+	}
+	return string(value[4 : len(value)-1])
+}
+
+func bsonAppendString(out []byte, name string, value string) []byte {
+	out = append(out, 0x02)
+	out = append(out, name...)
+	out = append(out, 0)
+	out = binary.LittleEndian.AppendUint32(out, uint32(len(value)+1))
+	out = append(out, value...)
+	return append(out, 0)
+}
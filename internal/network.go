@@ -0,0 +1,80 @@
+package internal
+
+import (
+	"context"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	networkCheckInterval = 5 * time.Second
+	hostCheckTimeout     = 5 * time.Second
+)
+
+// MonitorNetwork watches for changes to the local interface addresses (VPN up/down,
+// a different WiFi network) and for the wall clock jumping ahead of the ticker
+// (wake from sleep).  Either means existing SSH connections may be dead without
+// having noticed yet, so every connected host is checked and rebuilt if necessary.
+func MonitorNetwork(ctx context.Context) {
+	ticker := time.NewTicker(networkCheckInterval)
+	defer ticker.Stop()
+	addresses := interfaceAddresses()
+	last := time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			// Round(0) strips the monotonic reading, which stops while asleep
+			now := time.Now()
+			slept := now.Round(0).Sub(last.Round(0)) > 2*networkCheckInterval
+			last = now
+			current := interfaceAddresses()
+			changed := current != addresses
+			addresses = current
+			if slept || changed {
+				if verboseFlag {
+					Infof("network change detected (wake:%t interfaces:%t), checking hosts", slept, changed)
+				}
+				checkHosts()
+			}
+		}
+	}
+}
+
+func interfaceAddresses() string {
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return ""
+	}
+	var list []string
+	for _, i := range interfaces {
+		// The interface of the routes is ferret's own
+		if i.Name == routesInterface {
+			continue
+		}
+		addrs, err := i.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			list = append(list, addr.String())
+		}
+	}
+	sort.Strings(list)
+	return strings.Join(list, ",")
+}
+
+func checkHosts() {
+	for _, host := range Hosts {
+		go func(h *Host) {
+			h.wakeRetry()
+			if h.Connected() && !h.Check(hostCheckTimeout) {
+				Warnf("host (%s) connection lost after network change, reconnecting", h.Name)
+				h.Reconnect()
+			}
+		}(host)
+	}
+}
@@ -0,0 +1,53 @@
+package internal
+
+import (
+	"runtime"
+	"strings"
+)
+
+// pipeScheme marks an address as a windows named pipe, written as docker does:
+// npipe:////./pipe/<name>
+const pipeScheme = "npipe://"
+
+// pipePrefix is the namespace every local named pipe lives in
+const pipePrefix = `\\.\pipe\`
+
+func (a *Address) validatePipe(group string, name string, attr string) bool {
+	a.valid = true
+	a.pipe = true
+	a.address = strings.ReplaceAll(strings.TrimPrefix(a.address, pipeScheme), "/", `\`)
+	if !strings.HasPrefix(strings.ToLower(a.address), pipePrefix) || len(a.address) == len(pipePrefix) {
+		Errorf("%s(%s) %s(%s) is invalid.  Required syntax is npipe:////./pipe/<name>", group, name, attr, a.String())
+		a.valid = false
+	} else if runtime.GOOS != "windows" {
+		Errorf("%s(%s) %s(%s) is invalid.  Named pipes are only supported on windows", group, name, attr, a.String())
+		a.valid = false
+	}
+	return a.valid
+}
+
+// IsPipe reports whether the address is a windows named pipe
+func (a *Address) IsPipe() bool {
+	return a.pipe
+}
+
+// checkLocalSDDL warns of a security descriptor without a pipe to protect.  Its
+// syntax is checked by windows when the pipe is created.
+func (t *Tunnel) checkLocalSDDL() {
+	t.LocalSDDL = strings.TrimSpace(t.LocalSDDL)
+	if t.LocalSDDL != "" && (t.Local == nil || !t.Local.IsPipe()) {
+		Warnf("tunnel (%s) local_sddl is ignored without a named pipe local address", t.Name)
+	}
+}
+
+// pipeAddr is the address of both ends of a named pipe connection, as the
+// client of a pipe has none of its own
+type pipeAddr string
+
+func (a pipeAddr) Network() string {
+	return "npipe"
+}
+
+func (a pipeAddr) String() string {
+	return string(a)
+}
@@ -0,0 +1,13 @@
+//go:build !windows
+
+package internal
+
+import (
+	"errors"
+	"net"
+)
+
+// listenPipe is unsupported, so named pipes cannot be entrances
+func listenPipe(string, string) (net.Listener, error) {
+	return nil, errors.New("named pipes are only supported on windows")
+}
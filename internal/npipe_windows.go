@@ -0,0 +1,314 @@
+//go:build windows
+
+package internal
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// pipeBufferSize is the size of the in and out buffers of each pipe instance
+const pipeBufferSize = 64 * 1024
+
+// pipeListener accepts the clients of a named pipe, keeping one instance of the
+// pipe waiting for the next client, as a pipe instance serves a single client
+type pipeListener struct {
+	path        string
+	sa          *windows.SecurityAttributes
+	acceptLock  sync.Mutex
+	next        windows.Handle
+	overlapped  windows.Overlapped
+	closed      windows.Handle
+	closedState atomic.Bool
+	closeOnce   sync.Once
+}
+
+// listenPipe opens a named pipe entrance that only the clients the security
+// descriptor allows may connect to, by default the user running ferret and the
+// system.  Clients from other machines are always refused.
+func listenPipe(path string, sddl string) (net.Listener, error) {
+	if sddl == "" {
+		user, err := windows.GetCurrentProcessToken().GetTokenUser()
+		if err != nil {
+			return nil, err
+		}
+		sddl = fmt.Sprintf("D:P(A;;GA;;;SY)(A;;GA;;;%s)", user.User.Sid.String())
+	}
+	sd, err := windows.SecurityDescriptorFromString(sddl)
+	if err != nil {
+		return nil, fmt.Errorf("local_sddl (%s) is invalid: %v", sddl, err)
+	}
+	l := &pipeListener{
+		path: path,
+		sa: &windows.SecurityAttributes{
+			Length:             uint32(unsafe.Sizeof(windows.SecurityAttributes{})),
+			SecurityDescriptor: sd,
+		},
+	}
+	if l.closed, err = windows.CreateEvent(nil, 1, 0, nil); err != nil {
+		return nil, err
+	}
+	if l.overlapped.HEvent, err = windows.CreateEvent(nil, 1, 0, nil); err != nil {
+		_ = windows.CloseHandle(l.closed)
+		return nil, err
+	}
+	// Only the first instance may create the pipe, so a pipe in use is refused
+	if l.next, err = l.create(windows.FILE_FLAG_FIRST_PIPE_INSTANCE); err != nil {
+		_ = windows.CloseHandle(l.closed)
+		_ = windows.CloseHandle(l.overlapped.HEvent)
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return l, nil
+}
+
+func (l *pipeListener) create(flags uint32) (windows.Handle, error) {
+	name, err := windows.UTF16PtrFromString(l.path)
+	if err != nil {
+		return windows.InvalidHandle, err
+	}
+	return windows.CreateNamedPipe(
+		name,
+		windows.PIPE_ACCESS_DUPLEX|windows.FILE_FLAG_OVERLAPPED|flags,
+		windows.PIPE_TYPE_BYTE|windows.PIPE_READMODE_BYTE|windows.PIPE_WAIT|windows.PIPE_REJECT_REMOTE_CLIENTS,
+		windows.PIPE_UNLIMITED_INSTANCES, pipeBufferSize, pipeBufferSize, 0, l.sa,
+	)
+}
+
+func (l *pipeListener) Accept() (net.Conn, error) {
+	l.acceptLock.Lock()
+	defer l.acceptLock.Unlock()
+	for {
+		if l.closedState.Load() {
+			return nil, l.opError(net.ErrClosed)
+		}
+		if l.next == windows.InvalidHandle {
+			next, err := l.create(0)
+			if err != nil {
+				return nil, l.opError(err)
+			}
+			l.next = next
+		}
+		err := windows.ConnectNamedPipe(l.next, &l.overlapped)
+		if err == windows.ERROR_IO_PENDING {
+			_, err = pipeWait(l.next, &l.overlapped, l.closed, time.Time{})
+		} else if err == windows.ERROR_PIPE_CONNECTED {
+			err = nil
+		}
+		if err == windows.ERROR_NO_DATA {
+			// The client left before it was connected, so the instance is replaced
+			_ = windows.CloseHandle(l.next)
+			l.next = windows.InvalidHandle
+			continue
+		} else if err != nil {
+			return nil, l.opError(err)
+		}
+		handle := l.next
+		l.next = windows.InvalidHandle
+		conn, err := newPipeConn(handle, l.path)
+		if err != nil {
+			_ = windows.CloseHandle(handle)
+			return nil, l.opError(err)
+		}
+		return conn, nil
+	}
+}
+
+// opError wraps the errors of accept as those of the net package are, so the
+// closing of the listener is recognised
+func (l *pipeListener) opError(err error) error {
+	return &net.OpError{Op: "accept", Net: "npipe", Addr: l.Addr(), Err: err}
+}
+
+func (l *pipeListener) Close() error {
+	l.closeOnce.Do(func() {
+		l.closedState.Store(true)
+		_ = windows.SetEvent(l.closed)
+		// Wait for a pending accept to be cancelled before its handles are closed
+		l.acceptLock.Lock()
+		defer l.acceptLock.Unlock()
+		if l.next != windows.InvalidHandle {
+			_ = windows.CloseHandle(l.next)
+		}
+		_ = windows.CloseHandle(l.overlapped.HEvent)
+		_ = windows.CloseHandle(l.closed)
+	})
+	return nil
+}
+
+func (l *pipeListener) Addr() net.Addr {
+	return pipeAddr(l.path)
+}
+
+// pipeConn is a connected named pipe instance, read and written with
+// overlapped IO so that reads and writes can be cancelled by Close and by
+// deadlines, which apply to the reads and writes started after they are set
+type pipeConn struct {
+	handle        windows.Handle
+	path          string
+	readLock      sync.Mutex
+	read          windows.Overlapped
+	writeLock     sync.Mutex
+	write         windows.Overlapped
+	readDeadline  atomic.Value
+	writeDeadline atomic.Value
+	closed        windows.Handle
+	closedState   atomic.Bool
+	closeOnce     sync.Once
+}
+
+func newPipeConn(handle windows.Handle, path string) (*pipeConn, error) {
+	c := &pipeConn{handle: handle, path: path}
+	var err error
+	if c.closed, err = windows.CreateEvent(nil, 1, 0, nil); err != nil {
+		return nil, err
+	}
+	if c.read.HEvent, err = windows.CreateEvent(nil, 1, 0, nil); err != nil {
+		_ = windows.CloseHandle(c.closed)
+		return nil, err
+	}
+	if c.write.HEvent, err = windows.CreateEvent(nil, 1, 0, nil); err != nil {
+		_ = windows.CloseHandle(c.closed)
+		_ = windows.CloseHandle(c.read.HEvent)
+		return nil, err
+	}
+	c.readDeadline.Store(time.Time{})
+	c.writeDeadline.Store(time.Time{})
+	return c, nil
+}
+
+func (c *pipeConn) Read(b []byte) (int, error) {
+	c.readLock.Lock()
+	defer c.readLock.Unlock()
+	if c.closedState.Load() {
+		return 0, c.opError("read", net.ErrClosed)
+	}
+	if len(b) == 0 {
+		return 0, nil
+	}
+	err := windows.ReadFile(c.handle, b, nil, &c.read)
+	if err != nil && err != windows.ERROR_IO_PENDING {
+		return 0, c.readError(err)
+	}
+	n, err := pipeWait(c.handle, &c.read, c.closed, c.readDeadline.Load().(time.Time))
+	if err != nil {
+		return int(n), c.readError(err)
+	}
+	if n == 0 {
+		return 0, io.EOF
+	}
+	return int(n), nil
+}
+
+func (c *pipeConn) readError(err error) error {
+	if err == windows.ERROR_BROKEN_PIPE || err == windows.ERROR_PIPE_NOT_CONNECTED {
+		return io.EOF
+	}
+	return c.opError("read", err)
+}
+
+func (c *pipeConn) Write(b []byte) (int, error) {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	written := 0
+	for written < len(b) {
+		if c.closedState.Load() {
+			return written, c.opError("write", net.ErrClosed)
+		}
+		err := windows.WriteFile(c.handle, b[written:], nil, &c.write)
+		if err != nil && err != windows.ERROR_IO_PENDING {
+			return written, c.opError("write", err)
+		}
+		n, err := pipeWait(c.handle, &c.write, c.closed, c.writeDeadline.Load().(time.Time))
+		written += int(n)
+		if err != nil {
+			return written, c.opError("write", err)
+		}
+	}
+	return written, nil
+}
+
+func (c *pipeConn) opError(op string, err error) error {
+	return &net.OpError{Op: op, Net: "npipe", Addr: pipeAddr(c.path), Err: err}
+}
+
+func (c *pipeConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.closedState.Store(true)
+		_ = windows.SetEvent(c.closed)
+		// Wait for pending reads and writes to be cancelled before closing
+		c.readLock.Lock()
+		c.writeLock.Lock()
+		defer c.readLock.Unlock()
+		defer c.writeLock.Unlock()
+		// Closing without disconnecting leaves the client to read what remains
+		_ = windows.CloseHandle(c.handle)
+		_ = windows.CloseHandle(c.read.HEvent)
+		_ = windows.CloseHandle(c.write.HEvent)
+		_ = windows.CloseHandle(c.closed)
+	})
+	return nil
+}
+
+func (c *pipeConn) LocalAddr() net.Addr {
+	return pipeAddr(c.path)
+}
+
+func (c *pipeConn) RemoteAddr() net.Addr {
+	return pipeAddr(c.path)
+}
+
+func (c *pipeConn) SetDeadline(t time.Time) error {
+	c.readDeadline.Store(t)
+	c.writeDeadline.Store(t)
+	return nil
+}
+
+func (c *pipeConn) SetReadDeadline(t time.Time) error {
+	c.readDeadline.Store(t)
+	return nil
+}
+
+func (c *pipeConn) SetWriteDeadline(t time.Time) error {
+	c.writeDeadline.Store(t)
+	return nil
+}
+
+// pipeWait waits for an overlapped operation to complete, cancelling it when
+// the closed event is set or the deadline passes
+func pipeWait(handle windows.Handle, overlapped *windows.Overlapped, closed windows.Handle, deadline time.Time) (uint32, error) {
+	timeout := uint32(windows.INFINITE)
+	if !deadline.IsZero() {
+		timeout = 0
+		if remaining := time.Until(deadline); remaining > 0 {
+			timeout = uint32(remaining.Milliseconds())
+		}
+	}
+	var cancelled error
+	event, err := windows.WaitForMultipleObjects([]windows.Handle{overlapped.HEvent, closed}, false, timeout)
+	switch {
+	case err != nil:
+		cancelled = err
+	case event == windows.WAIT_OBJECT_0:
+	case event == windows.WAIT_OBJECT_0+1:
+		cancelled = net.ErrClosed
+	default:
+		cancelled = os.ErrDeadlineExceeded
+	}
+	if cancelled != nil {
+		_ = windows.CancelIoEx(handle, overlapped)
+	}
+	var n uint32
+	err = windows.GetOverlappedResult(handle, overlapped, &n, true)
+	if err == windows.ERROR_OPERATION_ABORTED && cancelled != nil {
+		err = cancelled
+	}
+	return n, err
+}
@@ -0,0 +1,15 @@
+//go:build !linux && !darwin
+
+package internal
+
+import (
+	"errors"
+	"net"
+)
+
+const peerCredentials = false
+
+// peerUID is unsupported, so tenants cannot be used
+func peerUID(net.Conn) (int, error) {
+	return 0, errors.New("peer credentials are unsupported")
+}
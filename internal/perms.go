@@ -0,0 +1,94 @@
+package internal
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+)
+
+// strictPermissions fails, rather than warns of, a config or identity file
+// that others may read or that belongs to another user
+var strictPermissions bool
+
+// SetStrictPermissions sets whether files with unsafe permissions are refused
+func SetStrictPermissions(strict bool) {
+	strictPermissions = strict
+}
+
+// checkPermissions refuses, as OpenSSH does, files of secrets accessible by
+// others or owned by another user, or when not strict only warns of them.
+// Ownership is not checked for files of a tenant, which belong to the tenant.
+func checkPermissions(what string, path string, owned bool) bool {
+	problem := permissionProblem(path, owned)
+	if problem == "" {
+		return true
+	}
+	if strictPermissions {
+		Errorf("%s (%s) %s.  ferret fixperms corrects permissions", what, path, problem)
+		return false
+	}
+	Warnf("%s (%s) %s.  ferret fixperms corrects permissions", what, path, problem)
+	return true
+}
+
+func permissionProblem(path string, owned bool) string {
+	if runtime.GOOS == "windows" {
+		// Access is by ACL, which file modes do not reflect
+		return ""
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return ""
+	}
+	if mode := fi.Mode().Perm(); mode&0077 != 0 {
+		return fmt.Sprintf("is accessible by others (mode %04o)", mode)
+	}
+	if uid, ok := fileOwner(fi); ok && owned && uid != os.Getuid() && uid != 0 {
+		return fmt.Sprintf("is owned by another user (uid %d)", uid)
+	}
+	return ""
+}
+
+// FixPermissions removes the access of others to the config files and the
+// identity files of the config's hosts
+func FixPermissions(config *Configuration, files ...string) bool {
+	hosts := config.Hosts
+	for _, tenant := range config.Tenants {
+		hosts = append(hosts, tenant.Hosts...)
+	}
+	for _, host := range hosts {
+		for _, identity := range host.Identity.trimmed() {
+			if !secretReference(identity) {
+				files = append(files, identity)
+			}
+		}
+	}
+	ok := true
+	fixed := make(map[string]bool)
+	for _, file := range files {
+		if file = strings.TrimSpace(file); file == "" || fixed[file] {
+			continue
+		}
+		fixed[file] = true
+		fi, err := os.Stat(file)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			Errorf("file (%s) cannot be read: %v", file, err)
+			ok = false
+			continue
+		}
+		mode := fi.Mode().Perm()
+		if mode&0077 == 0 {
+			continue
+		}
+		if err = os.Chmod(file, mode&^0077); err != nil {
+			Errorf("file (%s) permissions cannot be corrected: %v", file, err)
+			ok = false
+			continue
+		}
+		Infof("file (%s) mode changed from %04o to %04o", file, mode, mode&^0077)
+	}
+	return ok
+}
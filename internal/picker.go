@@ -0,0 +1,204 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"golang.org/x/term"
+)
+
+const (
+	selectionFile = "selection.json"
+	unlabeled     = "(unlabeled)"
+)
+
+type pickerRow struct {
+	group  string
+	tunnel *Tunnel
+}
+
+// PickTunnels presents the configured tunnels, grouped by label, as a checklist
+// on the terminal and keeps only the tunnels chosen.  The choice is remembered
+// and offered as the starting selection next time.
+func (c *Configuration) PickTunnels() bool {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		Errorf("interactive mode requires a terminal")
+		return false
+	}
+	if len(c.Tunnels) == 0 {
+		Errorf("no tunnels are configured")
+		return false
+	}
+
+	selected := c.loadSelection()
+	rows := pickerRows(c.Tunnels)
+	state, err := term.MakeRaw(fd)
+	if err != nil {
+		Errorf("interactive mode cannot control the terminal: %v", err)
+		return false
+	}
+	ok := pick(rows, selected)
+	_ = term.Restore(fd, state)
+	if !ok {
+		Infof("interactive selection cancelled")
+		return false
+	}
+
+	var tunnels []*Tunnel
+	var names []string
+	for _, tunnel := range c.Tunnels {
+		if selected[tunnel.Name] {
+			tunnels = append(tunnels, tunnel)
+			names = append(names, tunnel.Name)
+		}
+	}
+	if len(tunnels) == 0 {
+		Errorf("no tunnels selected")
+		return false
+	}
+	c.Tunnels = tunnels
+	c.saveSelection(names)
+	return true
+}
+
+// pickerRows lists each label as a group heading followed by its tunnels.  A
+// tunnel with several labels appears under each of them.
+func pickerRows(tunnels []*Tunnel) []*pickerRow {
+	groups := make(map[string][]*Tunnel)
+	for _, tunnel := range tunnels {
+		if len(tunnel.Labels) == 0 {
+			groups[unlabeled] = append(groups[unlabeled], tunnel)
+		}
+		for _, label := range tunnel.Labels {
+			groups[label] = append(groups[label], tunnel)
+		}
+	}
+	labels := make([]string, 0, len(groups))
+	for label := range groups {
+		if label != unlabeled {
+			labels = append(labels, label)
+		}
+	}
+	sort.Strings(labels)
+	if _, ok := groups[unlabeled]; ok {
+		labels = append(labels, unlabeled)
+	}
+
+	var rows []*pickerRow
+	for _, label := range labels {
+		rows = append(rows, &pickerRow{group: label})
+		for _, tunnel := range groups[label] {
+			rows = append(rows, &pickerRow{group: label, tunnel: tunnel})
+		}
+	}
+	return rows
+}
+
+// pick runs the checklist until the selection is confirmed with enter, or
+// abandoned with q, escape or ctrl-c.  Space toggles a tunnel, or every tunnel
+// of a group when on its heading, and a toggles all tunnels.
+func pick(rows []*pickerRow, selected map[string]bool) bool {
+	cursor := 0
+	drawn := 0
+	buf := make([]byte, 8)
+	for {
+		drawn = drawPicker(rows, selected, cursor, drawn)
+		n, err := os.Stdin.Read(buf)
+		if err != nil {
+			return false
+		}
+		switch key := string(buf[:n]); key {
+		case "\x1b[A", "k":
+			cursor = (cursor + len(rows) - 1) % len(rows)
+		case "\x1b[B", "j":
+			cursor = (cursor + 1) % len(rows)
+		case " ":
+			toggle(rows, selected, rows[cursor].group, rows[cursor].tunnel)
+		case "a":
+			toggle(rows, selected, "", nil)
+		case "\r", "\n":
+			fmt.Print("\r\n")
+			return true
+		case "q", "\x1b", "\x03":
+			fmt.Print("\r\n")
+			return false
+		}
+	}
+}
+
+// toggle flips a single tunnel, or when tunnel is nil every tunnel in group (or
+// all tunnels when group is blank); all become selected unless all already were.
+func toggle(rows []*pickerRow, selected map[string]bool, group string, tunnel *Tunnel) {
+	if tunnel != nil {
+		selected[tunnel.Name] = !selected[tunnel.Name]
+		return
+	}
+	all := true
+	for _, row := range rows {
+		if row.tunnel != nil && (group == "" || row.group == group) {
+			all = all && selected[row.tunnel.Name]
+		}
+	}
+	for _, row := range rows {
+		if row.tunnel != nil && (group == "" || row.group == group) {
+			selected[row.tunnel.Name] = !all
+		}
+	}
+}
+
+func drawPicker(rows []*pickerRow, selected map[string]bool, cursor int, drawn int) int {
+	sb := &strings.Builder{}
+	if drawn > 0 {
+		fmt.Fprintf(sb, "\x1b[%dA", drawn)
+	}
+	sb.WriteString("\r\x1b[JSelect tunnels to start (space toggles, a all, enter starts, q quits)\r\n")
+	for i, row := range rows {
+		pointer := "  "
+		if i == cursor {
+			pointer = "> "
+		}
+		if row.tunnel == nil {
+			fmt.Fprintf(sb, "%s%s\r\n", pointer, row.group)
+			continue
+		}
+		check := " "
+		if selected[row.tunnel.Name] {
+			check = "x"
+		}
+		fmt.Fprintf(sb, "%s  [%s] %s\r\n", pointer, check, row.tunnel.Name)
+	}
+	fmt.Print(sb.String())
+	return len(rows) + 1
+}
+
+func (c *Configuration) selectionPath() string {
+	return filepath.Join(filepath.Dir(c.file), selectionFile)
+}
+
+// loadSelection returns the last selection, or all tunnels when there is none
+func (c *Configuration) loadSelection() map[string]bool {
+	selected := make(map[string]bool)
+	var names []string
+	if bs, err := os.ReadFile(c.selectionPath()); err == nil && json.Unmarshal(bs, &names) == nil {
+		for _, name := range names {
+			selected[name] = true
+		}
+		return selected
+	}
+	for _, tunnel := range c.Tunnels {
+		selected[tunnel.Name] = true
+	}
+	return selected
+}
+
+func (c *Configuration) saveSelection(names []string) {
+	bs, _ := json.Marshal(names)
+	if err := os.WriteFile(c.selectionPath(), bs, 0600); err != nil {
+		Warnf("tunnel selection cannot be remembered: %v", err)
+	}
+}
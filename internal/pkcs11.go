@@ -0,0 +1,192 @@
+package internal
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// pkcs11Loaded are the modules whose keys ferret loaded into the agent, to be
+// removed again on shutdown
+var pkcs11Loaded = struct {
+	lock    sync.Mutex
+	modules map[string]bool
+}{modules: make(map[string]bool)}
+
+// pivSlots are the labels OpenSSH gives the keys in each PIV slot
+var pivSlots = map[string]string{
+	"9a": "PIV AUTH",
+	"9c": "SIGN",
+	"9d": "KEY MGMT",
+	"9e": "CARD AUTH",
+}
+
+// PKCS11Config authenticates with the keys of a smartcard or security key, such
+// as a YubiKey in PIV mode, through its PKCS#11 module.  The keys are loaded into
+// ssh-agent by ssh-add, so the private keys never leave the token, and removed
+// again when ferret stops.  Slot is a PIV
+// slot (9a, 9c, 9d or 9e) or a key label, and the PIN is prompted for unless
+// given, optionally as a secret reference.
+type PKCS11Config struct {
+	Module string `yaml:"module" json:"module"`
+	Slot   string `yaml:"slot,omitempty" json:"slot,omitempty"`
+	PIN    Secret `yaml:"pin,omitempty" json:"pin,omitempty"`
+	lock   sync.Mutex
+	keys   [][]byte
+}
+
+func (c *PKCS11Config) Validate(host string) bool {
+	c.Module = strings.TrimSpace(c.Module)
+	if c.Module == "" {
+		Errorf("host (%s) pkcs11 requires a module", host)
+		return false
+	}
+	if _, err := os.Stat(c.Module); err != nil {
+		Errorf("host (%s) pkcs11 module (%s) cannot be read: %v", host, c.Module, err)
+		return false
+	}
+	c.Slot = strings.TrimSpace(c.Slot)
+	c.PIN = Secret(strings.TrimSpace(string(c.PIN)))
+	keys, err := c.tokenKeys()
+	if err != nil {
+		Errorf("host (%s) pkcs11 token keys cannot be read: %v", host, err)
+		return false
+	}
+	c.keys = keys
+	if _, err = c.signers(); err != nil {
+		Warnf("host (%s) pkcs11 keys cannot be loaded into ssh-agent yet: %v", host, err)
+	}
+	return true
+}
+
+// tokenKeys lists the public keys on the token, in the slot when one is given
+func (c *PKCS11Config) tokenKeys() ([][]byte, error) {
+	stderr := &bytes.Buffer{}
+	cmd := exec.Command("ssh-keygen", "-D", c.Module)
+	cmd.Stderr = stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if message := strings.TrimSpace(stderr.String()); message != "" {
+			return nil, fmt.Errorf("ssh-keygen failed: %s", message)
+		}
+		return nil, fmt.Errorf("ssh-keygen failed: %w", err)
+	}
+	label, ok := pivSlots[strings.ToLower(c.Slot)]
+	if !ok {
+		label = c.Slot
+	}
+	var keys [][]byte
+	for _, line := range strings.Split(string(out), "\n") {
+		key, comment, _, _, err := ssh.ParseAuthorizedKey([]byte(line))
+		if err != nil {
+			continue
+		}
+		if label == "" || strings.Contains(strings.ToLower(comment), strings.ToLower(label)) {
+			keys = append(keys, key.Marshal())
+		}
+	}
+	if len(keys) == 0 && c.Slot != "" {
+		return nil, fmt.Errorf("no keys found in slot (%s)", c.Slot)
+	} else if len(keys) == 0 {
+		return nil, errors.New("no keys found")
+	}
+	return keys, nil
+}
+
+// signers returns the agent's signers for the token's keys, loading them into
+// the agent first when they are missing, as they are once the agent restarts
+func (c *PKCS11Config) signers() ([]ssh.Signer, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	signers, err := c.agentSigners()
+	if err != nil || len(signers) > 0 {
+		return signers, err
+	}
+	if err = c.load(); err != nil {
+		return nil, err
+	}
+	if signers, err = c.agentSigners(); err == nil && len(signers) == 0 {
+		err = errors.New("token keys are not held by ssh-agent")
+	}
+	return signers, err
+}
+
+func (c *PKCS11Config) agentSigners() ([]ssh.Signer, error) {
+	all, err := agentSigners()
+	if err != nil {
+		return nil, err
+	}
+	var signers []ssh.Signer
+	for _, signer := range all {
+		for _, key := range c.keys {
+			if bytes.Equal(signer.PublicKey().Marshal(), key) {
+				signers = append(signers, signer)
+			}
+		}
+	}
+	return signers, nil
+}
+
+// load adds the token's keys to the agent, ssh-add prompting for the PIN on the
+// terminal unless it is configured, when it is written to ssh-add's stdin
+func (c *PKCS11Config) load() error {
+	cmd := exec.Command("ssh-add", "-s", c.Module)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stderr
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = io.MultiWriter(os.Stderr, stderr)
+	if c.PIN != "" {
+		pin := []byte(c.PIN)
+		if secretReference(string(c.PIN)) {
+			secret, err := resolveSecret(string(c.PIN), "pin")
+			if err != nil {
+				return err
+			}
+			pin = secret
+		}
+		defer clear(pin)
+		// Without a terminal, and never asking an SSH_ASKPASS program, ssh-add
+		// reads the PIN from stdin
+		cmd.Stdin = io.MultiReader(bytes.NewReader(pin), strings.NewReader("\n"))
+		cmd.Env = append(os.Environ(), "SSH_ASKPASS_REQUIRE=never")
+	}
+	if err := cmd.Run(); err != nil {
+		if strings.Contains(stderr.String(), "agent refused operation") {
+			return fmt.Errorf("ssh-agent refused to load %s.  An agent started with -P loads only the providers it allows", c.Module)
+		}
+		if message := strings.TrimSpace(stderr.String()); message != "" {
+			return fmt.Errorf("ssh-add failed: %s", message)
+		}
+		return fmt.Errorf("ssh-add failed: %w", err)
+	}
+	pkcs11Loaded.lock.Lock()
+	pkcs11Loaded.modules[c.Module] = true
+	pkcs11Loaded.lock.Unlock()
+	return nil
+}
+
+// unloadPKCS11 removes the keys of the modules ferret loaded from the agent, so
+// they are not left usable once it has stopped
+func unloadPKCS11() {
+	pkcs11Loaded.lock.Lock()
+	defer pkcs11Loaded.lock.Unlock()
+	for module := range pkcs11Loaded.modules {
+		stderr := &bytes.Buffer{}
+		cmd := exec.Command("ssh-add", "-e", module)
+		cmd.Stderr = stderr
+		if err := cmd.Run(); err != nil {
+			if message := strings.TrimSpace(stderr.String()); message != "" {
+				err = errors.New(message)
+			}
+			Warnf("pkcs11 module (%s) keys cannot be removed from ssh-agent: %v", module, err)
+		}
+		delete(pkcs11Loaded.modules, module)
+	}
+}
@@ -0,0 +1,125 @@
+package internal
+
+import (
+	"net"
+	"os"
+
+	"gopkg.in/yaml.v3"
+)
+
+var policy *Policy
+
+// Policy is an optional, administrator owned set of constraints that every
+// user configuration must satisfy.
+type Policy struct {
+	DenyWildcardBind    bool       `yaml:"deny_wildcard_bind" json:"deny_wildcard_bind"`
+	AllowedDestinations []string   `yaml:"allowed_destinations" json:"allowed_destinations"`
+	RequireKnownHosts   bool       `yaml:"require_known_hosts" json:"require_known_hosts"`
+	Admission           *Admission `yaml:"admission" json:"admission"`
+	networks            []*net.IPNet
+}
+
+// LoadPolicy reads the policy file, if present, and enforces it during all
+// subsequent validation.  A missing policy file is not an error.
+func LoadPolicy(policyFile string) bool {
+	fi, err := os.Stat(policyFile)
+	if os.IsNotExist(err) {
+		return true
+	} else if err != nil {
+		Errorf("policy file (%s) cannot be read: %v", policyFile, err)
+		return false
+	} else if fi.IsDir() {
+		Errorf("policy file (%s) cannot be read: file is a directory", policyFile)
+		return false
+	}
+	bs, err := os.ReadFile(policyFile)
+	if err != nil {
+		Errorf("policy file (%s) cannot be read: %v", policyFile, err)
+		return false
+	}
+
+	p := &Policy{}
+	if err = yaml.Unmarshal(bs, p); err != nil {
+		Errorf("policy file (%s) cannot be parsed: %v", policyFile, err)
+		return false
+	}
+	for _, cidr := range p.AllowedDestinations {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			Errorf("policy file (%s) allowed destination (%s) is invalid: %v", policyFile, cidr, err)
+			return false
+		}
+		p.networks = append(p.networks, network)
+	}
+	if p.Admission != nil && !p.Admission.Validate("policy") {
+		return false
+	}
+	if verboseFlag {
+		Infof("Using policy file: %s", policyFile)
+	}
+	policy = p
+	return true
+}
+
+func (p *Policy) checkHost(h *Host) bool {
+	if p == nil {
+		return true
+	}
+	if p.RequireKnownHosts && h.KnownHosts == "" {
+		Errorf("host (%s) requires a known_hosts file by policy", h.Name)
+		return false
+	}
+	return true
+}
+
+func (p *Policy) checkTunnel(t *Tunnel) bool {
+	if p == nil {
+		return true
+	}
+	valid := true
+	if p.DenyWildcardBind && t.Local != nil && t.Local.IsValid() && !t.Local.IsUnix() && !t.Local.IsPipe() {
+		switch t.Local.Host() {
+		case "", "0.0.0.0", "::", "[::]":
+			Errorf("tunnel (%s) local address (%s) binds all interfaces, denied by policy", t.Name, t.Local.address)
+			valid = false
+		}
+	}
+	for _, forward := range append(t.targets(), t.routeTargets()...) {
+		if len(p.networks) > 0 && forward.IsUnix() {
+			Errorf("tunnel (%s) forward address (%s) is a unix socket, which is not an allowed destination by policy", t.Name, forward.address)
+			valid = false
+		} else if len(p.networks) > 0 && forward.IsValid() && !p.allowedDestination(forward.Host()) {
+			Errorf("tunnel (%s) forward address (%s) is not an allowed destination by policy", t.Name, forward.Host())
+			valid = false
+		}
+	}
+	return valid
+}
+
+// allowedDestination requires every address a destination resolves to, to
+// fall within one of the allowed networks.  Destinations that cannot be
+// resolved locally cannot be verified and are therefore denied.
+func (p *Policy) allowedDestination(host string) bool {
+	var ips []net.IP
+	if ip := net.ParseIP(host); ip != nil {
+		ips = []net.IP{ip}
+	} else if resolved, err := net.LookupIP(host); err == nil {
+		ips = resolved
+	}
+	if len(ips) == 0 {
+		return false
+	}
+	for _, ip := range ips {
+		allowed := false
+		for _, network := range p.networks {
+			if network.Contains(ip) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return false
+		}
+	}
+	return true
+}
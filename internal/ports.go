@@ -0,0 +1,147 @@
+package internal
+
+import (
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// freePortAttempts bounds how many ports the system may offer, when no range
+// is configured, before giving up on finding one that isn't excluded
+const freePortAttempts = 20
+
+// defaultExcludedPorts are the ports of common development servers, never
+// taken by ferret for itself even when the system would hand them out
+var defaultExcludedPorts = []string{
+	"1433", "1521", "2375-2376", "3000-3001", "3306", "4200", "5000", "5173", "5432", "5672", "6379",
+	"8000", "8080-8081", "8443", "8888", "9000", "9090", "9092", "9200", "9300", "11211", "27017",
+}
+
+var ports = &PortsConfig{excluded: parsePortRanges(defaultExcludedPorts)}
+
+// PortsConfig controls the ports ferret picks for itself, for the entrances of
+// jump hosts and cluster members.  The system picks them unless a range is
+// given, and in either case those excluded, as well as the ports of common
+// development servers, are passed over.
+type PortsConfig struct {
+	Range    string   `yaml:"range,omitempty" json:"range,omitempty"`
+	Exclude  []string `yaml:"exclude,omitempty" json:"exclude,omitempty"`
+	min      int
+	max      int
+	excluded [][2]int
+}
+
+func (c *PortsConfig) Validate() bool {
+	valid := true
+	c.Range = strings.TrimSpace(c.Range)
+	if c.Range != "" {
+		if r, ok := parsePortRange(c.Range); !ok {
+			Errorf("ports range (%s) is invalid.  Must be <first>-<last>, e.g. 20000-29999", c.Range)
+			valid = false
+		} else {
+			c.min, c.max = r[0], r[1]
+		}
+	}
+	c.excluded = parsePortRanges(defaultExcludedPorts)
+	for _, exclude := range c.Exclude {
+		r, ok := parsePortRange(strings.TrimSpace(exclude))
+		if !ok {
+			Errorf("ports exclude (%s) is invalid.  Must be a port or a range, e.g. 8000-8099", exclude)
+			valid = false
+			continue
+		}
+		c.excluded = append(c.excluded, r)
+	}
+	if valid && c.min != 0 && c.available() == 0 {
+		Errorf("ports range (%s) has no ports that are not excluded", c.Range)
+		valid = false
+	}
+	ports = c
+	return valid
+}
+
+func parsePortRanges(specs []string) [][2]int {
+	ranges := make([][2]int, 0, len(specs))
+	for _, spec := range specs {
+		if r, ok := parsePortRange(spec); ok {
+			ranges = append(ranges, r)
+		}
+	}
+	return ranges
+}
+
+// parsePortRange reads a port, e.g. 8080, or an inclusive range, e.g. 8000-8099
+func parsePortRange(spec string) ([2]int, bool) {
+	first, last, found := strings.Cut(spec, "-")
+	if !found {
+		last = first
+	}
+	from, err := strconv.Atoi(strings.TrimSpace(first))
+	if err != nil {
+		return [2]int{}, false
+	}
+	to, err := strconv.Atoi(strings.TrimSpace(last))
+	if err != nil || from < 1 || to > 65535 || from > to {
+		return [2]int{}, false
+	}
+	return [2]int{from, to}, true
+}
+
+func (c *PortsConfig) excludes(port int) bool {
+	for _, r := range c.excluded {
+		if port >= r[0] && port <= r[1] {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *PortsConfig) available() int {
+	count := 0
+	for port := c.min; port <= c.max; port++ {
+		if !c.excludes(port) {
+			count++
+		}
+	}
+	return count
+}
+
+// freePort opens a listener on a port ferret may take for itself.  The
+// listener is handed to the tunnel that the port is for, rather than closed
+// and the port bound again, so that nothing else can take the port between.
+func freePort(host string) (net.Listener, int32, bool) {
+	if ports.min == 0 {
+		var passed []net.Listener
+		defer func() {
+			for _, listener := range passed {
+				_ = listener.Close()
+			}
+		}()
+		for attempt := 0; attempt < freePortAttempts; attempt++ {
+			listener, err := net.Listen("tcp", net.JoinHostPort(host, "0"))
+			if err != nil {
+				return nil, -1, false
+			}
+			port := listener.Addr().(*net.TCPAddr).Port
+			if !ports.excludes(port) {
+				return listener, int32(port), true
+			}
+			// Held until a port is found, so the system offers another
+			passed = append(passed, listener)
+		}
+		return nil, -1, false
+	}
+	span := ports.max - ports.min + 1
+	start := rand.Intn(span)
+	for i := 0; i < span; i++ {
+		port := ports.min + (start+i)%span
+		if ports.excludes(port) {
+			continue
+		}
+		if listener, err := net.Listen("tcp", net.JoinHostPort(host, strconv.Itoa(port))); err == nil {
+			return listener, int32(port), true
+		}
+	}
+	return nil, -1, false
+}
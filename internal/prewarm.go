@@ -0,0 +1,60 @@
+package internal
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// PrewarmHosts connects, in parallel, to the hosts used by tunnels that have
+// prewarm set, or to all of them when all is set, so the first connection to a
+// tunnel doesn't wait on the SSH handshake.  Keyboard-interactive hosts are
+// left to OpenInteractiveHosts, whose prompts must take turns.  Prewarmed
+// connections are not closed when idle.
+func PrewarmHosts(all bool) {
+	hosts := make([]*Host, 0, len(Hosts))
+	for _, h := range Hosts {
+		if h.valid && h.isHost && !h.KeyboardInteractive && (all || h.Prewarm) {
+			h.keepOpen = true
+			hosts = append(hosts, h)
+		}
+	}
+	openHosts(hosts, "prewarmed")
+}
+
+// openHosts connects to the hosts in parallel, summarising how many did and
+// how long they took
+func openHosts(hosts []*Host, what string) {
+	if len(hosts) == 0 {
+		return
+	}
+	sort.Slice(hosts, func(i, j int) bool {
+		return hosts[i].Name < hosts[j].Name
+	})
+
+	start := time.Now()
+	opened := make([]bool, len(hosts))
+	wg := sync.WaitGroup{}
+	for i, h := range hosts {
+		wg.Add(1)
+		go func(i int, h *Host) {
+			defer wg.Done()
+			began := time.Now()
+			opened[i] = h.Open()
+			if opened[i] && verboseFlag {
+				Infof("host (%s) %s in %s", h.Name, what, time.Since(began).Round(time.Millisecond))
+			}
+		}(i, h)
+	}
+	wg.Wait()
+
+	connected := 0
+	for i, h := range hosts {
+		if opened[i] {
+			connected++
+		} else {
+			Warnf("host (%s) not yet connected, will retry", h.Name)
+		}
+	}
+	Infof("%s %d of %d hosts in %s", what, connected, len(hosts), time.Since(start).Round(time.Millisecond))
+}
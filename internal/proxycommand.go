@@ -0,0 +1,199 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// proxyStderrLimit is how much of what a proxy_command writes to stderr is kept
+// to report should it exit
+const proxyStderrLimit = 1024
+
+// validateProxyCommand reads proxy_command, a local command whose standard input
+// and output carry the SSH connection, as the ProxyCommand of OpenSSH, for hosts
+// reached through connectors such as aws ssm start-session.  The command may
+// contain {host}, {port} and {username}, replaced by those of the host.
+func (h *Host) validateProxyCommand() bool {
+	h.ProxyCommand = strings.TrimSpace(h.ProxyCommand)
+	if h.ProxyCommand == "" {
+		return true
+	}
+	valid := true
+	if h.JumpHost != "" || h.Websocket != "" || h.Relay != nil {
+		Errorf("host (%s) proxy_command cannot be combined with a jump_host, websocket or relay", h.Name)
+		valid = false
+	}
+	if h.SourceAddress != "" {
+		Errorf("host (%s) source_address cannot be used with a proxy_command", h.Name)
+		valid = false
+	}
+	return valid
+}
+
+// dialProxy starts the proxy_command, returning a connection carried by its
+// standard input and output
+func (h *Host) dialProxy(address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	command := strings.NewReplacer(
+		"{host}", shellQuote(host),
+		"{port}", shellQuote(port),
+		"{username}", shellQuote(h.Username),
+	).Replace(h.ProxyCommand)
+	if runtime.GOOS != "windows" {
+		// exec has the shell replaced by the command, so that it is the
+		// process stopped on closing
+		command = "exec " + command
+	}
+	cmd := shellCommand(context.Background(), command)
+	cmd.Env = append(os.Environ(), "FERRET_HOST="+h.Name)
+	// Pipes of its own, unlike those of exec, are not closed by Wait before
+	// all the command wrote has been read
+	stdinReader, stdin, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, stdoutWriter, err := os.Pipe()
+	if err != nil {
+		_, _ = stdinReader.Close(), stdin.Close()
+		return nil, err
+	}
+	stderr := &limitedBuffer{limit: proxyStderrLimit}
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = stdinReader, stdoutWriter, stderr
+	// Children of the command may hold its stderr open
+	cmd.WaitDelay = time.Second
+	err = cmd.Start()
+	_, _ = stdinReader.Close(), stdoutWriter.Close()
+	if err != nil {
+		_, _ = stdin.Close(), stdout.Close()
+		return nil, fmt.Errorf("proxy_command cannot be started: %v", err)
+	}
+	if verboseFlag {
+		Infof("host (%s) proxy_command started, pid %d", h.Name, cmd.Process.Pid)
+	}
+	conn := &proxyConn{
+		cmd:    cmd,
+		stdin:  stdin,
+		stdout: stdout,
+		stderr: stderr,
+		remote: commandAddr(address),
+		exited: make(chan struct{}),
+	}
+	go func() {
+		conn.err = cmd.Wait()
+		close(conn.exited)
+	}()
+	return conn, nil
+}
+
+// proxyConn is a connection carried by a local command's standard input and output
+type proxyConn struct {
+	cmd    *exec.Cmd
+	stdin  *os.File
+	stdout *os.File
+	stderr *limitedBuffer
+	remote net.Addr
+	once   sync.Once
+	exited chan struct{}
+	err    error
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	n, err := c.stdout.Read(b)
+	if err != nil && n == 0 {
+		return 0, c.exitError(err)
+	}
+	return n, err
+}
+
+func (c *proxyConn) Write(b []byte) (int, error) {
+	n, err := c.stdin.Write(b)
+	if err != nil {
+		return n, c.exitError(err)
+	}
+	return n, nil
+}
+
+// exitError reports the command having exited, with what it wrote to stderr,
+// as the cause of the connection ending, unless closed here
+func (c *proxyConn) exitError(err error) error {
+	select {
+	case <-c.exited:
+	case <-time.After(100 * time.Millisecond):
+		return err
+	}
+	message := strings.TrimSpace(c.stderr.String())
+	switch {
+	case message != "":
+		return fmt.Errorf("proxy_command exited: %s", message)
+	case c.err != nil:
+		return fmt.Errorf("proxy_command exited: %v", c.err)
+	}
+	return err
+}
+
+func (c *proxyConn) Close() error {
+	c.once.Do(func() {
+		_ = c.stdin.Close()
+		select {
+		case <-c.exited:
+		case <-time.After(time.Second):
+			_ = c.cmd.Process.Kill()
+		}
+		_ = c.stdout.Close()
+	})
+	return nil
+}
+
+func (c *proxyConn) LocalAddr() net.Addr {
+	return commandAddr("proxy_command:" + strconv.Itoa(c.cmd.Process.Pid))
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *proxyConn) SetDeadline(time.Time) error {
+	return errCommandDeadline
+}
+
+func (c *proxyConn) SetReadDeadline(time.Time) error {
+	return errCommandDeadline
+}
+
+func (c *proxyConn) SetWriteDeadline(time.Time) error {
+	return errCommandDeadline
+}
+
+// limitedBuffer keeps the first bytes written to it, discarding the rest
+type limitedBuffer struct {
+	lock  sync.Mutex
+	buf   bytes.Buffer
+	limit int
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if room := b.limit - b.buf.Len(); room > 0 {
+		b.buf.Write(p[:min(len(p), room)])
+	}
+	return len(p), nil
+}
+
+func (b *limitedBuffer) String() string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.String()
+}
@@ -0,0 +1,342 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// pushTimeout is how long the connections of a tunnel replaced or removed by a
+// push may drain
+const pushTimeout = 30 * time.Second
+
+var (
+	// pushLock keeps pushes from overlapping, as each is applied against the
+	// config the last left running
+	pushLock    sync.Mutex
+	pushTarget  *Configuration
+	pushServing *sync.WaitGroup
+	// pushedTunnels are the tunnels started by pushes, with the contexts they
+	// are served under
+	pushedTunnels = make(map[*Tunnel]*pushedTunnel)
+)
+
+type pushedTunnel struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// AcceptPushes lets the tunnels of the configuration be replaced by a config
+// pushed through the control socket, with the tunnels started by a push served
+// under the wait group, as the tunnels of the configuration are
+func (c *Configuration) AcceptPushes(serving *sync.WaitGroup) {
+	pushLock.Lock()
+	defer pushLock.Unlock()
+	pushTarget = c
+	pushServing = serving
+}
+
+// pushDiff holds the tunnels a push starts, and the running tunnels it stops
+type pushDiff struct {
+	added    []string
+	changed  []string
+	removed  []string
+	starting []*Tunnel
+	stopping map[string]*Tunnel
+}
+
+// pushConfig answers the push control command, replacing the config file of
+// ferret with that given.  Only the tunnels may differ from the config running,
+// as hosts are held open by the tunnels using them, and the other sections are
+// read once at startup, so a push changing them is refused.
+// The tunnels added or changed are validated before any tunnel is touched, and
+// with the argument canary are tried against the live environment too.  Then
+// the entrances are swapped, and should any new entrance fail to open, or the
+// config file fail to be written, the tunnels running before are restored.
+func pushConfig(tenant *Tenant, args []string) (string, error) {
+	if tenant != nil {
+		return "", errors.New("only the owner of ferret can push a config")
+	}
+	if len(args) == 0 || len(args) > 2 || (len(args) == 2 && args[1] != "canary") {
+		return "", errors.New("the config to push is required")
+	}
+	pushLock.Lock()
+	defer pushLock.Unlock()
+	c := pushTarget
+	if c == nil || controlContext == nil || controlStats == nil {
+		return "", errors.New("a config cannot be pushed until ferret is running")
+	}
+	if c.workspace != "" {
+		return "", fmt.Errorf("the workspace config (%s) is merged over the config file, so a config cannot be pushed", c.workspace)
+	}
+	bs := []byte(args[0])
+	current, err := parseConfig(c.file, c.source)
+	if err != nil {
+		return "", fmt.Errorf("running config cannot be parsed: %v", err)
+	}
+	pushed, err := parseConfig(c.file, bs)
+	if err != nil {
+		return "", fmt.Errorf("pushed config cannot be parsed: %v", err)
+	}
+	if sections := changedSections(current, pushed); len(sections) > 0 {
+		return "", fmt.Errorf("pushed config changes %s, which requires a restart.  Only changes to tunnels can be pushed", strings.Join(sections, ", "))
+	}
+	diff, err := diffTunnels(current.Tunnels, pushed.Tunnels)
+	if err != nil {
+		return "", err
+	}
+	if !diff.validate() {
+		return "", errors.New("pushed config is invalid, as the log of ferret explains")
+	}
+	if len(args) == 2 {
+		if err = diff.canary(); err != nil {
+			return "", err
+		}
+	}
+	if err = diff.apply(c.file, bs); err != nil {
+		return "", err
+	}
+	c.source = bs
+	return diff.String(), nil
+}
+
+// changedSections lists the sections, other than tunnels, that differ between
+// two configurations
+func changedSections(current *Configuration, pushed *Configuration) []string {
+	sections := func(c *Configuration) map[string]interface{} {
+		copied := *c
+		copied.Tunnels = nil
+		m := make(map[string]interface{})
+		bs, _ := yaml.Marshal(&copied)
+		_ = yaml.Unmarshal(bs, &m)
+		return m
+	}
+	a, b := sections(current), sections(pushed)
+	var changed []string
+	for name, value := range a {
+		if !reflect.DeepEqual(value, b[name]) {
+			changed = append(changed, name)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+// diffTunnels compares the tunnels of the running config with those pushed,
+// by their configuration
+func diffTunnels(current []*Tunnel, pushed []*Tunnel) (*pushDiff, error) {
+	d := &pushDiff{stopping: make(map[string]*Tunnel)}
+	was := make(map[string][]byte)
+	for _, t := range current {
+		if t != nil {
+			was[strings.TrimSpace(t.Name)], _ = yaml.Marshal(t)
+		}
+	}
+	names := make(map[string]bool)
+	for _, t := range pushed {
+		if t == nil {
+			return nil, errors.New("pushed config tunnels cannot contain a blank tunnel")
+		}
+		name := strings.TrimSpace(t.Name)
+		if names[name] {
+			return nil, fmt.Errorf("pushed config tunnel name (%s) redefined", name)
+		}
+		names[name] = true
+		bs, _ := yaml.Marshal(t)
+		previous, ok := was[name]
+		switch {
+		case !ok:
+			d.added = append(d.added, name)
+		case !bytes.Equal(previous, bs):
+			d.changed = append(d.changed, name)
+		default:
+			continue
+		}
+		d.starting = append(d.starting, t)
+	}
+	for name := range was {
+		if !names[name] {
+			d.removed = append(d.removed, name)
+		}
+	}
+	sort.Strings(d.removed)
+	// The running tunnels replaced, of the config rather than clones or discovery
+	tunnelsLock.RLock()
+	for _, name := range append(append([]string{}, d.changed...), d.removed...) {
+		if t, ok := Tunnels[name]; ok && t.tenant == "" && !t.ephemeral {
+			d.stopping[name] = t
+		}
+	}
+	tunnelsLock.RUnlock()
+	return d, nil
+}
+
+// validate validates the tunnels to be started, each in place of the tunnel it
+// replaces, leaving the running tunnels as they were
+func (d *pushDiff) validate() bool {
+	tunnelsLock.Lock()
+	defer tunnelsLock.Unlock()
+	valid := true
+	for _, t := range d.starting {
+		name := strings.TrimSpace(t.Name)
+		running := d.stopping[name]
+		if running != nil {
+			delete(Tunnels, name)
+		}
+		ok := t.Validate()
+		if host, found := Hosts[t.Host]; ok && found && !host.valid {
+			Errorf("tunnel (%s) remote host (%s) is invalid", t.Name, t.Host)
+			ok = false
+		}
+		if !ok {
+			valid = false
+		}
+		if Tunnels[t.Name] == t {
+			delete(Tunnels, t.Name)
+		}
+		if running != nil {
+			Tunnels[name] = running
+		}
+	}
+	return valid
+}
+
+// apply stops the tunnels replaced, starts those that replace them, then writes
+// the config file, rolling back should either fail
+func (d *pushDiff) apply(file string, bs []byte) error {
+	fi, err := os.Stat(file)
+	if err != nil {
+		return fmt.Errorf("config file (%s) cannot be written: %v", file, err)
+	}
+	// Ferret runs for as long as there are tunnels to serve, which for a moment
+	// there may not be
+	pushServing.Add(1)
+	defer pushServing.Done()
+
+	for _, running := range d.stopping {
+		// Free the entrance, as its replacement may be about to take it
+		running.closeListener()
+		unregisterTunnel(running)
+	}
+	var started []*Tunnel
+	for _, t := range d.starting {
+		if err = registerTunnel(t); err != nil {
+			break
+		}
+		t.Init(controlStats.UpdateChannel())
+		if err = t.Listen(); err != nil {
+			unregisterTunnel(t)
+			err = fmt.Errorf("tunnel (%s) entrance cannot be opened: %v", t.Name, err)
+			break
+		}
+		started = append(started, t)
+	}
+	if err == nil {
+		if err = writeConfigFile(file, fi.Mode().Perm(), bs); err != nil {
+			err = fmt.Errorf("config file (%s) cannot be written: %v", file, err)
+		}
+	}
+	if err != nil {
+		d.rollback(started)
+		return fmt.Errorf("%v, so the push was rolled back", err)
+	}
+
+	for _, running := range d.stopping {
+		if serving, ok := pushedTunnels[running]; ok {
+			serving.cancel()
+			delete(pushedTunnels, running)
+		}
+		go func(t *Tunnel) {
+			t.shutdown(time.Now().Add(pushTimeout))
+			controlStats.RemoveTunnelStats(t.stats)
+		}(running)
+	}
+	for _, t := range started {
+		controlStats.AddTunnelStats(t.stats)
+		servePushed(t)
+	}
+	for _, name := range d.added {
+		Infof("tunnel (%s) added by push", name)
+	}
+	for _, name := range d.changed {
+		Infof("tunnel (%s) changed by push", name)
+	}
+	for _, name := range d.removed {
+		Infof("tunnel (%s) removed by push", name)
+	}
+	return nil
+}
+
+// rollback closes the tunnels started by a push, and reopens those it stopped
+func (d *pushDiff) rollback(started []*Tunnel) {
+	for _, t := range started {
+		t.closeListener()
+		t.transition(StateClosed)
+		unregisterTunnel(t)
+	}
+	for name, running := range d.stopping {
+		if err := registerTunnel(running); err != nil {
+			Errorf("tunnel (%s) cannot be restored: %v", name, err)
+			continue
+		}
+		if err := running.Listen(); err != nil {
+			Errorf("tunnel (%s) cannot be restored: %v", name, err)
+			unregisterTunnel(running)
+			controlStats.RemoveTunnelStats(running.stats)
+			continue
+		}
+		servePushed(running)
+	}
+}
+
+// servePushed serves a tunnel under a context of its own, so that a later push
+// may stop it.  A tunnel reopened by a rollback keeps its context.
+func servePushed(t *Tunnel) {
+	serving, ok := pushedTunnels[t]
+	if !ok {
+		ctx, cancel := context.WithCancel(controlContext)
+		serving = &pushedTunnel{ctx: ctx, cancel: cancel}
+		pushedTunnels[t] = serving
+	}
+	pushServing.Add(1)
+	go func() {
+		defer pushServing.Done()
+		t.Serve(serving.ctx)
+	}()
+}
+
+func registerTunnel(t *Tunnel) error {
+	tunnelsLock.Lock()
+	defer tunnelsLock.Unlock()
+	if _, ok := Tunnels[t.Name]; ok {
+		return fmt.Errorf("tunnel (%s) is already defined", t.Name)
+	}
+	Tunnels[t.Name] = t
+	return nil
+}
+
+func (d *pushDiff) String() string {
+	if len(d.added)+len(d.changed)+len(d.removed) == 0 {
+		return "no tunnels changed\n"
+	}
+	var sb strings.Builder
+	for _, name := range d.added {
+		sb.WriteString(fmt.Sprintf("tunnel (%s) added\n", name))
+	}
+	for _, name := range d.changed {
+		sb.WriteString(fmt.Sprintf("tunnel (%s) changed\n", name))
+	}
+	for _, name := range d.removed {
+		sb.WriteString(fmt.Sprintf("tunnel (%s) removed\n", name))
+	}
+	return sb.String()
+}
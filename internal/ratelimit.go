@@ -0,0 +1,100 @@
+package internal
+
+import (
+	"container/list"
+	"math"
+	"net"
+	"sync"
+	"time"
+)
+
+// maxRateBuckets is how many sources are tracked, the least recently seen being
+// forgotten to make room for a new one
+const maxRateBuckets = 1024
+
+// RateLimit limits how often each source may open connections to a tunnel,
+// with a token bucket refilled at rate connections per second, holding up to
+// burst.  Sources are single addresses unless prefix groups IPv4 sources by
+// network, e.g. 24 for a /24.  IPv6 sources are grouped by /64.
+type RateLimit struct {
+	Rate    float64 `yaml:"rate" json:"rate"`
+	Burst   int     `yaml:"burst,omitempty" json:"burst,omitempty"`
+	Prefix  int     `yaml:"prefix,omitempty" json:"prefix,omitempty"`
+	lock    sync.Mutex
+	buckets map[string]*list.Element
+	// recent orders the buckets from the least to the most recently seen
+	recent *list.List
+}
+
+type rateBucket struct {
+	source string
+	tokens float64
+	last   time.Time
+}
+
+func (r *RateLimit) Validate(tunnel string) bool {
+	valid := true
+	if r.Rate <= 0 {
+		Errorf("tunnel (%s) rate_limit rate (%v) is invalid.  Must be connections per second above 0", tunnel, r.Rate)
+		valid = false
+	}
+	if r.Burst < 0 {
+		Errorf("tunnel (%s) rate_limit burst (%d) cannot be negative", tunnel, r.Burst)
+		valid = false
+	} else if r.Burst == 0 {
+		r.Burst = int(math.Max(1, math.Ceil(r.Rate)))
+	}
+	if r.Prefix == 0 {
+		r.Prefix = 32
+	} else if r.Prefix < 1 || r.Prefix > 32 {
+		Errorf("tunnel (%s) rate_limit prefix (%d) is invalid.  Must be between 1 and 32", tunnel, r.Prefix)
+		valid = false
+	}
+	r.buckets = make(map[string]*list.Element)
+	r.recent = list.New()
+	return valid
+}
+
+// allow takes a token from the source's bucket, reporting whether there was one
+func (r *RateLimit) allow(addr net.Addr) bool {
+	source := r.source(addr)
+	now := time.Now()
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	var b *rateBucket
+	if element, ok := r.buckets[source]; ok {
+		b = element.Value.(*rateBucket)
+		b.tokens = math.Min(float64(r.Burst), b.tokens+now.Sub(b.last).Seconds()*r.Rate)
+		r.recent.MoveToBack(element)
+	} else {
+		if len(r.buckets) >= maxRateBuckets {
+			// Most likely refilled, so no different from a source not yet seen
+			oldest := r.recent.Remove(r.recent.Front()).(*rateBucket)
+			delete(r.buckets, oldest.source)
+		}
+		b = &rateBucket{source: source, tokens: float64(r.Burst)}
+		r.buckets[source] = r.recent.PushBack(b)
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+func (r *RateLimit) source(addr net.Addr) string {
+	var ip net.IP
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		ip = addr.IP
+	case *net.UDPAddr:
+		ip = addr.IP
+	default:
+		return addr.String()
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(r.Prefix, 32)).String()
+	}
+	return ip.Mask(net.CIDRMask(64, 128)).String()
+}
@@ -0,0 +1,63 @@
+package internal
+
+import (
+	"encoding/json"
+	"net/url"
+	"strings"
+)
+
+const redactedSecret = "[redacted]"
+
+// showSecrets reveals secrets in logs and payloads, for debugging
+var showSecrets bool
+
+// SetShowSecrets sets whether secrets are shown, rather than redacted
+func SetShowSecrets(show bool) {
+	showSecrets = show
+}
+
+// Secret is a config value, such as a password or passphrase, that is read as
+// any other string, but shown redacted, whether logged, printed with the config
+// it belongs to, or marshalled as JSON, unless secrets are shown.  Yaml keeps
+// the value, as configs are copied through it.
+type Secret string
+
+func (s Secret) String() string {
+	if s == "" || showSecrets {
+		return string(s)
+	}
+	return redactedSecret
+}
+
+func (s Secret) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.String())
+}
+
+// SecretURL is a config url that may hold credentials, such as the user and
+// password of a proxy, shown with its password redacted, as Secret is, unless
+// secrets are shown
+type SecretURL string
+
+func (s SecretURL) String() string {
+	return redactURL(string(s))
+}
+
+func (s SecretURL) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.String())
+}
+
+// redactURL is the url with its password redacted, unless secrets are shown.
+// One that cannot be parsed is redacted whole, should it hold credentials.
+func redactURL(raw string) string {
+	if showSecrets {
+		return raw
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		if strings.Contains(raw, "@") {
+			return redactedSecret
+		}
+		return raw
+	}
+	return u.Redacted()
+}
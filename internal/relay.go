@@ -0,0 +1,411 @@
+package internal
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// The relay is an experimental alternative to SSH for hosts on high latency,
+// lossy links.  Each forwarded connection is carried by its own QUIC stream, so
+// a lost packet only holds up the connection it belongs to, rather than every
+// connection sharing the SSH session's TCP stream.
+
+const (
+	relayProtocol   = "ferret-relay"
+	relayTokenEnv   = "FERRET_RELAY_TOKEN"
+	relayKeepAlive  = 15 * time.Second
+	relayIdle       = 45 * time.Second
+	relayHeaderSize = 4096
+)
+
+// RelayConfig connects a host through a ferret relay instead of SSH.  The relay
+// is authenticated by the SHA256 fingerprint of its certificate, or by the
+// system's certificate authorities when no fingerprint is given, and ferret by
+// the token, which may be a secret reference.
+type RelayConfig struct {
+	Address     string `yaml:"address" json:"address"`
+	Fingerprint string `yaml:"fingerprint,omitempty" json:"fingerprint,omitempty"`
+	Token       Secret `yaml:"token,omitempty" json:"token,omitempty"`
+	token       string
+}
+
+type relayRequest struct {
+	Token   string `json:"token"`
+	Address string `json:"address,omitempty"`
+	Ping    bool   `json:"ping,omitempty"`
+}
+
+type relayResponse struct {
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+func (r *RelayConfig) Validate(host string) bool {
+	valid := true
+	r.Address = strings.TrimSpace(r.Address)
+	if _, _, err := net.SplitHostPort(r.Address); err != nil {
+		Errorf("host (%s) relay address (%s) is invalid.  Required syntax is <host>:<port>", host, r.Address)
+		valid = false
+	}
+	r.Fingerprint = strings.TrimSpace(r.Fingerprint)
+	if r.Fingerprint != "" && !strings.HasPrefix(r.Fingerprint, "SHA256:") {
+		Errorf("host (%s) relay fingerprint (%s) is invalid.  Must be SHA256:<base64>", host, r.Fingerprint)
+		valid = false
+	}
+	r.token = strings.TrimSpace(string(r.Token))
+	if secretReference(r.token) {
+		token, err := resolveSecret(r.token, "token")
+		if err != nil {
+			Errorf("host (%s) relay token cannot be read: %v", host, err)
+			valid = false
+		}
+		r.token = string(token)
+	}
+	if r.token == "" {
+		Errorf("host (%s) relay requires a token", host)
+		valid = false
+	}
+	return valid
+}
+
+// certificateFingerprint formats the fingerprint of a certificate as ssh does
+// that of a key
+func certificateFingerprint(raw []byte) string {
+	sum := sha256.Sum256(raw)
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(sum[:])
+}
+
+func (r *RelayConfig) tlsConfig() *tls.Config {
+	config := &tls.Config{NextProtos: []string{relayProtocol}}
+	if host, _, err := net.SplitHostPort(r.Address); err == nil {
+		config.ServerName = host
+	}
+	if r.Fingerprint != "" {
+		// The relay's certificate is typically self-signed, so is pinned instead
+		config.InsecureSkipVerify = true
+		config.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 {
+				return errors.New("relay presented no certificate")
+			}
+			if fingerprint := certificateFingerprint(rawCerts[0]); fingerprint != r.Fingerprint {
+				return fmt.Errorf("relay certificate fingerprint %s does not match %s", fingerprint, r.Fingerprint)
+			}
+			return nil
+		}
+	}
+	return config
+}
+
+// relayClient is a connection to a relay, standing in for the SSH client of a host
+type relayClient struct {
+	conn  quic.Connection
+	token string
+}
+
+func dialRelay(r *RelayConfig, timeout time.Duration) (*relayClient, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	conn, err := quic.DialAddr(ctx, r.Address, r.tlsConfig(), &quic.Config{
+		KeepAlivePeriod: relayKeepAlive,
+		MaxIdleTimeout:  relayIdle,
+	})
+	if err != nil {
+		return nil, err
+	}
+	client := &relayClient{conn: conn, token: r.token}
+	// Confirm the token is accepted now, rather than on the first connection
+	if _, _, err = client.SendRequest("ping", true, nil); err != nil {
+		_ = conn.CloseWithError(0, "")
+		return nil, err
+	}
+	return client, nil
+}
+
+// request opens a stream and sends a request, returning the stream once the
+// relay accepts it
+func (c *relayClient) request(ctx context.Context, request *relayRequest) (quic.Stream, error) {
+	stream, err := c.conn.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, err
+	}
+	request.Token = c.token
+	bs, _ := json.Marshal(request)
+	if _, err = stream.Write(append(bs, '\n')); err != nil {
+		stream.CancelRead(0)
+		_ = stream.Close()
+		return nil, err
+	}
+	response := &relayResponse{}
+	if err = readRelayLine(stream, response); err == nil && !response.OK {
+		err = errors.New(response.Error)
+	}
+	if err != nil {
+		stream.CancelRead(0)
+		_ = stream.Close()
+		return nil, err
+	}
+	return stream, nil
+}
+
+func (c *relayClient) Dial(_ string, address string) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+	defer cancel()
+	stream, err := c.request(ctx, &relayRequest{Address: address})
+	if err != nil {
+		return nil, err
+	}
+	return &relayConn{Stream: stream, conn: c.conn}, nil
+}
+
+// SendRequest answers keepalive requests with a round trip to the relay, so
+// hosts behind a relay are checked as any other
+func (c *relayClient) SendRequest(string, bool, []byte) (bool, []byte, error) {
+	stream, err := c.request(context.Background(), &relayRequest{Ping: true})
+	if err != nil {
+		return false, nil, err
+	}
+	stream.CancelRead(0)
+	_ = stream.Close()
+	return true, nil, nil
+}
+
+func (c *relayClient) Wait() error {
+	<-c.conn.Context().Done()
+	return context.Cause(c.conn.Context())
+}
+
+func (c *relayClient) Close() error {
+	return c.conn.CloseWithError(0, "")
+}
+
+// relayConn is a relayed connection.  Closing a QUIC stream only ends its
+// sending side, so Close also stops reading.
+type relayConn struct {
+	quic.Stream
+	conn quic.Connection
+	once sync.Once
+}
+
+func (c *relayConn) Close() error {
+	var err error
+	c.once.Do(func() {
+		c.Stream.CancelRead(0)
+		err = c.Stream.Close()
+	})
+	return err
+}
+
+func (c *relayConn) CloseWrite() error {
+	return c.Stream.Close()
+}
+
+func (c *relayConn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+func (c *relayConn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+// readRelayLine reads a single JSON line, byte by byte so nothing beyond it is
+// consumed from the stream
+func readRelayLine(r io.Reader, v interface{}) error {
+	line := make([]byte, 0, 128)
+	b := make([]byte, 1)
+	for {
+		if _, err := io.ReadFull(r, b); err != nil {
+			return err
+		}
+		if b[0] == '\n' {
+			break
+		}
+		if len(line) >= relayHeaderSize {
+			return errors.New("relay request too long")
+		}
+		line = append(line, b[0])
+	}
+	return json.Unmarshal(line, v)
+}
+
+// ServeRelay runs a relay on the port, forwarding the streams of ferrets
+// presenting the token in FERRET_RELAY_TOKEN to the addresses they ask for.  The
+// certificate and key are kept in keyFile, generated on first use, so that its
+// fingerprint stays the same, or are ephemeral without one.
+func ServeRelay(ctx context.Context, port int, keyFile string) bool {
+	token := os.Getenv(relayTokenEnv)
+	if token == "" {
+		Errorf("relay requires a token in %s", relayTokenEnv)
+		return false
+	}
+	certificate, ok := relayCertificate(keyFile)
+	if !ok {
+		return false
+	}
+	address := fmt.Sprintf(":%d", port)
+	listener, err := quic.ListenAddr(address, &tls.Config{
+		Certificates: []tls.Certificate{certificate},
+		NextProtos:   []string{relayProtocol},
+	}, &quic.Config{KeepAlivePeriod: relayKeepAlive, MaxIdleTimeout: relayIdle})
+	if err != nil {
+		Errorf("relay (%s) cannot listen: %v", address, err)
+		return false
+	}
+	Infof("relay listening on udp %s (certificate %s)", address, certificateFingerprint(certificate.Certificate[0]))
+
+	go func() {
+		<-ctx.Done()
+		_ = listener.Close()
+	}()
+	for {
+		conn, err := listener.Accept(ctx)
+		if err != nil {
+			return ctx.Err() != nil
+		}
+		if verboseFlag {
+			Infof("relay connection from %s", conn.RemoteAddr())
+		}
+		go func() {
+			for {
+				stream, err := conn.AcceptStream(ctx)
+				if err != nil {
+					return
+				}
+				go serveRelayStream(conn, stream, token)
+			}
+		}()
+	}
+}
+
+func serveRelayStream(conn quic.Connection, stream quic.Stream, token string) {
+	local := &relayConn{Stream: stream, conn: conn}
+	request := &relayRequest{}
+	if err := readRelayLine(stream, request); err != nil {
+		_ = local.Close()
+		return
+	}
+	respond := func(response *relayResponse) bool {
+		bs, _ := json.Marshal(response)
+		_, err := stream.Write(append(bs, '\n'))
+		return err == nil
+	}
+	if subtle.ConstantTimeCompare([]byte(request.Token), []byte(token)) != 1 {
+		Warnf("relay refused %s: invalid token", conn.RemoteAddr())
+		respond(&relayResponse{Error: "invalid token"})
+		_ = local.Close()
+		_ = conn.CloseWithError(1, "invalid token")
+		return
+	}
+	if request.Ping {
+		respond(&relayResponse{OK: true})
+		_ = local.Close()
+		return
+	}
+	remote, err := net.DialTimeout("tcp", request.Address, dialTimeout)
+	if err != nil {
+		respond(&relayResponse{Error: err.Error()})
+		_ = local.Close()
+		return
+	}
+	if !respond(&relayResponse{OK: true}) {
+		_ = remote.Close()
+		_ = local.Close()
+		return
+	}
+	if verboseFlag {
+		Infof("relay forwarding %s to %s", conn.RemoteAddr(), request.Address)
+	}
+	go func() {
+		_, _ = io.Copy(remote, local)
+		if tcpConn, ok := remote.(*net.TCPConn); ok {
+			_ = tcpConn.CloseWrite()
+		}
+	}()
+	_, _ = io.Copy(local, remote)
+	_ = local.Close()
+	_ = remote.Close()
+}
+
+func relayCertificate(keyFile string) (tls.Certificate, bool) {
+	if keyFile != "" {
+		if bs, err := os.ReadFile(keyFile); err == nil {
+			certificate, err := tls.X509KeyPair(bs, bs)
+			if err != nil {
+				Errorf("relay key (%s) cannot be parsed: %v", keyFile, err)
+				return tls.Certificate{}, false
+			}
+			return certificate, true
+		} else if !os.IsNotExist(err) {
+			Errorf("relay key (%s) cannot be read: %v", keyFile, err)
+			return tls.Certificate{}, false
+		}
+	}
+
+	bs, err := selfSignedCertificate("ferret relay", nil)
+	if err != nil {
+		Errorf("relay certificate cannot be generated: %v", err)
+		return tls.Certificate{}, false
+	}
+	if keyFile == "" {
+		Warnf("relay certificate is ephemeral, so its fingerprint changes on every start")
+	} else if err = os.WriteFile(keyFile, bs, 0600); err != nil {
+		Errorf("relay key (%s) cannot be written: %v", keyFile, err)
+		return tls.Certificate{}, false
+	}
+	certificate, _ := tls.X509KeyPair(bs, bs)
+	return certificate, true
+}
+
+// selfSignedCertificate generates a certificate and its key, both PEM encoded,
+// for the common name and any further host names and addresses
+func selfSignedCertificate(name string, hosts []string) ([]byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().AddDate(10, 0, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	keyDer, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	bs := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	return append(bs, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDer})...), nil
+}
@@ -0,0 +1,10 @@
+//go:build !linux && !darwin
+
+package internal
+
+import "syscall"
+
+const handoffSupported = false
+
+// reusePort is unsupported, so listening sockets are never shared
+var reusePort func(string, string, syscall.RawConn) error
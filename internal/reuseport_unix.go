@@ -0,0 +1,23 @@
+//go:build linux || darwin
+
+package internal
+
+import (
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+const handoffSupported = true
+
+// reusePort sets SO_REUSEPORT on a listening socket before it is bound, so a
+// ferret taking over may bind the same address alongside it
+func reusePort(_ string, _ string, c syscall.RawConn) error {
+	var err error
+	if cerr := c.Control(func(fd uintptr) {
+		err = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+	}); cerr != nil {
+		return cerr
+	}
+	return err
+}
@@ -0,0 +1,91 @@
+package internal
+
+import (
+	"fmt"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// RewriteRule changes the address a tunnel dials, for services that advertise
+// addresses that cannot be reached as given, e.g. Kafka advertised listeners or
+// MongoDB replica set members announcing 0.0.0.0 or internal domain names.  A
+// rule applies to addresses whose host matches the glob, and port when given.
+type RewriteRule struct {
+	Match        string `yaml:"match,omitempty" json:"match,omitempty"`
+	Port         int    `yaml:"port,omitempty" json:"port,omitempty"`
+	Host         string `yaml:"host,omitempty" json:"host,omitempty"`
+	StripSuffix  string `yaml:"strip_suffix,omitempty" json:"strip_suffix,omitempty"`
+	AppendSuffix string `yaml:"append_suffix,omitempty" json:"append_suffix,omitempty"`
+	ToPort       int    `yaml:"to_port,omitempty" json:"to_port,omitempty"`
+}
+
+func (r *RewriteRule) Validate(tunnel string) bool {
+	valid := true
+	r.Match = strings.ToLower(strings.TrimSpace(r.Match))
+	if r.Match == "" {
+		r.Match = "*"
+	}
+	if _, err := path.Match(r.Match, ""); err != nil {
+		Errorf("tunnel (%s) rewrite match (%s) is invalid: %v", tunnel, r.Match, err)
+		valid = false
+	}
+	if r.Port < 0 || r.Port > 65535 || r.ToPort < 0 || r.ToPort > 65535 {
+		Errorf("tunnel (%s) rewrite (%s) port range is invalid.  Must be between 1 and 65535", tunnel, r.Match)
+		valid = false
+	}
+	r.Host = strings.TrimSpace(r.Host)
+	r.StripSuffix = strings.ToLower(strings.TrimSpace(r.StripSuffix))
+	r.AppendSuffix = strings.TrimSpace(r.AppendSuffix)
+	if r.Host == "" && r.StripSuffix == "" && r.AppendSuffix == "" && r.ToPort == 0 {
+		Errorf("tunnel (%s) rewrite (%s) changes nothing.  Requires host, strip_suffix, append_suffix or to_port", tunnel, r.Match)
+		valid = false
+	}
+	return valid
+}
+
+// apply rewrites the address, reporting whether the rule matched it
+func (r *RewriteRule) apply(host string, port int) (string, int, bool) {
+	if matched, _ := path.Match(r.Match, strings.ToLower(host)); !matched || (r.Port != 0 && r.Port != port) {
+		return host, port, false
+	}
+	if r.Host != "" {
+		host = r.Host
+	}
+	if r.StripSuffix != "" && strings.HasSuffix(strings.ToLower(host), r.StripSuffix) {
+		host = host[:len(host)-len(r.StripSuffix)]
+	}
+	host += r.AppendSuffix
+	if r.ToPort != 0 {
+		port = r.ToPort
+	}
+	return host, port, true
+}
+
+// rewrite applies the first of the tunnel's rewrite rules matching an address
+// it is about to dial.  A rewritten address must still be an allowed
+// destination by policy, as the forward address it replaces was.
+func (t *Tunnel) rewrite(address string) (string, error) {
+	if len(t.Rewrite) == 0 {
+		return address, nil
+	}
+	host, portText, err := net.SplitHostPort(address)
+	if err != nil {
+		return address, nil
+	}
+	port, _ := strconv.Atoi(portText)
+	for _, rule := range t.Rewrite {
+		if host, port, ok := rule.apply(host, port); ok {
+			rewritten := net.JoinHostPort(host, strconv.Itoa(port))
+			if policy != nil && len(policy.networks) > 0 && !policy.allowedDestination(host) {
+				return "", fmt.Errorf("%s, rewritten from %s, is not an allowed destination by policy", rewritten, address)
+			}
+			if verboseFlag {
+				Infof("tunnel (%s) rewrote %s to %s", t.Name, address, rewritten)
+			}
+			return rewritten, nil
+		}
+	}
+	return address, nil
+}
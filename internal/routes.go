@@ -0,0 +1,122 @@
+package internal
+
+import (
+	"context"
+	"net"
+	"strings"
+)
+
+// routesInterface is the name of the TUN interface the networks of the routes
+// are routed to
+const routesInterface = "ferret0"
+
+// RouteConfig sends every TCP connection to the networks of its cidrs through
+// a host, by way of a TUN interface, so the services of a whole network are
+// reached without a tunnel for each, as sshuttle does.  Where the networks of
+// routes overlap, the most specific applies.  Only IPv4 is routed.
+type RouteConfig struct {
+	Name     string   `yaml:"name" json:"name"`
+	Host     string   `yaml:"host" json:"host"`
+	CIDRs    []string `yaml:"cidrs" json:"cidrs"`
+	networks []*net.IPNet
+}
+
+func (r *RouteConfig) Validate() bool {
+	valid := true
+	r.Name = strings.TrimSpace(r.Name)
+	if r.Name == "" {
+		Errorf("route name cannot be blank")
+		valid = false
+	}
+	r.Host = strings.TrimSpace(r.Host)
+	if host, ok := Hosts[r.Host]; !ok {
+		Errorf("route (%s) host (%s) undefined", r.Name, r.Host)
+		valid = false
+	} else {
+		host.isHost = true
+	}
+	if len(r.CIDRs) == 0 {
+		Errorf("route (%s) requires cidrs, e.g. 10.20.0.0/16", r.Name)
+		valid = false
+	}
+	r.networks = nil
+	for _, cidr := range r.CIDRs {
+		_, network, err := net.ParseCIDR(strings.TrimSpace(cidr))
+		if err != nil || network.IP.To4() == nil {
+			Errorf("route (%s) cidr (%s) is invalid.  Must be an IPv4 network, e.g. 10.20.0.0/16", r.Name, cidr)
+			valid = false
+			continue
+		}
+		r.networks = append(r.networks, network)
+	}
+	return valid
+}
+
+// OpenRoutes creates the TUN interface and routes the networks of the routes to
+// it, which requires privileges, so is done before they are dropped
+func (c *Configuration) OpenRoutes() bool {
+	if len(c.Routes) == 0 {
+		return true
+	}
+	var networks []*net.IPNet
+	var cidrs []string
+	for _, r := range c.Routes {
+		networks = append(networks, r.networks...)
+		for _, network := range r.networks {
+			cidrs = append(cidrs, network.String())
+		}
+	}
+	device, err := openTUN(routesInterface, tunMTU, networks)
+	if err != nil {
+		Errorf("routes cannot be opened: %v", err)
+		return false
+	}
+	c.routes = newPacketStack(device, c.dialRoute)
+	Infof("routes of %s opened on %s", strings.Join(cidrs, ", "), routesInterface)
+	return true
+}
+
+// ServeRoutes relays the connections routed to the TUN interface until the
+// context is done
+func (c *Configuration) ServeRoutes(ctx context.Context) {
+	if c.routes != nil {
+		c.routes.serve(ctx)
+		Infof("routes closed on %s", routesInterface)
+	}
+}
+
+// route returns the route of the most specific network containing the ip
+func (c *Configuration) route(ip net.IP) *RouteConfig {
+	var found *RouteConfig
+	bits := -1
+	for _, r := range c.Routes {
+		for _, network := range r.networks {
+			if ones, _ := network.Mask.Size(); network.Contains(ip) && ones > bits {
+				found, bits = r, ones
+			}
+		}
+	}
+	return found
+}
+
+func (c *Configuration) dialRoute(destination string) (net.Conn, bool) {
+	address, _, _ := net.SplitHostPort(destination)
+	r := c.route(net.ParseIP(address))
+	if r == nil {
+		return nil, false
+	}
+	if policy != nil && len(policy.networks) > 0 && !policy.allowedDestination(address) {
+		Errorf("route (%s) destination (%s) is not an allowed destination by policy", r.Name, destination)
+		return nil, false
+	}
+	host := Hosts[r.Host]
+	if !host.WaitOpen(hostWaitTimeout) {
+		Errorf("route (%s) destination (%s) cannot be reached: host (%s) is not connected", r.Name, destination, r.Host)
+		return nil, false
+	}
+	conn, ok := host.Dial(destination)
+	if ok && verboseFlag {
+		Infof("route (%s) connected to %s", r.Name, destination)
+	}
+	return conn, ok
+}
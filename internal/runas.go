@@ -0,0 +1,74 @@
+package internal
+
+import (
+	"os"
+	"os/user"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// controlSocket is the path of the control socket, once listening
+var controlSocket string
+
+func (c *Configuration) validateRunAs() bool {
+	c.RunAs = strings.TrimSpace(c.RunAs)
+	if c.RunAs == "" {
+		return true
+	}
+	if runtime.GOOS == "windows" {
+		Errorf("run_as (%s) is not supported on windows", c.RunAs)
+		return false
+	}
+	u, err := user.Lookup(c.RunAs)
+	if err != nil {
+		if u, err = user.LookupId(c.RunAs); err != nil {
+			Errorf("run_as user (%s) cannot be found: %v", c.RunAs, err)
+			return false
+		}
+	}
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		Errorf("run_as user (%s) has no numeric user id: %s", c.RunAs, u.Uid)
+		return false
+	}
+	gid, err := strconv.Atoi(u.Gid)
+	if err != nil {
+		Errorf("run_as user (%s) has no numeric group id: %s", c.RunAs, u.Gid)
+		return false
+	}
+	if os.Geteuid() != 0 {
+		Warnf("run_as (%s) is ignored, as ferret is not running as root", c.RunAs)
+	}
+	c.uid, c.gid = uid, gid
+	return true
+}
+
+// DropPrivileges becomes the run_as user, once the tunnels are listening, so
+// that only binding privileged ports is done as root.  The unix sockets of the
+// tunnels and of the control socket are handed to the user.
+func (c *Configuration) DropPrivileges() bool {
+	if c.RunAs == "" || os.Geteuid() != 0 {
+		return true
+	}
+	sockets := make([]string, 0, len(Tunnels)+1)
+	for _, t := range tunnelList() {
+		if t.Local != nil && t.Local.IsUnix() && t.Entrance() != "" {
+			sockets = append(sockets, t.Local.address)
+		}
+	}
+	if controlSocket != "" {
+		sockets = append(sockets, controlSocket)
+	}
+	for _, socket := range sockets {
+		if err := os.Lchown(socket, c.uid, c.gid); err != nil {
+			Warnf("socket (%s) cannot be handed to run_as user (%s): %v", socket, c.RunAs, err)
+		}
+	}
+	if err := setUser(c.uid, c.gid); err != nil {
+		Errorf("run_as user (%s) cannot be switched to: %v", c.RunAs, err)
+		return false
+	}
+	Infof("running as %s", c.RunAs)
+	return true
+}
@@ -0,0 +1,19 @@
+//go:build !windows
+
+package internal
+
+import (
+	"syscall"
+)
+
+// setUser switches every thread of the process to the user and group,
+// dropping any supplementary groups
+func setUser(uid int, gid int) error {
+	if err := syscall.Setgroups([]int{gid}); err != nil {
+		return err
+	}
+	if err := syscall.Setgid(gid); err != nil {
+		return err
+	}
+	return syscall.Setuid(uid)
+}
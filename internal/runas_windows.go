@@ -0,0 +1,10 @@
+package internal
+
+import (
+	"errors"
+)
+
+// setUser is not available on windows, which has no notion of a user id
+func setUser(int, int) error {
+	return errors.New("switching user is not supported on windows")
+}
@@ -0,0 +1,145 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// SecretProvider fetches secrets held outside the config, such as identities
+// and passphrases, from a secrets manager.  Config values of the form
+// <provider>:<reference> are resolved by the named provider, with an optional
+// #field selecting a field of the secret.
+type SecretProvider interface {
+	Secret(reference string, field string) ([]byte, error)
+}
+
+var secretProviders = map[string]SecretProvider{
+	"vault":   &vaultProvider{},
+	"aws-sm":  &awsSecretsProvider{},
+	"aws-ssm": &awsParameterProvider{},
+	"op":      &onePasswordProvider{},
+}
+
+// secretReference reports whether a config value refers to a secret provider
+func secretReference(value string) bool {
+	scheme, _, found := strings.Cut(value, ":")
+	_, ok := secretProviders[scheme]
+	return found && ok
+}
+
+// resolveSecret fetches the secret a config value refers to, reading the given
+// field unless the value names its own.
+func resolveSecret(value string, field string) ([]byte, error) {
+	scheme, reference, _ := strings.Cut(value, ":")
+	provider, ok := secretProviders[scheme]
+	if !ok {
+		return nil, fmt.Errorf("secret provider (%s) is unknown", scheme)
+	}
+	if path, named, found := strings.Cut(reference, "#"); found {
+		reference, field = path, named
+	}
+	secret, err := provider.Secret(reference, field)
+	if err != nil {
+		return nil, fmt.Errorf("secret (%s) cannot be read: %w", value, err)
+	}
+	return secret, nil
+}
+
+// onePasswordProvider reads secrets with the 1Password CLI, given references of
+// the form op://vault/item/field, which name their own field
+type onePasswordProvider struct{}
+
+func (p *onePasswordProvider) Secret(reference string, _ string) ([]byte, error) {
+	return runCLI("op", "read", "--no-newline", "op:"+reference)
+}
+
+// vaultProvider reads secrets from a HashiCorp Vault KV secrets engine, version
+// 2 or 1, using VAULT_ADDR and VAULT_TOKEN (or ~/.vault-token), and
+// VAULT_NAMESPACE when set.
+type vaultProvider struct{}
+
+func (v *vaultProvider) Secret(reference string, field string) ([]byte, error) {
+	address := strings.TrimRight(os.Getenv("VAULT_ADDR"), "/")
+	if address == "" {
+		return nil, fmt.Errorf("VAULT_ADDR is not set")
+	}
+	token := os.Getenv("VAULT_TOKEN")
+	if token == "" {
+		if home, err := os.UserHomeDir(); err == nil {
+			bs, _ := os.ReadFile(filepath.Join(home, ".vault-token"))
+			token = strings.TrimSpace(string(bs))
+		}
+	}
+	if token == "" {
+		return nil, fmt.Errorf("VAULT_TOKEN is not set")
+	}
+
+	reference = strings.Trim(reference, "/")
+	mount, path, _ := strings.Cut(reference, "/")
+	data, err := v.read(address, token, fmt.Sprintf("%s/data/%s", mount, path))
+	if errors.Is(err, errVaultNotFound) {
+		data, err = v.read(address, token, reference)
+	} else if nested, ok := data["data"].(map[string]interface{}); ok && err == nil {
+		// Version 2 nests the secret alongside its metadata
+		data = nested
+	}
+	if err != nil {
+		return nil, err
+	}
+	value, ok := data[field]
+	if !ok {
+		return nil, fmt.Errorf("field (%s) not found", field)
+	}
+	secret, ok := value.(string)
+	if !ok {
+		return nil, fmt.Errorf("field (%s) is not a string", field)
+	}
+	return []byte(secret), nil
+}
+
+var errVaultNotFound = errors.New("not found")
+
+func (v *vaultProvider) read(address string, token string, path string) (map[string]interface{}, error) {
+	request, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/v1/%s", address, path), nil)
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("X-Vault-Token", token)
+	if namespace := os.Getenv("VAULT_NAMESPACE"); namespace != "" {
+		request.Header.Set("X-Vault-Namespace", namespace)
+	}
+	client := &http.Client{Timeout: 15 * time.Second}
+	response, err := client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = response.Body.Close()
+	}()
+	bs, _ := io.ReadAll(io.LimitReader(response.Body, 1<<20))
+	switch response.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, errVaultNotFound
+	default:
+		var failure struct {
+			Errors []string `json:"errors"`
+		}
+		_ = json.Unmarshal(bs, &failure)
+		return nil, fmt.Errorf("vault answered %s %s", response.Status, strings.Join(failure.Errors, ", "))
+	}
+	var secret struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if err = json.Unmarshal(bs, &secret); err != nil {
+		return nil, fmt.Errorf("vault response cannot be parsed: %w", err)
+	}
+	return secret.Data, nil
+}
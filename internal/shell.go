@@ -0,0 +1,16 @@
+package internal
+
+import (
+	"context"
+	"os/exec"
+	"runtime"
+)
+
+// shellCommand runs the command line with the shell of the platform, sh, or
+// cmd on Windows, stopped should the context end
+func shellCommand(ctx context.Context, command string) *exec.Cmd {
+	if runtime.GOOS == "windows" {
+		return exec.CommandContext(ctx, "cmd", "/C", command)
+	}
+	return exec.CommandContext(ctx, "sh", "-c", command)
+}
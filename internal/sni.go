@@ -0,0 +1,112 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	TunnelTypeSNI = "sni"
+
+	// defaultSNIPort is the local port of an sni tunnel without one
+	defaultSNIPort = 8443
+)
+
+// errHelloRead stops the handshake once the ClientHello has been read
+var errHelloRead = errors.New("client hello read")
+
+// validateSNIRoutes checks the routes of an sni tunnel, which route by the
+// server name alone, either exactly or by a wildcard for a single label, such
+// as *.internal.example.com
+func (t *Tunnel) validateSNIRoutes() bool {
+	valid := true
+	for i, route := range t.Routes {
+		if route == nil {
+			continue
+		}
+		if route.Path != "" || route.StripPath {
+			Errorf("tunnel (%s) route %d cannot have a path, as type %s routes by server name alone", t.Name, i+1, t.Type)
+			valid = false
+		}
+		if name := strings.TrimPrefix(route.Host, "*."); strings.Contains(name, "*") {
+			Errorf("tunnel (%s) route %d host (%s) is invalid.  A wildcard may only be the first label, e.g. *.example.com", t.Name, i+1, route.Host)
+			valid = false
+		}
+	}
+	return valid
+}
+
+// sniRoute finds the route of a server name, preferring an exact match, then a
+// wildcard, then the route without a host, or nil when none matches
+func (t *Tunnel) sniRoute(name string) *HTTPRoute {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	var wildcard, fallback *HTTPRoute
+	for _, route := range t.Routes {
+		switch {
+		case route.Host == name && name != "":
+			return route
+		case strings.HasPrefix(route.Host, "*."):
+			label, found := strings.CutSuffix(name, route.Host[1:])
+			if found && label != "" && !strings.Contains(label, ".") && wildcard == nil {
+				wildcard = route
+			}
+		case route.Host == "" && fallback == nil:
+			fallback = route
+		}
+	}
+	if wildcard != nil {
+		return wildcard
+	}
+	return fallback
+}
+
+// sniTarget reads the ClientHello of a client of an sni tunnel for the server
+// name it asks for, returning the route of the name and the connection to carry
+// on with in place of conn, which replays the ClientHello to the forward address
+func (t *Tunnel) sniTarget(conn net.Conn) (net.Conn, *HTTPRoute, error) {
+	_ = conn.SetReadDeadline(time.Now().Add(socksHandshakeTimeout))
+	defer func() {
+		_ = conn.SetReadDeadline(time.Time{})
+	}()
+	peeked := &bytes.Buffer{}
+	var hello *tls.ClientHelloInfo
+	err := tls.Server(&helloConn{Conn: conn, reader: io.TeeReader(conn, peeked)}, &tls.Config{
+		GetConfigForClient: func(info *tls.ClientHelloInfo) (*tls.Config, error) {
+			hello = info
+			return nil, errHelloRead
+		},
+	}).Handshake()
+	if hello == nil {
+		return nil, nil, fmt.Errorf("client hello cannot be read: %v", err)
+	}
+	route := t.sniRoute(hello.ServerName)
+	if route == nil {
+		return nil, nil, fmt.Errorf("no route for server name (%s)", hello.ServerName)
+	}
+	if verboseFlag {
+		Infof("tunnel (%s) server name (%s) routed to %s", t.Name, hello.ServerName, route.Forward.address)
+	}
+	return &bufferedConn{Conn: conn, reader: bufio.NewReader(io.MultiReader(peeked, conn))}, route, nil
+}
+
+// helloConn lets a TLS server read the ClientHello of a client, keeping the
+// client from being written anything
+type helloConn struct {
+	net.Conn
+	reader io.Reader
+}
+
+func (c *helloConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+func (c *helloConn) Write(b []byte) (int, error) {
+	return 0, io.ErrClosedPipe
+}
@@ -0,0 +1,134 @@
+package internal
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+const (
+	TunnelTypeSOCKS5 = "socks5"
+
+	// defaultSOCKSPort is the customary port of a SOCKS proxy, as used by ssh -D
+	defaultSOCKSPort = 1080
+	// socksHandshakeTimeout bounds how long a client may take to name its destination
+	socksHandshakeTimeout = 10 * time.Second
+)
+
+// SOCKS5 (RFC 1928) protocol values
+const (
+	socksVersion           = 5
+	socksNoAuthentication  = 0
+	socksUsernamePassword  = 2
+	socksAuthVersion       = 1
+	socksNoAcceptable      = 0xff
+	socksConnect           = 1
+	socksIPv4              = 1
+	socksDomain            = 3
+	socksIPv6              = 4
+	socksSucceeded         = 0
+	socksGeneralFailure    = 1
+	socksNotAllowed        = 2
+	socksHostUnreachable   = 4
+	socksCommandNotSupport = 7
+	socksAddressNotSupport = 8
+)
+
+// socksRequest negotiates with a SOCKS5 client up to its connect request,
+// returning the destination it asked for.  The client is answered with
+// socksReply once the destination has been dialled.
+func socksRequest(conn net.Conn) (string, error) {
+	_ = conn.SetReadDeadline(time.Now().Add(socksHandshakeTimeout))
+	defer func() {
+		_ = conn.SetReadDeadline(time.Time{})
+	}()
+
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return "", err
+	}
+	if header[0] != socksVersion {
+		return "", fmt.Errorf("unsupported SOCKS version %d", header[0])
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return "", err
+	}
+	method := byte(socksNoAcceptable)
+	for _, m := range methods {
+		if m == socksNoAuthentication {
+			method = socksNoAuthentication
+		}
+	}
+	if _, err := conn.Write([]byte{socksVersion, method}); err != nil {
+		return "", err
+	}
+	if method == socksNoAcceptable {
+		return "", fmt.Errorf("client requires authentication")
+	}
+
+	request := make([]byte, 4)
+	if _, err := io.ReadFull(conn, request); err != nil {
+		return "", err
+	}
+	if request[1] != socksConnect {
+		socksReply(conn, socksCommandNotSupport)
+		return "", fmt.Errorf("unsupported SOCKS command %d", request[1])
+	}
+	var host string
+	switch request[3] {
+	case socksIPv4, socksIPv6:
+		ip := make([]byte, net.IPv4len)
+		if request[3] == socksIPv6 {
+			ip = make([]byte, net.IPv6len)
+		}
+		if _, err := io.ReadFull(conn, ip); err != nil {
+			return "", err
+		}
+		host = net.IP(ip).String()
+	case socksDomain:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(conn, length); err != nil {
+			return "", err
+		}
+		domain := make([]byte, length[0])
+		if _, err := io.ReadFull(conn, domain); err != nil {
+			return "", err
+		}
+		host = string(domain)
+	default:
+		socksReply(conn, socksAddressNotSupport)
+		return "", fmt.Errorf("unsupported SOCKS address type %d", request[3])
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(conn, port); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
+
+// socksReply answers a connect request.  The bound address is not revealed,
+// as the connection is made by the SSH server.
+func socksReply(conn net.Conn, reply byte) {
+	_, _ = conn.Write([]byte{socksVersion, reply, 0, socksIPv4, 0, 0, 0, 0, 0, 0})
+}
+
+// socksTarget reads the destination of a connection to a SOCKS5 tunnel,
+// refusing destinations the policy does not allow
+func (t *Tunnel) socksTarget(localConn net.Conn) (string, error) {
+	target, err := socksRequest(localConn)
+	if err != nil {
+		return "", err
+	}
+	if policy != nil && len(policy.networks) > 0 {
+		host, _, _ := net.SplitHostPort(target)
+		if !policy.allowedDestination(host) {
+			socksReply(localConn, socksNotAllowed)
+			return "", fmt.Errorf("%s is not an allowed destination by policy", target)
+		}
+	}
+	return target, nil
+}
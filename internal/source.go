@@ -0,0 +1,156 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// defaultSourceCommand is run on the host to dial from its source_address, as
+// an SSH server always dials forwarded addresses from its default route
+const defaultSourceCommand = "nc -s {source} {host} {port}"
+
+func (h *Host) validateSource() bool {
+	valid := true
+	h.SourceAddress = strings.TrimSpace(h.SourceAddress)
+	h.SourceCommand = strings.TrimSpace(h.SourceCommand)
+	if h.SourceAddress == "" {
+		if h.SourceCommand != "" {
+			Errorf("host (%s) source_command requires a source_address", h.Name)
+			valid = false
+		}
+		return valid
+	}
+	if net.ParseIP(h.SourceAddress) == nil {
+		Errorf("host (%s) source_address (%s) is not an IP address", h.Name, h.SourceAddress)
+		valid = false
+	}
+	if h.Relay != nil {
+		Errorf("host (%s) source_address cannot be used with a relay", h.Name)
+		valid = false
+	}
+	if h.SourceCommand == "" {
+		h.SourceCommand = defaultSourceCommand
+	}
+	if !strings.Contains(h.SourceCommand, "{host}") || !strings.Contains(h.SourceCommand, "{port}") {
+		Errorf("host (%s) source_command (%s) must contain {host} and {port}", h.Name, h.SourceCommand)
+		valid = false
+	}
+	return valid
+}
+
+// dialFrom connects to the address by running the source command on the host,
+// its standard input and output carrying the connection
+func (h *Host) dialFrom(client *ssh.Client, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	command := strings.NewReplacer(
+		"{source}", shellQuote(h.SourceAddress),
+		"{host}", shellQuote(host),
+		"{port}", shellQuote(port),
+	).Replace(h.SourceCommand)
+	return h.startCommand(client, command, address)
+}
+
+// startCommand runs a command on the host, returning a connection to the
+// address carried by its standard input and output
+func (h *Host) startCommand(client *ssh.Client, command string, address string) (net.Conn, error) {
+	session, err := client.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	h.requestAgent(session)
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		_ = session.Close()
+		return nil, err
+	}
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		_ = session.Close()
+		return nil, err
+	}
+	if err = session.Start(command); err != nil {
+		_ = session.Close()
+		return nil, fmt.Errorf("%s failed: %w", command, err)
+	}
+	return &commandConn{
+		session: session,
+		stdin:   stdin,
+		stdout:  stdout,
+		local:   client.LocalAddr(),
+		remote:  commandAddr(address),
+	}, nil
+}
+
+// commandConn is a connection carried by a command's standard input and output
+type commandConn struct {
+	session *ssh.Session
+	stdin   io.WriteCloser
+	stdout  io.Reader
+	local   net.Addr
+	remote  net.Addr
+	once    sync.Once
+}
+
+var errCommandDeadline = errors.New("deadlines are not supported by command connections")
+
+func (c *commandConn) Read(b []byte) (int, error) {
+	return c.stdout.Read(b)
+}
+
+func (c *commandConn) Write(b []byte) (int, error) {
+	return c.stdin.Write(b)
+}
+
+func (c *commandConn) Close() error {
+	var err error
+	c.once.Do(func() {
+		_ = c.stdin.Close()
+		err = c.session.Close()
+	})
+	return err
+}
+
+func (c *commandConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *commandConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *commandConn) SetDeadline(time.Time) error {
+	return errCommandDeadline
+}
+
+func (c *commandConn) SetReadDeadline(time.Time) error {
+	return errCommandDeadline
+}
+
+func (c *commandConn) SetWriteDeadline(time.Time) error {
+	return errCommandDeadline
+}
+
+type commandAddr string
+
+func (a commandAddr) Network() string {
+	return "tcp"
+}
+
+func (a commandAddr) String() string {
+	return string(a)
+}
+
+// shellQuote quotes a value for a POSIX shell
+func shellQuote(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", `'\''`) + "'"
+}
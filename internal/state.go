@@ -0,0 +1,90 @@
+package internal
+
+import (
+	"fmt"
+	"sync"
+)
+
+// TunnelState is where a tunnel is in its life: configured, then starting while
+// its entrance opens, listening, or degraded while its host is unreachable or
+// its connections are suspect, then draining its connections once stopped,
+// and finally closed.  A tunnel that fails to start goes straight to closed.
+type TunnelState string
+
+const (
+	StateConfigured TunnelState = "configured"
+	StateStarting   TunnelState = "starting"
+	StateListening  TunnelState = "listening"
+	StateDegraded   TunnelState = "degraded"
+	StateDraining   TunnelState = "draining"
+	StateClosed     TunnelState = "closed"
+)
+
+var (
+	transitions = map[TunnelState][]TunnelState{
+		StateConfigured: {StateStarting, StateClosed},
+		StateStarting:   {StateListening, StateClosed},
+		StateListening:  {StateDegraded, StateDraining},
+		StateDegraded:   {StateListening, StateDraining},
+		StateDraining:   {StateClosed},
+	}
+	stateLock  sync.Mutex
+	stateHooks []func(t *Tunnel, from TunnelState, to TunnelState)
+)
+
+// addStateHook registers a callback made after every tunnel state transition
+func addStateHook(hook func(t *Tunnel, from TunnelState, to TunnelState)) {
+	stateLock.Lock()
+	defer stateLock.Unlock()
+	stateHooks = append(stateHooks, hook)
+}
+
+func (t *Tunnel) State() TunnelState {
+	stateLock.Lock()
+	defer stateLock.Unlock()
+	if t.state == "" {
+		return StateConfigured
+	}
+	return t.state
+}
+
+// transition moves the tunnel to a new state, reporting whether it did.  Moves
+// the state machine does not allow are ignored.
+func (t *Tunnel) transition(to TunnelState) bool {
+	stateLock.Lock()
+	from := t.state
+	if from == "" {
+		from = StateConfigured
+	}
+	allowed := false
+	for _, state := range transitions[from] {
+		allowed = allowed || state == to
+	}
+	if !allowed {
+		stateLock.Unlock()
+		return false
+	}
+	t.state = to
+	hooks := stateHooks
+	stateLock.Unlock()
+
+	if verboseFlag {
+		Infof("tunnel (%s) %s -> %s", t.Name, from, to)
+	}
+	if t.stats != nil {
+		t.stats.lock.Lock()
+		t.stats.State = string(to)
+		t.stats.Entrance = t.Entrance()
+		t.stats.lock.Unlock()
+		if t.updateChan != nil {
+			go func() {
+				t.updateChan <- struct{}{}
+			}()
+		}
+	}
+	emit(&Event{Type: EventTunnelState, Tunnel: t.Name, TunnelID: t.id, Message: fmt.Sprintf("%s -> %s", from, to)})
+	for _, hook := range hooks {
+		hook(t, from, to)
+	}
+	return true
+}
@@ -1,11 +1,13 @@
 package internal
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"net"
+	"os"
 	"sort"
 	"strings"
 	"sync"
@@ -30,30 +32,321 @@ var (
 	interval = time.Second * 5
 )
 
+const (
+	StatsFieldHost    = "host"
+	StatsFieldForward = "forward"
+)
+
+// How the stats command prints updates
+const (
+	StatsOutputTable  = "table"
+	StatsOutputJSON   = "json"
+	StatsOutputPretty = "pretty"
+)
+
+var statsConfig *StatsConfig
+
+// StatsConfig controls what the stats payload reveals about each tunnel.  Redacted
+// fields are omitted entirely, while labels replace tunnel names, host names or
+// forward addresses with a more presentable (or less revealing) value.  Updates
+// are sent at most once an interval and, with delta enabled, hold only the
+// tunnels and hosts that changed, with a full snapshot once a snapshot period.
+type StatsConfig struct {
+	Redact   []string          `yaml:"redact" json:"redact"`
+	Labels   map[string]string `yaml:"labels" json:"labels"`
+	Instance string            `yaml:"instance,omitempty" json:"instance,omitempty"`
+	Interval string            `yaml:"interval,omitempty" json:"interval,omitempty"`
+	Delta    bool              `yaml:"delta,omitempty" json:"delta,omitempty"`
+	Snapshot string            `yaml:"snapshot,omitempty" json:"snapshot,omitempty"`
+	snapshot time.Duration
+}
+
 type TunnelStats struct {
 	id          int
-	Name        string `json:"name"`
-	Connected   int    `json:"connected"`
-	Connections int    `json:"connections"`
-	Received    int64  `json:"received"`
-	Transmitted int64  `json:"transmitted"`
+	lock        sync.Mutex
+	ID          string             `json:"id,omitempty"`
+	Name        string             `json:"name"`
+	State       string             `json:"state,omitempty"`
+	Host        string             `json:"host,omitempty"`
+	Forward     string             `json:"forward,omitempty"`
+	Entrance    string             `json:"entrance,omitempty"`
+	Connected   int                `json:"connected"`
+	Connections int                `json:"connections"`
+	Received    int64              `json:"received"`
+	Transmitted int64              `json:"transmitted"`
+	Active      []*ConnectionStats `json:"active,omitempty"`
+	RTT         int64              `json:"rtt_ms,omitempty"`
+	Stalled     int                `json:"stalled,omitempty"`
+	Suspect     bool               `json:"suspect,omitempty"`
+	Limited     int                `json:"limited,omitempty"`
+	Denied      int                `json:"denied,omitempty"`
+	tenant      string
+}
+
+// ConnectionStats describes a single forwarded connection that is currently open
+type ConnectionStats struct {
+	ID          int32     `json:"id"`
+	Client      string    `json:"client"`
+	Target      string    `json:"target"`
+	Started     time.Time `json:"started"`
+	Received    int64     `json:"received"`
+	Transmitted int64     `json:"transmitted"`
+	activity    activity
 }
 
 type StatsManager struct {
 	statsPort     int
 	statsAddress  string
 	updateChan    chan struct{}
-	connections   []net.Conn
+	connections   []*statsClient
 	statsListener net.Listener
 	lock          sync.Mutex
-	updated       bool
-	lastUpdate    []byte
 	tunnelStats   []*TunnelStats
+	hostStats     []*HostStats
+	statsLock     sync.Mutex
+	nextID        int
+	filter        *StatsFilter
+	previous      map[string]*TunnelStats
+	previousTime  time.Time
+	historySize   int
+	history       map[string]*RateHistory
+	optional      bool
+	output        string
+	fields        map[string]bool
+}
+
+func (c *StatsConfig) Validate() bool {
+	valid := true
+	for i, field := range c.Redact {
+		c.Redact[i] = strings.ToLower(strings.TrimSpace(field))
+		switch c.Redact[i] {
+		case StatsFieldHost, StatsFieldForward:
+		default:
+			Errorf("stats redact field (%s) is invalid.  Must be %s or %s", field, StatsFieldHost, StatsFieldForward)
+			valid = false
+		}
+	}
+	if strings.TrimSpace(c.Interval) != "" {
+		d, err := time.ParseDuration(strings.TrimSpace(c.Interval))
+		if err != nil || d < time.Second {
+			Errorf("stats interval (%s) is invalid.  Must be a duration of at least 1s", c.Interval)
+			valid = false
+		} else {
+			interval = d
+		}
+	}
+	c.snapshot = defaultStatsSnapshot
+	if strings.TrimSpace(c.Snapshot) != "" {
+		d, err := time.ParseDuration(strings.TrimSpace(c.Snapshot))
+		if err != nil || d < interval {
+			Errorf("stats snapshot (%s) is invalid.  Must be a duration of at least the interval (%s)", c.Snapshot, interval)
+			valid = false
+		}
+		c.snapshot = d
+		if !c.Delta {
+			Warnf("stats snapshot is ignored without delta")
+		}
+	}
+	statsConfig = c
+	return valid
+}
+
+// instance identifies this ferret in stats updates, by the configured instance
+// name or else the host name
+func (c *StatsConfig) instance() *StatsInstance {
+	instance := *statsInstance
+	if c != nil && strings.TrimSpace(c.Instance) != "" {
+		instance.Name = strings.TrimSpace(c.Instance)
+	}
+	return &instance
+}
+
+var statsInstance = func() *StatsInstance {
+	host, _ := os.Hostname()
+	return &StatsInstance{Name: host, Host: host, PID: os.Getpid(), Started: time.Now()}
+}()
+
+func (c *StatsConfig) redacted(field string) bool {
+	if c == nil {
+		return false
+	}
+	for _, redact := range c.Redact {
+		if redact == field {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *StatsConfig) label(value string) string {
+	if c != nil {
+		if label, ok := c.Labels[value]; ok {
+			return label
+		}
+	}
+	return value
+}
+
+func newTunnelStats(t *Tunnel) *TunnelStats {
+	stats := &TunnelStats{ID: t.id, Name: statsConfig.label(t.Name), State: string(t.State()), tenant: t.tenant}
+	if !statsConfig.redacted(StatsFieldHost) {
+		stats.Host = statsConfig.label(t.Host)
+	}
+	if !statsConfig.redacted(StatsFieldForward) {
+		targets := append(t.targets(), t.routeTargets()...)
+		labels := make([]string, 0, len(targets))
+		for _, target := range targets {
+			labels = append(labels, statsConfig.label(target.address))
+		}
+		stats.Forward = strings.Join(labels, ",")
+	}
+	return stats
+}
+
+func (t *TunnelStats) MarshalJSON() ([]byte, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	type tunnelStats TunnelStats
+	return json.Marshal((*tunnelStats)(t))
+}
+
+func (t *TunnelStats) addConnection(id int32, client string, target string) *ConnectionStats {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	conn := &ConnectionStats{
+		ID:      id,
+		Client:  client,
+		Target:  target,
+		Started: time.Now(),
+	}
+	t.Active = append(t.Active, conn)
+	return conn
+}
+
+// connected counts a connection opening, or closing with -1, as the stats are
+// read as they change
+func (t *TunnelStats) connected(delta int) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.Connected += delta
+}
+
+// received counts bytes read from the client of the connection
+func (t *TunnelStats) received(conn *ConnectionStats, n int) {
+	t.lock.Lock()
+	t.Received += int64(n)
+	conn.Received += int64(n)
+	t.lock.Unlock()
+	conn.activity.lastReceived.Store(time.Now().UnixNano())
+}
+
+// transmitted counts bytes written to the client of the connection
+func (t *TunnelStats) transmitted(conn *ConnectionStats, n int) {
+	t.lock.Lock()
+	t.Transmitted += int64(n)
+	conn.Transmitted += int64(n)
+	t.lock.Unlock()
+	conn.activity.lastTransmitted.Store(time.Now().UnixNano())
+}
+
+func (t *TunnelStats) removeConnection(conn *ConnectionStats) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for i, active := range t.Active {
+		if active == conn {
+			t.Active = append(t.Active[:i], t.Active[i+1:]...)
+			return
+		}
+	}
 }
 
 func NewStats(statsPort int) *StatsManager {
 	return &StatsManager{
 		statsPort: statsPort,
+		output:    StatsOutputTable,
+	}
+}
+
+func (s *StatsManager) SetFilter(filter *StatsFilter) {
+	s.filter = filter
+}
+
+// SetHistorySize sets the number of rate samples kept per tunnel for the
+// stats client sparklines.  A size of 0 disables the history column.
+func (s *StatsManager) SetHistorySize(size int) {
+	s.historySize = size
+	s.history = make(map[string]*RateHistory)
+}
+
+// SetOptional lets ferret carry on without serving stats, rather than becoming
+// a stats client, when another instance already holds the stats port.
+func (s *StatsManager) SetOptional(optional bool) {
+	s.optional = optional
+}
+
+// SetOutput chooses how the stats command prints each update, as a table or as
+// a line of JSON holding only the given fields of each tunnel and host
+func (s *StatsManager) SetOutput(output string, fields []string) bool {
+	switch output {
+	case StatsOutputTable, StatsOutputJSON, StatsOutputPretty:
+	default:
+		Errorf("stats output (%s) is invalid.  Must be %s, %s or %s", output, StatsOutputTable, StatsOutputJSON, StatsOutputPretty)
+		return false
+	}
+	s.output = output
+	s.fields = nil
+	for _, field := range fields {
+		if field = strings.ToLower(strings.TrimSpace(field)); field != "" {
+			if s.fields == nil {
+				s.fields = map[string]bool{"name": true}
+			}
+			s.fields[field] = true
+		}
+	}
+	return true
+}
+
+// printFrame prints a stats update as JSON, reduced to the chosen fields
+func (s *StatsManager) printFrame(update []byte) error {
+	var frame map[string]interface{}
+	if err := json.Unmarshal(update, &frame); err != nil {
+		return err
+	}
+	if s.fields != nil {
+		for _, group := range []string{"tunnels", "hosts"} {
+			items, _ := frame[group].([]interface{})
+			for _, item := range items {
+				if stats, ok := item.(map[string]interface{}); ok {
+					for field := range stats {
+						if !s.fields[field] {
+							delete(stats, field)
+						}
+					}
+				}
+			}
+		}
+	}
+	var bs []byte
+	var err error
+	if s.output == StatsOutputPretty {
+		bs, err = json.MarshalIndent(frame, "", "  ")
+	} else {
+		bs, err = json.Marshal(frame)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(bs))
+	return nil
+}
+
+func (s *StatsManager) discardUpdates(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.updateChan:
+		}
 	}
 }
 
@@ -62,12 +355,31 @@ func (s *StatsManager) UpdateChannel() chan struct{} {
 }
 
 func (s *StatsManager) StartStatsTunnel(ctx context.Context) bool {
+	controlStats = s
+	if supervisor != nil {
+		// Stats go to the supervisor alone
+		s.updateChan = make(chan struct{})
+		go s.superviseStats(ctx)
+		return true
+	}
+	if len(tenants) > 0 {
+		// The stats port cannot tell tenants apart, so stats are only offered,
+		// scoped to each tenant, by the control socket
+		Infof("ferret stats port disabled for tenants, use ferret stats")
+		s.updateChan = make(chan struct{})
+		go s.discardUpdates(ctx)
+		return true
+	}
 	if s.statsPort != -1 {
 		var err error
 		s.statsAddress = fmt.Sprintf("127.0.0.1:%d", s.statsPort)
 		s.updateChan = make(chan struct{})
-		s.statsListener, err = net.Listen("tcp", s.statsAddress)
-		if err != nil {
+		s.statsListener, err = listenTCP(s.statsAddress)
+		if err != nil && s.optional {
+			Warnf("ferret stats port %d is in use, stats unavailable", s.statsPort)
+			go s.discardUpdates(ctx)
+			return true
+		} else if err != nil {
 			s.receiveStats(ctx)
 			return false
 		}
@@ -77,7 +389,7 @@ func (s *StatsManager) StartStatsTunnel(ctx context.Context) bool {
 }
 
 func (s *StatsManager) transmitStats(ctx context.Context) {
-	fmt.Printf("  Info  - ferret stats listening on %d\n", s.statsPort)
+	Infof("ferret stats listening on %d", s.statsPort)
 	go s.statsBroadcaster(ctx)
 
 	for {
@@ -90,10 +402,9 @@ func (s *StatsManager) transmitStats(ctx context.Context) {
 					return
 				}
 			}
-			fmt.Printf("  Error - ferrent stats listener accept failed: %v\n", err)
+			Errorf("ferrent stats listener accept failed: %v", err)
 			return
 		}
-		fmt.Printf("  Info  - Connected stats client\n")
 		s.addConnection(conn)
 	}
 }
@@ -101,81 +412,53 @@ func (s *StatsManager) transmitStats(ctx context.Context) {
 func (s *StatsManager) addConnection(conn net.Conn) {
 	s.lock.Lock()
 	defer s.lock.Unlock()
-	if len(s.lastUpdate) > 0 {
-		_, _ = conn.Write(s.lastUpdate)
-	}
-	s.connections = append(s.connections, conn)
+	s.connections = append(s.connections, newStatsClient(s, conn))
 }
 
 func (s *StatsManager) closeAllConnections() {
 	s.lock.Lock()
 	defer s.lock.Unlock()
-	for _, conn := range s.connections {
-		_ = conn.Close()
+	for _, client := range s.connections {
+		client.close()
 	}
+	s.connections = nil
 	_ = s.statsListener.Close()
 }
 
+// statsBroadcaster tells every client of each change to the stats, leaving each
+// to send its update when its interval allows
 func (s *StatsManager) statsBroadcaster(ctx context.Context) {
-	lastBroadcast := time.Now().Add(-interval)
 	for {
 		select {
 		case <-ctx.Done():
-			fmt.Printf("  Info  - ferret stats closed\n")
+			Infof("ferret stats closed")
 			s.closeAllConnections()
+			// Tunnels still shutting down must never block on an update
+			s.discardUpdates(context.Background())
 			return
 		case <-s.updateChan:
-			if !s.updated {
-				s.updated = true
-				if len(s.connections) > 0 {
-					go func() {
-						// Don't repeat send data within 5 seconds, but always wait at least 1 second
-						// for any pending data to be sent.
-
-						diff := time.Until(lastBroadcast.Add(interval))
-						if diff > 0 {
-							<-time.NewTimer(diff).C
-						} else {
-							<-time.NewTimer(time.Second).C
-						}
-						bs, err := json.Marshal(s.tunnelStats)
-						lastBroadcast = time.Now()
-						if err == nil {
-							s.writeUpdate(bs)
-						}
-						s.updated = false
-					}()
-				}
-			}
+			s.notifyClients()
 		}
 	}
 }
 
-func (s *StatsManager) writeUpdate(update []byte) {
-	if !s.lock.TryLock() {
-		return
-	}
+// notifyClients wakes every client, never waiting on any of them, and forgets
+// those that have disconnected
+func (s *StatsManager) notifyClients() {
+	s.lock.Lock()
 	defer s.lock.Unlock()
-
-	x := 256 - (len(update) % 256)
-	s.lastUpdate = append(update, zeros[256-x:]...)
-	var alive []net.Conn
-	for _, conn := range s.connections {
-		if _, err := conn.Write(s.lastUpdate); err != nil {
-			fmt.Printf("  Info  - Disconnected stats client\n")
-		} else {
-			alive = append(alive, conn)
+	alive := s.connections[:0]
+	for _, client := range s.connections {
+		if client.notify() {
+			alive = append(alive, client)
 		}
 	}
-
-	if len(alive) != len(s.connections) {
-		s.connections = alive
-	}
+	s.connections = alive
 }
 
 func (s *StatsManager) receiveStats(ctx context.Context) {
-	fmt.Printf("Multiple instances running. Entering stats mode\n")
-	conn, err := net.DialTimeout("tcp", s.statsAddress, time.Second*5)
+	Infof("Multiple instances running. Entering stats mode")
+	conn, err := dialStats(s.statsAddress)
 	if err != nil {
 		return
 	}
@@ -185,47 +468,279 @@ func (s *StatsManager) receiveStats(ctx context.Context) {
 		_ = conn.Close()
 	}()
 
-	var n int
-	bs := make([]byte, 256)
-	str := ""
+	err = readFrames(conn, func(frame *StatsFrame) bool {
+		s.sortAndDisplay(frame.Tunnels)
+		displayHosts(frame.Hosts)
+		return true
+	})
+	if err != nil {
+		Infof("ferret terminated or cannot be reached")
+	}
+	_ = conn.Close()
+}
+
+// frame pads an update with zeros up to the next multiple of 256 bytes.  The
+// zeros mark the end of the update on the receiving side.
+func frame(update []byte) []byte {
+	x := 256 - (len(update) % 256)
+	return append(update, zeros[256-x:]...)
+}
+
+// readFrames reads zero terminated stats updates from a connection, calling handle
+// with each one until it returns false or the connection fails.  Delta updates
+// are applied to the previous frame, so handle always sees every tunnel.
+// Updates from older versions, a bare array of tunnel stats, are accepted too.
+func readFrames(conn net.Conn, handle func(frame *StatsFrame) bool) error {
+	bs := make([]byte, 4096)
+	var pending []byte
+	var current *StatsFrame
 	for {
-		n, err = conn.Read(bs)
+		n, err := conn.Read(bs)
 		if err != nil {
-			fmt.Printf("  Info  - ferret terminated or cannot be reached\n")
-			_ = conn.Close()
-			return
-		} else if n > 0 {
-			str = str + string(bs)
-		}
-		if bs[n-1] == 0 {
-			index := strings.IndexByte(str, byte(0))
-			str = str[:index]
-			var ts []*TunnelStats
-			if err = json.Unmarshal([]byte(str), &ts); err == nil {
-				sortAndDisplay(ts)
+			return err
+		}
+		pending = append(pending, bs[:n]...)
+		for {
+			index := bytes.IndexByte(pending, 0)
+			if index < 0 {
+				break
+			}
+			update := pending[:index]
+			pending = bytes.TrimLeft(pending[index:], "\x00")
+			if len(update) == 0 {
+				continue
+			}
+			frame := &StatsFrame{}
+			if bytes.HasPrefix(bytes.TrimSpace(update), []byte("[")) {
+				err = json.Unmarshal(update, &frame.Tunnels)
+			} else {
+				err = json.Unmarshal(update, frame)
+			}
+			if err != nil {
+				continue
+			}
+			if frame.Delta {
+				if current == nil {
+					continue
+				}
+				frame = current.apply(frame)
+			}
+			current = frame
+			if !handle(frame) {
+				return nil
 			}
-			str = ""
 		}
 	}
 }
 
-func sortAndDisplay(ts []*TunnelStats) {
+func (s *StatsManager) sortAndDisplay(ts []*TunnelStats) {
 	sort.Slice(ts, func(i, j int) bool {
 		if ts[i].Received != ts[j].Received {
 			return ts[i].Received > ts[j].Received
 		}
 		return ts[i].id < ts[j].id
 	})
-	fmt.Printf("%-35s %-13s %-13s %-6s %-6s\n", "Name", "Rcvd", "Sent", "Actv", "Total")
+	rates := s.rates(ts)
+	header := fmt.Sprintf("%-35s %-10s %-13s %-13s %-11s %-6s %-6s", "Name", "State", "Rcvd", "Sent", "Rate", "Actv", "Total")
+	diagnostics := false
 	for _, t := range ts {
-		_, _ = p.Printf(
-			"%-35s %-13d %-13d %-6d %-6d\n",
-			t.Name, t.Received, t.Transmitted, t.Connected, t.Connections,
+		diagnostics = diagnostics || t.RTT > 0 || t.Suspect
+	}
+	if diagnostics {
+		header = fmt.Sprintf("%s %-16s", header, "Diagnostics")
+	}
+	if s.historySize > 0 {
+		header = fmt.Sprintf("%s %s", header, "History")
+	}
+	if ts := Timestamp(); ts != "" {
+		fmt.Println(ts)
+	}
+	fmt.Println(header)
+	for _, t := range ts {
+		rate := rates[t.key()]
+		if !s.filter.include(t, rate) {
+			continue
+		}
+		state := t.State
+		if state == "" {
+			state = "-"
+		}
+		line := p.Sprintf(
+			"%-35s %-10s %-13d %-13d %-11d %-6d %-6d",
+			t.Name, state, t.Received, t.Transmitted, rate, t.Connected, t.Connections,
 		)
+		if diagnostics {
+			line = fmt.Sprintf("%s %-16s", line, t.diagnostics())
+		}
+		if history, ok := s.history[t.key()]; ok {
+			line = fmt.Sprintf("%s %s", line, history.Sparkline())
+		}
+		if t.Suspect || t.State == string(StateDegraded) || s.filter.highlight(t, rate) {
+			line = "\033[7m" + line + "\033[0m"
+		}
+		fmt.Println(line)
+	}
+}
+
+// key identifies a tunnel across updates by its id, so that a renamed tunnel
+// keeps its history.  Updates from older versions carry no id.
+func (t *TunnelStats) key() string {
+	if t.ID != "" {
+		return t.ID
+	}
+	return t.Name
+}
+
+func (t *TunnelStats) diagnostics() string {
+	var diagnostics string
+	if t.RTT > 0 {
+		diagnostics = fmt.Sprintf("%dms", t.RTT)
+	} else if t.Suspect && t.Stalled == 0 {
+		diagnostics = "no reply"
+	} else {
+		diagnostics = "-"
+	}
+	if t.Stalled > 0 {
+		diagnostics = fmt.Sprintf("%s stalled:%d", diagnostics, t.Stalled)
 	}
+	if t.Limited > 0 {
+		diagnostics = fmt.Sprintf("%s limited:%d", diagnostics, t.Limited)
+	}
+	if t.Denied > 0 {
+		diagnostics = fmt.Sprintf("%s denied:%d", diagnostics, t.Denied)
+	}
+	return diagnostics
+}
+
+// rates calculates the combined received and transmitted bytes per second
+// of each tunnel since the previous update, keyed as the tunnel's stats
+func (s *StatsManager) rates(ts []*TunnelStats) map[string]int64 {
+	now := time.Now()
+	elapsed := now.Sub(s.previousTime).Seconds()
+	rates := make(map[string]int64, len(ts))
+	current := make(map[string]*TunnelStats, len(ts))
+	for _, t := range ts {
+		current[t.key()] = t
+		if prev, ok := s.previous[t.key()]; ok && elapsed > 0 {
+			delta := (t.Received - prev.Received) + (t.Transmitted - prev.Transmitted)
+			if delta > 0 {
+				rates[t.key()] = int64(float64(delta) / elapsed)
+			}
+		}
+		if s.historySize > 0 {
+			history, ok := s.history[t.key()]
+			if !ok {
+				history = NewRateHistory(s.historySize)
+				s.history[t.key()] = history
+			}
+			history.Add(rates[t.key()])
+		}
+	}
+	s.previous = current
+	s.previousTime = now
+	return rates
 }
 
 func (s *StatsManager) AddTunnelStats(stats *TunnelStats) {
+	s.statsLock.Lock()
+	defer s.statsLock.Unlock()
+	s.nextID++
+	stats.id = s.nextID
 	s.tunnelStats = append(s.tunnelStats, stats)
-	stats.id = len(s.tunnelStats)
+}
+
+// RemoveTunnelStats drops the stats of a tunnel that no longer exists
+func (s *StatsManager) RemoveTunnelStats(stats *TunnelStats) {
+	s.statsLock.Lock()
+	defer s.statsLock.Unlock()
+	for i, existing := range s.tunnelStats {
+		if existing == stats {
+			s.tunnelStats = append(s.tunnelStats[:i:i], s.tunnelStats[i+1:]...)
+			return
+		}
+	}
+}
+
+// AddHostStats includes a host's connection in the stats updates, which are
+// then also sent whenever a host connects or disconnects.
+func (s *StatsManager) AddHostStats(stats *HostStats) {
+	if stats == nil {
+		return
+	}
+	if len(s.hostStats) == 0 && s.updateChan != nil {
+		updateChan := s.updateChan
+		addEventSink(func(event *Event) {
+			if event.Type == EventHostConnect || event.Type == EventHostDisconnect {
+				go func() {
+					updateChan <- struct{}{}
+				}()
+			}
+		})
+	}
+	s.hostStats = append(s.hostStats, stats)
+}
+
+// scopedFrame is a stats update holding only the tunnels and hosts of a tenant
+func (s *StatsManager) scopedFrame(tenant *Tenant) *StatsFrame {
+	s.statsLock.Lock()
+	defer s.statsLock.Unlock()
+	frame := &StatsFrame{Time: time.Now(), Instance: statsConfig.instance()}
+	for _, stats := range s.tunnelStats {
+		if tenant.owns(stats.tenant) {
+			frame.Tunnels = append(frame.Tunnels, stats)
+		}
+	}
+	for _, stats := range s.hostStats {
+		if tenant.owns(stats.tenant) {
+			frame.Hosts = append(frame.Hosts, stats)
+		}
+	}
+	return frame
+}
+
+// controlStats is the stats manager of the running ferret, queried by the
+// stats control command
+var controlStats *StatsManager
+
+func statsSnapshot(tenant *Tenant, _ []string) (string, error) {
+	if controlStats == nil {
+		return "", fmt.Errorf("stats unavailable")
+	}
+	bs, err := json.Marshal(controlStats.scopedFrame(tenant))
+	return string(bs), err
+}
+
+// ShowStats prints the stats of a running ferret obtained through its control
+// socket, scoped to the tenant running this command.  When following, the
+// stats are fetched again every interval.
+func (s *StatsManager) ShowStats(ctx context.Context, path string, follow bool) bool {
+	for {
+		output, err := Control(path, "stats")
+		if err != nil {
+			Errorf("stats failed: %v", err)
+			return false
+		}
+		if s.output != StatsOutputTable {
+			if err = s.printFrame([]byte(output)); err != nil {
+				Errorf("stats cannot be read: %v", err)
+				return false
+			}
+		} else {
+			frame := &StatsFrame{}
+			if err = json.Unmarshal([]byte(output), frame); err != nil {
+				Errorf("stats cannot be read: %v", err)
+				return false
+			}
+			s.sortAndDisplay(frame.Tunnels)
+			displayHosts(frame.Hosts)
+		}
+		if !follow {
+			return true
+		}
+		select {
+		case <-ctx.Done():
+			return true
+		case <-time.After(interval):
+		}
+	}
 }
@@ -0,0 +1,113 @@
+package internal
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// statsWriteTimeout disconnects a client that has not taken an update in time
+const statsWriteTimeout = 10 * time.Second
+
+// statsClient sends stats updates to a connected client from a goroutine of its
+// own, in the format and at the interval the client chose, so a slow or stuck
+// client never holds up the others, nor the tunnels reporting their stats.  A
+// client that falls behind is simply sent the latest stats when it catches up.
+type statsClient struct {
+	conn      net.Conn
+	manager   *StatsManager
+	encoding  statsEncoding
+	interval  time.Duration
+	delta     *statsDelta
+	wake      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newStatsClient(manager *StatsManager, conn net.Conn) *statsClient {
+	c := &statsClient{
+		conn:    conn,
+		manager: manager,
+		delta:   &statsDelta{},
+		wake:    make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+	// A client joining is brought up to date at once
+	c.wake <- struct{}{}
+	go c.send()
+	return c
+}
+
+func (c *statsClient) send() {
+	var err error
+	c.encoding, c.interval, err = readStatsHello(c.conn)
+	if err != nil {
+		Warnf("stats client %s refused: %v", c.conn.RemoteAddr(), err)
+		c.close()
+		return
+	}
+	Infof("Connected stats client %s, sent %s every %s", c.conn.RemoteAddr(), c.encoding.name(), c.interval)
+	var last time.Time
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-c.wake:
+		}
+		if !last.IsZero() {
+			// Don't repeat send data within the interval, but always wait at
+			// least 1 second for any pending data to be sent.
+			wait := time.Until(last.Add(c.interval))
+			if wait < time.Second {
+				wait = time.Second
+			}
+			timer := time.NewTimer(wait)
+			select {
+			case <-c.done:
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
+		}
+		update, err := c.manager.encodeFrame(c.encoding, c.delta)
+		last = time.Now()
+		if err != nil {
+			Errorf("stats update for %s cannot be encoded: %v", c.conn.RemoteAddr(), err)
+			continue
+		}
+		_ = c.conn.SetWriteDeadline(time.Now().Add(statsWriteTimeout))
+		if _, err = c.conn.Write(update); err != nil {
+			select {
+			case <-c.done:
+			default:
+				Infof("Disconnected stats client %s: %v", c.conn.RemoteAddr(), err)
+			}
+			c.close()
+			return
+		}
+	}
+}
+
+// notify tells the client the stats have changed, to be sent once its interval
+// allows, and reports whether the client is still connected
+func (c *statsClient) notify() bool {
+	select {
+	case <-c.done:
+		return false
+	default:
+	}
+	select {
+	case c.wake <- struct{}{}:
+	default:
+		// Already due an update, which will include this change
+	}
+	return true
+}
+
+// close disconnects the client
+func (c *statsClient) close() {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		_ = c.conn.Close()
+	})
+}
@@ -0,0 +1,124 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"sort"
+	"time"
+)
+
+const defaultStatsSnapshot = time.Minute
+
+// statsDelta remembers how each tunnel and host looked in the previous update
+// sent to a client, so that only those that have changed since need to be sent
+type statsDelta struct {
+	tunnels  map[string][]byte
+	hosts    map[string][]byte
+	snapshot time.Time
+}
+
+// rawStatsFrame is a stats frame whose tunnels and hosts are already encoded,
+// in the format of the client it is for
+type rawStatsFrame struct {
+	Time     time.Time         `json:"time"`
+	Instance *StatsInstance    `json:"instance,omitempty"`
+	Delta    bool              `json:"delta,omitempty"`
+	Tunnels  []json.RawMessage `json:"tunnels"`
+	Hosts    []json.RawMessage `json:"hosts,omitempty"`
+	Removed  []string          `json:"removed,omitempty"`
+}
+
+// encodeFrame encodes an update for a client.  With delta updates enabled, the
+// delta of the client remembers what it was last sent, so the update holds only
+// what changed since, but for a full frame once a snapshot period.  Otherwise
+// every update is a full frame.
+func (s *StatsManager) encodeFrame(encoding statsEncoding, delta *statsDelta) ([]byte, error) {
+	s.statsLock.Lock()
+	defer s.statsLock.Unlock()
+
+	now := time.Now()
+	full := statsConfig == nil || !statsConfig.Delta || now.Sub(delta.snapshot) >= statsConfig.snapshot
+	update := &rawStatsFrame{Time: now, Instance: statsConfig.instance(), Delta: !full}
+	tunnels := make(map[string][]byte, len(s.tunnelStats))
+	for _, stats := range s.tunnelStats {
+		bs, err := encoding.tunnel(stats)
+		if err != nil {
+			return nil, err
+		}
+		tunnels[stats.key()] = bs
+		if full || !bytes.Equal(delta.tunnels[stats.key()], bs) {
+			update.Tunnels = append(update.Tunnels, bs)
+		}
+	}
+	if !full {
+		for key := range delta.tunnels {
+			if _, ok := tunnels[key]; !ok {
+				update.Removed = append(update.Removed, key)
+			}
+		}
+		sort.Strings(update.Removed)
+	}
+	hosts := make(map[string][]byte, len(s.hostStats))
+	for _, stats := range s.hostStats {
+		bs, err := encoding.host(stats)
+		if err != nil {
+			return nil, err
+		}
+		hosts[stats.Name] = bs
+		if full || !bytes.Equal(delta.hosts[stats.Name], bs) {
+			update.Hosts = append(update.Hosts, bs)
+		}
+	}
+	delta.tunnels = tunnels
+	delta.hosts = hosts
+	if full {
+		delta.snapshot = now
+	}
+	return encoding.frame(update)
+}
+
+// apply returns the full frame resulting from a delta update to this one
+func (f *StatsFrame) apply(delta *StatsFrame) *StatsFrame {
+	merged := &StatsFrame{Time: delta.Time, Instance: delta.Instance}
+	removed := make(map[string]bool, len(delta.Removed))
+	for _, key := range delta.Removed {
+		removed[key] = true
+	}
+	tunnels := make(map[string]*TunnelStats, len(delta.Tunnels))
+	for _, stats := range delta.Tunnels {
+		tunnels[stats.key()] = stats
+	}
+	for _, stats := range f.Tunnels {
+		if removed[stats.key()] {
+			continue
+		}
+		if changed, ok := tunnels[stats.key()]; ok {
+			stats = changed
+			delete(tunnels, stats.key())
+		}
+		merged.Tunnels = append(merged.Tunnels, stats)
+	}
+	for _, stats := range delta.Tunnels {
+		if _, ok := tunnels[stats.key()]; ok {
+			merged.Tunnels = append(merged.Tunnels, stats)
+		}
+	}
+
+	hosts := make(map[string]*HostStats, len(delta.Hosts))
+	for _, stats := range delta.Hosts {
+		hosts[stats.Name] = stats
+	}
+	for _, stats := range f.Hosts {
+		if changed, ok := hosts[stats.Name]; ok {
+			stats = changed
+			delete(hosts, stats.Name)
+		}
+		merged.Hosts = append(merged.Hosts, stats)
+	}
+	for _, stats := range delta.Hosts {
+		if _, ok := hosts[stats.Name]; ok {
+			merged.Hosts = append(merged.Hosts, stats)
+		}
+	}
+	return merged
+}
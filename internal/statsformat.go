@@ -0,0 +1,313 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// The formats a stats client may ask for in its hello
+const (
+	statsFormatLegacy   = "legacy"
+	statsFormatNDJSON   = "ndjson"
+	statsFormatProtobuf = "protobuf"
+)
+
+// statsHelloTimeout is how long a client has to send its hello, after which it
+// is sent the legacy format at the configured interval, as older clients are
+const statsHelloTimeout = 250 * time.Millisecond
+
+// statsHello is the line of JSON a stats client may send on connecting, to
+// choose the format and the interval of its updates, e.g.
+// {"format":"ndjson","interval":"2s"}
+type statsHello struct {
+	Format   string `json:"format"`
+	Interval string `json:"interval,omitempty"`
+}
+
+// readStatsHello reads the hello of a client, if it sends one, returning the
+// encoding and interval of its updates
+func readStatsHello(conn net.Conn) (statsEncoding, time.Duration, error) {
+	_ = conn.SetReadDeadline(time.Now().Add(statsHelloTimeout))
+	defer func() {
+		_ = conn.SetReadDeadline(time.Time{})
+	}()
+	var line []byte
+	b := make([]byte, 1)
+	for len(line) < 1024 {
+		if _, err := conn.Read(b); err != nil {
+			if len(line) == 0 {
+				return legacyEncoding{}, interval, nil
+			}
+			return nil, 0, errors.New("hello incomplete")
+		}
+		if b[0] == '\n' {
+			break
+		}
+		line = append(line, b[0])
+	}
+	hello := &statsHello{}
+	if err := json.Unmarshal(line, hello); err != nil {
+		return nil, 0, fmt.Errorf("hello (%s) is invalid: %v", line, err)
+	}
+	every := interval
+	if strings.TrimSpace(hello.Interval) != "" {
+		d, err := time.ParseDuration(strings.TrimSpace(hello.Interval))
+		if err != nil || d < time.Second {
+			return nil, 0, fmt.Errorf("interval (%s) is invalid.  Must be a duration of at least 1s", hello.Interval)
+		}
+		every = d
+	}
+	switch strings.ToLower(strings.TrimSpace(hello.Format)) {
+	case "", statsFormatLegacy:
+		return legacyEncoding{}, every, nil
+	case statsFormatNDJSON:
+		return ndjsonEncoding{}, every, nil
+	case statsFormatProtobuf:
+		return protobufEncoding{}, every, nil
+	}
+	return nil, 0, fmt.Errorf("format (%s) is invalid.  Must be %s, %s or %s", hello.Format, statsFormatLegacy, statsFormatNDJSON, statsFormatProtobuf)
+}
+
+// dialStats connects to the stats port of a running ferret for legacy updates,
+// saying so at once rather than leaving it to wait for a hello
+func dialStats(address string) (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", address, time.Second*5)
+	if err != nil {
+		return nil, err
+	}
+	bs, _ := json.Marshal(&statsHello{Format: statsFormatLegacy})
+	// Older versions never read the hello, which is harmless
+	_, _ = conn.Write(append(bs, '\n'))
+	return conn, nil
+}
+
+// statsEncoding encodes stats updates in the format chosen by a client.  Each
+// tunnel and host is encoded alone, so that delta updates can tell which have
+// changed, and then the frame holding those encoded.
+type statsEncoding interface {
+	name() string
+	tunnel(stats *TunnelStats) ([]byte, error)
+	host(stats *HostStats) ([]byte, error)
+	frame(frame *rawStatsFrame) ([]byte, error)
+}
+
+// legacyEncoding is JSON padded with zeros, which mark the end of each update
+type legacyEncoding struct{}
+
+func (legacyEncoding) name() string {
+	return statsFormatLegacy
+}
+
+func (legacyEncoding) tunnel(stats *TunnelStats) ([]byte, error) {
+	return json.Marshal(stats)
+}
+
+func (legacyEncoding) host(stats *HostStats) ([]byte, error) {
+	return json.Marshal(stats)
+}
+
+func (legacyEncoding) frame(f *rawStatsFrame) ([]byte, error) {
+	bs, err := json.Marshal(f)
+	if err != nil {
+		return nil, err
+	}
+	return frame(bs), nil
+}
+
+// ndjsonEncoding is JSON with each update on a line of its own
+type ndjsonEncoding struct {
+	legacyEncoding
+}
+
+func (ndjsonEncoding) name() string {
+	return statsFormatNDJSON
+}
+
+func (ndjsonEncoding) frame(f *rawStatsFrame) ([]byte, error) {
+	bs, err := json.Marshal(f)
+	if err != nil {
+		return nil, err
+	}
+	return append(bs, '\n'), nil
+}
+
+// protobufEncoding is protocol buffers, each update preceded by its length as a
+// varint, as written by writeDelimited in most protobuf libraries.  Times are
+// unix milliseconds.  The messages are:
+//
+//	message Frame {
+//	  int64 time = 1; Instance instance = 2; bool delta = 3;
+//	  repeated Tunnel tunnels = 4; repeated Host hosts = 5; repeated string removed = 6;
+//	}
+//	message Instance { string name = 1; string host = 2; int64 pid = 3; int64 started = 4; }
+//	message Tunnel {
+//	  string id = 1; string name = 2; string state = 3; string host = 4; string forward = 5;
+//	  string entrance = 6; int64 connected = 7; int64 connections = 8; int64 received = 9;
+//	  int64 transmitted = 10; repeated Connection active = 11; int64 rtt_ms = 12;
+//	  int64 stalled = 13; bool suspect = 14; int64 limited = 15; int64 denied = 16;
+//	}
+//	message Connection {
+//	  int32 id = 1; string client = 2; string target = 3; int64 started = 4;
+//	  int64 received = 5; int64 transmitted = 6;
+//	}
+//	message Host {
+//	  string name = 1; string address = 2; string via = 3; bool connected = 4;
+//	  int64 connected_since = 5; int64 reconnects = 6; int64 channels = 7; int64 received = 8;
+//	  int64 transmitted = 9; map<string, ChannelTotals> tunnels = 10; repeated Channel open = 11;
+//	}
+//	message ChannelTotals { int64 channels = 1; int64 received = 2; int64 transmitted = 3; }
+//	message Channel {
+//	  string tunnel = 1; int32 connection = 2; string target = 3; int64 opened = 4;
+//	  int64 received = 5; int64 transmitted = 6;
+//	}
+type protobufEncoding struct{}
+
+func (protobufEncoding) name() string {
+	return statsFormatProtobuf
+}
+
+func (protobufEncoding) tunnel(t *TunnelStats) ([]byte, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	var b []byte
+	b = pbString(b, 1, t.ID)
+	b = pbString(b, 2, t.Name)
+	b = pbString(b, 3, t.State)
+	b = pbString(b, 4, t.Host)
+	b = pbString(b, 5, t.Forward)
+	b = pbString(b, 6, t.Entrance)
+	b = pbInt(b, 7, int64(t.Connected))
+	b = pbInt(b, 8, int64(t.Connections))
+	b = pbInt(b, 9, t.Received)
+	b = pbInt(b, 10, t.Transmitted)
+	for _, conn := range t.Active {
+		var c []byte
+		c = pbInt(c, 1, int64(conn.ID))
+		c = pbString(c, 2, conn.Client)
+		c = pbString(c, 3, conn.Target)
+		c = pbTime(c, 4, conn.Started)
+		c = pbInt(c, 5, conn.Received)
+		c = pbInt(c, 6, conn.Transmitted)
+		b = pbMessage(b, 11, c)
+	}
+	b = pbInt(b, 12, t.RTT)
+	b = pbInt(b, 13, int64(t.Stalled))
+	b = pbBool(b, 14, t.Suspect)
+	b = pbInt(b, 15, int64(t.Limited))
+	b = pbInt(b, 16, int64(t.Denied))
+	return b, nil
+}
+
+func (protobufEncoding) host(s *HostStats) ([]byte, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var b []byte
+	b = pbString(b, 1, s.Name)
+	b = pbString(b, 2, s.Address)
+	b = pbString(b, 3, s.Via)
+	b = pbBool(b, 4, s.Connected)
+	if s.ConnectedSince != nil {
+		b = pbTime(b, 5, *s.ConnectedSince)
+	}
+	b = pbInt(b, 6, int64(s.Reconnects))
+	b = pbInt(b, 7, int64(s.Channels))
+	b = pbInt(b, 8, s.Received)
+	b = pbInt(b, 9, s.Transmitted)
+	tunnels := make([]string, 0, len(s.Tunnels))
+	for tunnel := range s.Tunnels {
+		tunnels = append(tunnels, tunnel)
+	}
+	sort.Strings(tunnels)
+	for _, tunnel := range tunnels {
+		totals := s.Tunnels[tunnel]
+		var v []byte
+		v = pbInt(v, 1, int64(totals.Channels))
+		v = pbInt(v, 2, totals.Received)
+		v = pbInt(v, 3, totals.Transmitted)
+		var entry []byte
+		entry = pbString(entry, 1, tunnel)
+		entry = pbMessage(entry, 2, v)
+		b = pbMessage(b, 10, entry)
+	}
+	for _, channel := range s.Open {
+		var c []byte
+		c = pbString(c, 1, channel.Tunnel)
+		c = pbInt(c, 2, int64(channel.Connection))
+		c = pbString(c, 3, channel.Target)
+		c = pbTime(c, 4, channel.Opened)
+		c = pbInt(c, 5, channel.Received)
+		c = pbInt(c, 6, channel.Transmitted)
+		b = pbMessage(b, 11, c)
+	}
+	return b, nil
+}
+
+func (protobufEncoding) frame(f *rawStatsFrame) ([]byte, error) {
+	var b []byte
+	b = pbTime(b, 1, f.Time)
+	if f.Instance != nil {
+		var i []byte
+		i = pbString(i, 1, f.Instance.Name)
+		i = pbString(i, 2, f.Instance.Host)
+		i = pbInt(i, 3, int64(f.Instance.PID))
+		i = pbTime(i, 4, f.Instance.Started)
+		b = pbMessage(b, 2, i)
+	}
+	b = pbBool(b, 3, f.Delta)
+	for _, tunnel := range f.Tunnels {
+		b = pbMessage(b, 4, tunnel)
+	}
+	for _, host := range f.Hosts {
+		b = pbMessage(b, 5, host)
+	}
+	for _, key := range f.Removed {
+		b = protowire.AppendTag(b, 6, protowire.BytesType)
+		b = protowire.AppendString(b, key)
+	}
+	return protowire.AppendBytes(nil, b), nil
+}
+
+// The fields of protobuf messages, which like proto3 leave out zero values
+
+func pbString(b []byte, num protowire.Number, v string) []byte {
+	if v == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, v)
+}
+
+func pbInt(b []byte, num protowire.Number, v int64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, uint64(v))
+}
+
+func pbBool(b []byte, num protowire.Number, v bool) []byte {
+	if !v {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, protowire.EncodeBool(v))
+}
+
+func pbTime(b []byte, num protowire.Number, v time.Time) []byte {
+	if v.IsZero() {
+		return b
+	}
+	return pbInt(b, num, v.UnixMilli())
+}
+
+func pbMessage(b []byte, num protowire.Number, v []byte) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, v)
+}
@@ -0,0 +1,89 @@
+package internal
+
+import (
+	"context"
+	"io"
+	"strings"
+)
+
+// Stdio connects the input and output of ferret to an address reached through one
+// of the configured hosts, so ferret can serve as an OpenSSH ProxyCommand or
+// as the pipe of tools such as rsync and git.  Only the host, and the hosts it
+// jumps through, are validated; the tunnels of the config are not started.
+func (c *Configuration) Stdio(ctx context.Context, hostName string, address string, defaultUsername string, in io.Reader, out io.Writer) bool {
+	hops, valid := jumpHops(c.Hosts)
+	if !valid {
+		return false
+	}
+	hosts := append(c.Hosts, hops...)
+	find := func(name string) *Host {
+		for _, h := range hosts {
+			if strings.TrimSpace(h.Name) == name {
+				return h
+			}
+		}
+		return nil
+	}
+	host := find(hostName)
+	if host == nil {
+		Errorf("host (%s) is not defined", hostName)
+		return false
+	}
+	validated := make(map[*Host]bool)
+	for jumpHost := find(strings.TrimSpace(host.JumpHost)); jumpHost != nil && !validated[jumpHost]; jumpHost = find(strings.TrimSpace(jumpHost.JumpHost)) {
+		if !jumpHost.Validate(defaultUsername) {
+			return false
+		}
+		validated[jumpHost] = true
+	}
+	if !host.Validate(defaultUsername) {
+		return false
+	}
+	host.isHost = true
+	if !validateJumpHosts() {
+		return false
+	}
+
+	forward := NewAddress(address)
+	if !forward.Validate("host", hostName, "address", true, false) {
+		return false
+	}
+	if policy != nil && len(policy.networks) > 0 && (forward.IsUnix() || !policy.allowedDestination(forward.Host())) {
+		Errorf("host (%s) address (%s) is not an allowed destination by policy", hostName, address)
+		return false
+	}
+	if !host.Open() {
+		return false
+	}
+	var conn io.ReadWriteCloser
+	var ok bool
+	if forward.IsUnix() {
+		conn, ok = host.DialUnix(forward.address)
+	} else {
+		conn, ok = host.Dial(forward.address)
+	}
+	if !ok {
+		return false
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	done := make(chan struct{})
+	go func() {
+		_, _ = io.Copy(out, conn)
+		close(done)
+	}()
+	go func() {
+		_, _ = io.Copy(conn, in)
+		// Let the destination see the end of the input while its answer is read
+		if closer, ok := conn.(interface{ CloseWrite() error }); ok {
+			_ = closer.CloseWrite()
+		}
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+	}
+	return true
+}
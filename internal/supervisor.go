@@ -0,0 +1,127 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Supervisor message types
+const (
+	SupervisorResponse = "response"
+	SupervisorStats    = "stats"
+	SupervisorEvent    = "event"
+)
+
+// supervisorStatsInterval is how often, at most, stats are written to a supervisor
+const supervisorStatsInterval = time.Second
+
+// supervisor is stdout when ferret is run by a supervisor, such as a GUI, over
+// stdio, or nil
+var supervisor *supervisorOutput
+
+// supervisorRequest is a line of JSON read from stdin: a control command, with
+// an id of any JSON value echoed in its response
+type supervisorRequest struct {
+	ID json.RawMessage `json:"id,omitempty"`
+	ControlRequest
+}
+
+// supervisorMessage is a line of JSON written to stdout: the response to a
+// request, the stats as they change, or an event
+type supervisorMessage struct {
+	Type string          `json:"type"`
+	ID   json.RawMessage `json:"id,omitempty"`
+	*ControlResponse
+	Stats *StatsFrame `json:"stats,omitempty"`
+	Event *Event      `json:"event,omitempty"`
+}
+
+type supervisorOutput struct {
+	lock sync.Mutex
+	out  io.Writer
+}
+
+func (o *supervisorOutput) write(message *supervisorMessage) {
+	bs, err := json.Marshal(message)
+	if err != nil {
+		return
+	}
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	_, _ = o.out.Write(append(bs, '\n'))
+}
+
+// SuperviseOverStdio has stdout carry only the lines of JSON for a supervisor,
+// including every event, so all messages go to stderr
+func SuperviseOverStdio() {
+	supervisor = &supervisorOutput{out: os.Stdout}
+	os.Stdout = os.Stderr
+	addEventSink(func(event *Event) {
+		supervisor.write(&supervisorMessage{Type: SupervisorEvent, Event: event})
+	})
+}
+
+// ServeSupervisor answers the control commands a supervisor writes to stdin, in
+// place of the control socket, as the owner of ferret.  Stdin closing means the
+// supervisor has gone, so ferret stops.
+func ServeSupervisor(ctx context.Context, stop func()) {
+	controlContext = ctx
+	go func() {
+		reader := bufio.NewReader(os.Stdin)
+		for {
+			line, err := reader.ReadBytes('\n')
+			if len(bytes.TrimSpace(line)) > 0 {
+				go serveSupervisorRequest(line)
+			}
+			if err != nil {
+				break
+			}
+		}
+		Infof("supervisor closed stdin, stopping")
+		stop()
+	}()
+}
+
+func serveSupervisorRequest(line []byte) {
+	request := &supervisorRequest{}
+	response := &ControlResponse{}
+	if err := json.Unmarshal(line, request); err != nil {
+		response.Error = fmt.Sprintf("invalid request: %v", err)
+	} else if handler, ok := controlHandlers[request.Command]; !ok {
+		response.Error = fmt.Sprintf("unknown command (%s)", request.Command)
+	} else if response.Output, err = handler(nil, request.Args); err != nil {
+		response.Error = err.Error()
+	} else {
+		response.OK = true
+	}
+	supervisor.write(&supervisorMessage{Type: SupervisorResponse, ID: request.ID, ControlResponse: response})
+}
+
+// superviseStats writes the stats to the supervisor as they change
+func (s *StatsManager) superviseStats(ctx context.Context) {
+	ticker := time.NewTicker(supervisorStatsInterval)
+	defer ticker.Stop()
+	changed := true
+	for {
+		select {
+		case <-ctx.Done():
+			// Tunnels still shutting down must never block on an update
+			s.discardUpdates(context.Background())
+			return
+		case <-s.updateChan:
+			changed = true
+		case <-ticker.C:
+			if changed {
+				changed = false
+				supervisor.write(&supervisorMessage{Type: SupervisorStats, Stats: s.scopedFrame(nil)})
+			}
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package internal
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Files written by SynthConfig
+const (
+	SynthConfigFile = "ferret.yaml"
+	SynthIdentity   = "id_ed25519"
+	SynthHostKey    = "host_key"
+	SynthKnownHosts = "known_hosts"
+)
+
+// SynthConfig writes a throwaway configuration of hosts and tunnels, together
+// with a client identity, a host key and a known_hosts file, into dir.  Every
+// host is bound to the test SSH server on 127.0.0.1:port, and every tunnel
+// forwards to that same server, so the configuration is fully usable as soon
+// as a test server is started with the generated host key.  It returns the
+// path of the configuration file.
+func SynthConfig(dir string, hosts int, tunnels int, port int) (string, bool) {
+	if hosts < 1 || tunnels < 1 {
+		Errorf("synthesized config requires at least one host and one tunnel")
+		return "", false
+	}
+	if port < 1 || port > 65535 {
+		Errorf("synthesized config port (%d) is invalid", port)
+		return "", false
+	}
+	if dir == "" {
+		var err error
+		if dir, err = os.MkdirTemp("", "ferret-synth-"); err != nil {
+			Errorf("synthesized config directory cannot be created: %v", err)
+			return "", false
+		}
+	} else if err := os.MkdirAll(dir, 0700); err != nil {
+		Errorf("synthesized config directory (%s) cannot be created: %v", dir, err)
+		return "", false
+	}
+	dir, _ = filepath.Abs(dir)
+
+	identity := filepath.Join(dir, SynthIdentity)
+	if _, ok := writeSynthKey(identity); !ok {
+		return "", false
+	}
+	hostKey, ok := writeSynthKey(filepath.Join(dir, SynthHostKey))
+	if !ok {
+		return "", false
+	}
+	address := fmt.Sprintf("127.0.0.1:%d", port)
+	knownHosts := filepath.Join(dir, SynthKnownHosts)
+	line := fmt.Sprintf("[127.0.0.1]:%d %s", port, ssh.MarshalAuthorizedKey(hostKey.PublicKey()))
+	if err := os.WriteFile(knownHosts, []byte(line), 0600); err != nil {
+		Errorf("synthesized known_hosts (%s) cannot be written: %v", knownHosts, err)
+		return "", false
+	}
+
+	config := &strings.Builder{}
+	config.WriteString("hosts:\n")
+	for i := 1; i <= hosts; i++ {
+		fmt.Fprintf(config, "  - name: host-%d\n", i)
+		fmt.Fprintf(config, "    address: %s\n", address)
+		config.WriteString("    username: ferret\n")
+		fmt.Fprintf(config, "    identity: %q\n", identity)
+		fmt.Fprintf(config, "    known_hosts: %q\n", knownHosts)
+	}
+	config.WriteString("tunnels:\n")
+	for i := 1; i <= tunnels; i++ {
+		local, ok := freeLocalAddress()
+		if !ok {
+			return "", false
+		}
+		fmt.Fprintf(config, "  - name: tunnel-%d\n", i)
+		fmt.Fprintf(config, "    local: %s\n", local)
+		fmt.Fprintf(config, "    host: host-%d\n", (i-1)%hosts+1)
+		fmt.Fprintf(config, "    forward: %s\n", address)
+	}
+	configFile := filepath.Join(dir, SynthConfigFile)
+	if err := os.WriteFile(configFile, []byte(config.String()), 0600); err != nil {
+		Errorf("synthesized config (%s) cannot be written: %v", configFile, err)
+		return "", false
+	}
+	return configFile, true
+}
+
+func writeSynthKey(path string) (ssh.Signer, bool) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		Errorf("synthesized key cannot be generated: %v", err)
+		return nil, false
+	}
+	block, err := ssh.MarshalPrivateKey(key, "ferret synth")
+	if err != nil {
+		Errorf("synthesized key cannot be encoded: %v", err)
+		return nil, false
+	}
+	if err = os.WriteFile(path, pem.EncodeToMemory(block), 0600); err != nil {
+		Errorf("synthesized key (%s) cannot be written: %v", path, err)
+		return nil, false
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		Errorf("synthesized key cannot be used: %v", err)
+		return nil, false
+	}
+	return signer, true
+}
+
+// freeLocalAddress finds a loopback port that is currently unused
+func freeLocalAddress() (string, bool) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		Errorf("synthesized tunnel cannot find a free port: %v", err)
+		return "", false
+	}
+	defer func() { _ = listener.Close() }()
+	return listener.Addr().String(), true
+}
@@ -0,0 +1,219 @@
+package internal
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	syslogQueueSize = 1024
+	// syslogSDID identifies ferret's structured data.  32473 is the enterprise
+	// number reserved for documentation, as ferret has none of its own.
+	syslogSDID = "ferret@32473"
+)
+
+var (
+	syslogFacilities = map[string]int{
+		"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5, "lpr": 6, "news": 7,
+		"uucp": 8, "cron": 9, "authpriv": 10, "ftp": 11,
+		"local0": 16, "local1": 17, "local2": 18, "local3": 19,
+		"local4": 20, "local5": 21, "local6": 22, "local7": 23,
+	}
+	syslogSeverities = map[string]int{
+		LevelError: 3,
+		LevelWarn:  4,
+		LevelInfo:  6,
+	}
+	syslogLocalSockets = []string{"/dev/log", "/var/run/syslog", "/var/run/log"}
+)
+
+// SyslogConfig sends log messages, and optionally connection events, to syslog
+// in RFC 5424 format.  The address is either blank for the local syslog daemon,
+// or udp://host:port or tcp://host:port for a remote collector.
+type SyslogConfig struct {
+	Address  string `yaml:"address" json:"address"`
+	Level    string `yaml:"level" json:"level"`
+	Facility string `yaml:"facility" json:"facility"`
+	Events   bool   `yaml:"events" json:"events"`
+	network  string
+	address  string
+	facility int
+}
+
+func (c *SyslogConfig) Validate() bool {
+	valid := true
+	c.Address = strings.TrimSpace(c.Address)
+	switch {
+	case c.Address == "":
+	case strings.HasPrefix(c.Address, "udp://"):
+		c.network, c.address = "udp", strings.TrimPrefix(c.Address, "udp://")
+	case strings.HasPrefix(c.Address, "tcp://"):
+		c.network, c.address = "tcp", strings.TrimPrefix(c.Address, "tcp://")
+	default:
+		Errorf("syslog address (%s) is invalid.  Must be blank, udp://host:port or tcp://host:port", c.Address)
+		valid = false
+	}
+	if c.network != "" {
+		if _, _, err := net.SplitHostPort(c.address); err != nil {
+			Errorf("syslog address (%s) is invalid: %v", c.Address, err)
+			valid = false
+		}
+	}
+	if !validateSinkLevel("syslog", &c.Level) {
+		valid = false
+	}
+	c.Facility = strings.ToLower(strings.TrimSpace(c.Facility))
+	if c.Facility == "" {
+		c.Facility = "daemon"
+	}
+	facility, ok := syslogFacilities[c.Facility]
+	if !ok {
+		Errorf("syslog facility (%s) is invalid", c.Facility)
+		valid = false
+	}
+	c.facility = facility
+	return valid
+}
+
+func (c *SyslogConfig) start() bool {
+	if c.Level == LevelNone && !c.Events {
+		return true
+	}
+	sink := &datagramSink{name: "syslog", dial: c.dial, framed: c.network == "tcp"}
+	if !sink.start() {
+		return false
+	}
+	hostname, _ := os.Hostname()
+	if hostname == "" {
+		hostname = "-"
+	}
+	app := filepath.Base(os.Args[0])
+	pid := os.Getpid()
+	message := func(t time.Time, severity int, msgID string, data string, text string) []byte {
+		if text != "" {
+			text = " " + text
+		}
+		return []byte(fmt.Sprintf(
+			"<%d>1 %s %s %s %d %s [%s%s]%s",
+			c.facility*8+severity, t.Format(time.RFC3339Nano), hostname, app, pid, msgID, syslogSDID, data, text,
+		))
+	}
+	if c.Level != LevelNone {
+		addLogSink(c.Level, func(entry *logEntry) {
+			level := strings.ToLower(entry.Level)
+			sink.send(message(entry.Time, syslogSeverities[entry.Level], "log", sdParam("level", level), entry.Message))
+		})
+	}
+	if c.Events {
+		addEventSink(func(event *Event) {
+			severity := syslogSeverities[LevelInfo]
+			if event.Type == EventError {
+				severity = syslogSeverities[LevelError]
+			}
+			data := sdParam("type", event.Type) + sdParam("tunnel", event.Tunnel) + sdParam("host", event.Host) +
+				sdParam("client", event.Client)
+			if event.ID != 0 {
+				data += sdParam("id", fmt.Sprint(event.ID))
+			}
+			if event.Type == EventDisconnect {
+				data += sdParam("received", fmt.Sprint(event.Received)) + sdParam("transmitted", fmt.Sprint(event.Transmitted))
+			}
+			sink.send(message(event.Time, severity, "event", data, event.Message))
+		})
+	}
+	if verboseFlag {
+		Infof("logging %s and above to syslog %s", strings.ToLower(c.Level), c.Address)
+	}
+	return true
+}
+
+func (c *SyslogConfig) dial() (net.Conn, error) {
+	if c.network != "" {
+		return net.DialTimeout(c.network, c.address, 5*time.Second)
+	}
+	var err error
+	for _, path := range syslogLocalSockets {
+		var conn net.Conn
+		if conn, err = net.Dial("unixgram", path); err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
+
+// sdParam renders a structured data parameter, escaping as RFC 5424 requires.
+// Blank values are omitted.
+func sdParam(name string, value string) string {
+	if value == "" {
+		return ""
+	}
+	value = strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`).Replace(value)
+	return fmt.Sprintf(` %s="%s"`, name, value)
+}
+
+func validateSinkLevel(sink string, level *string) bool {
+	*level = strings.TrimSpace(*level)
+	if *level == "" {
+		*level = LevelInfo
+		return true
+	}
+	parsed, ok := parseLevel(*level)
+	if !ok {
+		Errorf("%s level (%s) is invalid.  Must be error, warn, info or none", sink, *level)
+		return false
+	}
+	*level = parsed
+	return true
+}
+
+// datagramSink queues messages for a connection to a log collector, so a slow
+// or unreachable collector never holds up ferret.  Messages are dropped when
+// the queue is full, and the connection is re-established after a failure.
+type datagramSink struct {
+	name   string
+	dial   func() (net.Conn, error)
+	framed bool
+	queue  chan []byte
+}
+
+func (s *datagramSink) start() bool {
+	conn, err := s.dial()
+	if err != nil {
+		Errorf("%s cannot be reached: %v", s.name, err)
+		return false
+	}
+	s.queue = make(chan []byte, syslogQueueSize)
+	go func() {
+		for message := range s.queue {
+			if s.framed {
+				// Octet counting, as RFC 6587 requires over a stream
+				message = append([]byte(fmt.Sprintf("%d ", len(message))), message...)
+			}
+			for attempt := 0; attempt < 2; attempt++ {
+				if conn == nil {
+					if conn, err = s.dial(); err != nil {
+						conn = nil
+						break
+					}
+				}
+				if _, err = conn.Write(message); err == nil {
+					break
+				}
+				_ = conn.Close()
+				conn = nil
+			}
+		}
+	}()
+	return true
+}
+
+func (s *datagramSink) send(message []byte) {
+	select {
+	case s.queue <- message:
+	default:
+	}
+}
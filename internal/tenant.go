@@ -0,0 +1,236 @@
+package internal
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// Tenant is a user of a ferret daemon shared by a team, e.g. on a jump server.
+// A tenant's hosts and tunnels are named <user>/<name>, so need not be unique
+// across tenants, and its tunnels may only open entrances on the addresses and
+// ports the tenant is allowed.  Tenants identify themselves to the control
+// socket by the credentials of the connecting process, and only see and manage
+// their own hosts and tunnels.
+type Tenant struct {
+	User      string    `yaml:"user" json:"user"`
+	Binds     []string  `yaml:"binds,omitempty" json:"binds,omitempty"`
+	Ports     string    `yaml:"ports,omitempty" json:"ports,omitempty"`
+	Hosts     []*Host   `yaml:"hosts" json:"hosts"`
+	Tunnels   []*Tunnel `yaml:"tunnels" json:"tunnels"`
+	uid       int
+	networks  []*net.IPNet
+	firstPort int
+	lastPort  int
+}
+
+// tenants holds the validated tenants by user id
+var tenants = make(map[int]*Tenant)
+
+func (t *Tenant) Validate() bool {
+	valid := true
+	t.User = strings.TrimSpace(t.User)
+	if t.User == "" {
+		Errorf("tenant user cannot be blank")
+		return false
+	}
+	if !peerCredentials {
+		Errorf("tenant (%s) cannot be identified on %s", t.User, runtime.GOOS)
+		return false
+	}
+	if u, err := user.Lookup(t.User); err != nil {
+		Errorf("tenant (%s) is not a user: %v", t.User, err)
+		valid = false
+	} else if t.uid, err = strconv.Atoi(u.Uid); err != nil {
+		Errorf("tenant (%s) user id (%s) is invalid", t.User, u.Uid)
+		valid = false
+	} else if _, ok := tenants[t.uid]; ok {
+		Errorf("tenant (%s) redefined", t.User)
+		valid = false
+	}
+
+	if len(t.Binds) == 0 {
+		t.Binds = []string{"127.0.0.1"}
+	}
+	for _, bind := range t.Binds {
+		bind = strings.TrimSpace(bind)
+		switch {
+		case strings.Contains(bind, "/"):
+		case strings.Contains(bind, ":"):
+			bind += "/128"
+		default:
+			bind += "/32"
+		}
+		if _, network, err := net.ParseCIDR(bind); err != nil {
+			Errorf("tenant (%s) bind (%s) is not an address or network", t.User, bind)
+			valid = false
+		} else {
+			t.networks = append(t.networks, network)
+		}
+	}
+
+	t.firstPort, t.lastPort = 1, 65535
+	if ports := strings.TrimSpace(t.Ports); ports != "" {
+		first, last, ok := strings.Cut(ports, "-")
+		if !ok {
+			last = first
+		}
+		var err1, err2 error
+		t.firstPort, err1 = strconv.Atoi(strings.TrimSpace(first))
+		t.lastPort, err2 = strconv.Atoi(strings.TrimSpace(last))
+		if err1 != nil || err2 != nil || t.firstPort < 1 || t.lastPort > 65535 || t.firstPort > t.lastPort {
+			Errorf("tenant (%s) ports (%s) is invalid.  Must be a port or range, e.g. 20000-20099", t.User, t.Ports)
+			valid = false
+		}
+	}
+
+	// Namespace the tenant's hosts and tunnels, leaving references to hosts the
+	// tenant does not define to the shared hosts.
+	own := make(map[string]bool)
+	for _, host := range t.Hosts {
+		own[strings.TrimSpace(host.Name)] = true
+	}
+	qualify := func(name string) string {
+		name = strings.TrimSpace(name)
+		if own[name] {
+			return t.User + "/" + name
+		}
+		return name
+	}
+	for _, host := range t.Hosts {
+		host.Name = qualify(host.Name)
+		jumps := strings.Split(host.JumpHost, ",")
+		for i, jump := range jumps {
+			jumps[i] = qualify(jump)
+		}
+		host.JumpHost = strings.Join(jumps, ",")
+		host.tenant = t.User
+		if host.Username == "" {
+			host.Username = t.User
+		}
+	}
+	for _, tunnel := range t.Tunnels {
+		if name := strings.TrimSpace(tunnel.Name); name != "" {
+			tunnel.Name = t.User + "/" + name
+		}
+		tunnel.Host = qualify(tunnel.Host)
+		tunnel.tenant = t.User
+	}
+	if valid {
+		tenants[t.uid] = t
+	}
+	return valid
+}
+
+// checkBinds confirms each of the tenant's validated tunnels opens its entrance
+// on an address and port the tenant is allowed.
+func (t *Tenant) checkBinds() bool {
+	valid := true
+	for _, tunnel := range t.Tunnels {
+		if Tunnels[tunnel.Name] != tunnel || tunnel.Local == nil || !tunnel.Local.IsValid() {
+			continue
+		}
+		if reason := t.bindRefusal(tunnel); reason != "" {
+			Errorf("tenant (%s) tunnel (%s) local address refused: %s", t.User, tunnel.Name, reason)
+			if !skipTunnel(tunnel) {
+				valid = false
+			}
+		}
+	}
+	return valid
+}
+
+// bindRefusal explains why the tenant may not open the entrance of a tunnel, or
+// is empty when it may.  A port picked by the system is only allowed to tenants
+// without a range of ports.
+func (t *Tenant) bindRefusal(tunnel *Tunnel) string {
+	if t == nil {
+		return ""
+	}
+	if tunnel.Local.IsUnix() {
+		return "unix sockets are not allowed"
+	}
+	if tunnel.Local.IsPipe() {
+		return "named pipes are not allowed"
+	}
+	unrestricted := t.firstPort == 1 && t.lastPort == 65535
+	if port := tunnel.Local.port; (port != 0 || !unrestricted) && (port < t.firstPort || port > t.lastPort) {
+		return fmt.Sprintf("port %d is outside %d-%d", port, t.firstPort, t.lastPort)
+	}
+	if !t.allowsBind(tunnel.Local.host) {
+		return fmt.Sprintf("address %s is not allowed", tunnel.Local.host)
+	}
+	return ""
+}
+
+// forwardRefusal explains why the tenant may not point a copy of the tunnel at a
+// forward address of its own choosing, or is empty when it may.  Only a tunnel
+// through a host of the tenant's own may be, as any other would carry the
+// tenant to any destination over the connection, and credentials, of another.
+func (t *Tenant) forwardRefusal(tunnel *Tunnel) string {
+	if t == nil {
+		return ""
+	}
+	if tunnel.direct() {
+		return "direct tunnels cannot be pointed elsewhere"
+	}
+	if host, ok := Hosts[tunnel.Host]; !ok || host.tenant != t.User {
+		return fmt.Sprintf("host (%s) is not the tenant's own", tunnel.Host)
+	}
+	return ""
+}
+
+func (t *Tenant) allowsBind(host string) bool {
+	ips, err := net.LookupIP(host)
+	if err != nil || len(ips) == 0 {
+		return false
+	}
+	for _, ip := range ips {
+		allowed := false
+		for _, network := range t.networks {
+			allowed = allowed || network.Contains(ip)
+		}
+		if !allowed {
+			return false
+		}
+	}
+	return true
+}
+
+// owns reports whether something belonging to the named tenant is visible to
+// this one.  A nil tenant is the owner of the daemon, to whom everything is.
+func (t *Tenant) owns(tenant string) bool {
+	return t == nil || t.User == tenant
+}
+
+// qualify names a host or tunnel of the tenant as it is known to ferret
+func (t *Tenant) qualify(name string) string {
+	if t == nil {
+		return name
+	}
+	return t.User + "/" + name
+}
+
+// controlTenant identifies the tenant connected to the control socket.  The user
+// running ferret, and root, are given a nil tenant, any other user must be a
+// tenant.
+func controlTenant(conn net.Conn) (*Tenant, error) {
+	if len(tenants) == 0 {
+		return nil, nil
+	}
+	uid, err := peerUID(conn)
+	if err != nil {
+		return nil, fmt.Errorf("caller cannot be identified: %w", err)
+	}
+	if uid == os.Getuid() || uid == 0 {
+		return nil, nil
+	}
+	if tenant, ok := tenants[uid]; ok {
+		return tenant, nil
+	}
+	return nil, fmt.Errorf("user %d is not a tenant", uid)
+}
@@ -0,0 +1,127 @@
+package internal
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"syscall"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	dialTimeout   = 15 * time.Second
+	recordedBytes = 512
+)
+
+var errInterceptedHandshake = errors.New("ssh handshake intercepted")
+
+// recordingConn keeps the first bytes received from the server so a failed
+// handshake can be diagnosed.
+type recordingConn struct {
+	net.Conn
+	received []byte
+}
+
+func (c *recordingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if room := recordedBytes - len(c.received); room > 0 && n > 0 {
+		c.received = append(c.received, b[:min(n, room)]...)
+	}
+	return n, err
+}
+
+// dial connects to the host, directly, through its jump host or proxy, or by
+// its proxy command, and performs the SSH handshake.  Handshakes that fail because
+// something other than an SSH server answered are reported as
+// errInterceptedHandshake with guidance on the likely cause.
+func (h *Host) dial() (hostClient, error) {
+	if h.Relay != nil {
+		return dialRelay(h.Relay, dialTimeout)
+	}
+	address, err := h.sshAddress()
+	if err != nil {
+		return nil, err
+	}
+	var conn net.Conn
+	if h.JumpHost != "" {
+		conn, err = h.dialJump(address)
+	} else if h.ProxyCommand != "" {
+		conn, err = h.dialProxy(address)
+	} else if h.proxy != nil {
+		conn, err = dialHostProxy(h.proxy, address, dialTimeout)
+	} else if h.websocket != nil {
+		conn, err = dialWebsocket(h.websocket, dialTimeout)
+	} else {
+		conn, err = net.DialTimeout("tcp", address, dialTimeout)
+	}
+	if err != nil {
+		h.forgetAddress()
+		return nil, err
+	}
+	recorder := &recordingConn{Conn: h.stats.count(conn)}
+	sshConn, channels, requests, err := ssh.NewClientConn(recorder, address, h.config)
+	if err != nil {
+		_ = conn.Close()
+		h.forgetAddress()
+		if intercepted := interceptedHandshake(recorder.received, err); intercepted != nil {
+			return nil, intercepted
+		}
+		return nil, err
+	}
+	return ssh.NewClient(sshConn, channels, requests), nil
+}
+
+// dialJump connects to the host through a channel of the SSH connection of its
+// jump host, over which the SSH connection of the host is then made, so the
+// connection is nested within that of each host it jumps through
+func (h *Host) dialJump(address string) (net.Conn, error) {
+	jumpHost := Hosts[h.JumpHost]
+	if jumpHost == nil || !jumpHost.WaitOpen(dialTimeout) {
+		return nil, fmt.Errorf("jump_host (%s) cannot be connected to", h.JumpHost)
+	}
+	jumpHost.lock.Lock()
+	client := jumpHost.client
+	jumpHost.lock.Unlock()
+	if client == nil {
+		return nil, fmt.Errorf("jump_host (%s) is not connected", h.JumpHost)
+	}
+	conn, err := client.Dial("tcp", address)
+	if err != nil {
+		return nil, fmt.Errorf("jump_host (%s) cannot reach %s: %v", h.JumpHost, address, err)
+	}
+	return jumpHost.stats.channel(conn, address), nil
+}
+
+func interceptedHandshake(received []byte, err error) error {
+	lower := bytes.ToLower(received)
+	switch {
+	case bytes.HasPrefix(lower, []byte("http/")) || bytes.Contains(lower, []byte("<html")) || bytes.Contains(lower, []byte("<!doctype")):
+		return fmt.Errorf(
+			"%w: the server answered with HTTP instead of SSH.  This is typically a captive portal (hotel or "+
+				"airport WiFi) or an authenticating proxy; sign in with a browser and ferret will reconnect once "+
+				"the network recovers", errInterceptedHandshake,
+		)
+	case len(received) == 0 && (errors.Is(err, io.EOF) || errors.Is(err, syscall.ECONNRESET)):
+		return fmt.Errorf(
+			"%w: the connection was closed before the SSH banner arrived.  A firewall or proxy (e.g. NTLM) "+
+				"may be intercepting the connection", errInterceptedHandshake,
+		)
+	case len(received) > 0 && !bytes.Contains(received, []byte("SSH-")):
+		return fmt.Errorf(
+			"%w: the server did not answer with an SSH banner (received %q).  Check the address and port, or "+
+				"whether a proxy is intercepting the connection", errInterceptedHandshake, printable(received, 40),
+		)
+	}
+	return nil
+}
+
+func printable(bs []byte, limit int) string {
+	if len(bs) > limit {
+		bs = bs[:limit]
+	}
+	return string(bytes.TrimSpace(bs))
+}
@@ -0,0 +1,51 @@
+package internal
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// openTUN creates a TUN interface and routes the networks to it.  The interface,
+// and its routes with it, are removed by the system once it is closed.
+func openTUN(name string, mtu int, networks []*net.IPNet) (io.ReadWriteCloser, error) {
+	fd, err := unix.Open("/dev/net/tun", unix.O_RDWR|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("/dev/net/tun cannot be opened: %v", err)
+	}
+	ifr, err := unix.NewIfreq(name)
+	if err != nil {
+		_ = unix.Close(fd)
+		return nil, err
+	}
+	ifr.SetUint16(unix.IFF_TUN | unix.IFF_NO_PI)
+	if err = unix.IoctlIfreq(fd, unix.TUNSETIFF, ifr); err != nil {
+		_ = unix.Close(fd)
+		return nil, fmt.Errorf("interface %s cannot be created: %v", name, err)
+	}
+	// Non-blocking, the device is read through the runtime's poller, so closing
+	// it ends a read in progress
+	if err = unix.SetNonblock(fd, true); err != nil {
+		_ = unix.Close(fd)
+		return nil, err
+	}
+	device := os.NewFile(uintptr(fd), "/dev/net/tun")
+
+	commands := [][]string{{"link", "set", "dev", name, "mtu", strconv.Itoa(mtu), "up"}}
+	for _, network := range networks {
+		commands = append(commands, []string{"route", "replace", network.String(), "dev", name})
+	}
+	for _, args := range commands {
+		if out, err := exec.Command("ip", args...).CombinedOutput(); err != nil {
+			_ = device.Close()
+			return nil, fmt.Errorf("ip %s failed: %v %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+		}
+	}
+	return device, nil
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package internal
+
+import (
+	"errors"
+	"io"
+	"net"
+)
+
+// openTUN is unsupported, so routes cannot be used
+func openTUN(string, int, []*net.IPNet) (io.ReadWriteCloser, error) {
+	return nil, errors.New("routes are only supported on linux")
+}
@@ -6,15 +6,28 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"net/http/httputil"
+	"os"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
+
+	"golang.org/x/sync/errgroup"
+)
+
+const (
+	OnErrorFail     = "fail"
+	OnErrorContinue = "continue"
 )
 
 var (
 	Tunnels         = make(map[string]*Tunnel)
 	errInvalidWrite = errors.New("invalid write result")
+	partial         bool
+	// tunnelsLock guards Tunnels once running, as discovery adds and removes tunnels
+	tunnelsLock sync.RWMutex
 )
 
 type HostName struct {
@@ -22,12 +35,50 @@ type HostName struct {
 }
 
 type Tunnel struct {
-	Name       string   `yaml:"name" json:"name"`
-	Local      *Address `yaml:"local,omitempty" json:"local,omitempty"`
-	Host       string   `yaml:"host" json:"host"`
-	Forward    *Address `yaml:"forward" json:"forward"`
-	stats      *TunnelStats
-	updateChan chan struct{}
+	ID                    string         `yaml:"id,omitempty" json:"id,omitempty"`
+	Name                  string         `yaml:"name" json:"name"`
+	Type                  string         `yaml:"type,omitempty" json:"type,omitempty"`
+	Local                 *Address       `yaml:"local,omitempty" json:"local,omitempty"`
+	Host                  string         `yaml:"host" json:"host"`
+	Forward               *Address       `yaml:"forward" json:"forward"`
+	Forwards              []*Address     `yaml:"forwards,omitempty" json:"forwards,omitempty"`
+	Balance               string         `yaml:"balance,omitempty" json:"balance,omitempty"`
+	Activation            string         `yaml:"activation,omitempty" json:"activation,omitempty"`
+	IdleTimeout           string         `yaml:"idle_timeout,omitempty" json:"idle_timeout,omitempty"`
+	MaxConnectionAge      string         `yaml:"max_connection_age,omitempty" json:"max_connection_age,omitempty"`
+	MaxConnectionAgeQuiet string         `yaml:"max_connection_age_quiet,omitempty" json:"max_connection_age_quiet,omitempty"`
+	OnError               string         `yaml:"on_error,omitempty" json:"on_error,omitempty"`
+	ClientInfo            string         `yaml:"client_info,omitempty" json:"client_info,omitempty"`
+	Labels                []string       `yaml:"labels,omitempty" json:"labels,omitempty"`
+	URL                   string         `yaml:"url,omitempty" json:"url,omitempty"`
+	Copy                  bool           `yaml:"copy,omitempty" json:"copy,omitempty"`
+	LocalMode             string         `yaml:"local_mode,omitempty" json:"local_mode,omitempty"`
+	LocalSDDL             string         `yaml:"local_sddl,omitempty" json:"local_sddl,omitempty"`
+	Rewrite               []*RewriteRule `yaml:"rewrite,omitempty" json:"rewrite,omitempty"`
+	Protocol              string         `yaml:"protocol,omitempty" json:"protocol,omitempty"`
+	RateLimit             *RateLimit     `yaml:"rate_limit,omitempty" json:"rate_limit,omitempty"`
+	Admission             *Admission     `yaml:"admission,omitempty" json:"admission,omitempty"`
+	Chaos                 *ChaosConfig   `yaml:"chaos,omitempty" json:"chaos,omitempty"`
+	TLS                   *TLSConfig     `yaml:"tls,omitempty" json:"tls,omitempty"`
+	Routes                []*HTTPRoute   `yaml:"routes,omitempty" json:"routes,omitempty"`
+	entrance              atomic.Value
+	listener              net.Listener
+	connLock              sync.Mutex
+	conns                 map[int32][]net.Conn
+	stats                 *TunnelStats
+	updateChan            chan struct{}
+	state                 TunnelState
+	tenant                string
+	cluster               *clusterMembers
+	id                    string
+	localMode             os.FileMode
+	reserved              net.Listener
+	balancer              *balancer
+	idleTimeout           time.Duration
+	maxConnectionAge      time.Duration
+	connectionAgeQuiet    time.Duration
+	ephemeral             bool
+	httpProxy             *httputil.ReverseProxy
 }
 
 var (
@@ -37,34 +88,92 @@ var (
 
 func (t *Tunnel) Init(updateChan chan struct{}) {
 	t.updateChan = updateChan
-	t.stats = &TunnelStats{Name: t.Name}
+	t.stats = newTunnelStats(t)
+}
+
+// Entrance returns the address the tunnel is listening on, or an empty string
+// when it is not listening
+func (t *Tunnel) Entrance() string {
+	entrance, _ := t.entrance.Load().(string)
+	return entrance
+}
+
+// entrancePort returns the port the tunnel is listening on, which differs from
+// that configured when the system picked it
+func (t *Tunnel) entrancePort() int {
+	if _, port, err := net.SplitHostPort(t.Entrance()); err == nil {
+		if p, err := strconv.Atoi(port); err == nil {
+			return p
+		}
+	}
+	return t.Local.port
 }
 
 func (t *Tunnel) Stats() *TunnelStats {
 	return t.stats
 }
 
-func (t *Tunnel) Open(ctx context.Context, listeningChan chan<- bool) {
-	localListener, err := net.Listen("tcp", t.Local.address)
+// Listen opens the entrance of the tunnel
+func (t *Tunnel) Listen() error {
+	t.transition(StateStarting)
+	var localListener net.Listener
+	var err error
+	if t.Protocol == ProtocolUDP {
+		localListener, err = listenUDP(t.Local.address)
+	} else if t.Local.IsUnix() {
+		localListener, err = listenUnix(t.Local.address, t.localMode)
+	} else if t.Local.IsPipe() {
+		localListener, err = listenPipe(t.Local.address, t.LocalSDDL)
+	} else if t.reserved != nil {
+		// Bound when the port was picked
+		localListener, t.reserved = t.reserved, nil
+	} else {
+		localListener, err = listenTCP(t.Local.address)
+	}
 	if err != nil {
-		fmt.Printf("  Error - tunnel (%s) entrance (%s) cannot be created: %v\n", t.Name, t.Local.address, err)
-		listeningChan <- false
-		return
+		Errorf("tunnel (%s) entrance (%s) cannot be created: %v", t.Name, t.Local.address, err)
+		emit(&Event{Type: EventError, Tunnel: t.Name, TunnelID: t.id, Message: fmt.Sprintf("entrance cannot be created: %v", err)})
+		t.transition(StateClosed)
+		return err
+	}
+	t.connLock.Lock()
+	t.listener = localListener
+	t.connLock.Unlock()
+	entrance := localListener.Addr().String()
+	t.entrance.Store(entrance)
+	if t.Local.port == 0 && !t.Local.IsUnix() && !t.Local.IsPipe() {
+		Infof("tunnel (%s) entrance opened at %s, a port picked by the system", t.Name, entrance)
+	} else {
+		Infof("tunnel (%s) entrance opened at %s", t.Name, entrance)
+	}
+	emit(&Event{Type: EventTunnelOpen, Tunnel: t.Name, TunnelID: t.id, Message: entrance})
+	t.transition(StateListening)
+	go t.copyEndpoint()
+	return nil
+}
+
+// Serve forwards the connections made to the tunnel's entrance until the
+// context is cancelled.  The entrance must be open.
+func (t *Tunnel) Serve(ctx context.Context) {
+	t.connLock.Lock()
+	localListener := t.listener
+	t.connLock.Unlock()
+	if t.cluster != nil && t.cluster.tunnel == t {
+		t.cluster.serve(ctx)
 	}
-	fmt.Printf("  Info  - tunnel (%s) entrance opened at %s\n", t.Name, t.Local.address)
-	listeningChan <- true
 
 	// Wait indefinitely until the sigTerm channel closes
 	go func() {
 		<-ctx.Done()
-		fmt.Printf("  Info  - tunnel (%s) stopped listening on %s\n", t.Name, t.Local.address)
+		Infof("tunnel (%s) stopped listening on %s", t.Name, t.Entrance())
+		t.entrance.Store("")
+		emit(&Event{Type: EventTunnelClose, Tunnel: t.Name, TunnelID: t.id})
+		t.transition(StateDraining)
 		_ = localListener.Close()
 	}()
 
 	for {
-		var localConn net.Conn
-		localConn, err = localListener.Accept()
-		t.updateChan <- struct{}{}
+		localConn, err := localListener.Accept()
 		if err != nil {
 			var opErr *net.OpError
 			if errors.As(err, &opErr) {
@@ -73,41 +182,252 @@ func (t *Tunnel) Open(ctx context.Context, listeningChan chan<- bool) {
 					return
 				}
 			}
-			fmt.Printf("  Error - tunnel (%s) listener accept failed: %v\n", t.Name, err)
+			Errorf("tunnel (%s) listener accept failed: %v", t.Name, err)
 			return
 		}
-		fmt.Printf("  Info  - Connected tunnel: %v\n", t.Name)
+		if t.RateLimit != nil && !t.RateLimit.allow(localConn.RemoteAddr()) {
+			t.stats.lock.Lock()
+			t.stats.Limited++
+			t.stats.lock.Unlock()
+			if verboseFlag {
+				Infof("tunnel (%s) connection from %s refused: rate limited", t.Name, localConn.RemoteAddr())
+			}
+			_ = localConn.Close()
+			t.updateChan <- struct{}{}
+			continue
+		}
+		if t.Admission != nil || (policy != nil && policy.Admission != nil) {
+			go t.admitAndForward(localConn)
+			continue
+		}
+		t.updateChan <- struct{}{}
+		watchdog.watch(localConn)
+		Infof("Connected tunnel: %v", t.Name)
 		go t.forward(localConn)
 	}
 }
 
+// admitAndForward forwards the connection once the admission hooks allow it,
+// away from the accept loop as the hooks may take a while to decide
+func (t *Tunnel) admitAndForward(localConn net.Conn) {
+	client := clientName(localConn)
+	if ok, reason := t.admit(client); !ok {
+		t.stats.lock.Lock()
+		t.stats.Denied++
+		t.stats.lock.Unlock()
+		Infof("tunnel (%s) connection from %s denied: %s", t.Name, client, reason)
+		emit(&Event{Type: EventDenied, Tunnel: t.Name, TunnelID: t.id, Host: t.Host, Client: client, Message: reason})
+		_ = localConn.Close()
+		t.updateChan <- struct{}{}
+		return
+	}
+	t.updateChan <- struct{}{}
+	watchdog.watch(localConn)
+	Infof("Connected tunnel: %v", t.Name)
+	t.forward(localConn)
+}
+
+// ListenAll opens the entrance of every tunnel at once and, once the outcome of
+// each is known, reports them all and returns the tunnels now listening.  A
+// tunnel failing to listen fails the start unless it may be skipped.
+func ListenAll(tunnels []*Tunnel) ([]*Tunnel, bool) {
+	results := make([]error, len(tunnels))
+	g := errgroup.Group{}
+	for i, t := range tunnels {
+		i, t := i, t
+		g.Go(func() error {
+			results[i] = t.Listen()
+			if results[i] != nil && !t.ContinueOnError() {
+				return results[i]
+			}
+			return nil
+		})
+	}
+	err := g.Wait()
+
+	var listening []*Tunnel
+	for i, t := range tunnels {
+		if results[i] == nil {
+			listening = append(listening, t)
+		} else if t.ContinueOnError() {
+			Warnf("tunnel (%s) SKIPPED: entrance could not be opened", t.Name)
+		}
+	}
+	if verboseFlag || len(listening) != len(tunnels) {
+		Infof("%d of %d tunnel entrances opened", len(listening), len(tunnels))
+	}
+	if err != nil {
+		return listening, false
+	}
+	if len(listening) == 0 && len(tunnels) > 0 {
+		Errorf("no tunnel entrances could be opened")
+		return nil, false
+	}
+	return listening, true
+}
+
 func (t *Tunnel) forward(localConn net.Conn) {
+	t.stats.lock.Lock()
 	t.stats.Connections++
+	t.stats.lock.Unlock()
 	connection.Add(1)
 	id := connection.Load()
 
+	client := clientName(localConn)
+	if t.TLS != nil {
+		tlsConn, err := t.TLS.handshake(localConn)
+		if err != nil {
+			Errorf("tunnel (%s) id:%d tls handshake with %s failed: %v", t.Name, id, client, err)
+			_ = localConn.Close()
+			return
+		}
+		localConn = tlsConn
+	}
+	if t.Type == TunnelTypeHTTP {
+		t.forwardHTTP(localConn, id, client)
+		return
+	}
+	target, statsTarget := "", t.stats.Forward
+	forward, release := t.nextForward()
+	defer release()
+	if t.proxied() {
+		conn, proxyTarget, err := t.proxyTarget(localConn)
+		if err != nil {
+			Errorf("tunnel (%s) id:%d %s request from %s failed: %v", t.Name, id, t.Type, client, err)
+			_ = localConn.Close()
+			return
+		}
+		localConn, target = conn, proxyTarget
+		if !statsConfig.redacted(StatsFieldForward) {
+			statsTarget = statsConfig.label(target)
+		}
+	} else if t.Type == TunnelTypeSNI {
+		conn, route, err := t.sniTarget(localConn)
+		if err != nil {
+			Errorf("tunnel (%s) id:%d connection from %s refused: %v", t.Name, id, client, err)
+			_ = localConn.Close()
+			return
+		}
+		localConn, forward, target = conn, route.Forward, route.Forward.address
+		if !statsConfig.redacted(StatsFieldForward) {
+			statsTarget = statsConfig.label(target)
+		}
+	} else {
+		target = forward.address
+		if t.balancer != nil && !statsConfig.redacted(StatsFieldForward) {
+			statsTarget = statsConfig.label(target)
+		}
+	}
+	if forward == nil || !forward.IsUnix() {
+		rewritten, err := t.rewrite(target)
+		if err != nil {
+			Errorf("tunnel (%s) id:%d connection from %s refused: %v", t.Name, id, client, err)
+			emit(&Event{Type: EventError, Tunnel: t.Name, TunnelID: t.id, Host: t.Host, ID: id, Client: client, Message: err.Error()})
+			if t.proxied() {
+				t.proxyReply(localConn, proxyNotAllowed)
+			}
+			_ = localConn.Close()
+			return
+		}
+		target = rewritten
+	}
 	if verboseFlag {
-		fmt.Printf("  Info  - tunnel (%s) id:%d conneting to forward server %s\n", t.Name, id, t.Forward.address)
+		Infof("tunnel (%s) id:%d conneting to forward server %s", t.Name, id, target)
 	}
 
+	emit(&Event{Type: EventConnect, Tunnel: t.Name, TunnelID: t.id, Host: t.Host, ID: id, Client: client})
 	host := Hosts[t.Host]
-	if !host.Open() {
-		// TODO Failed to connect
+	if !t.direct() && !host.WaitOpen(hostWaitTimeout) {
+		t.transition(StateDegraded)
+		Errorf("tunnel (%s) id:%d host (%s) unreachable, closing connection", t.Name, id, t.Host)
+		emit(&Event{Type: EventError, Tunnel: t.Name, TunnelID: t.id, Host: t.Host, ID: id, Client: client, Message: "host unreachable"})
+		if t.proxied() {
+			t.proxyReply(localConn, proxyHostDown)
+		}
+		_ = localConn.Close()
 		return
 	}
-	sshConn, ok := host.Dial(t.Forward.address)
+	var sshConn net.Conn
+	var ok bool
+	if t.direct() && forward != nil && forward.IsUnix() {
+		sshConn, ok = t.dialDirect("unix", target)
+	} else if t.direct() {
+		sshConn, ok = t.dialDirect("tcp", target)
+	} else if t.Protocol == ProtocolUDP {
+		sshConn, ok = host.DialUDP(target)
+	} else if forward != nil && forward.IsUnix() {
+		sshConn, ok = host.DialUnix(target)
+	} else {
+		sshConn, ok = host.Dial(target)
+	}
 	if !ok {
-		// TODO failed to connect
+		if t.proxied() {
+			// An unreachable destination says nothing of the tunnel's health
+			t.proxyReply(localConn, proxyUnreachable)
+		} else {
+			t.transition(StateDegraded)
+		}
+		emit(&Event{Type: EventError, Tunnel: t.Name, TunnelID: t.id, Host: t.Host, ID: id, Client: client, Message: "forward address cannot be reached"})
+		_ = localConn.Close()
 		return
 	}
+	labelChannel(sshConn, t.stats.Name, id)
+	if t.proxied() {
+		t.proxyReply(localConn, proxySucceeded)
+	}
+
+	if t.State() == StateDegraded && !t.stats.suspect() {
+		t.transition(StateListening)
+	}
+	connStats := t.stats.addConnection(id, client, statsTarget)
+	t.track(id, localConn, sshConn)
+	defer func() {
+		t.untrack(id)
+		t.stats.removeConnection(connStats)
+		emit(&Event{
+			Type:        EventDisconnect,
+			Tunnel:      t.Name,
+			TunnelID:    t.id,
+			Host:        t.Host,
+			ID:          id,
+			Client:      client,
+			Received:    connStats.Received,
+			Transmitted: connStats.Transmitted,
+		})
+	}()
+
+	var src io.Reader = localConn
+	switch t.ClientInfo {
+	case ClientInfoProxy:
+		if _, err := io.WriteString(sshConn, proxyHeader(localConn)); err != nil {
+			Errorf("tunnel (%s) id:%d client info cannot be sent: %v", t.Name, id, err)
+			_ = sshConn.Close()
+			_ = localConn.Close()
+			return
+		}
+	case ClientInfoForwardedFor:
+		src = forwardedFor(localConn)
+	}
+	var dst io.Reader = sshConn
+	switch t.Protocol {
+	case ProtocolKafka:
+		src, dst = t.cluster.kafka(src, sshConn)
+	case ProtocolMongoDB:
+		dst = t.cluster.mongodb(sshConn)
+	}
+	if t.Chaos != nil {
+		src, dst = t.Chaos.reader(src), t.Chaos.reader(dst)
+		defer t.Chaos.disrupt(localConn, sshConn)()
+	}
 
 	wg := sync.WaitGroup{}
 	wg.Add(2)
-	t.stats.Connected++
+	t.stats.connected(1)
 	ctx, cancel := context.WithCancel(context.Background())
 	closer := func() {
 		t.autoClose(ctx, sshConn, localConn, id)
 	}
+	go t.ageOut(ctx, id, client, connStats, localConn, sshConn)
 
 	connected1 := true
 	connected2 := true
@@ -115,14 +435,15 @@ func (t *Tunnel) forward(localConn net.Conn) {
 	go func() {
 		connections.Add(1)
 		defer wg.Done()
-		err1 := t.copy(sshConn, localConn, true)
+		err1 := t.copy(sshConn, src, true, connStats)
 		connected1 = false
+		t.reap(err1, id, client, sshConn, localConn)
 		connections.Add(-1)
 		if verboseFlag {
-			fmt.Printf("  Info  - tunnel (%s) id:%d c:%d transmit tunnel closed\n", t.Name, id, connections.Load())
+			Infof("tunnel (%s) id:%d c:%d transmit tunnel closed", t.Name, id, connections.Load())
 		}
 		if err1 != nil && verboseFlag {
-			fmt.Printf("  Error - tunnel (%s) transmit encountered a closed tunnel: %v\n", t.Name, err1)
+			Errorf("tunnel (%s) transmit encountered a closed tunnel: %v", t.Name, err1)
 		}
 		if connected2 {
 			go closer()
@@ -133,14 +454,15 @@ func (t *Tunnel) forward(localConn net.Conn) {
 	go func() {
 		connections.Add(1)
 		defer wg.Done()
-		err2 := t.copy(localConn, sshConn, false)
+		err2 := t.copy(localConn, dst, false, connStats)
 		connected2 = false
+		t.reap(err2, id, client, sshConn, localConn)
 		connections.Add(-1)
 		if verboseFlag {
-			fmt.Printf("  Info  - tunnel (%s) id:%d c:%d receive tunnel closed\n", t.Name, id, connections.Load())
+			Infof("tunnel (%s) id:%d c:%d receive tunnel closed", t.Name, id, connections.Load())
 		}
 		if err2 != nil && verboseFlag {
-			fmt.Printf("  Info - tunnel (%s) receive encountered a closed tunnel: %v\n", t.Name, err2)
+			Infof("tunnel (%s) receive encountered a closed tunnel: %v", t.Name, err2)
 		}
 		if connected1 {
 			go closer()
@@ -148,10 +470,10 @@ func (t *Tunnel) forward(localConn net.Conn) {
 	}()
 
 	wg.Wait()
-	t.stats.Connected--
+	t.stats.connected(-1)
 	cancel()
 	if verboseFlag {
-		fmt.Printf("  Info  - id:%d c:%d closing connection %s\n", id, connections.Load(), localConn.RemoteAddr())
+		Infof("id:%d c:%d closing connection %s", id, connections.Load(), localConn.RemoteAddr())
 	}
 }
 
@@ -160,53 +482,309 @@ func (t *Tunnel) Validate() bool {
 
 	t.Name = strings.TrimSpace(t.Name)
 	if t.Name == "" {
-		fmt.Printf("  Error - tunnel name cannot be blank\n")
+		Errorf("tunnel name cannot be blank")
 		valid = false
 	}
 	if _, ok := Tunnels[t.Name]; ok {
-		fmt.Printf("  Error - tunnel name (%s) redfined\n", t.Name)
+		Errorf("tunnel name (%s) redfined", t.Name)
 		valid = false
 	}
 
-	if t.Forward == nil || t.Forward.IsBlank() {
-		fmt.Printf("  Error - tunnel (%s) requires a forward address\n", t.Name)
+	t.Type = strings.ToLower(strings.TrimSpace(t.Type))
+	switch t.Type {
+	case "":
+		if len(t.Forwards) > 0 {
+			if !t.validateForwards() {
+				valid = false
+			}
+		} else if t.Forward == nil || t.Forward.IsBlank() {
+			Errorf("tunnel (%s) requires a forward address", t.Name)
+			valid = false
+		} else if !t.Forward.Validate("tunnel", t.Name, "forward address", true, false) {
+			valid = false
+		} else if t.Forward.IsUnix() && t.Protocol != "" {
+			Errorf("tunnel (%s) protocol (%s) cannot be used with a unix socket forward address", t.Name, t.Protocol)
+			valid = false
+		}
+	case TunnelTypeSOCKS5, TunnelTypeHTTPProxy:
+		if len(t.targets()) > 0 {
+			Errorf("tunnel (%s) of type %s cannot have a forward address, as clients name their own", t.Name, t.Type)
+			valid = false
+		}
+		if t.Local == nil || t.Local.IsBlank() {
+			port := defaultSOCKSPort
+			if t.Type == TunnelTypeHTTPProxy {
+				port = defaultHTTPProxyPort
+			}
+			Warnf("tunnel (%s) Local entrance undefined. Defaulting to 127.0.0.1:%d", t.Name, port)
+			t.Local = NewAddress(fmt.Sprintf("127.0.0.1:%d", port))
+		}
+		if t.ClientInfo != "" || t.Protocol != "" {
+			Errorf("tunnel (%s) of type %s cannot have client_info or protocol", t.Name, t.Type)
+			valid = false
+		}
+	case TunnelTypeHTTP:
+		if len(t.targets()) > 0 {
+			Errorf("tunnel (%s) of type %s cannot have a forward address, as its routes name their own", t.Name, t.Type)
+			valid = false
+		}
+		if !t.validateRoutes() {
+			valid = false
+		}
+		if t.Local == nil || t.Local.IsBlank() {
+			Warnf("tunnel (%s) Local entrance undefined. Defaulting to 127.0.0.1:%d", t.Name, defaultHTTPPort)
+			t.Local = NewAddress(fmt.Sprintf("127.0.0.1:%d", defaultHTTPPort))
+		}
+		if t.ClientInfo != "" || t.Protocol != "" {
+			Errorf("tunnel (%s) of type %s cannot have client_info or protocol", t.Name, t.Type)
+			valid = false
+		}
+	case TunnelTypeSNI:
+		if len(t.targets()) > 0 {
+			Errorf("tunnel (%s) of type %s cannot have a forward address, as its routes name their own", t.Name, t.Type)
+			valid = false
+		}
+		if !t.validateRoutes() || !t.validateSNIRoutes() {
+			valid = false
+		}
+		if t.Local == nil || t.Local.IsBlank() {
+			Warnf("tunnel (%s) Local entrance undefined. Defaulting to 127.0.0.1:%d", t.Name, defaultSNIPort)
+			t.Local = NewAddress(fmt.Sprintf("127.0.0.1:%d", defaultSNIPort))
+		}
+		if t.ClientInfo == ClientInfoForwardedFor || t.Protocol != "" || t.TLS != nil {
+			Errorf("tunnel (%s) of type %s cannot have tls, protocol or client_info %s, as it forwards the TLS of its clients unopened", t.Name, t.Type, ClientInfoForwardedFor)
+			valid = false
+		}
+	default:
+		Errorf("tunnel (%s) type (%s) is invalid.  Must be %s, %s, %s or %s, or omitted to forward to a single address", t.Name, t.Type, TunnelTypeSOCKS5, TunnelTypeHTTPProxy, TunnelTypeHTTP, TunnelTypeSNI)
 		valid = false
-	} else if !t.Forward.Validate("tunnel", t.Name, "forward address", true, false) {
+	}
+	if t.Type != TunnelTypeHTTP && t.Type != TunnelTypeSNI && len(t.Routes) > 0 {
+		Errorf("tunnel (%s) routes require type %s or %s", t.Name, TunnelTypeHTTP, TunnelTypeSNI)
 		valid = false
 	}
 
-	if (t.Local == nil || t.Local.IsBlank()) && t.Forward != nil && t.Forward.IsValid() {
-		fmt.Printf("  Warn  - tunnel (%s) Local entrance undefined. Defaulting to 127.0.0.1:%d\n", t.Name, t.Forward.Port())
-		t.Local = NewAddress(fmt.Sprintf("127.0.0.1:%d", t.Forward.Port()))
+	if targets := t.targets(); (t.Local == nil || t.Local.IsBlank()) && len(targets) > 0 && targets[0].IsValid() && !targets[0].IsUnix() {
+		Warnf("tunnel (%s) Local entrance undefined. Defaulting to 127.0.0.1:%d", t.Name, targets[0].Port())
+		t.Local = NewAddress(fmt.Sprintf("127.0.0.1:%d", targets[0].Port()))
 	}
 	if t.Local == nil || t.Local.IsBlank() {
-		fmt.Printf("  Error - tunnel (%s) missing a local address that cannot be derived\n", t.Name)
-	} else if !t.Local.Validate("tunnel", t.Name, "local address", true, false) {
+		Errorf("tunnel (%s) missing a local address that cannot be derived", t.Name)
+		valid = false
+	} else if t.Local.anyPort = true; !t.Local.Validate("tunnel", t.Name, "local address", true, false) {
+		valid = false
+	}
+
+	if !t.validateLocalMode() {
+		valid = false
+	}
+	t.checkLocalSDDL()
+	if t.Local != nil && t.Local.IsUnix() && t.Protocol != "" {
+		Errorf("tunnel (%s) protocol (%s) cannot be used with a unix socket local address", t.Name, t.Protocol)
+		valid = false
+	}
+	if t.Local != nil && t.Local.IsPipe() && t.Protocol != "" {
+		Errorf("tunnel (%s) protocol (%s) cannot be used with a named pipe local address", t.Name, t.Protocol)
+		valid = false
+	}
+	for _, forward := range t.targets() {
+		if forward != nil && forward.IsPipe() {
+			Errorf("tunnel (%s) forward address (%s) is a named pipe, which can only be a local address", t.Name, forward)
+			valid = false
+		}
+	}
+
+	if !policy.checkTunnel(t) {
+		valid = false
+	}
+	for _, rule := range t.Rewrite {
+		if !rule.Validate(t.Name) {
+			valid = false
+		}
+	}
+	if t.RateLimit != nil && !t.RateLimit.Validate(t.Name) {
+		valid = false
+	}
+	if t.Admission != nil && !t.Admission.Validate(fmt.Sprintf("tunnel (%s)", t.Name)) {
+		valid = false
+	}
+	if !t.validateActivation() {
+		valid = false
+	}
+	if !t.validateConnectionAge() {
+		valid = false
+	}
+	if t.Chaos != nil && !t.Chaos.Validate(t.Name) {
+		valid = false
+	}
+	if t.TLS != nil && !t.TLS.Validate(t) {
+		valid = false
+	}
+
+	t.OnError = strings.TrimSpace(t.OnError)
+	switch t.OnError {
+	case "", OnErrorFail, OnErrorContinue:
+	default:
+		Errorf("tunnel (%s) on_error (%s) is invalid.  Must be %s or %s", t.Name, t.OnError, OnErrorFail, OnErrorContinue)
+		valid = false
+	}
+
+	t.ClientInfo = strings.ToLower(strings.TrimSpace(t.ClientInfo))
+	switch t.ClientInfo {
+	case "", ClientInfoProxy, ClientInfoForwardedFor:
+	default:
+		Errorf("tunnel (%s) client_info (%s) is invalid.  Must be %s or %s", t.Name, t.ClientInfo, ClientInfoProxy, ClientInfoForwardedFor)
+		valid = false
+	}
+
+	t.Protocol = strings.ToLower(strings.TrimSpace(t.Protocol))
+	switch t.Protocol {
+	case "":
+	case ProtocolKafka, ProtocolMongoDB:
+		if len(t.Forwards) > 0 {
+			Errorf("tunnel (%s) protocol %s cannot be used with forwards", t.Name, t.Protocol)
+			valid = false
+		}
+		if t.ClientInfo == ClientInfoForwardedFor {
+			Errorf("tunnel (%s) client_info (%s) cannot be used with protocol %s", t.Name, t.ClientInfo, t.Protocol)
+			valid = false
+		}
+		if t.cluster == nil {
+			t.cluster = newClusterMembers(t)
+		}
+	case ProtocolUDP:
+		if t.ClientInfo != "" {
+			Errorf("tunnel (%s) client_info (%s) cannot be used with protocol %s", t.Name, t.ClientInfo, t.Protocol)
+			valid = false
+		}
+	default:
+		Errorf("tunnel (%s) protocol (%s) is invalid.  Must be %s, %s or %s", t.Name, t.Protocol, ProtocolKafka, ProtocolMongoDB, ProtocolUDP)
 		valid = false
 	}
 
 	t.Host = strings.TrimSpace(t.Host)
 	if t.Host == "" {
-		fmt.Printf("  Error - tunnel (%s) missing remote host\n", t.Name)
-		valid = false
+		if !t.validateDirect() {
+			valid = false
+		}
 	} else if host, ok := Hosts[t.Host]; !ok {
-		fmt.Printf("  Error - tunnel (%s) remote host (%s) undefined\n", t.Name, t.Host)
+		Errorf("tunnel (%s) remote host (%s) undefined", t.Name, t.Host)
+		valid = false
+	} else if host.Relay != nil && t.unixTarget() {
+		Errorf("tunnel (%s) unix socket forward address cannot be reached through the relay of host (%s)", t.Name, t.Host)
 		valid = false
 	} else {
 		host.isHost = true
+		t.activate(host)
 	}
 
+	t.ID = strings.TrimSpace(t.ID)
+	if other := tunnelWithID(t.ID); t.ID != "" && other != nil && other != t {
+		Errorf("tunnel (%s) id (%s) is already that of tunnel (%s)", t.Name, t.ID, other.Name)
+		valid = false
+	}
+	t.id = t.stableID(func(id string) bool {
+		other := tunnelWithID(id)
+		return other != nil && other != t
+	})
+
 	if verboseFlag && valid {
-		fmt.Printf("  Info  - tunnel (%s) validated\n", t.Name)
+		Infof("tunnel (%s) validated", t.Name)
 	}
 	Tunnels[t.Name] = t
 	return valid
 }
 
+func (t *Tunnel) closeListener() {
+	t.connLock.Lock()
+	defer t.connLock.Unlock()
+	if t.listener != nil {
+		_ = t.listener.Close()
+	}
+}
+
+// tunnelList returns the tunnels currently defined
+func tunnelList() []*Tunnel {
+	tunnelsLock.RLock()
+	defer tunnelsLock.RUnlock()
+	tunnels := make([]*Tunnel, 0, len(Tunnels))
+	for _, t := range Tunnels {
+		tunnels = append(tunnels, t)
+	}
+	return tunnels
+}
+
+// ContinueOnError reports whether ferret should carry on without this tunnel when
+// it fails validation or cannot open its entrance, rather than terminating.
+func (t *Tunnel) ContinueOnError() bool {
+	return t.OnError == OnErrorContinue || (t.OnError == "" && partial)
+}
+
+func (t *Tunnel) track(id int32, conns ...net.Conn) {
+	t.connLock.Lock()
+	defer t.connLock.Unlock()
+	if t.conns == nil {
+		t.conns = make(map[int32][]net.Conn)
+	}
+	t.conns[id] = conns
+}
+
+func (t *Tunnel) untrack(id int32) {
+	t.connLock.Lock()
+	defer t.connLock.Unlock()
+	delete(t.conns, id)
+}
+
+func (t *Tunnel) active() int {
+	t.connLock.Lock()
+	defer t.connLock.Unlock()
+	return len(t.conns)
+}
+
+// shutdown closes the tunnel entrance and waits until the deadline for its open
+// connections to finish, then force closes any that remain.
+func (t *Tunnel) shutdown(deadline time.Time) {
+	t.transition(StateDraining)
+	t.closeListener()
+	defer t.transition(StateClosed)
+
+	open := t.active()
+	for t.active() > 0 && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.connLock.Lock()
+	forced := len(t.conns)
+	for _, conns := range t.conns {
+		for _, conn := range conns {
+			_ = conn.Close()
+		}
+	}
+	t.connLock.Unlock()
+	if open > 0 || verboseFlag {
+		Infof("tunnel (%s) shut down: %d connections drained, %d force closed", t.Name, open-forced, forced)
+	}
+}
+
+// Shutdown stops every tunnel in parallel, giving open connections until the
+// timeout to drain before they are force closed.
+func Shutdown(timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	wg := sync.WaitGroup{}
+	for _, t := range tunnelList() {
+		wg.Add(1)
+		go func(t *Tunnel) {
+			defer wg.Done()
+			t.shutdown(deadline)
+		}(t)
+	}
+	wg.Wait()
+	unloadPKCS11()
+}
+
 func (t *Tunnel) autoClose(ctx context.Context, conn net.Conn, conn2 net.Conn, id int32) {
 	status := "terminated"
 	if verboseFlag {
-		fmt.Printf("  Info  - tunnel (%s) id:%d c:%d auto-closer initiated\n", t.Name, id, connections.Load())
+		Infof("tunnel (%s) id:%d c:%d auto-closer initiated", t.Name, id, connections.Load())
 	}
 	timer := time.NewTimer(30 * time.Second)
 	select {
@@ -221,12 +799,28 @@ func (t *Tunnel) autoClose(ctx context.Context, conn net.Conn, conn2 net.Conn, i
 		_ = conn2.Close()
 	}
 	if verboseFlag {
-		fmt.Printf("  Info  - tunnel (%s) id:%d c:%d auto-closer %s\n", t.Name, id, connections.Load(), status)
+		Infof("tunnel (%s) id:%d c:%d auto-closer %s", t.Name, id, connections.Load(), status)
 	}
 }
 
-func (t *Tunnel) copy(dst io.Writer, src io.Reader, read bool) (err error) {
+// reap closes both sides of a connection at once when the watchdog has given up
+// on its client, rather than leaving the SSH channel open for the auto-closer.
+func (t *Tunnel) reap(err error, id int32, client string, sshConn net.Conn, localConn net.Conn) {
+	if !vanished(err) {
+		return
+	}
+	Warnf("tunnel (%s) id:%d client %s stopped responding, connection reaped", t.Name, id, client)
+	emit(&Event{Type: EventError, Tunnel: t.Name, TunnelID: t.id, Host: t.Host, ID: id, Client: client, Message: "client stopped responding"})
+	_ = sshConn.Close()
+	_ = localConn.Close()
+}
+
+func (t *Tunnel) copy(dst io.Writer, src io.Reader, read bool, connStats *ConnectionStats) (err error) {
 	buf := make([]byte, 32*1024)
+	if t.Protocol == ProtocolUDP {
+		// Each read is a datagram, which must fit whole
+		buf = make([]byte, maxDatagram)
+	}
 	for {
 		nr, er := src.Read(buf)
 		if nr > 0 {
@@ -239,12 +833,11 @@ func (t *Tunnel) copy(dst io.Writer, src io.Reader, read bool) (err error) {
 			}
 			if t.stats != nil {
 				if read {
-					t.stats.Received += int64(nw)
-					t.updateChan <- struct{}{}
+					t.stats.received(connStats, nw)
 				} else {
-					t.stats.Transmitted += int64(nw)
-					t.updateChan <- struct{}{}
+					t.stats.transmitted(connStats, nw)
 				}
+				t.updateChan <- struct{}{}
 			}
 			if ew != nil {
 				err = ew
@@ -0,0 +1,55 @@
+package internal
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// stableID is the tunnel's explicit id or else one derived from its host and
+// destination, so that the tunnel keeps its identity, and with it its stats and
+// journal, when renamed.  Tunnels sharing a destination are told apart by their
+// order, with taken reporting the ids of the tunnels before it.
+func (t *Tunnel) stableID(taken func(id string) bool) string {
+	if id := strings.TrimSpace(t.ID); id != "" {
+		return id
+	}
+	destination := strings.ToLower(strings.TrimSpace(t.Type))
+	if addresses := t.forwardAddresses(); addresses != "" {
+		destination = strings.ToLower(strings.TrimSpace(addresses))
+	} else if t.Local != nil {
+		destination += "@" + strings.TrimSpace(t.Local.address)
+	}
+	sum := sha256.Sum256([]byte(strings.TrimSpace(t.Host) + "\x00" + destination))
+	id := hex.EncodeToString(sum[:8])
+	for n := 2; taken(id); n++ {
+		id = fmt.Sprintf("%s-%d", hex.EncodeToString(sum[:8]), n)
+	}
+	return id
+}
+
+// tunnelWithID returns the tunnel already defined with an id, if any
+func tunnelWithID(id string) *Tunnel {
+	for _, t := range Tunnels {
+		if t.id == id {
+			return t
+		}
+	}
+	return nil
+}
+
+// TunnelIDs returns the ids of the configured tunnels whose names match the
+// filter, through which events recorded under any earlier name are found
+func TunnelIDs(tunnels []*Tunnel, filter *StatsFilter) map[string]bool {
+	ids := make(map[string]bool)
+	taken := make(map[string]bool)
+	for _, t := range tunnels {
+		id := t.stableID(func(id string) bool { return taken[id] })
+		taken[id] = true
+		if filter.matchesTunnel(strings.TrimSpace(t.Name)) {
+			ids[id] = true
+		}
+	}
+	return ids
+}
@@ -0,0 +1,549 @@
+package internal
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"math/rand"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// tunMTU is the largest packet exchanged with the TUN interface
+	tunMTU = 1500
+	// tunMSS is the largest segment sent, the MTU less the IPv4 and TCP headers
+	tunMSS = tunMTU - 40
+	// tunWindow is how much received data may wait on a slow destination before
+	// the client is told to stop sending
+	tunWindow = 65535
+	// tunRTO is how long an unacknowledged segment waits before it is sent
+	// again, doubling with each attempt up to tunRetries
+	tunRTO     = time.Second
+	tunRetries = 6
+
+	tcpFIN = 0x01
+	tcpSYN = 0x02
+	tcpRST = 0x04
+	tcpPSH = 0x08
+	tcpACK = 0x10
+)
+
+// flowKey identifies a connection by the addresses and ports of the client and
+// of its destination
+type flowKey struct {
+	src   [4]byte
+	dst   [4]byte
+	sport uint16
+	dport uint16
+}
+
+func (k flowKey) destination() string {
+	return net.JoinHostPort(net.IP(k.dst[:]).String(), strconv.Itoa(int(k.dport)))
+}
+
+type tcpSegment struct {
+	key     flowKey
+	seq     uint32
+	ack     uint32
+	flags   byte
+	window  uint16
+	mss     int
+	payload []byte
+}
+
+// packetStack terminates the TCP connections of the packets read from a TUN
+// interface, relaying each through a connection of its own from dial.  It is
+// just enough TCP for a lossless local link: segments arriving out of order are
+// dropped, to be sent again by the client, and those it loses are sent again,
+// all those unacknowledged, after a timeout.  Only IPv4 is handled.
+type packetStack struct {
+	device    io.ReadWriteCloser
+	dial      func(destination string) (net.Conn, bool)
+	writeLock sync.Mutex
+	lock      sync.Mutex
+	flows     map[flowKey]*tcpFlow
+}
+
+func newPacketStack(device io.ReadWriteCloser, dial func(destination string) (net.Conn, bool)) *packetStack {
+	return &packetStack{
+		device: device,
+		dial:   dial,
+		flows:  make(map[flowKey]*tcpFlow),
+	}
+}
+
+// serve handles the packets of the device until the context is done
+func (s *packetStack) serve(ctx context.Context) {
+	go func() {
+		<-ctx.Done()
+		_ = s.device.Close()
+	}()
+	go s.retransmit(ctx)
+	packet := make([]byte, 65535)
+	for {
+		n, err := s.device.Read(packet)
+		if err != nil {
+			break
+		}
+		if seg, ok := parseSegment(packet[:n]); ok {
+			s.handle(seg)
+		}
+	}
+	s.lock.Lock()
+	flows := make([]*tcpFlow, 0, len(s.flows))
+	for _, f := range s.flows {
+		flows = append(flows, f)
+	}
+	s.lock.Unlock()
+	for _, f := range flows {
+		f.lock.Lock()
+		f.close()
+		f.lock.Unlock()
+	}
+}
+
+func (s *packetStack) handle(seg *tcpSegment) {
+	s.lock.Lock()
+	f, ok := s.flows[seg.key]
+	if !ok && seg.flags&(tcpSYN|tcpACK|tcpRST) == tcpSYN {
+		f = newTCPFlow(s, seg)
+		s.flows[seg.key] = f
+		s.lock.Unlock()
+		go f.open()
+		return
+	}
+	s.lock.Unlock()
+	if ok {
+		f.receive(seg)
+	} else if seg.flags&tcpRST == 0 {
+		s.refuse(seg)
+	}
+}
+
+// refuse resets the client of a segment belonging to no known connection
+func (s *packetStack) refuse(seg *tcpSegment) {
+	if seg.flags&tcpACK != 0 {
+		s.send(seg.key, seg.ack, 0, tcpRST, 0, nil)
+		return
+	}
+	length := uint32(len(seg.payload))
+	if seg.flags&tcpSYN != 0 {
+		length++
+	}
+	if seg.flags&tcpFIN != 0 {
+		length++
+	}
+	s.send(seg.key, 0, seg.seq+length, tcpRST|tcpACK, 0, nil)
+}
+
+func (s *packetStack) remove(f *tcpFlow) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.flows[f.key] == f {
+		delete(s.flows, f.key)
+	}
+}
+
+func (s *packetStack) retransmit(ctx context.Context) {
+	ticker := time.NewTicker(tunRTO / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			s.lock.Lock()
+			flows := make([]*tcpFlow, 0, len(s.flows))
+			for _, f := range s.flows {
+				flows = append(flows, f)
+			}
+			s.lock.Unlock()
+			for _, f := range flows {
+				f.retransmit(now)
+			}
+		}
+	}
+}
+
+// send writes a segment from the destination of a connection to its client
+func (s *packetStack) send(key flowKey, seq uint32, ack uint32, flags byte, window uint16, payload []byte) {
+	tcpLength := 20
+	if flags&tcpSYN != 0 {
+		tcpLength += 4
+	}
+	packet := make([]byte, 20+tcpLength+len(payload))
+	packet[0] = 0x45
+	binary.BigEndian.PutUint16(packet[2:], uint16(len(packet)))
+	binary.BigEndian.PutUint16(packet[6:], 0x4000) // don't fragment
+	packet[8] = 64
+	packet[9] = 6
+	copy(packet[12:16], key.dst[:])
+	copy(packet[16:20], key.src[:])
+	binary.BigEndian.PutUint16(packet[10:], checksum(packet[:20], 0))
+
+	tcp := packet[20:]
+	binary.BigEndian.PutUint16(tcp[0:], key.dport)
+	binary.BigEndian.PutUint16(tcp[2:], key.sport)
+	binary.BigEndian.PutUint32(tcp[4:], seq)
+	binary.BigEndian.PutUint32(tcp[8:], ack)
+	tcp[12] = byte(tcpLength/4) << 4
+	tcp[13] = flags
+	binary.BigEndian.PutUint16(tcp[14:], window)
+	if flags&tcpSYN != 0 {
+		tcp[20], tcp[21] = 2, 4
+		binary.BigEndian.PutUint16(tcp[22:], tunMSS)
+	}
+	copy(tcp[tcpLength:], payload)
+	// The pseudo header of the addresses, protocol and length
+	pseudo := checksumSum(packet[12:20], 6+uint32(len(tcp)))
+	binary.BigEndian.PutUint16(tcp[16:], checksum(tcp, pseudo))
+
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	_, _ = s.device.Write(packet)
+}
+
+func parseSegment(packet []byte) (*tcpSegment, bool) {
+	if len(packet) < 20 || packet[0]>>4 != 4 || packet[9] != 6 {
+		return nil, false
+	}
+	headerLength := int(packet[0]&0x0f) * 4
+	total := int(binary.BigEndian.Uint16(packet[2:]))
+	if headerLength < 20 || total < headerLength+20 || total > len(packet) {
+		return nil, false
+	}
+	if binary.BigEndian.Uint16(packet[6:])&0x3fff != 0 {
+		// Fragments are not reassembled
+		return nil, false
+	}
+	tcp := packet[headerLength:total]
+	offset := int(tcp[12]>>4) * 4
+	if offset < 20 || offset > len(tcp) {
+		return nil, false
+	}
+	seg := &tcpSegment{
+		seq:    binary.BigEndian.Uint32(tcp[4:]),
+		ack:    binary.BigEndian.Uint32(tcp[8:]),
+		flags:  tcp[13],
+		window: binary.BigEndian.Uint16(tcp[14:]),
+		mss:    536,
+	}
+	copy(seg.key.src[:], packet[12:16])
+	copy(seg.key.dst[:], packet[16:20])
+	seg.key.sport = binary.BigEndian.Uint16(tcp[0:])
+	seg.key.dport = binary.BigEndian.Uint16(tcp[2:])
+	for options := tcp[20:offset]; len(options) > 0; {
+		kind := options[0]
+		if kind == 0 {
+			break
+		}
+		if kind == 1 || len(options) < 2 || int(options[1]) < 2 || int(options[1]) > len(options) {
+			options = options[1:]
+			continue
+		}
+		if kind == 2 && options[1] == 4 {
+			seg.mss = int(binary.BigEndian.Uint16(options[2:]))
+		}
+		options = options[options[1]:]
+	}
+	seg.payload = make([]byte, len(tcp)-offset)
+	copy(seg.payload, tcp[offset:])
+	return seg, true
+}
+
+func checksumSum(b []byte, sum uint32) uint32 {
+	for ; len(b) > 1; b = b[2:] {
+		sum += uint32(binary.BigEndian.Uint16(b))
+	}
+	if len(b) == 1 {
+		sum += uint32(b[0]) << 8
+	}
+	return sum
+}
+
+func checksum(b []byte, sum uint32) uint16 {
+	sum = checksumSum(b, sum)
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return ^uint16(sum)
+}
+
+// tcpFlow is a connection of a client of the TUN interface, relayed to its
+// destination by conn
+type tcpFlow struct {
+	stack       *packetStack
+	key         flowKey
+	lock        sync.Mutex
+	cond        *sync.Cond
+	conn        net.Conn
+	established bool
+	closed      bool
+	mss         int
+	// sent to the client: from sndUna, the oldest unacknowledged, to sndNxt,
+	// within the window it last advertised
+	sndUna  uint32
+	sndNxt  uint32
+	window  uint32
+	unacked []byte
+	finSent bool
+	sentAt  time.Time
+	retries int
+	// received from the client, waiting to be written to conn
+	rcvNxt       uint32
+	received     []byte
+	finReceived  bool
+	finDelivered bool
+	advertised   int
+}
+
+func newTCPFlow(s *packetStack, syn *tcpSegment) *tcpFlow {
+	isn := rand.Uint32()
+	f := &tcpFlow{
+		stack:  s,
+		key:    syn.key,
+		mss:    min(syn.mss, tunMSS),
+		sndUna: isn,
+		sndNxt: isn + 1,
+		window: uint32(syn.window),
+		rcvNxt: syn.seq + 1,
+	}
+	f.cond = sync.NewCond(&f.lock)
+	return f
+}
+
+// open connects to the destination, then accepts the client's connection
+func (f *tcpFlow) open() {
+	conn, ok := f.stack.dial(f.key.destination())
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if !ok || f.closed {
+		if ok {
+			_ = conn.Close()
+		}
+		f.abort()
+		return
+	}
+	f.conn = conn
+	f.sentAt = time.Now()
+	f.segment(tcpSYN|tcpACK, f.sndUna, nil)
+	go f.deliver()
+	go f.forward()
+}
+
+// segment sends a segment acknowledging all that has been received
+func (f *tcpFlow) segment(flags byte, seq uint32, payload []byte) {
+	f.advertised = max(tunWindow-len(f.received), 0)
+	f.stack.send(f.key, seq, f.rcvNxt, flags|tcpACK, uint16(f.advertised), payload)
+}
+
+func (f *tcpFlow) receive(seg *tcpSegment) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.closed {
+		return
+	}
+	if seg.flags&tcpRST != 0 {
+		f.close()
+		return
+	}
+	if f.conn == nil {
+		// Still connecting to the destination, the client waits
+		return
+	}
+	if seg.flags&tcpSYN != 0 {
+		if !f.established {
+			f.segment(tcpSYN|tcpACK, f.sndUna, nil)
+		}
+		return
+	}
+	if seg.flags&tcpACK == 0 {
+		return
+	}
+
+	if acked := seg.ack - f.sndUna; int32(acked) > 0 && int32(seg.ack-f.sndNxt) <= 0 {
+		if !f.established {
+			f.established = true
+			acked--
+		}
+		data := min(int(acked), len(f.unacked))
+		f.unacked = f.unacked[data:]
+		f.sndUna = seg.ack
+		f.sentAt = time.Now()
+		f.retries = 0
+	}
+	f.window = uint32(seg.window)
+
+	if len(seg.payload) > 0 || seg.flags&tcpFIN != 0 {
+		if seg.seq == f.rcvNxt && !f.finReceived {
+			payload := seg.payload
+			if space := tunWindow - len(f.received); len(payload) > space {
+				payload = payload[:space]
+			}
+			f.received = append(f.received, payload...)
+			f.rcvNxt += uint32(len(payload))
+			if len(payload) == len(seg.payload) && seg.flags&tcpFIN != 0 {
+				f.finReceived = true
+				f.rcvNxt++
+			}
+		}
+		// Segments out of order are answered with what is still expected
+		f.segment(tcpACK, f.sndNxt, nil)
+	}
+	f.cond.Broadcast()
+	f.finish()
+}
+
+// deliver writes what the client sends to the destination
+func (f *tcpFlow) deliver() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	for {
+		for len(f.received) == 0 && !f.finReceived && !f.closed {
+			f.cond.Wait()
+		}
+		if f.closed {
+			return
+		}
+		if len(f.received) == 0 {
+			// The client has finished sending, which the destination is told
+			if closer, ok := f.conn.(interface{ CloseWrite() error }); ok {
+				_ = closer.CloseWrite()
+			}
+			f.finDelivered = true
+			f.finish()
+			return
+		}
+		data := f.received
+		f.received = nil
+		f.lock.Unlock()
+		_, err := f.conn.Write(data)
+		f.lock.Lock()
+		if err != nil {
+			f.abort()
+			return
+		}
+		if f.advertised < tunWindow/2 && !f.closed {
+			// The client is told its window has opened again
+			f.segment(tcpACK, f.sndNxt, nil)
+		}
+	}
+}
+
+// forward sends what the destination answers to the client
+func (f *tcpFlow) forward() {
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := f.conn.Read(buf)
+		if n > 0 && !f.transmit(buf[:n]) {
+			return
+		}
+		if err != nil {
+			f.lock.Lock()
+			if err != io.EOF {
+				f.abort()
+			} else if !f.closed {
+				if len(f.unacked) == 0 {
+					f.sentAt = time.Now()
+				}
+				f.segment(tcpFIN|tcpACK, f.sndNxt, nil)
+				f.finSent = true
+				f.sndNxt++
+				f.finish()
+			}
+			f.lock.Unlock()
+			return
+		}
+	}
+}
+
+func (f *tcpFlow) transmit(data []byte) bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	for len(data) > 0 {
+		for !f.closed && (!f.established || f.sndNxt-f.sndUna >= f.window) {
+			f.cond.Wait()
+		}
+		if f.closed {
+			return false
+		}
+		n := min(len(data), f.mss, int(f.window-(f.sndNxt-f.sndUna)))
+		if len(f.unacked) == 0 {
+			f.sentAt = time.Now()
+		}
+		f.segment(tcpACK|tcpPSH, f.sndNxt, data[:n])
+		f.unacked = append(f.unacked, data[:n]...)
+		f.sndNxt += uint32(n)
+		data = data[n:]
+	}
+	return true
+}
+
+// retransmit sends again all that the client has not acknowledged in time
+func (f *tcpFlow) retransmit(now time.Time) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.closed || f.conn == nil || now.Sub(f.sentAt) < tunRTO<<f.retries {
+		return
+	}
+	if f.sndUna == f.sndNxt {
+		if f.established && f.window == 0 {
+			// A probe of a closed window, in case the update opening it was lost
+			f.sentAt = now
+			f.segment(tcpACK, f.sndNxt-1, nil)
+		}
+		return
+	}
+	if f.retries == tunRetries {
+		f.abort()
+		return
+	}
+	f.retries++
+	f.sentAt = now
+	if !f.established {
+		f.segment(tcpSYN|tcpACK, f.sndUna, nil)
+		return
+	}
+	seq := f.sndUna
+	for data := f.unacked; len(data) > 0; {
+		n := min(len(data), f.mss)
+		f.segment(tcpACK|tcpPSH, seq, data[:n])
+		seq += uint32(n)
+		data = data[n:]
+	}
+	if f.finSent {
+		f.segment(tcpFIN|tcpACK, seq, nil)
+	}
+}
+
+// finish closes the connection once both sides have finished sending and the
+// client has acknowledged all that was sent.  The flow lock must be held.
+func (f *tcpFlow) finish() {
+	if f.finDelivered && f.finSent && f.sndUna == f.sndNxt {
+		f.close()
+	}
+}
+
+// abort resets the client's connection.  The flow lock must be held.
+func (f *tcpFlow) abort() {
+	if !f.closed {
+		f.segment(tcpRST|tcpACK, f.sndNxt, nil)
+	}
+	f.close()
+}
+
+// close releases the connection.  The flow lock must be held.
+func (f *tcpFlow) close() {
+	if f.closed {
+		return
+	}
+	f.closed = true
+	if f.conn != nil {
+		_ = f.conn.Close()
+	}
+	f.stack.remove(f)
+	f.cond.Broadcast()
+}
@@ -0,0 +1,324 @@
+package internal
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	ProtocolUDP = "udp"
+
+	// udpFlowIdle is how long a client may go without sending or receiving a
+	// datagram before its flow, and the helper serving it, are closed
+	udpFlowIdle = 60 * time.Second
+	// udpFlowQueue is how many datagrams may wait for a flow before further
+	// datagrams are dropped, as a congested network would
+	udpFlowQueue = 64
+	// maxDatagram is the largest datagram, as its length is framed in two bytes
+	maxDatagram = 0xffff
+)
+
+// defaultUDPCommand relays datagrams between its standard input and output,
+// each preceded by its length as two bytes, and the address it is given.  It
+// only requires python3 on the host.
+const defaultUDPCommand = `python3 -c '
+import socket, struct, sys, threading
+a = socket.getaddrinfo(sys.argv[1], int(sys.argv[2]), 0, socket.SOCK_DGRAM)[0]
+s = socket.socket(a[0], socket.SOCK_DGRAM)
+s.connect(a[4])
+i, o = sys.stdin.buffer, sys.stdout.buffer
+def receive():
+    while True:
+        try:
+            d = s.recv(65535)
+        except ConnectionRefusedError:
+            continue
+        o.write(struct.pack(">H", len(d)) + d)
+        o.flush()
+threading.Thread(target=receive, daemon=True).start()
+while True:
+    h = i.read(2)
+    if len(h) < 2:
+        break
+    s.send(i.read(struct.unpack(">H", h)[0]))
+' {host} {port}`
+
+func (h *Host) validateUDP() bool {
+	h.UDPCommand = strings.TrimSpace(h.UDPCommand)
+	if h.UDPCommand == "" {
+		return true
+	}
+	if !strings.Contains(h.UDPCommand, "{host}") || !strings.Contains(h.UDPCommand, "{port}") {
+		Errorf("host (%s) udp_command (%s) must contain {host} and {port}", h.Name, h.UDPCommand)
+		return false
+	}
+	return true
+}
+
+// DialUDP connects to a UDP address by running the udp command on the host,
+// returning a connection on which each read and write is a single datagram
+func (h *Host) DialUDP(address string) (net.Conn, bool) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.client == nil {
+		Errorf("Host (%s) failed to call remote address: not connected", h.Name)
+		return nil, false
+	}
+	client, ok := h.client.(*ssh.Client)
+	if !ok {
+		Errorf("Host (%s) failed to call remote address: UDP cannot be relayed", h.Name)
+		return nil, false
+	}
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		Errorf("Host (%s) failed to call remote address: %v", h.Name, err)
+		return nil, false
+	}
+	command := h.UDPCommand
+	if command == "" {
+		command = defaultUDPCommand
+	}
+	command = strings.NewReplacer("{host}", shellQuote(host), "{port}", shellQuote(port)).Replace(command)
+	conn, err := h.startCommand(client, command, address)
+	if err != nil {
+		Errorf("Host (%s) failed to call remote address: %v", h.Name, err)
+		return nil, false
+	}
+	return h.stats.channel(&datagramConn{Conn: conn}, address), true
+}
+
+// datagramConn frames the datagrams written to and read from a stream, each
+// preceded by its length as two bytes
+type datagramConn struct {
+	net.Conn
+	readLock  sync.Mutex
+	writeLock sync.Mutex
+}
+
+func (c *datagramConn) Read(b []byte) (int, error) {
+	c.readLock.Lock()
+	defer c.readLock.Unlock()
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(c.Conn, header); err != nil {
+		return 0, err
+	}
+	datagram := make([]byte, binary.BigEndian.Uint16(header))
+	if _, err := io.ReadFull(c.Conn, datagram); err != nil {
+		return 0, err
+	}
+	if len(datagram) > len(b) {
+		return 0, fmt.Errorf("datagram of %d bytes exceeds the buffer of %d", len(datagram), len(b))
+	}
+	return copy(b, datagram), nil
+}
+
+func (c *datagramConn) Write(b []byte) (int, error) {
+	if len(b) > maxDatagram {
+		return 0, fmt.Errorf("datagram of %d bytes is too large", len(b))
+	}
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	frame := make([]byte, 2+len(b))
+	binary.BigEndian.PutUint16(frame, uint16(len(b)))
+	copy(frame[2:], b)
+	if _, err := c.Conn.Write(frame); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// udpListener accepts the datagrams of each client address as a connection of
+// its own, so UDP tunnels are served just as TCP tunnels are
+type udpListener struct {
+	conn    net.PacketConn
+	lock    sync.Mutex
+	flows   map[string]*udpFlow
+	accept  chan *udpFlow
+	done    chan struct{}
+	closing sync.Once
+}
+
+func listenUDP(address string) (net.Listener, error) {
+	if l, ok, err := inheritedListener("udp", address); ok {
+		return l, err
+	}
+	conn, err := net.ListenPacket("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	return newUDPListener(conn), nil
+}
+
+func newUDPListener(conn net.PacketConn) *udpListener {
+	l := &udpListener{
+		conn:   conn,
+		flows:  make(map[string]*udpFlow),
+		accept: make(chan *udpFlow),
+		done:   make(chan struct{}),
+	}
+	go l.receive()
+	return l
+}
+
+func (l *udpListener) receive() {
+	buf := make([]byte, maxDatagram)
+	for {
+		n, addr, err := l.conn.ReadFrom(buf)
+		if err != nil {
+			_ = l.Close()
+			return
+		}
+		datagram := make([]byte, n)
+		copy(datagram, buf[:n])
+
+		l.lock.Lock()
+		flow, ok := l.flows[addr.String()]
+		if !ok {
+			flow = newUDPFlow(l, addr)
+			l.flows[addr.String()] = flow
+		}
+		l.lock.Unlock()
+		if !ok {
+			select {
+			case l.accept <- flow:
+			case <-l.done:
+				return
+			}
+		}
+		flow.deliver(datagram)
+	}
+}
+
+func (l *udpListener) Accept() (net.Conn, error) {
+	select {
+	case flow := <-l.accept:
+		return flow, nil
+	case <-l.done:
+		return nil, &net.OpError{Op: "accept", Net: "udp", Addr: l.Addr(), Err: net.ErrClosed}
+	}
+}
+
+// Close stops the listener and with it every flow, which cannot outlive the
+// socket they are answered from
+func (l *udpListener) Close() error {
+	var err error
+	l.closing.Do(func() {
+		close(l.done)
+		err = l.conn.Close()
+		l.lock.Lock()
+		flows := make([]*udpFlow, 0, len(l.flows))
+		for _, flow := range l.flows {
+			flows = append(flows, flow)
+		}
+		l.lock.Unlock()
+		for _, flow := range flows {
+			_ = flow.Close()
+		}
+	})
+	return err
+}
+
+func (l *udpListener) Addr() net.Addr {
+	return l.conn.LocalAddr()
+}
+
+func (l *udpListener) remove(flow *udpFlow) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.flows[flow.addr.String()] == flow {
+		delete(l.flows, flow.addr.String())
+	}
+}
+
+// udpFlow is the exchange of datagrams with a single client address, closed
+// once idle
+type udpFlow struct {
+	listener *udpListener
+	addr     net.Addr
+	queue    chan []byte
+	done     chan struct{}
+	idle     *time.Timer
+	closing  sync.Once
+}
+
+var errUDPDeadline = errors.New("deadlines are not supported by UDP flows")
+
+func newUDPFlow(l *udpListener, addr net.Addr) *udpFlow {
+	flow := &udpFlow{
+		listener: l,
+		addr:     addr,
+		queue:    make(chan []byte, udpFlowQueue),
+		done:     make(chan struct{}),
+	}
+	flow.idle = time.AfterFunc(udpFlowIdle, func() {
+		_ = flow.Close()
+	})
+	return flow
+}
+
+func (f *udpFlow) deliver(datagram []byte) {
+	f.idle.Reset(udpFlowIdle)
+	select {
+	case f.queue <- datagram:
+	default:
+	}
+}
+
+func (f *udpFlow) Read(b []byte) (int, error) {
+	select {
+	case datagram := <-f.queue:
+		if len(datagram) > len(b) {
+			return 0, fmt.Errorf("datagram of %d bytes exceeds the buffer of %d", len(datagram), len(b))
+		}
+		return copy(b, datagram), nil
+	case <-f.done:
+		return 0, io.EOF
+	}
+}
+
+func (f *udpFlow) Write(b []byte) (int, error) {
+	select {
+	case <-f.done:
+		return 0, net.ErrClosed
+	default:
+	}
+	f.idle.Reset(udpFlowIdle)
+	return f.listener.conn.WriteTo(b, f.addr)
+}
+
+func (f *udpFlow) Close() error {
+	f.closing.Do(func() {
+		f.idle.Stop()
+		close(f.done)
+		f.listener.remove(f)
+	})
+	return nil
+}
+
+func (f *udpFlow) LocalAddr() net.Addr {
+	return f.listener.Addr()
+}
+
+func (f *udpFlow) RemoteAddr() net.Addr {
+	return f.addr
+}
+
+func (f *udpFlow) SetDeadline(time.Time) error {
+	return errUDPDeadline
+}
+
+func (f *udpFlow) SetReadDeadline(time.Time) error {
+	return errUDPDeadline
+}
+
+func (f *udpFlow) SetWriteDeadline(time.Time) error {
+	return errUDPDeadline
+}
@@ -0,0 +1,90 @@
+package internal
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// unixScheme marks an address as the path of a unix domain socket
+const unixScheme = "unix://"
+
+// defaultLocalMode keeps a tunnel's unix socket to the user running ferret
+const defaultLocalMode = 0600
+
+func (a *Address) validateUnix(group string, name string, attr string) bool {
+	a.valid = true
+	a.unix = true
+	a.address = strings.TrimPrefix(a.address, unixScheme)
+	if strings.TrimSpace(a.address) == "" {
+		Errorf("%s(%s) %s(%s) is invalid.  Required syntax is unix://<path>", group, name, attr, unixScheme)
+		a.valid = false
+	}
+	return a.valid
+}
+
+// IsUnix reports whether the address is the path of a unix domain socket
+func (a *Address) IsUnix() bool {
+	return a.unix
+}
+
+func (t *Tunnel) validateLocalMode() bool {
+	t.LocalMode = strings.TrimSpace(t.LocalMode)
+	t.localMode = defaultLocalMode
+	if t.LocalMode == "" {
+		return true
+	}
+	if t.Local == nil || !t.Local.IsUnix() {
+		Warnf("tunnel (%s) local_mode is ignored without a unix socket local address", t.Name)
+	}
+	mode, err := strconv.ParseUint(t.LocalMode, 8, 32)
+	if err != nil || mode > 0777 {
+		Errorf("tunnel (%s) local_mode (%s) is invalid.  Must be octal permissions, e.g. 0660", t.Name, t.LocalMode)
+		return false
+	}
+	t.localMode = os.FileMode(mode)
+	return true
+}
+
+// listenUnix opens a unix socket entrance, replacing a socket left behind by a
+// ferret that did not shut down cleanly, but never one still in use nor any
+// other kind of file
+func listenUnix(path string, mode os.FileMode) (net.Listener, error) {
+	if l, ok, err := inheritedListener("unix", path); ok {
+		return l, err
+	}
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if conn, err := net.DialTimeout("unix", path, time.Second); err == nil {
+			_ = conn.Close()
+			return nil, fmt.Errorf("%s is in use", path)
+		}
+		_ = os.Remove(path)
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err = os.Chmod(path, mode); err != nil {
+		_ = listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+// clientName describes the client of a connection: its address or, for unix
+// sockets, which have none, the user id of the connecting process
+func clientName(conn net.Conn) string {
+	if _, ok := conn.(*net.UnixConn); !ok {
+		return conn.RemoteAddr().String()
+	}
+	if uid, err := peerUID(conn); err == nil {
+		return fmt.Sprintf("uid:%d", uid)
+	}
+	return "unix"
+}
@@ -0,0 +1,231 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"runtime"
+	"slices"
+	"sync"
+	"time"
+)
+
+// listenersEnv passes a new ferret the listeners handed down to it by the ferret
+// upgrading to it, as a JSON object of file descriptors by network and address
+const listenersEnv = "FERRET_LISTENERS"
+
+var (
+	upgradeLock sync.Mutex
+	// inherited are the listeners handed down for an upgrade, not yet taken up
+	inheritedLock sync.Mutex
+	inherited     map[string]*os.File
+)
+
+// upgrade answers the upgrade control command, starting the binary given, or
+// else this binary again, to take over from this ferret
+func upgrade(tenant *Tenant, args []string) (string, error) {
+	if tenant != nil {
+		return "", errors.New("only the owner of ferret can upgrade it")
+	}
+	if len(args) > 1 {
+		return "", errors.New("only the binary to upgrade to may be given")
+	}
+	binary := ""
+	if len(args) == 1 {
+		binary = args[0]
+	}
+	return startUpgrade(binary)
+}
+
+// startUpgrade starts a new ferret from the binary with the arguments of this
+// one, handing down the open entrances and stats port, and waits for it to take
+// over through a handoff.  No connection is refused in between, though those
+// open here are not handed down, but drained, as a handoff does.
+func startUpgrade(binary string) (string, error) {
+	if !handoffSupported {
+		return "", fmt.Errorf("upgrade is not supported on %s", runtime.GOOS)
+	}
+	if !upgradeLock.TryLock() {
+		return "", errors.New("an upgrade is already in progress")
+	}
+	defer upgradeLock.Unlock()
+	select {
+	case <-handedOff:
+		return "", errors.New("already handed off")
+	default:
+	}
+	if binary == "" {
+		var err error
+		if binary, err = os.Executable(); err != nil {
+			return "", fmt.Errorf("binary of ferret cannot be found: %v", err)
+		}
+	}
+	if _, err := os.Stat(binary); err != nil {
+		return "", fmt.Errorf("binary (%s) cannot be run: %v", binary, err)
+	}
+
+	files, fds := handDownListeners()
+	defer func() {
+		for _, f := range files {
+			_ = f.Close()
+		}
+	}()
+	spec, _ := json.Marshal(fds)
+	args := os.Args[1:]
+	if !slices.Contains(args, "--handoff") {
+		args = append(append([]string{}, args...), "--handoff")
+	}
+	cmd := exec.Command(binary, args...)
+	cmd.Env = append(os.Environ(), fmt.Sprintf("%s=%s", listenersEnv, spec))
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = files
+	if err := cmd.Start(); err != nil {
+		return "", fmt.Errorf("binary (%s) cannot be started: %v", binary, err)
+	}
+	Infof("upgrading to %s, pid %d, handing down %d listeners", binary, cmd.Process.Pid, len(files))
+	exited := make(chan error, 1)
+	go func() {
+		exited <- cmd.Wait()
+	}()
+	select {
+	case <-handedOff:
+		return fmt.Sprintf("upgraded to %s, pid %d\n", binary, cmd.Process.Pid), nil
+	case err := <-exited:
+		return "", fmt.Errorf("new ferret exited before taking over: %v", err)
+	case <-time.After(handoffTimeout):
+		_ = cmd.Process.Kill()
+		return "", fmt.Errorf("new ferret has not taken over within %s", handoffTimeout)
+	}
+}
+
+// handDownListeners duplicates the open entrances and stats port, to be passed
+// to a new ferret as the file descriptors following stderr
+func handDownListeners() ([]*os.File, map[string]int) {
+	var files []*os.File
+	fds := make(map[string]int)
+	add := func(key string, listener net.Listener) {
+		if _, ok := fds[key]; ok || listener == nil {
+			return
+		}
+		f, err := listenerFile(listener)
+		if err != nil {
+			Warnf("listener (%s) cannot be handed down, so will be opened again: %v", key, err)
+			return
+		}
+		fds[key] = 3 + len(files)
+		files = append(files, f)
+	}
+	for _, t := range tunnelList() {
+		network := "tcp"
+		switch {
+		case t.Local.IsPipe():
+			continue
+		case t.Protocol == ProtocolUDP:
+			network = "udp"
+		case t.Local.IsUnix():
+			network = "unix"
+		}
+		t.connLock.Lock()
+		listener := t.listener
+		t.connLock.Unlock()
+		add(inheritKey(network, t.Local.address), listener)
+	}
+	if controlStats != nil && controlStats.statsListener != nil {
+		add(inheritKey("tcp", controlStats.statsAddress), controlStats.statsListener)
+	}
+	return files, fds
+}
+
+func listenerFile(listener net.Listener) (*os.File, error) {
+	switch l := listener.(type) {
+	case *net.TCPListener:
+		return l.File()
+	case *net.UnixListener:
+		return l.File()
+	case *udpListener:
+		if conn, ok := l.conn.(*net.UDPConn); ok {
+			return conn.File()
+		}
+	}
+	return nil, fmt.Errorf("%T cannot be duplicated", listener)
+}
+
+// inheritListeners takes up the listeners handed down by an upgrade, if any
+func inheritListeners() {
+	spec := os.Getenv(listenersEnv)
+	_ = os.Unsetenv(listenersEnv)
+	if spec == "" {
+		return
+	}
+	fds := make(map[string]int)
+	if err := json.Unmarshal([]byte(spec), &fds); err != nil {
+		Warnf("listeners handed down cannot be read, so will be opened again: %v", err)
+		return
+	}
+	inheritedLock.Lock()
+	defer inheritedLock.Unlock()
+	inherited = make(map[string]*os.File)
+	for key, fd := range fds {
+		inherited[key] = os.NewFile(uintptr(fd), key)
+	}
+	if verboseFlag {
+		Infof("%d listeners handed down", len(inherited))
+	}
+}
+
+// isInherited reports whether a listener of the network and address was handed down
+func isInherited(network string, address string) bool {
+	inheritedLock.Lock()
+	defer inheritedLock.Unlock()
+	_, ok := inherited[inheritKey(network, address)]
+	return ok
+}
+
+// inheritedListener returns the listener of the network and address handed
+// down, if there is one, which is then no longer available
+func inheritedListener(network string, address string) (net.Listener, bool, error) {
+	inheritedLock.Lock()
+	f, ok := inherited[inheritKey(network, address)]
+	delete(inherited, inheritKey(network, address))
+	inheritedLock.Unlock()
+	if !ok {
+		return nil, false, nil
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	if network == "udp" {
+		conn, err := net.FilePacketConn(f)
+		if err != nil {
+			return nil, true, err
+		}
+		return newUDPListener(conn), true, nil
+	}
+	listener, err := net.FileListener(f)
+	if err != nil {
+		return nil, true, err
+	}
+	if l, ok := listener.(*net.UnixListener); ok {
+		// Removed on close as though opened here
+		l.SetUnlinkOnClose(true)
+	}
+	return listener, true, nil
+}
+
+// closeInherited closes the listeners handed down that were not taken up
+func closeInherited() {
+	inheritedLock.Lock()
+	defer inheritedLock.Unlock()
+	for key, f := range inherited {
+		_ = f.Close()
+		delete(inherited, key)
+	}
+}
+
+func inheritKey(network string, address string) string {
+	return network + " " + address
+}
@@ -0,0 +1,6 @@
+//go:build !linux && !darwin
+
+package internal
+
+// UpgradeOnSignal does nothing, as there is no SIGUSR2 to upgrade on
+func UpgradeOnSignal() {}
@@ -0,0 +1,26 @@
+//go:build linux || darwin
+
+package internal
+
+import (
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+)
+
+// UpgradeOnSignal upgrades ferret to its binary on SIGUSR2, as the upgrade
+// command does, e.g. once a package manager has replaced the binary
+func UpgradeOnSignal() {
+	upgrades := make(chan os.Signal, 1)
+	signal.Notify(upgrades, syscall.SIGUSR2)
+	go func() {
+		for range upgrades {
+			if output, err := startUpgrade(""); err != nil {
+				Errorf("upgrade failed: %v", err)
+			} else {
+				Infof("%s", strings.TrimSpace(output))
+			}
+		}
+	}()
+}
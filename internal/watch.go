@@ -0,0 +1,125 @@
+package internal
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+)
+
+var watchOperators = []string{">=", "<=", "==", "!=", ">", "<"}
+
+// StatsFilter narrows down and highlights the tunnels displayed in stats client mode
+type StatsFilter struct {
+	Tunnel  string
+	MinRate int64
+	Watch   *WatchExpression
+}
+
+// WatchExpression compares a stats column against a value, e.g. "rate>10M"
+type WatchExpression struct {
+	field string
+	op    string
+	value int64
+}
+
+func ParseWatchExpression(expr string) (*WatchExpression, error) {
+	expr = strings.ReplaceAll(expr, " ", "")
+	for _, op := range watchOperators {
+		if index := strings.Index(expr, op); index > 0 {
+			w := &WatchExpression{
+				field: strings.ToLower(expr[:index]),
+				op:    op,
+			}
+			switch w.field {
+			case "rate", "rcvd", "sent", "actv", "total", "rtt", "stall":
+			default:
+				return nil, fmt.Errorf("unknown field (%s).  Expected rate, rcvd, sent, actv, total, rtt or stall", w.field)
+			}
+			var err error
+			if w.value, err = ParseByteCount(expr[index+len(op):]); err != nil {
+				return nil, err
+			}
+			return w, nil
+		}
+	}
+	return nil, fmt.Errorf("expression (%s) requires one of %s", expr, strings.Join(watchOperators, " "))
+}
+
+// ParseByteCount parses a number with an optional K, M or G (1024 based) suffix
+func ParseByteCount(value string) (int64, error) {
+	multiplier := int64(1)
+	value = strings.TrimSpace(value)
+	if value != "" {
+		switch strings.ToUpper(value[len(value)-1:]) {
+		case "K":
+			multiplier = 1024
+		case "M":
+			multiplier = 1024 * 1024
+		case "G":
+			multiplier = 1024 * 1024 * 1024
+		}
+		if multiplier != 1 {
+			value = value[:len(value)-1]
+		}
+	}
+	i, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid number (%s)", value)
+	}
+	return i * multiplier, nil
+}
+
+func (w *WatchExpression) Matches(t *TunnelStats, rate int64) bool {
+	var actual int64
+	switch w.field {
+	case "rate":
+		actual = rate
+	case "rcvd":
+		actual = t.Received
+	case "sent":
+		actual = t.Transmitted
+	case "actv":
+		actual = int64(t.Connected)
+	case "total":
+		actual = int64(t.Connections)
+	case "rtt":
+		actual = t.RTT
+	case "stall":
+		actual = int64(t.Stalled)
+	}
+	switch w.op {
+	case ">=":
+		return actual >= w.value
+	case "<=":
+		return actual <= w.value
+	case "==":
+		return actual == w.value
+	case "!=":
+		return actual != w.value
+	case ">":
+		return actual > w.value
+	case "<":
+		return actual < w.value
+	}
+	return false
+}
+
+func (f *StatsFilter) include(t *TunnelStats, rate int64) bool {
+	if f == nil {
+		return true
+	}
+	return f.matchesTunnel(t.Name) && rate >= f.MinRate
+}
+
+func (f *StatsFilter) matchesTunnel(name string) bool {
+	if f == nil || f.Tunnel == "" {
+		return true
+	}
+	matched, err := path.Match(f.Tunnel, name)
+	return err == nil && matched
+}
+
+func (f *StatsFilter) highlight(t *TunnelStats, rate int64) bool {
+	return f != nil && f.Watch != nil && f.Watch.Matches(t, rate)
+}
@@ -0,0 +1,77 @@
+package internal
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	defaultWatchdogIdle     = 30 * time.Second
+	defaultWatchdogInterval = 10 * time.Second
+	defaultWatchdogProbes   = 3
+)
+
+var watchdog = &WatchdogConfig{idle: defaultWatchdogIdle, interval: defaultWatchdogInterval, Probes: defaultWatchdogProbes}
+
+// WatchdogConfig controls the TCP keepalive probing of local connections, which
+// detects clients that vanished without closing their connection (e.g. a LAN
+// peer powered off) so their SSH channels are released.  A client is given up
+// on once it has been idle, then failed to answer every probe.
+type WatchdogConfig struct {
+	Disabled bool   `yaml:"disabled" json:"disabled"`
+	Idle     string `yaml:"idle" json:"idle"`
+	Interval string `yaml:"interval" json:"interval"`
+	Probes   int    `yaml:"probes" json:"probes"`
+	idle     time.Duration
+	interval time.Duration
+}
+
+func (c *WatchdogConfig) Validate() bool {
+	valid := true
+	c.idle = defaultWatchdogIdle
+	if strings.TrimSpace(c.Idle) != "" {
+		d, err := time.ParseDuration(strings.TrimSpace(c.Idle))
+		if err != nil || d < time.Second {
+			Errorf("watchdog idle (%s) is invalid.  Must be a duration of at least 1s", c.Idle)
+			valid = false
+		}
+		c.idle = d
+	}
+	c.interval = defaultWatchdogInterval
+	if strings.TrimSpace(c.Interval) != "" {
+		d, err := time.ParseDuration(strings.TrimSpace(c.Interval))
+		if err != nil || d < time.Second {
+			Errorf("watchdog interval (%s) is invalid.  Must be a duration of at least 1s", c.Interval)
+			valid = false
+		}
+		c.interval = d
+	}
+	if c.Probes == 0 {
+		c.Probes = defaultWatchdogProbes
+	} else if c.Probes < 0 {
+		Errorf("watchdog probes (%d) is invalid.  Must be at least 1", c.Probes)
+		valid = false
+	}
+	watchdog = c
+	return valid
+}
+
+// watch enables keepalive probing on a local connection
+func (c *WatchdogConfig) watch(conn net.Conn) {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok || c.Disabled {
+		return
+	}
+	if err := setKeepalive(tcpConn, c.idle, c.interval, c.Probes); err != nil && verboseFlag {
+		Warnf("keepalive cannot be enabled for %s: %v", conn.RemoteAddr(), err)
+	}
+}
+
+// vanished reports whether a connection failed because the watchdog gave up on
+// the client
+func vanished(err error) bool {
+	return errors.Is(err, syscall.ETIMEDOUT)
+}
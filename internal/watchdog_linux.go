@@ -0,0 +1,41 @@
+package internal
+
+import (
+	"net"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// setKeepalive sets the idle time, probe interval and probe count directly, and
+// the user timeout so that a client which vanished while data was still being
+// sent to it is given up on in the same time, as keepalives are not sent then.
+func setKeepalive(conn *net.TCPConn, idle time.Duration, interval time.Duration, probes int) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var serr error
+	err = raw.Control(func(fd uintptr) {
+		options := []struct {
+			level int
+			name  int
+			value int
+		}{
+			{unix.SOL_SOCKET, unix.SO_KEEPALIVE, 1},
+			{unix.IPPROTO_TCP, unix.TCP_KEEPIDLE, int(idle.Seconds())},
+			{unix.IPPROTO_TCP, unix.TCP_KEEPINTVL, int(interval.Seconds())},
+			{unix.IPPROTO_TCP, unix.TCP_KEEPCNT, probes},
+			{unix.IPPROTO_TCP, unix.TCP_USER_TIMEOUT, int((idle + interval*time.Duration(probes)).Milliseconds())},
+		}
+		for _, option := range options {
+			if serr = unix.SetsockoptInt(int(fd), option.level, option.name, option.value); serr != nil {
+				return
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
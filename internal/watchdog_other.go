@@ -0,0 +1,17 @@
+//go:build !linux
+
+package internal
+
+import (
+	"net"
+	"time"
+)
+
+// setKeepalive enables keepalive probes every interval once idle.  The probe
+// count cannot be set portably, so the system default applies.
+func setKeepalive(conn *net.TCPConn, idle time.Duration, interval time.Duration, _ int) error {
+	if err := conn.SetKeepAlive(true); err != nil {
+		return err
+	}
+	return conn.SetKeepAlivePeriod(min(idle, interval))
+}
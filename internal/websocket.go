@@ -0,0 +1,246 @@
+package internal
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+const (
+	opContinuation = 0x0
+	opText         = 0x1
+	opBinary       = 0x2
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xa
+
+	// maxControlPayload is the most a control frame (close, ping or pong) may
+	// carry, per RFC 6455
+	maxControlPayload = 125
+)
+
+// validateWebsocket checks the websocket url of a host, defaulting the address,
+// which names the host to known_hosts, to the url's host on port 22.
+func (h *Host) validateWebsocket() bool {
+	u, err := url.Parse(h.Websocket)
+	if err != nil {
+		Errorf("host (%s) websocket (%s) is invalid: %v", h.Name, redactURL(h.Websocket), err)
+		return false
+	}
+	if u.Scheme != "ws" && u.Scheme != "wss" {
+		Errorf("host (%s) websocket (%s) is invalid.  Must be a ws:// or wss:// url", h.Name, redactURL(h.Websocket))
+		return false
+	}
+	if h.JumpHost != "" {
+		Errorf("host (%s) cannot use both a websocket and a jump_host", h.Name)
+		return false
+	}
+	if h.Address == nil || h.Address.IsBlank() {
+		h.Address = NewAddress(u.Hostname())
+	}
+	h.websocket = u
+	return true
+}
+
+// dialWebsocket opens a websocket to the url, over TLS for wss, and returns it as
+// a connection carrying the SSH stream in binary messages.  Credentials in the
+// url are sent as basic authentication.
+func dialWebsocket(u *url.URL, timeout time.Duration) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	address := u.Host
+	if u.Port() == "" {
+		if u.Scheme == "wss" {
+			address = net.JoinHostPort(u.Hostname(), "443")
+		} else {
+			address = net.JoinHostPort(u.Hostname(), "80")
+		}
+	}
+	dialer := &net.Dialer{}
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "wss" {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: u.Hostname()})
+		if err = tlsConn.HandshakeContext(ctx); err != nil {
+			_ = conn.Close()
+			return nil, fmt.Errorf("websocket tls handshake failed: %w", err)
+		}
+		conn = tlsConn
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+
+	nonce := make([]byte, 16)
+	_, _ = rand.Read(nonce)
+	key := base64.StdEncoding.EncodeToString(nonce)
+	request := &http.Request{
+		Method: http.MethodGet,
+		URL:    &url.URL{Path: u.Path, RawPath: u.RawPath, RawQuery: u.RawQuery},
+		Host:   u.Host,
+		Header: http.Header{
+			"Upgrade":               {"websocket"},
+			"Connection":            {"Upgrade"},
+			"Sec-Websocket-Key":     {key},
+			"Sec-Websocket-Version": {"13"},
+		},
+	}
+	if u.User != nil {
+		password, _ := u.User.Password()
+		request.SetBasicAuth(u.User.Username(), password)
+	}
+	if err = request.Write(conn); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	reader := bufio.NewReader(conn)
+	response, err := http.ReadResponse(reader, request)
+	if err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("websocket upgrade failed: %w", err)
+	}
+	_ = response.Body.Close()
+	if response.StatusCode != http.StatusSwitchingProtocols {
+		_ = conn.Close()
+		return nil, fmt.Errorf("websocket upgrade refused: %s", response.Status)
+	}
+	accept := sha1.Sum([]byte(key + websocketGUID))
+	if response.Header.Get("Sec-Websocket-Accept") != base64.StdEncoding.EncodeToString(accept[:]) {
+		_ = conn.Close()
+		return nil, fmt.Errorf("websocket upgrade failed: invalid accept key")
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return &websocketConn{Conn: conn, reader: reader}, nil
+}
+
+// websocketConn presents the payload of the messages of a websocket as a stream
+type websocketConn struct {
+	net.Conn
+	reader    *bufio.Reader
+	remaining uint64
+	writeLock sync.Mutex
+	closed    bool
+}
+
+func (c *websocketConn) Read(b []byte) (int, error) {
+	for c.remaining == 0 {
+		opcode, length, err := c.readHeader()
+		if err != nil {
+			return 0, err
+		}
+		if opcode >= opClose && length > maxControlPayload {
+			return 0, fmt.Errorf("websocket control frame of %d bytes exceeds %d", length, maxControlPayload)
+		}
+		switch opcode {
+		case opBinary, opText, opContinuation:
+			c.remaining = length
+		case opPing:
+			payload := make([]byte, length)
+			if _, err = io.ReadFull(c.reader, payload); err != nil {
+				return 0, err
+			}
+			if err = c.writeFrame(opPong, payload); err != nil {
+				return 0, err
+			}
+		case opClose:
+			_ = c.writeFrame(opClose, nil)
+			return 0, io.EOF
+		default:
+			if _, err = c.reader.Discard(int(length)); err != nil {
+				return 0, err
+			}
+		}
+	}
+	if uint64(len(b)) > c.remaining {
+		b = b[:c.remaining]
+	}
+	n, err := c.reader.Read(b)
+	c.remaining -= uint64(n)
+	return n, err
+}
+
+func (c *websocketConn) readHeader() (byte, uint64, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(c.reader, header); err != nil {
+		return 0, 0, err
+	}
+	if header[1]&0x80 != 0 {
+		return 0, 0, errors.New("websocket server sent a masked frame")
+	}
+	length := uint64(header[1] & 0x7f)
+	switch length {
+	case 126:
+		extended := make([]byte, 2)
+		if _, err := io.ReadFull(c.reader, extended); err != nil {
+			return 0, 0, err
+		}
+		length = uint64(binary.BigEndian.Uint16(extended))
+	case 127:
+		extended := make([]byte, 8)
+		if _, err := io.ReadFull(c.reader, extended); err != nil {
+			return 0, 0, err
+		}
+		length = binary.BigEndian.Uint64(extended)
+	}
+	return header[0] & 0x0f, length, nil
+}
+
+func (c *websocketConn) Write(b []byte) (int, error) {
+	if err := c.writeFrame(opBinary, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// writeFrame sends a single final frame, masked as clients must
+func (c *websocketConn) writeFrame(opcode byte, payload []byte) error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	if c.closed {
+		return net.ErrClosed
+	}
+	frame := []byte{0x80 | opcode}
+	switch length := len(payload); {
+	case length < 126:
+		frame = append(frame, 0x80|byte(length))
+	case length <= 0xffff:
+		frame = append(frame, 0x80|126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(length))
+	default:
+		frame = append(frame, 0x80|127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(length))
+	}
+	mask := make([]byte, 4)
+	_, _ = rand.Read(mask)
+	frame = append(frame, mask...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+	_, err := c.Conn.Write(frame)
+	if opcode == opClose {
+		c.closed = true
+	}
+	return err
+}
+
+func (c *websocketConn) Close() error {
+	_ = c.writeFrame(opClose, nil)
+	return c.Conn.Close()
+}
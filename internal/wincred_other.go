@@ -0,0 +1,12 @@
+//go:build !windows
+
+package internal
+
+import (
+	"fmt"
+)
+
+// wincredSecret is only available on windows
+func wincredSecret(target string) (string, string, error) {
+	return "", "", fmt.Errorf("credential (%s) cannot be read: the credential manager is only available on windows", target)
+}
@@ -0,0 +1,74 @@
+package internal
+
+import (
+	"fmt"
+	"unicode/utf16"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+const credTypeGeneric = 1
+
+var (
+	advapi32     = windows.NewLazySystemDLL("advapi32.dll")
+	procCredRead = advapi32.NewProc("CredReadW")
+	procCredFree = advapi32.NewProc("CredFree")
+)
+
+// credential mirrors the CREDENTIALW structure
+type credential struct {
+	Flags              uint32
+	Type               uint32
+	TargetName         *uint16
+	Comment            *uint16
+	LastWritten        windows.Filetime
+	CredentialBlobSize uint32
+	CredentialBlob     *byte
+	Persist            uint32
+	AttributeCount     uint32
+	Attributes         uintptr
+	TargetAlias        *uint16
+	UserName           *uint16
+}
+
+// wincredSecret reads the username and secret of a generic credential from the
+// Windows Credential Manager, as added by cmdkey /generic or the control panel.
+func wincredSecret(target string) (string, string, error) {
+	name, err := windows.UTF16PtrFromString(target)
+	if err != nil {
+		return "", "", err
+	}
+	var cred *credential
+	result, _, err := procCredRead.Call(uintptr(unsafe.Pointer(name)), credTypeGeneric, 0, uintptr(unsafe.Pointer(&cred)))
+	if result == 0 {
+		return "", "", fmt.Errorf("credential (%s) cannot be read: %w", target, err)
+	}
+	defer func() {
+		_, _, _ = procCredFree.Call(uintptr(unsafe.Pointer(cred)))
+	}()
+
+	blob := unsafe.Slice(cred.CredentialBlob, cred.CredentialBlobSize)
+	return windows.UTF16PtrToString(cred.UserName), decodeCredentialBlob(blob), nil
+}
+
+// decodeCredentialBlob returns the secret of a credential.  The credential
+// manager stores secrets as UTF-16, though other tools may store UTF-8, which
+// never contains a zero byte.
+func decodeCredentialBlob(blob []byte) string {
+	utf16Encoded := len(blob)%2 == 0
+	if utf16Encoded {
+		utf16Encoded = false
+		for _, b := range blob {
+			utf16Encoded = utf16Encoded || b == 0
+		}
+	}
+	if !utf16Encoded {
+		return string(blob)
+	}
+	units := make([]uint16, len(blob)/2)
+	for i := range units {
+		units[i] = uint16(blob[2*i]) | uint16(blob[2*i+1])<<8
+	}
+	return string(utf16.Decode(units))
+}
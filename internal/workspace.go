@@ -0,0 +1,190 @@
+package internal
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// WorkspaceFile is the name of a project's own configuration, discovered in the
+// current directory or any of its parents.
+const WorkspaceFile = ".ferret.yaml"
+
+// FindWorkspace returns the nearest workspace configuration, searching from the
+// current directory up to the root, or an empty string when there is none.
+func FindWorkspace() string {
+	dir, err := os.Getwd()
+	if err != nil {
+		return ""
+	}
+	for {
+		path := filepath.Join(dir, WorkspaceFile)
+		if fi, err := os.Stat(path); err == nil && !fi.IsDir() {
+			return path
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return ""
+		}
+		dir = parent
+	}
+}
+
+// LoadWorkspace loads the user configuration and merges the workspace
+// configuration, if any, over it.  Either may be missing, but not both.  A
+// workspace can carry hosts and commands, so it is only merged once allowed,
+// and ignored should it change since.
+func LoadWorkspace(configFile string, workspaceFile string, verbose bool) *Configuration {
+	if workspaceFile == "" {
+		return (&Configuration{}).Load(configFile, verbose)
+	}
+	verboseFlag = verbose
+	bs, err := os.ReadFile(workspaceFile)
+	if err != nil {
+		Errorf("workspace config file (%s) cannot be read: %v", workspaceFile, err)
+		return nil
+	}
+	if !workspaceAllowed(workspaceFile, bs) {
+		Warnf("workspace config file (%s) is ignored, as it has not been allowed or has changed since.  Review it, then run: ferret allow %s", workspaceFile, workspaceFile)
+		return (&Configuration{}).Load(configFile, verbose)
+	}
+	workspace := (&Configuration{}).load(workspaceFile, bs)
+	if workspace == nil {
+		return nil
+	}
+	if _, err := os.Stat(configFile); os.IsNotExist(err) {
+		if verbose {
+			Infof("Using workspace config file: %s", workspaceFile)
+		}
+		return workspace
+	}
+	config := (&Configuration{}).Load(configFile, verbose)
+	if config == nil {
+		return nil
+	}
+	if verbose {
+		Infof("Using workspace config file: %s", workspaceFile)
+	}
+	config.merge(workspace)
+	return config
+}
+
+// allowedFile records the workspaces allowed, a line each of the sha256 of the
+// workspace and its absolute path, as sha256sum prints them
+func allowedFile() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("home directory cannot be determined: %w", err)
+	}
+	return filepath.Join(home, ".ferret", "allowed"), nil
+}
+
+// workspaceAllowed reports whether the workspace, as read, has been allowed
+func workspaceAllowed(workspaceFile string, bs []byte) bool {
+	path, err := filepath.Abs(workspaceFile)
+	if err != nil {
+		return false
+	}
+	file, err := allowedFile()
+	if err != nil {
+		return false
+	}
+	allowed, err := os.ReadFile(file)
+	if err != nil {
+		return false
+	}
+	entry := workspaceEntry(path, bs)
+	for _, line := range strings.Split(string(allowed), "\n") {
+		if line == entry {
+			return true
+		}
+	}
+	return false
+}
+
+func workspaceEntry(path string, bs []byte) string {
+	return fmt.Sprintf("%x  %s", sha256.Sum256(bs), path)
+}
+
+// AllowWorkspace records the workspace, as it is now, as allowed to be merged,
+// replacing any earlier entry for it
+func AllowWorkspace(workspaceFile string) bool {
+	path, err := filepath.Abs(workspaceFile)
+	if err != nil {
+		Errorf("workspace config file (%s) cannot be found: %v", workspaceFile, err)
+		return false
+	}
+	bs, err := os.ReadFile(path)
+	if err != nil {
+		Errorf("workspace config file (%s) cannot be read: %v", path, err)
+		return false
+	}
+	file, err := allowedFile()
+	if err != nil {
+		Errorf("workspace config file (%s) cannot be allowed: %v", path, err)
+		return false
+	}
+	var lines []string
+	if allowed, err := os.ReadFile(file); err == nil {
+		for _, line := range strings.Split(string(allowed), "\n") {
+			if _, entryPath, ok := strings.Cut(line, "  "); ok && entryPath != path {
+				lines = append(lines, line)
+			}
+		}
+	} else if !os.IsNotExist(err) {
+		Errorf("allowed workspaces file (%s) cannot be read: %v", file, err)
+		return false
+	}
+	lines = append(lines, workspaceEntry(path, bs))
+	if err = os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+		Errorf("allowed workspaces file (%s) cannot be written: %v", file, err)
+		return false
+	}
+	if err = os.WriteFile(file, []byte(strings.Join(lines, "\n")+"\n"), 0600); err != nil {
+		Errorf("allowed workspaces file (%s) cannot be written: %v", file, err)
+		return false
+	}
+	Infof("workspace config file (%s) allowed", path)
+	return true
+}
+
+// merge overlays a workspace configuration.  Workspace hosts replace user hosts
+// of the same name, and when the workspace defines tunnels (or discovery), only
+// they are run.
+func (c *Configuration) merge(w *Configuration) {
+	c.workspace = w.file
+	c.Hardened = c.Hardened || w.Hardened
+	if w.Stats != nil {
+		c.Stats = w.Stats
+	}
+	if w.Diagnostics != nil {
+		c.Diagnostics = w.Diagnostics
+	}
+	if w.Log != nil {
+		c.Log = w.Log
+	}
+	if w.Watchdog != nil {
+		c.Watchdog = w.Watchdog
+	}
+	for _, host := range w.Hosts {
+		replaced := false
+		for i, existing := range c.Hosts {
+			if strings.TrimSpace(existing.Name) == strings.TrimSpace(host.Name) {
+				c.Hosts[i] = host
+				replaced = true
+				break
+			}
+		}
+		if !replaced {
+			c.Hosts = append(c.Hosts, host)
+		}
+	}
+	if len(w.Tunnels) > 0 {
+		c.Tunnels = w.Tunnels
+	}
+	if len(w.Discovery) > 0 {
+		c.Discovery = w.Discovery
+	}
+}
@@ -2,11 +2,15 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"os"
+	"os/exec"
 	"os/signal"
 	"os/user"
+	"path/filepath"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -22,6 +26,36 @@ const (
 	GoosWindows = "windows"
 )
 
+// Commands
+const (
+	CommandRun       = "run"
+	CommandConns     = "conns"
+	CommandReconnect = "reconnect"
+	CommandJournal   = "journal"
+	CommandConfig    = "config"
+	CommandBastion   = "fake-bastion"
+	CommandDump      = "dump"
+	CommandEnv       = "env"
+	CommandStats     = "stats"
+	CommandRelay     = "relay"
+	CommandURL       = "url"
+	CommandNC        = "nc"
+	CommandFixPerms  = "fixperms"
+	CommandClone     = "clone"
+	CommandDrop      = "drop"
+	CommandUpgrade   = "upgrade"
+	CommandBanner    = "banner"
+	CommandAllow     = "allow"
+)
+
+// Config sub-commands
+const (
+	ConfigSynth  = "synth"
+	ConfigSet    = "set"
+	ConfigExport = "export"
+	ConfigPush   = "push"
+)
+
 // Version information, populated by the build process
 var (
 	Version     string // this variable is defined in Makefile
@@ -32,14 +66,52 @@ var (
 
 // Default and operating variables
 var (
-	helpFlag    bool
-	versionFlag bool
-	verboseFlag bool
-	configFile  string
-	username    string
-	statsPort   int
-	config      *internal.Configuration
-	cancel      func()
+	helpFlag        bool
+	versionFlag     bool
+	verboseFlag     bool
+	partialFlag     bool
+	followFlag      bool
+	utcFlag         bool
+	interactiveFlag bool
+	copyFlag        bool
+	ephemeralFlag   bool
+	canaryFlag      bool
+	prewarmFlag     bool
+	strictFlag      bool
+	secretsFlag     bool
+	eventsFlag      bool
+	noWorkspaceFlag bool
+	handoffFlag     bool
+	stdioFlag       bool
+	workspaceFile   string
+	upgradeBinary   string
+	emitEnv         string
+	execArgs        []string
+	shutdownTimeout time.Duration
+	debugPort       int
+	terminating     sync.Once
+	keyHolder       bool
+	command         string
+	commandArgs     []string
+	controlPath     string
+	timestamps      string
+	statsOutput     string
+	statsFields     []string
+	since           time.Time
+	until           time.Time
+	configFile      string
+	policyFile      string
+	username        string
+	statsPort       int
+	statsFilter     = &internal.StatsFilter{}
+	historySize     int
+	synthHosts      int
+	synthTunnels    int
+	synthDir        string
+	bastionPort     int
+	bastionKey      string
+	config          *internal.Configuration
+	cancel          func()
 )
 
 func main() {
@@ -47,40 +119,431 @@ func main() {
 	ctx, cancel = context.WithCancel(context.Background())
 	defaultValues()
 	parseCommandLine()
+	if keyHolder {
+		internal.ServeKeyHolder(configFile, workspaceFile)
+		os.Exit(0)
+	}
+	switch command {
+	case CommandConns:
+		monitorShutdown()
+		showConnections(ctx)
+	case CommandReconnect:
+		reconnect()
+	case CommandBanner:
+		banner()
+	case CommandDump:
+		dump()
+	case CommandEnv:
+		env()
+	case CommandURL:
+		tunnelURL()
+	case CommandClone:
+		cloneTunnel()
+	case CommandDrop:
+		dropTunnel()
+	case CommandUpgrade:
+		upgradeFerret()
+	case CommandStats:
+		monitorShutdown()
+		showStats(ctx)
+	case CommandJournal:
+		showJournal()
+	case CommandConfig:
+		configCommand()
+	case CommandBastion:
+		monitorShutdown()
+		fakeBastion(ctx)
+	case CommandRelay:
+		monitorShutdown()
+		relay(ctx)
+	case CommandNC:
+		monitorShutdown()
+		netcat(ctx)
+	case CommandFixPerms:
+		fixPermissions()
+	case CommandAllow:
+		allowWorkspace()
+	default:
+		run(ctx)
+	}
+}
+
+func run(ctx context.Context) {
+	if stdioFlag && (eventsFlag || handoffFlag) {
+		internal.Errorf("--stdio-control cannot be used with --events-stdout or --handoff")
+		terminate(1)
+	}
+	if stdioFlag {
+		internal.SuperviseOverStdio()
+	} else if eventsFlag {
+		internal.EventsToStdout()
+	}
+	if handoffFlag && (interactiveFlag || len(execArgs) > 0) {
+		internal.Errorf("--handoff cannot be used with --interactive or a command to run")
+		terminate(1)
+	}
 	loadConfiguration()
+	if !config.Log.StartLogging() {
+		terminate(1)
+	}
+	if handoffFlag && !internal.BeginHandoff(controlPath) {
+		terminate(1)
+	}
 	monitorShutdown()
+	internal.SetDumpDirectory(filepath.Dir(configFile))
+	monitorDump()
+	internal.UpgradeOnSignal()
 	stats := internal.NewStats(statsPort)
+	stats.SetFilter(statsFilter)
+	stats.SetHistorySize(historySize)
+	stats.SetOptional(len(execArgs) > 0)
 	if ok := stats.StartStatsTunnel(ctx); ok {
+		if !config.Journal.StartJournal() {
+			terminate(1)
+		}
+		if debugPort != 0 && !internal.StartDebug(ctx, debugPort) {
+			terminate(1)
+		}
+		if stdioFlag {
+			internal.ServeSupervisor(ctx, func() {
+				terminate(0)
+			})
+		} else if !handoffFlag {
+			// Taken over from the ferret using it once the tunnels are listening
+			internal.StartControl(ctx, controlPath)
+		}
+		config.Diagnostics.StartDiagnostics(ctx)
+		if emitEnv != "" {
+			internal.EmitEnv(emitEnv)
+		}
+		go internal.MonitorNetwork(ctx)
 		startTunnels(ctx, stats)
 	}
 	if verboseFlag {
-		fmt.Printf(" Status - All tunnels closed.  Stopped\n")
+		internal.Infof("All tunnels closed.  Stopped")
+	}
+	terminate(0)
+}
+
+// runCommand runs the wrapped command once every tunnel is listening, with the
+// tunnel entrances in its environment, then stops ferret with its exit code.
+func runCommand() {
+	exitCode := 0
+	cmd := exec.Command(execArgs[0], execArgs[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.Env = append(os.Environ(), internal.TunnelEnvironment()...)
+	if verboseFlag {
+		internal.Infof("Running %s", strings.Join(execArgs, " "))
+	}
+	if err := cmd.Run(); err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			exitCode = exitErr.ExitCode()
+		} else {
+			internal.Errorf("command (%s) cannot be run: %v", execArgs[0], err)
+			exitCode = 127
+		}
+	}
+	cancel()
+	terminate(exitCode)
+}
+
+func dump() {
+	output, err := internal.Control(controlPath, CommandDump)
+	fmt.Print(output)
+	if err != nil {
+		internal.Errorf("dump failed: %v", err)
+		terminate(1)
+	}
+}
+
+func env() {
+	output, err := internal.Control(controlPath, CommandEnv)
+	fmt.Print(output)
+	if err != nil {
+		internal.Errorf("env failed: %v", err)
+		terminate(1)
+	}
+}
+
+func showJournal() {
+	config = config.Load(configFile, verboseFlag)
+	if config == nil || !config.Journal.Validate(configFile) {
+		terminate(1)
+	}
+	// Events of a renamed tunnel are found through its id
+	ids := internal.TunnelIDs(config.Tunnels, statsFilter)
+	if !config.Journal.ShowJournal(since, until, statsFilter, ids) {
+		terminate(1)
+	}
+}
+
+func tunnelURL() {
+	output, err := internal.Control(controlPath, CommandURL, commandArgs...)
+	fmt.Print(output)
+	if err != nil {
+		internal.Errorf("url failed: %v", err)
+		terminate(1)
+	}
+	if copyFlag {
+		if err = internal.CopyToClipboard(strings.TrimSpace(output)); err != nil {
+			internal.Errorf("url cannot be copied to the clipboard: %v", err)
+			terminate(1)
+		}
+	}
+}
+
+func cloneTunnel() {
+	output, err := internal.Control(controlPath, CommandClone, commandArgs...)
+	fmt.Print(output)
+	if err != nil {
+		internal.Errorf("clone failed: %v", err)
+		terminate(1)
+	}
+}
+
+func dropTunnel() {
+	output, err := internal.Control(controlPath, CommandDrop, commandArgs...)
+	fmt.Print(output)
+	if err != nil {
+		internal.Errorf("drop failed: %v", err)
+		terminate(1)
+	}
+}
+
+// upgradeFerret has the running ferret start the binary given, or its own again,
+// to take over from it
+func upgradeFerret() {
+	var args []string
+	if upgradeBinary != "" {
+		binary, err := filepath.Abs(upgradeBinary)
+		if err != nil {
+			internal.Errorf("binary (%s) cannot be found: %v", upgradeBinary, err)
+			terminate(1)
+		}
+		args = append(args, binary)
+	}
+	output, err := internal.Control(controlPath, CommandUpgrade, args...)
+	fmt.Print(output)
+	if err != nil {
+		internal.Errorf("upgrade failed: %v", err)
+		terminate(1)
+	}
+}
+
+func banner() {
+	output, err := internal.Control(controlPath, CommandBanner, commandArgs...)
+	fmt.Print(output)
+	if err != nil {
+		internal.Errorf("banner failed: %v", err)
+		terminate(1)
+	}
+}
+
+func reconnect() {
+	output, err := internal.Control(controlPath, CommandReconnect, commandArgs...)
+	fmt.Print(output)
+	if err != nil {
+		internal.Errorf("reconnect failed: %v", err)
+		terminate(1)
+	}
+}
+
+func configCommand() {
+	switch {
+	case len(commandArgs) == 1 && commandArgs[0] == ConfigSynth:
+		configFile, ok := internal.SynthConfig(synthDir, synthHosts, synthTunnels, bastionPort)
+		if !ok {
+			terminate(1)
+		}
+		fmt.Println(configFile)
+	case len(commandArgs) == 3 && commandArgs[0] == ConfigSet:
+		document, err := internal.LoadConfigDocument(configFile)
+		if err == nil {
+			err = document.Set(commandArgs[1], commandArgs[2])
+		}
+		if err == nil {
+			err = document.Save()
+		}
+		if err != nil {
+			internal.Errorf("config file (%s) cannot be changed: %v", configFile, err)
+			terminate(1)
+		}
+	case len(commandArgs) == 1 && commandArgs[0] == ConfigExport:
+		var args []string
+		if ephemeralFlag {
+			args = append(args, "ephemeral")
+		}
+		output, err := internal.Control(controlPath, ConfigExport, args...)
+		fmt.Print(output)
+		if err != nil {
+			internal.Errorf("config export failed: %v", err)
+			terminate(1)
+		}
+	case len(commandArgs) == 2 && commandArgs[0] == ConfigPush:
+		bs, err := os.ReadFile(commandArgs[1])
+		if err != nil {
+			internal.Errorf("config (%s) cannot be read: %v", commandArgs[1], err)
+			terminate(1)
+		}
+		args := []string{string(bs)}
+		if canaryFlag {
+			args = append(args, "canary")
+		}
+		output, err := internal.Control(controlPath, ConfigPush, args...)
+		fmt.Print(output)
+		if err != nil {
+			internal.Errorf("config push failed: %v", err)
+			terminate(1)
+		}
+	default:
+		internal.Errorf("config requires a sub-command: %s, %s, %s <file>, or %s <path> <value>", ConfigSynth, ConfigExport, ConfigPush, ConfigSet)
+		terminate(1)
+	}
+}
+
+// netcat connects stdin and stdout to an address through a host, as an OpenSSH
+// ProxyCommand does
+func netcat(ctx context.Context) {
+	// Stdout carries the connection, so all messages go to stderr
+	out := os.Stdout
+	os.Stdout = os.Stderr
+	if !verboseFlag {
+		internal.SetConsoleLevel(internal.LevelWarn)
+	}
+	if len(commandArgs) != 2 {
+		internal.Errorf("nc requires a host and an address, e.g. nc bastion db.internal:5432")
+		terminate(1)
+	}
+	if !noWorkspaceFlag && workspaceFile == "" {
+		workspaceFile = internal.FindWorkspace()
+	}
+	config = internal.LoadWorkspace(configFile, workspaceFile, verboseFlag)
+	if config == nil {
+		terminate(1)
+	}
+	if config.Hardened && !internal.StartKeyHolder(configFile, workspaceFile) {
+		terminate(1)
+	}
+	if !internal.LoadPolicy(policyFile) {
+		terminate(1)
+	}
+	if !config.Stdio(ctx, commandArgs[0], commandArgs[1], username, os.Stdin, out) {
+		terminate(1)
+	}
+	terminate(0)
+}
+
+func fixPermissions() {
+	if !noWorkspaceFlag && workspaceFile == "" {
+		workspaceFile = internal.FindWorkspace()
+	}
+	config = internal.LoadWorkspace(configFile, workspaceFile, verboseFlag)
+	if config == nil || !internal.FixPermissions(config, configFile, workspaceFile) {
+		terminate(1)
+	}
+}
+
+// allowWorkspace allows the workspace config given, or else the nearest, to be
+// merged over the config file
+func allowWorkspace() {
+	if len(commandArgs) > 1 {
+		internal.Errorf("allow takes a single workspace config file")
+		terminate(1)
+	}
+	if len(commandArgs) == 1 {
+		workspaceFile = commandArgs[0]
+	} else if workspaceFile == "" {
+		workspaceFile = internal.FindWorkspace()
+	}
+	if workspaceFile == "" {
+		internal.Errorf("no %s found in the current or parent directories", internal.WorkspaceFile)
+		terminate(1)
+	}
+	if !internal.AllowWorkspace(workspaceFile) {
+		terminate(1)
+	}
+}
+
+func fakeBastion(ctx context.Context) {
+	if !internal.FakeBastion(ctx, bastionPort, bastionKey) {
+		terminate(1)
+	}
+}
+
+func relay(ctx context.Context) {
+	if !internal.ServeRelay(ctx, bastionPort, bastionKey) {
+		terminate(1)
+	}
+}
+
+func showConnections(ctx context.Context) {
+	stats := internal.NewStats(statsPort)
+	stats.SetFilter(statsFilter)
+	if !stats.ShowConnections(ctx, followFlag) {
+		terminate(1)
+	}
+}
+
+func showStats(ctx context.Context) {
+	stats := internal.NewStats(statsPort)
+	stats.SetFilter(statsFilter)
+	stats.SetHistorySize(historySize)
+	if !stats.SetOutput(statsOutput, statsFields) {
+		terminate(1)
+	}
+	if !stats.ShowStats(ctx, controlPath, followFlag) {
+		terminate(1)
 	}
 }
 
 func defaultValues() {
 	statsPort = 2663
+	historySize = 20
+	shutdownTimeout = 5 * time.Second
+	synthHosts = 1
+	synthTunnels = 1
+	bastionPort = 2222
+	timestamps = internal.DefaultTimestampFormat
+	statsOutput = internal.StatsOutputTable
 	currentUser, err := user.Current()
 	if err != nil {
-		fmt.Printf("  Error - failed to lookup current user: %v\n", err)
+		internal.Errorf("failed to lookup current user: %v", err)
 		terminate(1)
 	}
 	username = currentUser.Username
 	switch runtime.GOOS {
 	case GoosLinux:
 		configFile = fmt.Sprintf("/home/%s/.ferret/config.yaml", currentUser.Username)
+		controlPath = fmt.Sprintf("/home/%s/.ferret/ferret.sock", currentUser.Username)
+		policyFile = "/etc/ferret/policy.yaml"
 	case GoosDarwin:
 		configFile = fmt.Sprintf("/Users/%s/.ferret/config.yaml", currentUser.Username)
+		controlPath = fmt.Sprintf("/Users/%s/.ferret/ferret.sock", currentUser.Username)
+		policyFile = "/etc/ferret/policy.yaml"
 	case GoosWindows:
 		configFile = fmt.Sprintf("C:\\Users\\%s\\.ferret\\config.yaml", currentUser.Username)
+		controlPath = fmt.Sprintf("C:\\Users\\%s\\.ferret\\ferret.sock", currentUser.Username)
+		policyFile = "C:\\ProgramData\\ferret\\policy.yaml"
 	default:
-		fmt.Printf("  Error - unsupported OS type: %s\n", runtime.GOOS)
+		internal.Errorf("unsupported OS type: %s", runtime.GOOS)
 		terminate(1)
 	}
 }
 
 func parseCommandLine() {
-	for index := 1; index < len(os.Args); index++ {
+	start := 1
+	if len(os.Args) > 1 && !strings.HasPrefix(os.Args[1], "-") {
+		command = os.Args[1]
+		start = 2
+		switch command {
+		case CommandRun, CommandConns, CommandReconnect, CommandJournal, CommandConfig, CommandBastion, CommandDump, CommandEnv, CommandStats, CommandRelay, CommandURL, CommandNC, CommandFixPerms, CommandClone, CommandDrop, CommandUpgrade, CommandBanner, CommandAllow:
+		default:
+			internal.Errorf("unknown command (%s)", command)
+			helpFlag = true
+		}
+	}
+	for index := start; index < len(os.Args); index++ {
 		switch os.Args[index] {
 		case "-h", "--help":
 			helpFlag = true
@@ -88,23 +551,144 @@ func parseCommandLine() {
 			versionFlag = true
 		case "-v", "--verbose":
 			verboseFlag = true
+		case internal.KeyHolderFlag:
+			keyHolder = true
 		case "-p", "--stats-port":
 			index++
 			statsPort = parameterInt(index)
 		case "-c", "--config":
 			index++
 			configFile = parameter(index)
+		case "-t", "--tunnel":
+			index++
+			statsFilter.Tunnel = parameter(index)
+		case "-r", "--min-rate":
+			index++
+			statsFilter.MinRate = parameterByteCount(index)
+		case "-w", "--watch":
+			index++
+			watch, err := internal.ParseWatchExpression(parameter(index))
+			if err != nil {
+				internal.Errorf("paramreter %s %v", os.Args[index-1], err)
+				terminate(1)
+			}
+			statsFilter.Watch = watch
+		case "--control":
+			index++
+			controlPath = parameter(index)
+		case "--since":
+			index++
+			since = parameterTime(index)
+		case "--until":
+			index++
+			until = parameterTime(index)
+		case "--partial":
+			partialFlag = true
+		case "-i", "--interactive":
+			interactiveFlag = true
+		case "--copy":
+			copyFlag = true
+		case "--ephemeral":
+			ephemeralFlag = true
+		case "--canary":
+			canaryFlag = true
+		case "--prewarm":
+			prewarmFlag = true
+		case "--handoff":
+			handoffFlag = true
+		case "--exec":
+			index++
+			upgradeBinary = parameter(index)
+		case "--strict":
+			strictFlag = true
+		case "--show-secrets":
+			secretsFlag = true
+		case "--events-stdout":
+			eventsFlag = true
+		case "--stdio-control":
+			stdioFlag = true
+		case "--workspace":
+			index++
+			workspaceFile = parameter(index)
+		case "--no-workspace":
+			noWorkspaceFlag = true
+		case "--":
+			execArgs = os.Args[index+1:]
+			index = len(os.Args)
+			if len(execArgs) == 0 || (command != "" && command != CommandRun) {
+				internal.Errorf("-- must be followed by a command to run, and only with the run command")
+				helpFlag = true
+			}
+		case "--shutdown-timeout":
+			index++
+			timeout, err := time.ParseDuration(parameter(index))
+			if err != nil || timeout < 0 {
+				internal.Errorf("paramreter %s expected a duration (e.g. 10s)", os.Args[index-1])
+				terminate(1)
+			}
+			shutdownTimeout = timeout
+		case "--debug-port":
+			index++
+			debugPort = parameterInt(index)
+			if debugPort <= 0 || debugPort > 65535 {
+				internal.Errorf("paramreter %s must be a port number", os.Args[index-1])
+				terminate(1)
+			}
+		case "--emit-env":
+			index++
+			emitEnv = parameter(index)
+		case "-f", "--follow":
+			followFlag = true
+		case "--timestamps":
+			index++
+			timestamps = parameter(index)
+		case "--utc":
+			utcFlag = true
+		case "-o", "--output":
+			index++
+			statsOutput = parameter(index)
+		case "--fields":
+			index++
+			statsFields = strings.Split(parameter(index), ",")
+		case "--hosts":
+			index++
+			synthHosts = parameterInt(index)
+		case "--tunnels":
+			index++
+			synthTunnels = parameterInt(index)
+		case "--port":
+			index++
+			bastionPort = parameterInt(index)
+		case "--dir":
+			index++
+			synthDir = parameter(index)
+		case "--key":
+			index++
+			bastionKey = parameter(index)
+		case "-H", "--history":
+			index++
+			historySize = parameterInt(index)
+			if historySize < 0 {
+				internal.Errorf("paramreter %s cannot be negative", os.Args[index-1])
+				terminate(1)
+			}
 
 		default:
 			if strings.HasPrefix(os.Args[index], "-") {
-				fmt.Printf("  Error - unknown paramters (%s) at position %d\n", os.Args[index], index)
+				internal.Errorf("unknown paramters (%s) at position %d", os.Args[index], index)
+			} else if command == CommandReconnect || command == CommandBanner || command == CommandAllow || command == CommandConfig || command == CommandURL || command == CommandNC || command == CommandClone || command == CommandDrop {
+				commandArgs = append(commandArgs, os.Args[index])
+				continue
 			} else {
-				fmt.Printf("  Error - unexpected argument (%s) as position %d\n", os.Args[index], index)
+				internal.Errorf("unexpected argument (%s) as position %d", os.Args[index], index)
 			}
 			helpFlag = true
 		}
 	}
 
+	internal.SetTimestamps(timestamps, utcFlag)
+	internal.SetStrictPermissions(strictFlag)
+	internal.SetShowSecrets(secretsFlag)
 	if helpFlag {
 		help()
 	}
@@ -117,7 +701,7 @@ func parameter(index int) string {
 	if index < len(os.Args) && !strings.HasPrefix(os.Args[index], "-") {
 		return os.Args[index]
 	}
-	fmt.Printf("  Error - paramreter %s requires a value\n", os.Args[index-1])
+	internal.Errorf("paramreter %s requires a value", os.Args[index-1])
 	terminate(1)
 	return ""
 }
@@ -126,22 +710,54 @@ func parameterInt(index int) int {
 	value := parameter(index)
 	i, err := strconv.ParseInt(value, 10, 32)
 	if err != nil {
-		fmt.Printf("  Error - paramreter %s expected an int value\n", os.Args[index-1])
+		internal.Errorf("paramreter %s expected an int value", os.Args[index-1])
 		terminate(1)
 	}
 	return int(i)
 }
 
+func parameterByteCount(index int) int64 {
+	value := parameter(index)
+	i, err := internal.ParseByteCount(value)
+	if err != nil {
+		internal.Errorf("paramreter %s expected a byte count (e.g. 512K): %v", os.Args[index-1], err)
+		terminate(1)
+	}
+	return i
+}
+
+func parameterTime(index int) time.Time {
+	value := parameter(index)
+	t, err := internal.ParseJournalTime(value)
+	if err != nil {
+		internal.Errorf("paramreter %s %v", os.Args[index-1], err)
+		terminate(1)
+	}
+	return t
+}
+
 func loadConfiguration() {
-	config = config.Load(configFile, verboseFlag)
+	if !noWorkspaceFlag && workspaceFile == "" {
+		workspaceFile = internal.FindWorkspace()
+	}
+	config = internal.LoadWorkspace(configFile, workspaceFile, verboseFlag)
 	if config == nil {
 		terminate(1)
 	}
 	if verboseFlag {
-		fmt.Printf("  Info  - Using config file: %s\n", configFile)
+		internal.Infof("Using config file: %s", configFile)
 	}
 
-	if !config.Validate(username) {
+	if interactiveFlag && !config.PickTunnels() {
+		terminate(1)
+	}
+	if config.Hardened && !internal.StartKeyHolder(configFile, workspaceFile) {
+		terminate(1)
+	}
+	if !internal.LoadPolicy(policyFile) {
+		terminate(1)
+	}
+	if !config.Validate(username, partialFlag) {
 		terminate(1)
 	}
 }
@@ -150,47 +766,160 @@ func monitorShutdown() {
 	shutdown := make(chan os.Signal, 1)
 	signal.Notify(shutdown, syscall.SIGINT, syscall.SIGTERM)
 	go func() {
-		<-shutdown
-		cancel()
-		fmt.Printf("%s terminated\n", os.Args[0])
-		terminate(1)
+		select {
+		case <-shutdown:
+			cancel()
+			internal.Infof("%s terminated", os.Args[0])
+			terminate(1)
+		case <-internal.HandedOff():
+			terminate(0)
+		}
+	}()
+}
+
+// monitorDump writes a dump, rather than exiting, on SIGQUIT
+func monitorDump() {
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGQUIT)
+	go func() {
+		for range quit {
+			if path, err := internal.WriteDump(); err != nil {
+				internal.Errorf("dump cannot be written: %v", err)
+			} else {
+				internal.Infof("dump written to %s", path)
+			}
+		}
 	}()
 }
 
 func startTunnels(ctx context.Context, stats *internal.StatsManager) {
-	wg := sync.WaitGroup{}
+	for _, host := range internal.Hosts {
+		stats.AddHostStats(host.Stats())
+	}
+	tunnels := make([]*internal.Tunnel, 0, len(internal.Tunnels))
 	for _, tunnel := range internal.Tunnels {
-		wg.Add(1)
 		tunnel.Init(stats.UpdateChannel())
 		stats.AddTunnelStats(tunnel.Stats())
+		tunnels = append(tunnels, tunnel)
+	}
+	sort.Slice(tunnels, func(i, j int) bool {
+		return tunnels[i].Name < tunnels[j].Name
+	})
+	listening, ok := internal.ListenAll(tunnels)
+	if !ok || !config.OpenRoutes() || !config.DropPrivileges() {
+		terminate(1)
+	}
+	if handoffFlag {
+		if !internal.CompleteHandoff(controlPath) {
+			terminate(1)
+		}
+		internal.StartControl(ctx, controlPath)
+	}
+	if len(execArgs) > 0 {
+		go runCommand()
+	}
+
+	wg := sync.WaitGroup{}
+	for _, tunnel := range listening {
+		wg.Add(1)
 		go func(t *internal.Tunnel) {
-			defer func() {
-				wg.Done()
-			}()
-			listenerChan := make(chan bool)
-			go monitorForFailureToConnect(listenerChan)
-			t.Open(ctx, listenerChan)
+			defer wg.Done()
+			t.Serve(ctx)
 		}(tunnel)
 	}
-	wg.Wait()
-}
-
-func monitorForFailureToConnect(listener <-chan bool) {
-	// listen to the successful starting of a channel, and call terminate
-	// if any of them fail to start up.
-	if !<-listener {
-		terminate(1)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		config.ServeRoutes(ctx)
+	}()
+	for _, discovery := range config.Discovery {
+		wg.Add(1)
+		go func(d *internal.DiscoveryConfig) {
+			defer wg.Done()
+			d.StartDiscovery(ctx, stats)
+		}(discovery)
 	}
+	config.AcceptPushes(&wg)
+	internal.PrewarmHosts(prewarmFlag)
+	go internal.ActivateHosts(ctx)
+	internal.OpenInteractiveHosts()
+	wg.Wait()
 }
 
 func help() {
 	fmt.Printf("Automatic tunneling on demand\n")
-	fmt.Printf("Usage:\n")
+	fmt.Printf("Usage: %s [command] [options]\n", os.Args[0])
+	fmt.Printf("Commands:\n")
+	fmt.Printf("  run               Start the configured tunnels.  This is the default\n")
+	fmt.Printf("  run -- <command>  Start the tunnels, run the command with the tunnel entrances in its environment, then stop\n")
+	fmt.Printf("  conns             List the connections forwarded by a running ferret\n")
+	fmt.Printf("  stats             Show the stats of a running ferret by its control socket, scoped to your own tunnels when a tenant\n")
+	fmt.Printf("  reconnect [host]  Rebuild the SSH connections of a running ferret, or just the named hosts\n")
+	fmt.Printf("  banner [host]     Show the last login banner of each host of a running ferret, or just the named hosts\n")
+	fmt.Printf("  journal           Show the journal of recorded connection events\n")
+	fmt.Printf("  env               Print the tunnel entrances of a running ferret as shell exports, e.g. FERRET_DB_ADDR\n")
+	fmt.Printf("  url <tunnel>      Print the url, or else the entrance, of a tunnel of a running ferret.  --copy copies it to the clipboard\n")
+	fmt.Printf("  clone <tunnel> <name> [local=<address>] [forward=<address>]  Open a copy of a tunnel of a running ferret until dropped.  Default local port is picked by the system\n")
+	fmt.Printf("  drop <name>       Close a tunnel made by clone\n")
+	fmt.Printf("  upgrade           Restart a running ferret from its binary, or that of --exec, without closing its entrances.  Open connections drain in the old ferret.  As does SIGUSR2\n")
+	fmt.Printf("  nc <host> <address>  Connect stdin and stdout to an address through a host, e.g. as an OpenSSH ProxyCommand\n")
+	fmt.Printf("  allow [file]      Allow the nearest .ferret.yaml, or the one given, to be merged over the config file, as it now is.  One not allowed, or changed since, is ignored\n")
+	fmt.Printf("  fixperms          Remove the access of others to the config and identity files\n")
+	fmt.Printf("  dump              Write the goroutines, hosts and connections of a running ferret to a file.  As does SIGQUIT\n")
+	fmt.Printf("  config set <path> <value>  Change a value in the config file, e.g. tunnels.db.local, keeping its comments\n")
+	fmt.Printf("  config export     Print the tunnels of a running ferret as config.  --ephemeral includes those made by clone\n")
+	fmt.Printf("  config push <file>  Replace the config file of a running ferret, applying its changes to the tunnels without a restart, or none should any fail.  Only tunnels may differ from the running config, as hosts and other sections require a restart.  --canary first tries the new entrances and forward addresses\n")
+	fmt.Printf("  config synth      Generate a throwaway config, keys and known_hosts for a local test SSH server\n")
+	fmt.Printf("  fake-bastion      Run a minimal local SSH server, supporting direct-tcpip only, for testing\n")
+	fmt.Printf("  relay             Experimental.  Relay tunnel connections over QUIC for hosts with a relay, given FERRET_RELAY_TOKEN\n")
+	fmt.Printf("Options:\n")
 	fmt.Printf("  -h, --help        Display this message.\n")
 	fmt.Printf("  -c, --config      Specify the tunnel configuration file\n")
+	fmt.Printf("      --workspace   Project config merged over the config file, once allowed.  Default is the nearest .ferret.yaml\n")
+	fmt.Printf("      --no-workspace Ignore any .ferret.yaml in the current or parent directories\n")
 	fmt.Printf("  -p, --stats-port  Ferret stats port.  Default is 2663\n")
+	fmt.Printf("      --control     Ferret control socket.  Default is ~/.ferret/ferret.sock\n")
 	fmt.Printf("  -v, --verbose     Verbose mode.  Prints progress debug messages.\n")
+	fmt.Printf("      --partial     Skip tunnels and hosts that fail to validate or start, rather than terminating\n")
+	fmt.Printf("      --shutdown-timeout  Time open connections have to finish when stopping.  Default is 5s, 0 force closes\n")
+	fmt.Printf("      --debug-port  Serve Go profiling endpoints (/debug/pprof/) on this localhost port\n")
+	fmt.Printf("      --events-stdout  Write every event to stdout as a line of JSON, and all messages to stderr\n")
+	fmt.Printf("      --stdio-control  Read control commands from stdin and write their answers, the stats and every event to stdout, each a line of JSON, rather than open the control socket and stats port.  For a supervisor such as a GUI.  Stops once stdin closes\n")
+	fmt.Printf("      --emit-env    Keep a file (e.g. .envrc, .env or entrances.json) of the tunnel entrances up to date\n")
+	fmt.Printf("      --strict      Refuse config and identity files that others may access, rather than warn\n")
+	fmt.Printf("      --show-secrets  Show passwords, passphrases and tokens in logs and payloads, rather than redact them\n")
+	fmt.Printf("      --prewarm     Connect to every host in use at startup, in parallel, rather than on first use\n")
+	fmt.Printf("      --handoff     Take over from the ferret running on the control socket without refusing connections, e.g. after an upgrade.  TCP entrances only\n")
+	fmt.Printf("      --exec        Binary the upgrade command starts.  Default is the binary of the running ferret\n")
+	fmt.Printf("  -i, --interactive Choose which tunnels to start from a list grouped by label.  The choice is remembered\n")
+	fmt.Printf("      --timestamps  Timestamp layout (Go layout, rfc3339, iso, time or none).  Default is \"2006-01-02 15:04:05.000\"\n")
+	fmt.Printf("      --utc         Timestamp in UTC rather than local time\n")
 	fmt.Printf("  -V, --version     Display version information.\n")
+	fmt.Printf("Stats client mode:\n")
+	fmt.Printf("  -t, --tunnel      Only display tunnels whose name matches the glob\n")
+	fmt.Printf("  -r, --min-rate    Only display tunnels transferring at least this many bytes/sec (e.g. 64K)\n")
+	fmt.Printf("  -w, --watch       Highlight tunnels matching an expression (e.g. rate>1M, actv>=5, rtt>200, stall>0)\n")
+	fmt.Printf("  -H, --history     Number of rate samples graphed per tunnel.  Default is 20, 0 disables\n")
+	fmt.Printf("  -o, --output      How the stats command prints: table, json (a line per update) or pretty.  Default is table\n")
+	fmt.Printf("      --fields      Tunnel and host fields the stats command prints as JSON (e.g. name,received,transmitted)\n")
+	fmt.Printf("Connections:\n")
+	fmt.Printf("  -f, --follow      Keep listing connections as they change, or stats every 5s\n")
+	fmt.Printf("  -t, --tunnel      Only list connections of tunnels whose name matches the glob\n")
+	fmt.Printf("Config synth:\n")
+	fmt.Printf("      --hosts       Number of hosts to generate.  Default is 1\n")
+	fmt.Printf("      --tunnels     Number of tunnels to generate.  Default is 1\n")
+	fmt.Printf("      --port        Port of the test SSH server.  Default is 2222\n")
+	fmt.Printf("      --dir         Directory to generate into.  Default is a new temporary directory\n")
+	fmt.Printf("Fake bastion:\n")
+	fmt.Printf("      --port        Port to listen on, on 127.0.0.1.  Default is 2222\n")
+	fmt.Printf("      --key         Host key file (e.g. host_key of config synth).  Default is an ephemeral key\n")
+	fmt.Printf("Relay:\n")
+	fmt.Printf("      --port        UDP port to listen on, on all interfaces.  Default is 2222\n")
+	fmt.Printf("      --key         Certificate and key file, created on first use.  Default is an ephemeral certificate\n")
+	fmt.Printf("Journal:\n")
+	fmt.Printf("      --since       Show events from this time (e.g. \"2006-01-02 15:04\", 14:30 or 2h ago)\n")
+	fmt.Printf("      --until       Show events up to this time\n")
+	fmt.Printf("  -t, --tunnel      Only show events of tunnels or hosts whose name matches the glob\n")
 	terminate(0)
 }
 
@@ -209,14 +938,14 @@ func version() {
 	terminate(0)
 }
 
+// terminate shuts down every tunnel and exits.  Only the first call has any
+// effect, later callers wait for it to exit.
 func terminate(code int) {
-	go func() {
-		defer func() {
-			_ = recover()
-		}()
-	}()
-	<-time.NewTimer(time.Second).C
-	fmt.Printf("Terminated\n")
-	os.Exit(code)
-
+	terminating.Do(func() {
+		cancel()
+		internal.Shutdown(shutdownTimeout)
+		internal.Infof("Terminated")
+		os.Exit(code)
+	})
+	select {}
 }